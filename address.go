@@ -0,0 +1,50 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+)
+
+// addressSource extracts the address of the client from the link-connect
+// event of a session, reporting false if it can't tell.
+type addressSource struct {
+	name    string
+	address func(src net.Addr, dest net.Addr) (net.Addr, bool)
+}
+
+// addressSources are tried in order to find the address a session is scored
+// under. The framework only surfaces the source address of the connection,
+// which smtpd already sets to the client announced by the PROXY header on
+// listeners configured with proxy-v2. Should a PROXY-aware value ever be
+// exposed to filters, its source goes ahead of src.
+var addressSources = []addressSource{
+	{name: "src", address: func(src net.Addr, dest net.Addr) (net.Addr, bool) {
+		return src, src != nil
+	}},
+}
+
+// clientAddress returns the address of the client of a session along with
+// the name of the source it was found by, src if none could tell.
+func clientAddress(src net.Addr, dest net.Addr) (net.Addr, string) {
+	for _, source := range addressSources {
+		if addr, ok := source.address(src, dest); ok {
+			return addr, source.name
+		}
+	}
+	return src, "src"
+}
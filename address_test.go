@@ -0,0 +1,48 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	balancer := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	listener := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 25}
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.4"), Port: 51234}
+
+	if addr, source := clientAddress(client, listener); addr != client || source != "src" {
+		t.Errorf("clientAddress = %v from %s, want %v from src", addr, source, client)
+	}
+
+	saved := addressSources
+	defer func() { addressSources = saved }()
+	addressSources = append([]addressSource{{name: "proxy", address: func(src net.Addr, dest net.Addr) (net.Addr, bool) {
+		if src.String() != balancer.String() {
+			return nil, false
+		}
+		return client, true
+	}}}, saved...)
+
+	if addr, source := clientAddress(balancer, listener); addr != client || source != "proxy" {
+		t.Errorf("clientAddress behind the balancer = %v from %s, want %v from proxy", addr, source, client)
+	}
+	if addr, source := clientAddress(client, listener); addr != client || source != "src" {
+		t.Errorf("clientAddress without the balancer = %v from %s, want %v from src", addr, source, client)
+	}
+}
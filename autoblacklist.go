@@ -0,0 +1,117 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// autoBlacklist holds the keys promoted for a persistently bad reputation,
+// with the time each entry expires at. It is persisted as a snapshot along
+// with the scoring histories, see snapshotStore.
+type autoBlacklist struct {
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+var autoBlacklisted = newAutoBlacklist()
+
+func newAutoBlacklist() *autoBlacklist {
+	return &autoBlacklist{entries: make(map[string]time.Time)}
+}
+
+// add blacklists key until expires and reports whether it wasn't already.
+func (b *autoBlacklist) add(key string, expires time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, exists := b.entries[key]
+	b.entries[key] = expires
+	return !exists
+}
+
+// contains reports whether key is blacklisted at timestamp.
+func (b *autoBlacklist) contains(key string, timestamp time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	expires, exists := b.entries[key]
+	return exists && timestamp.Before(expires)
+}
+
+// prune forgets the entries expired at timestamp.
+func (b *autoBlacklist) prune(timestamp time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, expires := range b.entries {
+		if !timestamp.Before(expires) {
+			logger.Info("auto-blacklist-expire", "key", key)
+			delete(b.entries, key)
+		}
+	}
+}
+
+func (b *autoBlacklist) snapshot() ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return json.Marshal(b.entries)
+}
+
+// restore replaces the entries with those of a snapshot not yet expired at
+// timestamp.
+func (b *autoBlacklist) restore(data []byte, timestamp time.Time) (int, error) {
+	entries := make(map[string]time.Time)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, err
+	}
+	for key, expires := range entries {
+		if !timestamp.Before(expires) {
+			delete(entries, key)
+		}
+	}
+	b.mutex.Lock()
+	b.entries = entries
+	b.mutex.Unlock()
+	return len(entries), nil
+}
+
+func (b *autoBlacklist) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.entries)
+}
+
+// checkAutoBlacklist promotes the key of a session to the auto-blacklist if
+// the min-samples most recent scorings of its history all fall below the
+// threshold. Only recent scorings count so that, once the entry expired, a
+// single decent session is enough to stay off the list until the key
+// misbehaves again.
+func checkAutoBlacklist(data *SessionData, cfg *AutoBlacklist, history []Scoring, timestamp time.Time) {
+	if len(history) < cfg.MinSamples {
+		return
+	}
+	for _, s := range history[len(history)-cfg.MinSamples:] {
+		if s.Score >= cfg.Threshold {
+			return
+		}
+	}
+	expires := timestamp.Add(cfg.TTL.Duration)
+	if autoBlacklisted.add(data.key, expires) {
+		logger.Info("auto-blacklist", "ip", data.addr.String(), "key", data.key,
+			"samples", cfg.MinSamples, "expires", expires)
+	}
+}
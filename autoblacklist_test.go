@@ -0,0 +1,116 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAutoBlacklist(t *testing.T) {
+	b := newAutoBlacklist()
+	start := time.Now()
+
+	if !b.add("192.0.2.1", start.Add(time.Hour)) {
+		t.Errorf("first promotion isn't new")
+	}
+	if b.add("192.0.2.1", start.Add(time.Hour)) {
+		t.Errorf("second promotion is new")
+	}
+	if !b.contains("192.0.2.1", start.Add(time.Minute)) {
+		t.Errorf("promoted key isn't blacklisted")
+	}
+	if b.contains("192.0.2.1", start.Add(time.Hour)) {
+		t.Errorf("expired key is blacklisted")
+	}
+
+	b.prune(start.Add(time.Hour))
+	if b.len() != 0 {
+		t.Errorf("expired entry wasn't pruned")
+	}
+}
+
+func TestCheckAutoBlacklist(t *testing.T) {
+	savedStore, savedList := ipStore, autoBlacklisted
+	defer func() { ipStore, autoBlacklisted = savedStore, savedList }()
+	ipStore = newMemoryBackend()
+	autoBlacklisted = newAutoBlacklist()
+
+	cfg := defaultConfig().AutoBlacklist
+	cfg.Threshold = 0.05
+	cfg.MinSamples = 3
+	start := time.Now()
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1"}
+
+	record := func(score float64) {
+		scoring := Scoring{Timestamp: start, Score: score}
+		history := recordedHistory(data.key, scoring, currentConfig())
+		ipStore.Append(data.key, scoring)
+		checkAutoBlacklist(data, &cfg, history, start)
+	}
+
+	record(0.0)
+	record(0.0)
+	if autoBlacklisted.contains(data.key, start) {
+		t.Errorf("key promoted with too few samples")
+	}
+	record(0.01)
+	if !autoBlacklisted.contains(data.key, start) {
+		t.Errorf("key with only bad samples isn't promoted")
+	}
+
+	// once expired, a decent session keeps the key off the list
+	autoBlacklisted.prune(start.Add(cfg.TTL.Duration))
+	record(0.6)
+	record(0.0)
+	if autoBlacklisted.contains(data.key, start) {
+		t.Errorf("reformed key promoted again")
+	}
+}
+
+// laggingStore is a memory backend whose appends haven't landed yet, like
+// those of the redis and postgres backends, made in the background.
+type laggingStore struct {
+	*memoryBackend
+}
+
+func (s *laggingStore) Append(key string, scoring Scoring) {}
+
+func TestCheckAutoBlacklistPendingAppend(t *testing.T) {
+	savedStore, savedList := ipStore, autoBlacklisted
+	defer func() { ipStore, autoBlacklisted = savedStore, savedList }()
+	store := &laggingStore{memoryBackend: newMemoryBackend()}
+	ipStore = store
+	autoBlacklisted = newAutoBlacklist()
+
+	cfg := defaultConfig().AutoBlacklist
+	cfg.Threshold = 0.05
+	cfg.MinSamples = 3
+	start := time.Now()
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1"}
+
+	store.memoryBackend.Append(data.key, Scoring{Timestamp: start, Score: 0.0})
+	store.memoryBackend.Append(data.key, Scoring{Timestamp: start, Score: 0.0})
+	scoring := Scoring{Timestamp: start, Score: 0.01}
+	history := recordedHistory(data.key, scoring, currentConfig())
+	ipStore.Append(data.key, scoring)
+	checkAutoBlacklist(data, &cfg, history, start)
+	if !autoBlacklisted.contains(data.key, start) {
+		t.Errorf("key not promoted before its last scoring landed")
+	}
+}
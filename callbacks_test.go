@@ -0,0 +1,244 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// fakeSession makes the callbacks act on data when given the returned
+// session, standing in for the framework which allocates the data of real
+// sessions on link-connect and looks it up on every event.
+func fakeSession(t *testing.T, data *SessionData) filter.Session {
+	saved := sd
+	t.Cleanup(func() { sd = saved })
+	sd = func(filter.Session) *SessionData { return data }
+	return filter.Session{}
+}
+
+// freshStores replaces the stores with empty memory backends for the
+// duration of a test.
+func freshStores(t *testing.T) {
+	saved := []StorageBackend{ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore}
+	t.Cleanup(func() {
+		ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = saved[0], saved[1], saved[2], saved[3], saved[4], saved[5]
+	})
+	ipStore, rdnsStore, heloStore = newMemoryBackend(), newMemoryBackend(), newMemoryBackend()
+	domainStore, asnStore, rcptDomainStore = newMemoryBackend(), newMemoryBackend(), newMemoryBackend()
+}
+
+// runSession drives a whole session of a client at ip through the
+// callbacks, as the framework would on the events of smtpd, and returns
+// the responses to its connect, MAIL FROM, RCPT TO and DATA.
+func runSession(t *testing.T, ip string, start time.Time) (*SessionData, []filter.Response) {
+	data := &SessionData{}
+	session := fakeSession(t, data)
+	src := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	dest := &net.TCPAddr{IP: net.ParseIP("198.51.100.25"), Port: 25}
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	responses := make([]filter.Response, 0, 4)
+	linkConnectCb(at(0), session, "mail.example.org", "pass", src, dest)
+	responses = append(responses, filterConnectCb(at(0), session, "mail.example.org", src))
+	linkIdentifyCb(at(1), session, "EHLO", "mail.example.org")
+	linkTLSCb(at(2), session, "version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256")
+	linkIdentifyCb(at(3), session, "EHLO", "mail.example.org")
+	txBeginCb(at(4), session, "0123456789abcdef")
+	responses = append(responses, filterMailFromCb(at(4), session, "alice@example.org"))
+	txMailCb(at(4), session, "0123456789abcdef", "ok", "alice@example.org")
+	responses = append(responses, filterRcptToCb(at(5), session, "bob@example.net"))
+	txRcptCb(at(5), session, "0123456789abcdef", "ok", "bob@example.net")
+	responses = append(responses, filterDataCb(at(6), session))
+	txDataCb(at(6), session, "0123456789abcdef", "ok")
+	txCommitCb(at(8), session, "0123456789abcdef", 4096)
+	txResetCb(at(9), session, "0123456789abcdef")
+	linkDisconnectCb(at(10), session)
+	return data, responses
+}
+
+func TestSessionCallbacks(t *testing.T) {
+	freshStores(t)
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	fakeClock(t, start)
+
+	data, responses := runSession(t, "192.0.2.1", start)
+	for i, response := range responses {
+		if response != filter.Proceed() {
+			t.Errorf("response %d = %#v, want proceed", i, response)
+		}
+	}
+
+	history := ipStore.Load("192.0.2.1")
+	if len(history) != 1 {
+		t.Fatalf("%d scorings stored, want 1", len(history))
+	}
+	s := history[0]
+	cfg := currentConfig()
+	if s.Score != scoreSession(data, cfg) || s.Score <= cfg.Aggregation.Prior {
+		t.Errorf("stored score %.04f, session score %.04f, want the same above the prior", s.Score, scoreSession(data, cfg))
+	}
+	if !s.Timestamp.Equal(now()) {
+		t.Errorf("stored timestamp %s, want the current time", s.Timestamp)
+	}
+	got := [...]int{s.Transactions, s.RcptCount, s.DataCount, s.CommitCount, s.RollbackCount, s.Resets, s.TLSCount, s.RDNSCount, s.FCrDNSCount}
+	if want := [...]int{1, 1, 1, 1, 0, 1, 1, 1, 1}; got != want {
+		t.Errorf("stored counters %v, want %v", got, want)
+	}
+	if s.Bytes != 4096 || s.MeanTransactionTime != 4*time.Second {
+		t.Errorf("stored %d bytes in %s, want 4096 in 4s", s.Bytes, s.MeanTransactionTime)
+	}
+	for name, store := range map[string]StorageBackend{"mail.example.org": rdnsStore, "example.org": domainStore} {
+		if len(store.Load(name)) != 1 {
+			t.Errorf("no scoring stored for %s", name)
+		}
+	}
+	if len(heloStore.Load("mail.example.org")) != 1 {
+		t.Errorf("session not recorded under its HELO name")
+	}
+}
+
+func TestSessionCallbacksRefused(t *testing.T) {
+	freshStores(t)
+	saved := dryRun
+	defer func() { dryRun = saved }()
+	dryRun = false
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	fakeClock(t, start)
+
+	for i := 0; i < 50; i++ {
+		ipStore.Append("192.0.2.2", Scoring{Timestamp: start.Add(-time.Hour), Score: 0.0})
+		rdnsStore.Append("mail.example.org", Scoring{Timestamp: start.Add(-time.Hour), Score: 0.0})
+	}
+	_, responses := runSession(t, "192.0.2.2", start)
+	if want := filter.Disconnect(currentConfig().Thresholds.RejectMessage); responses[0] != want {
+		t.Errorf("connect response = %#v, want %#v", responses[0], want)
+	}
+}
+
+func TestCallbacksOutOfOrder(t *testing.T) {
+	freshStores(t)
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+
+	// events of a session whose connect was never seen, as after a
+	// restart, or of transactions that never began must not panic
+	data := &SessionData{}
+	session := fakeSession(t, data)
+	linkIdentifyCb(start, session, "HELO", "mail.example.org")
+	txMailCb(start, session, "0123456789abcdef", "ok", "alice@example.org")
+	txRcptCb(start, session, "0123456789abcdef", "ok", "bob@example.net")
+	txDataCb(start, session, "0123456789abcdef", "ok")
+	txCommitCb(start, session, "0123456789abcdef", 4096)
+	txRollbackCb(start, session, "0123456789abcdef")
+	txResetCb(start, session, "0123456789abcdef")
+	linkDisconnectCb(start, session)
+	if ipStore.Count() != 0 {
+		t.Errorf("session without a key was recorded")
+	}
+}
+
+func TestTransactionLimit(t *testing.T) {
+	freshStores(t)
+	saved := currentConfig()
+	defer activeConfig.Store(saved)
+	cfg := defaultConfig()
+	cfg.TransactionLimit.Max = 3
+	activeConfig.Store(cfg)
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	fakeClock(t, start)
+
+	data := &SessionData{}
+	session := fakeSession(t, data)
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	linkConnectCb(start, session, "mail.example.org", "pass", src, &net.TCPAddr{IP: net.ParseIP("198.51.100.25"), Port: 25})
+	linkIdentifyCb(start, session, "EHLO", "mail.example.org")
+	for i := 0; i < 10; i++ {
+		txBeginCb(start, session, "0123456789abcdef")
+		txMailCb(start, session, "0123456789abcdef", "ok", "alice@example.org")
+		txRcptCb(start, session, "0123456789abcdef", "ok", "bob@example.net")
+		txRollbackCb(start, session, "0123456789abcdef")
+	}
+
+	if len(data.transactions) != 3 || data.extraTxs != 7 {
+		t.Errorf("%d transactions kept and %d counted, want 3 and 7", len(data.transactions), data.extraTxs)
+	}
+	if tx := currentTx(data); tx != data.overflow || tx.rcptToOK != 1 {
+		t.Errorf("events past the limit don't go to the transaction in progress")
+	}
+	for _, tx := range data.transactions {
+		if tx.rcptToOK != 1 {
+			t.Errorf("kept transaction has %d recipients, want 1", tx.rcptToOK)
+		}
+	}
+	within := *data
+	within.extraTxs, within.overflow = 0, nil
+	if scoreSession(data, cfg) >= scoreSession(&within, cfg) {
+		t.Errorf("session past the limit scored %.04f, not below %.04f", scoreSession(data, cfg), scoreSession(&within, cfg))
+	}
+
+	linkDisconnectCb(start, session)
+	if history := ipStore.Load("192.0.2.1"); len(history) != 1 || history[0].Transactions != 10 {
+		t.Errorf("stored %v, want a scoring of 10 transactions", history)
+	}
+}
+
+func TestIdentifySequences(t *testing.T) {
+	freshStores(t)
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	fakeClock(t, start)
+	cfg := defaultConfig()
+
+	type identify struct{ method, hostname string }
+	tests := []struct {
+		name      string
+		sequence  []identify
+		changed   bool
+		penalized bool
+	}{
+		{"single", []identify{{"EHLO", "mail.example.org"}}, false, false},
+		{"starttls", []identify{{"EHLO", "mail.example.org"}, {"EHLO", "MAIL.example.org"}}, false, false},
+		{"repeated", []identify{{"EHLO", "mail.example.org"}, {"EHLO", "mail.example.org"},
+			{"EHLO", "mail.example.org"}, {"EHLO", "mail.example.org"}}, false, true},
+		{"renamed", []identify{{"EHLO", "mail.example.org"}, {"EHLO", "relay.example.com"}}, true, true},
+		{"mixed", []identify{{"EHLO", "mail.example.org"}, {"HELO", "mail.example.org"}}, false, true},
+	}
+	for _, test := range tests {
+		data := &SessionData{}
+		session := fakeSession(t, data)
+		src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+		linkConnectCb(start, session, "mail.example.org", "pass", src, &net.TCPAddr{IP: net.ParseIP("198.51.100.25"), Port: 25})
+		for _, id := range test.sequence {
+			linkIdentifyCb(start, session, id.method, id.hostname)
+		}
+
+		if data.identifies != len(test.sequence) {
+			t.Errorf("%s: %d identifies counted, want %d", test.name, data.identifies, len(test.sequence))
+		}
+		if data.heloname != "mail.example.org" || len(data.currentReputation) != 3 {
+			t.Errorf("%s: heloname %q with %d reputations, want the first name and 3", test.name, data.heloname, len(data.currentReputation))
+		}
+		if data.heloChanged != test.changed {
+			t.Errorf("%s: heloChanged = %v, want %v", test.name, data.heloChanged, test.changed)
+		}
+		if penalized := scoreIdentify(data, &cfg.Identify) != 0; penalized != test.penalized {
+			t.Errorf("%s: penalized = %v, want %v", test.name, penalized, test.penalized)
+		}
+	}
+}
@@ -0,0 +1,1175 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Weights are the bonuses and penalties applied by scoreTransaction and
+// scoreSession. Penalties are expressed as positive values.
+type Weights struct {
+	ValidSender         float64 `toml:"valid-sender"`
+	Data                float64 `toml:"data"`
+	Commit              float64 `toml:"commit"`
+	SuccessfulRecipient float64 `toml:"successful-recipient"`
+	TempfailRecipient   float64 `toml:"tempfail-recipient"`
+	PermfailRecipient   float64 `toml:"permfail-recipient"`
+
+	// NullSender replaces ValidSender for transactions from the null
+	// sender, which lose NullSenderRecipient for each recipient past the
+	// first one as bounces have a single recipient.
+	NullSender          float64 `toml:"null-sender"`
+	NullSenderRecipient float64 `toml:"null-sender-recipient"`
+
+	AuthSuccess    float64 `toml:"auth-success"`
+	AuthSuccessCap float64 `toml:"auth-success-cap"`
+	AuthFailure    float64 `toml:"auth-failure"`
+	AuthFailureCap float64 `toml:"auth-failure-cap"`
+	TLS            float64 `toml:"tls"`
+	TLSModern      float64 `toml:"tls-modern"`
+	TLSLegacy      float64 `toml:"tls-legacy"`
+	RDNS           float64 `toml:"rdns"`
+	FCrDNS         float64 `toml:"fcrdns"`
+	Reset          float64 `toml:"reset"`
+	BadHelo        float64 `toml:"bad-helo"`
+	NoHelo         float64 `toml:"no-helo"`
+
+	AbandonedTransaction float64 `toml:"abandoned-transaction"`
+	RollbackRatio        float64 `toml:"rollback-ratio"`
+	DroppedAfterData     float64 `toml:"dropped-after-data"`
+}
+
+// Aggregation controls how the scoring history of a key is reduced to a
+// single reputation score.
+type Aggregation struct {
+	// Strategy is how the scores of a history are averaged: "mean"
+	// weighs them all alike, "decay" by their age and half-life, and
+	// "linear-recency" by their rank from the oldest to the newest.
+	Strategy string `toml:"strategy"`
+
+	// HalfLife is the age at which a scoring counts half as much as a
+	// fresh one, zero disables time decay.
+	HalfLife duration `toml:"half-life"`
+
+	// Prior is the reputation of a key without history, which the mean
+	// of a key with little history is pulled toward as if PriorWeight
+	// sessions had scored it.
+	Prior       float64 `toml:"prior"`
+	PriorWeight float64 `toml:"prior-weight"`
+
+	// MaxRise is how much higher than the previous one a session counts at
+	// most, so that a reputation rises over sustained good behavior but
+	// falls right away, zero not limiting it.
+	MaxRise float64 `toml:"max-rise"`
+
+	// TransactionRecency is how much more each transaction of a session
+	// weighs in its score than the previous one, 1 weighs them alike.
+	TransactionRecency float64 `toml:"transaction-recency"`
+}
+
+// Failure controls how the failures of external dependencies, the storage
+// backends and the DNSBL zones, are judged: "open" treats a dependency that
+// failed as having nothing to say, so that mail never stops on an outage,
+// and "closed" as suspicious, a key whose history couldn't be loaded getting
+// the bottom of the scale and a zone that didn't answer listing the address.
+type Failure struct {
+	Policy string `toml:"policy"`
+}
+
+// closed reports whether failures are held against sessions.
+func (f *Failure) closed() bool {
+	return f.Policy == "closed"
+}
+
+// Grace controls how keys with fewer than MinSamples sessions are treated:
+// "neutral" gives them the prior and exempts them from the thresholds and
+// the tarpit, "greylist" does the same but defers them with GreylistMessage
+// until GreylistDelay after their first contact, "strict" judges them on
+// the little history they have like any other key, and "blend" as well but
+// on a score moving from the prior toward their history by a MinSamples
+// part per session. "challenge" greylists them like "greylist", but only
+// lets through a retry within ChallengeWindow past the delay, the session
+// retrying earning ChallengeBonus.
+type Grace struct {
+	MinSamples      int      `toml:"min-samples"`
+	Policy          string   `toml:"policy"`
+	GreylistDelay   duration `toml:"greylist-delay"`
+	GreylistMessage string   `toml:"greylist-message"`
+	ChallengeWindow duration `toml:"challenge-window"`
+	ChallengeBonus  float64  `toml:"challenge-bonus"`
+}
+
+// Greylist controls the greylisting of recipients for sessions with a
+// connect reputation between Lower and Upper: the first attempt of each
+// (address, sender, recipient) triplet is deferred with Message and
+// accepted once retried Delay later, but within Window past the delay,
+// sessions retrying earning RetryBonus. A later retry is deferred as if first
+// seen.
+type Greylist struct {
+	Enabled    bool     `toml:"enabled"`
+	Lower      float64  `toml:"lower"`
+	Upper      float64  `toml:"upper"`
+	Delay      duration `toml:"delay"`
+	Window     duration `toml:"window"`
+	Message    string   `toml:"message"`
+	RetryBonus float64  `toml:"retry-bonus"`
+}
+
+// Keys controls how addresses are grouped into reputation keys.
+type Keys struct {
+	IPv4Prefix int `toml:"ipv4-prefix"`
+	IPv6Prefix int `toml:"ipv6-prefix"`
+}
+
+// Local controls how sessions coming from a local socket are handled:
+// "fixed" gives them Score as reputation and learns nothing from them,
+// "bucket" scores them all under a single "local" key, and "skip" ignores
+// them entirely.
+type Local struct {
+	Mode  string  `toml:"mode"`
+	Score float64 `toml:"score"`
+}
+
+// Tarpit controls the slowing down of sessions whose reputation is below
+// Threshold, which are held up to MaxDelay at connect and on each RCPT.
+type Tarpit struct {
+	Threshold float64  `toml:"threshold"`
+	MaxDelay  duration `toml:"max-delay"`
+}
+
+// maxTarpitDelay is the longest a session may be held by the tarpit.
+const maxTarpitDelay = 30 * time.Second
+
+// Escalation controls the harsher treatment of keys refused at connect
+// repeatedly, each refusal counting for less by half every HalfLife. Once
+// refused RejectAfter times, a key its reputation would defer is rejected,
+// and the refusal of a key refused before is held Delay, multiplied by
+// Factor for each further refusal. Zero disables either.
+type Escalation struct {
+	HalfLife    duration `toml:"half-life"`
+	RejectAfter float64  `toml:"reject-after"`
+	Delay       duration `toml:"delay"`
+	Factor      float64  `toml:"factor"`
+}
+
+// Distribution controls the report of the connect scores seen, counted in
+// buckets whose upper bounds are Buckets, logged every Interval, zero
+// disabling it. Counts start over after each report unless Cumulative is
+// set.
+type Distribution struct {
+	Interval   duration  `toml:"interval"`
+	Buckets    []float64 `toml:"buckets"`
+	Cumulative bool      `toml:"cumulative"`
+}
+
+// maxDistributionBuckets bounds the number of buckets, and so the labels of
+// the metric counting them.
+const maxDistributionBuckets = 20
+
+// enabled reports whether refusals are to be counted at all.
+func (cfg *Escalation) enabled() bool {
+	return cfg.RejectAfter > 0 || cfg.Delay.Duration > 0
+}
+
+// DNSBL controls the lookup of connecting addresses in blocklists. Each zone
+// listing an address lowers its reputation by Penalty, or rejects it outright
+// if Reject is set.
+type DNSBL struct {
+	Zones    []string `toml:"zones"`
+	Penalty  float64  `toml:"penalty"`
+	Reject   bool     `toml:"reject"`
+	Timeout  duration `toml:"timeout"`
+	CacheTTL duration `toml:"cache-ttl"`
+}
+
+// DNS controls the cache shared by the features doing their own DNS
+// lookups: answers are kept for CacheTTL and names that don't exist for
+// NegativeTTL, zero disabling either. At most MaxInFlight queries go to
+// the network at once, the others waiting up to QueueTimeout for a slot
+// before failing, zero not limiting them.
+type DNS struct {
+	CacheTTL     duration `toml:"cache-ttl"`
+	NegativeTTL  duration `toml:"negative-ttl"`
+	MaxInFlight  int      `toml:"max-in-flight"`
+	QueueTimeout duration `toml:"queue-timeout"`
+}
+
+// Harvest controls the detection of directory-harvest attacks. Once a
+// session has tried MinRecipients recipients, a ratio of refused ones of
+// at least Ratio lowers its score by up to Penalty and, if Reject is set,
+// closes the session at the next RCPT.
+type Harvest struct {
+	MinRecipients int     `toml:"min-recipients"`
+	Ratio         float64 `toml:"ratio"`
+	Penalty       float64 `toml:"penalty"`
+	Reject        bool    `toml:"reject"`
+}
+
+// BruteForce controls the detection of credential-stuffing sessions. Once a
+// session has failed to authenticate Failures times, its score is lowered
+// by Penalty, its next AUTH closes the session if Disconnect is set and its
+// key is put on the auto-blacklist if Blacklist is set. A zero Failures
+// disables it.
+type BruteForce struct {
+	Failures   int     `toml:"failures"`
+	Penalty    float64 `toml:"penalty"`
+	Disconnect bool    `toml:"disconnect"`
+	Blacklist  bool    `toml:"blacklist"`
+}
+
+// Velocity controls the handling of keys reconnecting more than MaxRate
+// times a minute, which are deferred if Defer is set or have their
+// reputation lowered by Penalty otherwise. A zero MaxRate disables it.
+type Velocity struct {
+	MaxRate int     `toml:"max-rate"`
+	Penalty float64 `toml:"penalty"`
+	Defer   bool    `toml:"defer"`
+}
+
+// Timing controls the penalty applied to sessions sending at least
+// MinCommands commands with a mean gap below MinMeanGap, as scripted bots
+// fire commands back-to-back. Sessions committing a message in less than
+// MinTransactionTime from MAIL FROM lose TransactionPenalty, zero by default.
+type Timing struct {
+	MinCommands int      `toml:"min-commands"`
+	MinMeanGap  duration `toml:"min-mean-gap"`
+	Penalty     float64  `toml:"penalty"`
+
+	MinTransactionTime duration `toml:"min-transaction-time"`
+	TransactionPenalty float64  `toml:"transaction-penalty"`
+}
+
+// SenderDomains controls the penalty applied to sessions with at least
+// MinTransactions transactions for each sender domain past the first,
+// up to MaxPenalty.
+type SenderDomains struct {
+	MinTransactions int     `toml:"min-transactions"`
+	Penalty         float64 `toml:"penalty"`
+	MaxPenalty      float64 `toml:"max-penalty"`
+}
+
+// TransactionLimit controls the number of transactions kept per session,
+// those past the first Max being only counted, and the penalty applied to
+// sessions going past it.
+type TransactionLimit struct {
+	Max     int     `toml:"max"`
+	Penalty float64 `toml:"penalty"`
+}
+
+// SharedHelo controls the penalty applied to sessions identifying with a
+// HELO name that more than MaxAddresses address keys used during Window.
+type SharedHelo struct {
+	Window       duration `toml:"window"`
+	MaxAddresses int      `toml:"max-addresses"`
+	Penalty      float64  `toml:"penalty"`
+}
+
+// Identify controls the penalty applied to sessions identifying more than
+// Max times, with another name than they first did, or with both HELO and
+// EHLO.
+type Identify struct {
+	Max     int     `toml:"max"`
+	Penalty float64 `toml:"penalty"`
+}
+
+// Size controls the mild penalty applied to committed messages smaller than
+// Min or larger than Max bytes, a zero Max meaning no upper bound.
+type Size struct {
+	Min     int     `toml:"min"`
+	Max     int     `toml:"max"`
+	Penalty float64 `toml:"penalty"`
+}
+
+// LocalParts controls the penalty applied to transactions whose sender,
+// or any recipient if Recipients is set, has a random looking local part:
+// one of at least MinLength characters with more than a DigitRatio part of
+// digits, no vowel or a token, separated by dots, dashes or underscores,
+// with an entropy of at least Entropy bits per character.
+// Local parts starting with one of the Exempt prefixes never are.
+type LocalParts struct {
+	Enabled    bool     `toml:"enabled"`
+	Recipients bool     `toml:"recipients"`
+	MinLength  int      `toml:"min-length"`
+	DigitRatio float64  `toml:"digit-ratio"`
+	Entropy    float64  `toml:"entropy"`
+	Penalty    float64  `toml:"penalty"`
+	Exempt     []string `toml:"exempt"`
+}
+
+// GeoIP controls the use of the ASN database: with ASNBucket set, the
+// reputation of autonomous systems is tracked and a new address starts with
+// the reputation of its autonomous system rather than a neutral one.
+type GeoIP struct {
+	ASNBucket bool `toml:"asn-bucket"`
+}
+
+// Storage controls how much history is kept per reputation key: at most
+// HistorySize scorings, keys with no scoring in MaxAge being forgotten by
+// the prune pass running every PruneInterval. Past MaxKeys keys in a memory
+// store, the least recently seen ones are evicted by the same pass.
+type Storage struct {
+	HistorySize   int      `toml:"history-size"`
+	MaxAge        duration `toml:"max-age"`
+	PruneInterval duration `toml:"prune-interval"`
+	MaxKeys       int      `toml:"max-keys"`
+}
+
+// RecipientDomains controls the tracking of the ratio of accepted
+// recipients per recipient domain, in its own store.
+type RecipientDomains struct {
+	Enabled bool `toml:"enabled"`
+}
+
+// RequireTLS controls the refusal of transactions in clear from sessions
+// with a connect reputation below Threshold, with Message as response.
+type RequireTLS struct {
+	Threshold float64 `toml:"threshold"`
+	Message   string  `toml:"message"`
+}
+
+// MandatoryTLS controls the refusal of transactions in clear from every
+// unauthenticated session, whatever its reputation, with Message.
+type MandatoryTLS struct {
+	Enabled bool   `toml:"enabled"`
+	Message string `toml:"message"`
+}
+
+// RequireFCrDNS controls the refusal of transactions from unauthenticated
+// sessions without forward-confirmed reverse DNS and with a connect
+// reputation below Threshold, deferred or rejected as Action says.
+type RequireFCrDNS struct {
+	Threshold float64 `toml:"threshold"`
+	Action    string  `toml:"action"`
+}
+
+// RefuseData controls the refusal of message bodies from sessions with a
+// connect reputation below Threshold, with Message as response to DATA, so
+// that the recipients they attempted are still seen.
+type RefuseData struct {
+	Threshold float64 `toml:"threshold"`
+	Message   string  `toml:"message"`
+}
+
+// RecipientLimit controls the tempfail of recipients past the first Max of
+// a session, with Message, for sessions with a connect reputation below
+// Threshold, to slow down dictionary attacks.
+type RecipientLimit struct {
+	Threshold float64 `toml:"threshold"`
+	Max       int     `toml:"max"`
+	Message   string  `toml:"message"`
+}
+
+// RecipientCap controls the refusal at DATA, with Message, of transactions
+// naming more than Max recipients, accepted or not, from unauthenticated
+// sessions with a connect reputation below Threshold.
+type RecipientCap struct {
+	Threshold float64 `toml:"threshold"`
+	Max       int     `toml:"max"`
+	Message   string  `toml:"message"`
+}
+
+// Downgrade controls the penalty applied to sessions that issue EHLO, and
+// are thus told STARTTLS is available, but commit a message in clear. It only
+// applies if STARTTLSOffered declares that the listeners offer STARTTLS.
+type Downgrade struct {
+	STARTTLSOffered bool    `toml:"starttls-offered"`
+	Penalty         float64 `toml:"penalty"`
+}
+
+// Webhook controls the notification POSTed to URL when the reputation of an
+// address drops below Threshold, each attempt timing out after Timeout and
+// failed deliveries being retried Retries times.
+type Webhook struct {
+	URL       string   `toml:"url"`
+	Threshold float64  `toml:"threshold"`
+	Timeout   duration `toml:"timeout"`
+	Retries   int      `toml:"retries"`
+}
+
+// AutoBlacklist controls the promotion of persistently bad keys to an
+// in-memory blacklist rejecting them at connect for TTL: a key is promoted
+// once its MinSamples most recent sessions all scored below Threshold.
+// A zero Threshold disables it.
+type AutoBlacklist struct {
+	Threshold  float64  `toml:"threshold"`
+	MinSamples int      `toml:"min-samples"`
+	TTL        duration `toml:"ttl"`
+}
+
+// Scale is the range reputations are expressed in, from the worst Min to the
+// best Max, scores being clamped to it. The neutral reputation of keys without
+// history is the aggregation prior, which must lie strictly within it.
+type Scale struct {
+	Min float64 `toml:"min"`
+	Max float64 `toml:"max"`
+}
+
+// clamp returns v bounded to the scale.
+func (s *Scale) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// Thresholds are the reputations below which connections are rejected or
+// deferred, with RejectMessage or DeferMessage as response once their
+// placeholders are interpolated, see renderMessage().
+type Thresholds struct {
+	Reject float64 `toml:"reject"`
+	Defer  float64 `toml:"defer"`
+
+	RejectMessage string `toml:"reject-message"`
+	DeferMessage  string `toml:"defer-message"`
+}
+
+// messagePlaceholders are the placeholders a reject or defer message may
+// hold.
+var messagePlaceholders = []string{"{score}", "{ip}", "{samples}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateMessage checks that a response template starts with a code of the
+// given class and only holds known placeholders, so that a mistake is
+// reported at startup rather than sent to clients.
+func validateMessage(message string, class byte) error {
+	if len(message) < 4 || message[0] != class || message[3] != ' ' {
+		return fmt.Errorf("must start with a %cxx code", class)
+	}
+	if strings.ContainsAny(message, "\r\n") {
+		return fmt.Errorf("must fit on a single line")
+	}
+	for _, placeholder := range placeholderPattern.FindAllString(message, -1) {
+		if !slices.Contains(messagePlaceholders, placeholder) {
+			return fmt.Errorf("unknown placeholder %s", placeholder)
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	Scale       Scale       `toml:"scale"`
+	Thresholds  Thresholds  `toml:"thresholds"`
+	Weights     Weights     `toml:"weights"`
+	Aggregation Aggregation `toml:"aggregation"`
+	Grace       Grace       `toml:"grace"`
+	Failure     Failure     `toml:"failure"`
+	Greylist    Greylist    `toml:"greylist"`
+	Keys        Keys        `toml:"keys"`
+	Local       Local       `toml:"local"`
+	Tarpit      Tarpit      `toml:"tarpit"`
+	DNSBL       DNSBL       `toml:"dnsbl"`
+	DNS         DNS         `toml:"dns"`
+	Harvest     Harvest     `toml:"harvest"`
+	BruteForce  BruteForce  `toml:"brute-force"`
+	Velocity    Velocity    `toml:"velocity"`
+	Timing      Timing      `toml:"timing"`
+	Size        Size        `toml:"size"`
+	GeoIP       GeoIP       `toml:"geoip"`
+	Storage     Storage     `toml:"storage"`
+
+	RecipientDomains RecipientDomains `toml:"recipient-domains"`
+	SenderDomains    SenderDomains    `toml:"sender-domains"`
+	TransactionLimit TransactionLimit `toml:"transaction-limit"`
+	LocalParts       LocalParts       `toml:"local-parts"`
+	SharedHelo       SharedHelo       `toml:"shared-helo"`
+	Identify         Identify         `toml:"identify"`
+	RequireTLS       RequireTLS       `toml:"require-tls"`
+	MandatoryTLS     MandatoryTLS     `toml:"mandatory-tls"`
+	RequireFCrDNS    RequireFCrDNS    `toml:"require-fcrdns"`
+	Escalation       Escalation       `toml:"escalation"`
+	Distribution     Distribution     `toml:"distribution"`
+	RefuseData       RefuseData       `toml:"refuse-data"`
+	RecipientLimit   RecipientLimit   `toml:"recipient-limit"`
+	RecipientCap     RecipientCap     `toml:"recipient-cap"`
+	Downgrade        Downgrade        `toml:"downgrade"`
+	Webhook          Webhook          `toml:"webhook"`
+	AutoBlacklist    AutoBlacklist    `toml:"auto-blacklist"`
+
+	Profiles []Profile `toml:"profiles"`
+}
+
+// duration allows time.Duration values to be written as "48h" in the
+// configuration file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the active configuration, which may be swapped at
+// any time by a reload and must be treated as read-only.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Scale: Scale{
+			Min: 0.0,
+			Max: 1.0,
+		},
+		Thresholds: Thresholds{
+			Reject: 0.1,
+			Defer:  0.3,
+
+			RejectMessage: "554 5.7.1 Connection refused: poor reputation",
+			DeferMessage:  "421 4.7.0 Connection deferred: poor reputation, try again later",
+		},
+		Weights: Weights{
+			ValidSender:         0.4,
+			Data:                0.3,
+			Commit:              0.3,
+			SuccessfulRecipient: 0.1,
+			TempfailRecipient:   0.1,
+			PermfailRecipient:   0.2,
+
+			NullSender:          0.2,
+			NullSenderRecipient: 0.1,
+
+			AuthSuccess:    0.1,
+			AuthSuccessCap: 0.2,
+			AuthFailure:    0.1,
+			AuthFailureCap: 0.5,
+			TLS:            0.2,
+			TLSModern:      0.25,
+			TLSLegacy:      0.05,
+			RDNS:           0.1,
+			FCrDNS:         0.1,
+			Reset:          0.05,
+			BadHelo:        0.1,
+			NoHelo:         0.1,
+
+			AbandonedTransaction: 0.15,
+			RollbackRatio:        0.2,
+			DroppedAfterData:     0.2,
+		},
+		Aggregation: Aggregation{
+			Strategy:    "decay",
+			HalfLife:    duration{48 * time.Hour},
+			Prior:       0.5,
+			PriorWeight: 5,
+
+			TransactionRecency: 1,
+		},
+		Grace: Grace{
+			MinSamples:      6,
+			Policy:          "neutral",
+			GreylistDelay:   duration{5 * time.Minute},
+			GreylistMessage: "451 4.7.1 Greylisted, please try again later",
+			ChallengeWindow: duration{24 * time.Hour},
+			ChallengeBonus:  0.2,
+		},
+		Failure: Failure{
+			Policy: "open",
+		},
+		Greylist: Greylist{
+			Enabled:    false,
+			Lower:      0.3,
+			Upper:      0.6,
+			Delay:      duration{5 * time.Minute},
+			Window:     duration{24 * time.Hour},
+			Message:    "451 4.7.1 Greylisted, please try again later",
+			RetryBonus: 0.1,
+		},
+		Keys: Keys{
+			IPv4Prefix: 32,
+			IPv6Prefix: 64,
+		},
+		Local: Local{
+			Mode:  "fixed",
+			Score: 0.5,
+		},
+		Tarpit: Tarpit{
+			Threshold: 0.0,
+			MaxDelay:  duration{10 * time.Second},
+		},
+		DNSBL: DNSBL{
+			Zones:    []string{},
+			Penalty:  0.3,
+			Timeout:  duration{2 * time.Second},
+			CacheTTL: duration{time.Hour},
+		},
+		DNS: DNS{
+			CacheTTL:     duration{time.Hour},
+			NegativeTTL:  duration{5 * time.Minute},
+			MaxInFlight:  64,
+			QueueTimeout: duration{time.Second},
+		},
+		Harvest: Harvest{
+			MinRecipients: 10,
+			Ratio:         0.5,
+			Penalty:       0.5,
+		},
+		BruteForce: BruteForce{
+			Failures: 5,
+			Penalty:  0.5,
+		},
+		Velocity: Velocity{
+			MaxRate: 0,
+			Penalty: 0.3,
+		},
+		Timing: Timing{
+			MinCommands: 8,
+			MinMeanGap:  duration{50 * time.Millisecond},
+			Penalty:     0.2,
+
+			MinTransactionTime: duration{100 * time.Millisecond},
+		},
+		SenderDomains: SenderDomains{
+			MinTransactions: 3,
+			Penalty:         0.1,
+			MaxPenalty:      0.5,
+		},
+		TransactionLimit: TransactionLimit{
+			Max:     100,
+			Penalty: 0.3,
+		},
+		SharedHelo: SharedHelo{
+			Window:       duration{24 * time.Hour},
+			MaxAddresses: 20,
+			Penalty:      0.2,
+		},
+		Identify: Identify{
+			Max:     3,
+			Penalty: 0.1,
+		},
+		RequireTLS: RequireTLS{
+			Threshold: 0.0,
+			Message:   "530 5.7.0 Must issue a STARTTLS command first",
+		},
+		MandatoryTLS: MandatoryTLS{
+			Enabled: false,
+			Message: "530 5.7.0 Must issue a STARTTLS command first",
+		},
+		RequireFCrDNS: RequireFCrDNS{
+			Threshold: 0.0,
+			Action:    "defer",
+		},
+		Escalation: Escalation{
+			HalfLife:    duration{time.Hour},
+			RejectAfter: 0,
+			Delay:       duration{0},
+			Factor:      2,
+		},
+		Distribution: Distribution{
+			Interval:   duration{0},
+			Buckets:    []float64{0.1, 0.3, 0.5, 0.7, 0.9},
+			Cumulative: false,
+		},
+		RefuseData: RefuseData{
+			Threshold: 0.0,
+			Message:   "451 4.7.1 Message refused for poor reputation, try again later",
+		},
+		RecipientLimit: RecipientLimit{
+			Threshold: 0.0,
+			Max:       20,
+			Message:   "452 4.5.3 Too many recipients, try again later",
+		},
+		RecipientCap: RecipientCap{
+			Threshold: 0.0,
+			Max:       50,
+			Message:   "550 5.5.3 Too many recipients for a single message",
+		},
+		Downgrade: Downgrade{
+			STARTTLSOffered: false,
+			Penalty:         0.1,
+		},
+		Webhook: Webhook{
+			Threshold: 0.3,
+			Timeout:   duration{5 * time.Second},
+			Retries:   3,
+		},
+		AutoBlacklist: AutoBlacklist{
+			Threshold:  0.0,
+			MinSamples: 20,
+			TTL:        duration{24 * time.Hour},
+		},
+		Storage: Storage{
+			HistorySize:   100,
+			MaxAge:        duration{5 * 24 * time.Hour},
+			PruneInterval: duration{30 * time.Second},
+		},
+		Size: Size{
+			Min:     200,
+			Max:     50 * 1024 * 1024,
+			Penalty: 0.05,
+		},
+		LocalParts: LocalParts{
+			Enabled:    false,
+			Recipients: false,
+			MinLength:  8,
+			DigitRatio: 0.5,
+			Entropy:    3.7,
+			Penalty:    0.05,
+			Exempt:     []string{"bounce", "mailer-daemon", "postmaster", "noreply", "no-reply", "prvs", "msprvs", "btv1", "srs0", "srs1"},
+		},
+	}
+}
+
+// loadConfig reads the TOML configuration at path on top of the defaults.
+// A missing file is not an error, the defaults are used as is.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	// profiles must be decoded before looking for unknown keys in them
+	if err := cfg.buildProfiles(md); err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		keys := make([]string, 0, len(undecoded))
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return nil, fmt.Errorf("unknown configuration keys: %s", strings.Join(keys, ", "))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	scale := cfg.Scale
+	if scale.Min >= scale.Max {
+		return fmt.Errorf("scale min %.04f must be below max %.04f", scale.Min, scale.Max)
+	}
+	if cfg.Thresholds.Reject > cfg.Thresholds.Defer {
+		return fmt.Errorf("reject threshold %.04f must not be above defer threshold %.04f", cfg.Thresholds.Reject, cfg.Thresholds.Defer)
+	}
+	if err := validateMessage(cfg.Thresholds.RejectMessage, '5'); err != nil {
+		return fmt.Errorf("reject-message: %s", err)
+	}
+	if err := validateMessage(cfg.Thresholds.DeferMessage, '4'); err != nil {
+		return fmt.Errorf("defer-message: %s", err)
+	}
+
+	w := cfg.Weights
+	weights := map[string]float64{
+		"valid-sender":          w.ValidSender,
+		"data":                  w.Data,
+		"commit":                w.Commit,
+		"successful-recipient":  w.SuccessfulRecipient,
+		"tempfail-recipient":    w.TempfailRecipient,
+		"permfail-recipient":    w.PermfailRecipient,
+		"null-sender":           w.NullSender,
+		"null-sender-recipient": w.NullSenderRecipient,
+		"auth-success":          w.AuthSuccess,
+		"auth-success-cap":      w.AuthSuccessCap,
+		"auth-failure":          w.AuthFailure,
+		"auth-failure-cap":      w.AuthFailureCap,
+		"tls":                   w.TLS,
+		"tls-modern":            w.TLSModern,
+		"tls-legacy":            w.TLSLegacy,
+		"rdns":                  w.RDNS,
+		"fcrdns":                w.FCrDNS,
+		"reset":                 w.Reset,
+		"bad-helo":              w.BadHelo,
+		"no-helo":               w.NoHelo,
+		"abandoned-transaction": w.AbandonedTransaction,
+		"rollback-ratio":        w.RollbackRatio,
+		"dropped-after-data":    w.DroppedAfterData,
+	}
+	for name, value := range weights {
+		if value < 0 {
+			return fmt.Errorf("weight %s must not be negative", name)
+		}
+	}
+
+	switch cfg.Aggregation.Strategy {
+	case "mean", "decay", "linear-recency":
+	default:
+		return fmt.Errorf("unknown aggregation strategy %s", cfg.Aggregation.Strategy)
+	}
+	if cfg.Aggregation.HalfLife.Duration < 0 {
+		return fmt.Errorf("half-life must not be negative")
+	}
+	if cfg.Aggregation.Prior <= scale.Min || cfg.Aggregation.Prior >= scale.Max {
+		return fmt.Errorf("prior must be strictly between scale min and max")
+	}
+	if cfg.Aggregation.PriorWeight < 0 {
+		return fmt.Errorf("prior-weight must not be negative")
+	}
+	if cfg.Aggregation.MaxRise < 0 {
+		return fmt.Errorf("max-rise must not be negative")
+	}
+	if cfg.Aggregation.TransactionRecency < 1 {
+		return fmt.Errorf("transaction-recency must be at least 1")
+	}
+
+	switch cfg.Failure.Policy {
+	case "open", "closed":
+	default:
+		return fmt.Errorf("unknown failure policy %s", cfg.Failure.Policy)
+	}
+
+	if cfg.Grace.MinSamples < 1 {
+		return fmt.Errorf("grace min-samples must be at least 1")
+	}
+	// histories are bounded by history-size, a key needing more samples
+	// would stay in grace for good
+	if cfg.Grace.MinSamples > cfg.Storage.HistorySize {
+		return fmt.Errorf("grace min-samples must not exceed history-size")
+	}
+	switch cfg.Grace.Policy {
+	case "neutral", "greylist", "strict", "blend", "challenge":
+	default:
+		return fmt.Errorf("unknown grace policy %s", cfg.Grace.Policy)
+	}
+	if cfg.Grace.GreylistDelay.Duration <= 0 {
+		return fmt.Errorf("grace greylist-delay must be positive")
+	}
+	if len(cfg.Grace.GreylistMessage) < 4 || cfg.Grace.GreylistMessage[0] != '4' {
+		return fmt.Errorf("grace greylist-message must start with a 4xx code")
+	}
+	if cfg.Grace.ChallengeWindow.Duration <= 0 {
+		return fmt.Errorf("grace challenge-window must be positive")
+	}
+	if cfg.Grace.ChallengeBonus < 0 {
+		return fmt.Errorf("grace challenge-bonus must not be negative")
+	}
+
+	if cfg.Greylist.Lower < scale.Min || cfg.Greylist.Lower > cfg.Greylist.Upper || cfg.Greylist.Upper > scale.Max {
+		return fmt.Errorf("greylist band must satisfy min <= lower <= upper <= max")
+	}
+	if cfg.Greylist.Delay.Duration <= 0 {
+		return fmt.Errorf("greylist delay must be positive")
+	}
+	if cfg.Greylist.Window.Duration <= 0 {
+		return fmt.Errorf("greylist window must be positive")
+	}
+	if len(cfg.Greylist.Message) < 4 || cfg.Greylist.Message[0] != '4' {
+		return fmt.Errorf("greylist message must start with a 4xx code")
+	}
+	if cfg.Greylist.RetryBonus < 0 {
+		return fmt.Errorf("greylist retry-bonus must not be negative")
+	}
+
+	if cfg.Keys.IPv4Prefix < 1 || cfg.Keys.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4-prefix must be between 1 and 32")
+	}
+	if cfg.Keys.IPv6Prefix < 1 || cfg.Keys.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6-prefix must be between 1 and 128")
+	}
+
+	switch cfg.Local.Mode {
+	case "fixed", "bucket", "skip":
+	default:
+		return fmt.Errorf("unknown local mode %s", cfg.Local.Mode)
+	}
+	if cfg.Local.Score < scale.Min || cfg.Local.Score > scale.Max {
+		return fmt.Errorf("local score must be between scale min and max")
+	}
+
+	if cfg.Tarpit.MaxDelay.Duration < 0 || cfg.Tarpit.MaxDelay.Duration > maxTarpitDelay {
+		return fmt.Errorf("tarpit max-delay must be between 0 and %s", maxTarpitDelay)
+	}
+
+	if cfg.DNSBL.Penalty < 0 {
+		return fmt.Errorf("dnsbl penalty must not be negative")
+	}
+	if cfg.DNSBL.Timeout.Duration <= 0 {
+		return fmt.Errorf("dnsbl timeout must be positive")
+	}
+	if cfg.DNSBL.CacheTTL.Duration < 0 {
+		return fmt.Errorf("dnsbl cache-ttl must not be negative")
+	}
+	if cfg.DNS.CacheTTL.Duration < 0 || cfg.DNS.NegativeTTL.Duration < 0 {
+		return fmt.Errorf("dns cache-ttl and negative-ttl must not be negative")
+	}
+	if cfg.DNS.MaxInFlight < 0 {
+		return fmt.Errorf("dns max-in-flight must not be negative")
+	}
+	if cfg.DNS.QueueTimeout.Duration <= 0 {
+		return fmt.Errorf("dns queue-timeout must be positive")
+	}
+
+	if cfg.Harvest.MinRecipients < 1 {
+		return fmt.Errorf("harvest min-recipients must be at least 1")
+	}
+	if cfg.Harvest.Ratio <= 0 || cfg.Harvest.Ratio > 1 {
+		return fmt.Errorf("harvest ratio must be above 0 and at most 1")
+	}
+	if cfg.Harvest.Penalty < 0 {
+		return fmt.Errorf("harvest penalty must not be negative")
+	}
+
+	if cfg.BruteForce.Failures < 0 {
+		return fmt.Errorf("brute-force failures must not be negative")
+	}
+	if cfg.BruteForce.Penalty < 0 {
+		return fmt.Errorf("brute-force penalty must not be negative")
+	}
+
+	if cfg.Velocity.MaxRate < 0 || cfg.Velocity.MaxRate >= velocityWindow {
+		return fmt.Errorf("velocity max-rate must be between 0 and %d", velocityWindow-1)
+	}
+	if cfg.Velocity.Penalty < 0 {
+		return fmt.Errorf("velocity penalty must not be negative")
+	}
+
+	if cfg.Timing.MinCommands < 1 {
+		return fmt.Errorf("timing min-commands must be at least 1")
+	}
+	if cfg.Timing.MinMeanGap.Duration < 0 {
+		return fmt.Errorf("timing min-mean-gap must not be negative")
+	}
+	if cfg.Timing.Penalty < 0 {
+		return fmt.Errorf("timing penalty must not be negative")
+	}
+	if cfg.Timing.MinTransactionTime.Duration < 0 || cfg.Timing.TransactionPenalty < 0 {
+		return fmt.Errorf("timing min-transaction-time and transaction-penalty must not be negative")
+	}
+
+	if cfg.Size.Min < 0 || cfg.Size.Max < 0 {
+		return fmt.Errorf("size bounds must not be negative")
+	}
+	if cfg.Size.Max > 0 && cfg.Size.Min > cfg.Size.Max {
+		return fmt.Errorf("size min must not be above max")
+	}
+	if cfg.Size.Penalty < 0 {
+		return fmt.Errorf("size penalty must not be negative")
+	}
+
+	if cfg.LocalParts.MinLength < 1 {
+		return fmt.Errorf("local-parts min-length must be at least 1")
+	}
+	if cfg.LocalParts.DigitRatio <= 0 || cfg.LocalParts.DigitRatio > 1 {
+		return fmt.Errorf("local-parts digit-ratio must be within (0, 1]")
+	}
+	if cfg.LocalParts.Entropy <= 0 {
+		return fmt.Errorf("local-parts entropy must be positive")
+	}
+	if cfg.LocalParts.Penalty < 0 {
+		return fmt.Errorf("local-parts penalty must not be negative")
+	}
+
+	if cfg.SenderDomains.MinTransactions < 1 {
+		return fmt.Errorf("sender-domains min-transactions must be at least 1")
+	}
+	if cfg.SenderDomains.Penalty < 0 || cfg.SenderDomains.MaxPenalty < 0 {
+		return fmt.Errorf("sender-domains penalties must not be negative")
+	}
+
+	if cfg.TransactionLimit.Max < 1 {
+		return fmt.Errorf("transaction-limit max must be at least 1")
+	}
+	if cfg.TransactionLimit.Penalty < 0 {
+		return fmt.Errorf("transaction-limit penalty must not be negative")
+	}
+
+	if cfg.SharedHelo.Window.Duration <= 0 {
+		return fmt.Errorf("shared-helo window must be positive")
+	}
+	if cfg.SharedHelo.MaxAddresses < 1 || cfg.SharedHelo.MaxAddresses > heloMaxAddresses {
+		return fmt.Errorf("shared-helo max-addresses must be between 1 and %d", heloMaxAddresses)
+	}
+	if cfg.SharedHelo.Penalty < 0 {
+		return fmt.Errorf("shared-helo penalty must not be negative")
+	}
+
+	if cfg.Identify.Max < 1 {
+		return fmt.Errorf("identify max must be at least 1")
+	}
+	if cfg.Identify.Penalty < 0 {
+		return fmt.Errorf("identify penalty must not be negative")
+	}
+
+	if cfg.Storage.HistorySize < 1 || cfg.Storage.HistorySize > 10000 {
+		return fmt.Errorf("history-size must be between 1 and 10000")
+	}
+	if cfg.Storage.PruneInterval.Duration <= 0 {
+		return fmt.Errorf("prune-interval must be positive")
+	}
+	if cfg.Storage.MaxAge.Duration <= cfg.Storage.PruneInterval.Duration {
+		return fmt.Errorf("max-age must be greater than prune-interval")
+	}
+	if cfg.Storage.MaxKeys < 0 {
+		return fmt.Errorf("max-keys must not be negative")
+	}
+
+	if len(cfg.RequireTLS.Message) < 4 || cfg.RequireTLS.Message[0] != '4' && cfg.RequireTLS.Message[0] != '5' {
+		return fmt.Errorf("require-tls message must start with a 4xx or 5xx code")
+	}
+	if len(cfg.MandatoryTLS.Message) < 4 || cfg.MandatoryTLS.Message[0] != '4' && cfg.MandatoryTLS.Message[0] != '5' {
+		return fmt.Errorf("mandatory-tls message must start with a 4xx or 5xx code")
+	}
+	switch cfg.RequireFCrDNS.Action {
+	case "defer", "reject":
+	default:
+		return fmt.Errorf("unknown require-fcrdns action %s", cfg.RequireFCrDNS.Action)
+	}
+	if cfg.Escalation.HalfLife.Duration <= 0 {
+		return fmt.Errorf("escalation half-life must be positive")
+	}
+	if cfg.Escalation.RejectAfter < 0 {
+		return fmt.Errorf("escalation reject-after must not be negative")
+	}
+	if cfg.Escalation.Delay.Duration < 0 || cfg.Escalation.Delay.Duration > maxTarpitDelay {
+		return fmt.Errorf("escalation delay must be between 0 and %s", maxTarpitDelay)
+	}
+	if cfg.Escalation.Factor < 1 {
+		return fmt.Errorf("escalation factor must be at least 1")
+	}
+
+	if cfg.Distribution.Interval.Duration < 0 {
+		return fmt.Errorf("distribution interval must not be negative")
+	}
+	if len(cfg.Distribution.Buckets) > maxDistributionBuckets {
+		return fmt.Errorf("distribution has more than %d buckets", maxDistributionBuckets)
+	}
+	for i, bound := range cfg.Distribution.Buckets {
+		if bound <= scale.Min || bound >= scale.Max || i > 0 && bound <= cfg.Distribution.Buckets[i-1] {
+			return fmt.Errorf("distribution buckets must be increasing and strictly within the scale")
+		}
+	}
+	if len(cfg.RefuseData.Message) < 4 || cfg.RefuseData.Message[0] != '4' && cfg.RefuseData.Message[0] != '5' {
+		return fmt.Errorf("refuse-data message must start with a 4xx or 5xx code")
+	}
+
+	if cfg.RecipientLimit.Max < 1 {
+		return fmt.Errorf("recipient-limit max must be at least 1")
+	}
+	if len(cfg.RecipientLimit.Message) < 4 || cfg.RecipientLimit.Message[0] != '4' {
+		return fmt.Errorf("recipient-limit message must start with a 4xx code")
+	}
+	if cfg.RecipientCap.Max < 1 {
+		return fmt.Errorf("recipient-cap max must be at least 1")
+	}
+	if len(cfg.RecipientCap.Message) < 4 || cfg.RecipientCap.Message[0] != '4' && cfg.RecipientCap.Message[0] != '5' {
+		return fmt.Errorf("recipient-cap message must start with a 4xx or 5xx code")
+	}
+
+	if cfg.Downgrade.Penalty < 0 {
+		return fmt.Errorf("downgrade penalty must not be negative")
+	}
+
+	if cfg.Webhook.URL != "" {
+		u, err := url.Parse(cfg.Webhook.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook url must be an http or https URL")
+		}
+	}
+	if cfg.Webhook.Threshold < scale.Min || cfg.Webhook.Threshold > scale.Max {
+		return fmt.Errorf("webhook threshold must be between scale min and max")
+	}
+	if cfg.Webhook.Timeout.Duration <= 0 {
+		return fmt.Errorf("webhook timeout must be positive")
+	}
+	if cfg.Webhook.Retries < 0 {
+		return fmt.Errorf("webhook retries must not be negative")
+	}
+
+	if cfg.AutoBlacklist.Threshold != 0 && (cfg.AutoBlacklist.Threshold < scale.Min || cfg.AutoBlacklist.Threshold > scale.Max) {
+		return fmt.Errorf("auto-blacklist threshold must be between scale min and max")
+	}
+	if cfg.AutoBlacklist.MinSamples < 1 {
+		return fmt.Errorf("auto-blacklist min-samples must be at least 1")
+	}
+	if cfg.AutoBlacklist.MinSamples > cfg.Storage.HistorySize {
+		return fmt.Errorf("auto-blacklist min-samples must not exceed history-size")
+	}
+	if cfg.AutoBlacklist.TTL.Duration <= 0 {
+		return fmt.Errorf("auto-blacklist ttl must be positive")
+	}
+
+	// best case: a single authenticated TLS session, with valid rDNS and
+	// FCrDNS, delivering one message to one recipient.
+	best := math.Min(scale.Max, w.ValidSender+w.Data+w.Commit+w.SuccessfulRecipient)
+	best += math.Min(w.AuthSuccess, w.AuthSuccessCap) + math.Max(w.TLS, w.TLSModern) + w.RDNS + w.FCrDNS
+	if best < scale.Max {
+		logger.Warn("weights-unreachable", "best-score", best)
+	}
+
+	for _, p := range cfg.Profiles {
+		if err := p.config.validate(); err != nil {
+			return fmt.Errorf("profile %s: %s", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig reads the configuration at path again and swaps it in, the
+// active configuration is kept if the new one is invalid.
+func reloadConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	old := activeConfig.Swap(cfg)
+	logger.Info("config-reload", "path", path,
+		"old-reject", old.Thresholds.Reject, "reject", cfg.Thresholds.Reject,
+		"old-defer", old.Thresholds.Defer, "defer", cfg.Thresholds.Defer)
+	return nil
+}
+
+// reloadAll reloads the configuration and the address lists, as on SIGHUP,
+// returning the errors of those that failed to reload and kept their
+// previous contents.
+func reloadAll(configFile string) error {
+	var errs []error
+	if err := reloadConfig(configFile); err != nil {
+		logger.Error("config-reload-failed", "path", configFile, "error", err)
+		errs = append(errs, err)
+	}
+	if err := blacklist.reload(); err != nil {
+		logger.Error("blacklist-reload-failed", "error", err)
+		errs = append(errs, err)
+	} else {
+		logger.Info("blacklist-reload", "networks", blacklist.len())
+	}
+	if err := whitelist.reload(); err != nil {
+		logger.Error("whitelist-reload-failed", "error", err)
+		errs = append(errs, err)
+	} else {
+		logger.Info("whitelist-reload", "networks", whitelist.len())
+	}
+	if err := pins.reload(); err != nil {
+		logger.Error("pins-reload-failed", "error", err)
+		errs = append(errs, err)
+	} else {
+		logger.Info("pins-reload", "pins", pins.len())
+	}
+	return errors.Join(errs...)
+}
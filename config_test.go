@@ -0,0 +1,119 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateStorage(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %s", err)
+	}
+
+	for _, storage := range []Storage{
+		{HistorySize: 0, MaxAge: duration{time.Hour}, PruneInterval: duration{time.Minute}},
+		{HistorySize: 100, MaxAge: duration{time.Hour}, PruneInterval: duration{0}},
+		{HistorySize: 100, MaxAge: duration{time.Minute}, PruneInterval: duration{time.Minute}},
+		{HistorySize: 100, MaxAge: duration{time.Minute}, PruneInterval: duration{time.Hour}},
+	} {
+		cfg := defaultConfig()
+		cfg.Storage = storage
+		if err := cfg.validate(); err == nil {
+			t.Errorf("storage %+v was accepted", storage)
+		}
+	}
+}
+
+func TestValidateGraceSamples(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AutoBlacklist.MinSamples = 1
+	cfg.Storage.HistorySize = cfg.Grace.MinSamples
+	if err := cfg.validate(); err != nil {
+		t.Errorf("min-samples equal to history-size was refused: %s", err)
+	}
+	cfg.Storage.HistorySize = cfg.Grace.MinSamples - 1
+	if err := cfg.validate(); err == nil {
+		t.Errorf("grace min-samples above history-size was accepted")
+	}
+}
+
+func TestValidateScale(t *testing.T) {
+	for _, scale := range []struct{ min, max, prior float64 }{
+		{1, 0, 0.5},
+		{0, 0, 0},
+		{0, 1, 0},
+		{0, 1, 1},
+		{0, 10, 12},
+	} {
+		cfg := defaultConfig()
+		cfg.Scale = Scale{Min: scale.min, Max: scale.max}
+		cfg.Aggregation.Prior = scale.prior
+		if err := cfg.validate(); err == nil {
+			t.Errorf("scale %+v was accepted", scale)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Scale = Scale{Min: -1, Max: 1}
+	cfg.Aggregation.Prior = 0
+	if err := cfg.validate(); err != nil {
+		t.Errorf("scale from -1 to 1 was refused: %s", err)
+	}
+	session := &SessionData{authfail: 10, transactions: []*Transaction{{rcptToPermfail: 10}}}
+	if score := scoreSession(session, cfg); score != -1 {
+		t.Errorf("bad session scored %.04f, want the scale min", score)
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	for _, thresholds := range []struct{ reject, deferral string }{
+		{"421 4.7.0 Connection refused", "421 4.7.0 Connection deferred"},
+		{"554 5.7.1 Connection refused", "554 5.7.1 Connection deferred"},
+		{"554", "421 4.7.0 Connection deferred"},
+		{"554 5.7.1 Connection refused: score {scor}", "421 4.7.0 Connection deferred"},
+		{"554 5.7.1 Connection refused", "421 4.7.0 Connection deferred for {address}"},
+		{"554 5.7.1 Connection refused\r\n250 OK", "421 4.7.0 Connection deferred"},
+	} {
+		cfg := defaultConfig()
+		cfg.Thresholds.RejectMessage = thresholds.reject
+		cfg.Thresholds.DeferMessage = thresholds.deferral
+		if err := cfg.validate(); err == nil {
+			t.Errorf("messages %q and %q were accepted", thresholds.reject, thresholds.deferral)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Thresholds.RejectMessage = "554 5.7.1 {ip} refused, score {score} over {samples} sessions, see https://example.org/rbl"
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("valid reject message refused: %s", err)
+	}
+}
+
+func TestValidateAutoBlacklistSamples(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Grace.MinSamples = 1
+	cfg.AutoBlacklist.MinSamples = cfg.Storage.HistorySize
+	if err := cfg.validate(); err != nil {
+		t.Errorf("min-samples equal to history-size was refused: %s", err)
+	}
+	cfg.AutoBlacklist.MinSamples = cfg.Storage.HistorySize + 1
+	if err := cfg.validate(); err == nil {
+		t.Errorf("auto-blacklist min-samples above history-size was accepted")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// listenControl listens on the Unix socket at path for the control protocol,
+// replacing a socket left over by a previous instance. The socket is given
+// mode, which should keep it out of reach of other users as the protocol
+// has no authentication of its own.
+func listenControl(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveControl accepts control connections on listener until it is closed,
+// reload being called by the reload command.
+func serveControl(listener net.Listener, reload func() error) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("control-accept-failed", "error", err)
+			}
+			return
+		}
+		go handleControl(conn, reload)
+	}
+}
+
+// handleControl runs the commands read from conn, one per line, until the
+// client closes it. The reply to each command is its output, if any, then
+// a line with either "ok" or "error" and the reason.
+func handleControl(conn net.Conn, reload func() error) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := runControl(w, fields[0], fields[1:], reload); err != nil {
+			// errors joined by reload span several lines
+			fmt.Fprintf(w, "error %s\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+		} else {
+			fmt.Fprintln(w, "ok")
+		}
+		if err := w.Flush(); err != nil {
+			logger.Warn("control-write-failed", "error", err)
+			return
+		}
+	}
+}
+
+// runControl writes the output of a control command to w.
+func runControl(w io.Writer, command string, args []string, reload func() error) error {
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: get <ip>")
+		}
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return fmt.Errorf("invalid ip %s", args[0])
+		}
+		reply, exists := lookupReputation(ip)
+		if !exists {
+			return fmt.Errorf("no reputation for %s", reply.Key)
+		}
+		return json.NewEncoder(w).Encode(reply)
+
+	case "reset":
+		if len(args) < 1 || len(args) > 2 || len(args) == 2 && args[1] != "dry-run" {
+			return fmt.Errorf("usage: reset <address or network> [dry-run]")
+		}
+		target, err := parseNetwork(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid target %s", args[0])
+		}
+		dryRun := len(args) == 2
+		keys := resetReputation(target, dryRun)
+		logger.Info("reset", "remote", "control", "target", target.String(), "keys", len(keys), "dry-run", dryRun)
+		for _, key := range keys {
+			fmt.Fprintln(w, key)
+		}
+		return nil
+
+	case "dump":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: dump")
+		}
+		cfg := currentConfig()
+		entries := make(map[string][]Scoring)
+		for _, key := range ipStore.Keys() {
+			entries[key] = ipStore.Load(key)
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, stats := range dumpRows(entries, cfg, dumpOptions{sortBy: "score", minScore: cfg.Scale.Min, maxScore: cfg.Scale.Max}) {
+			fmt.Fprintf(tw, "%s\t%d\t%.4f\t%s\n", stats.Key, stats.Samples, stats.Score, stats.LastSeen.Format(time.RFC3339))
+		}
+		return tw.Flush()
+
+	case "reload":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: reload")
+		}
+		return reload()
+
+	case "stats":
+		n := statsDefaultN
+		if len(args) > 1 {
+			return fmt.Errorf("usage: stats [n]")
+		}
+		if len(args) == 1 {
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid n %s", args[0])
+			}
+			n = min(n, statsMaxN)
+		}
+		return json.NewEncoder(w).Encode(collectStats(n))
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
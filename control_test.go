@@ -0,0 +1,152 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// controlClient sends commands over a control connection and returns the
+// output lines and status line of their replies.
+type controlClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func (c *controlClient) run(t *testing.T, command string) ([]string, string) {
+	t.Helper()
+	if _, err := fmt.Fprintln(c.conn, command); err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if line == "ok" || strings.HasPrefix(line, "error ") {
+			return lines, line
+		}
+		lines = append(lines, line)
+	}
+	t.Fatalf("%s: connection closed before the status line", command)
+	return nil, ""
+}
+
+func TestControlSocket(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	for i := 0; i < 10; i++ {
+		ipStore.Append("192.0.2.1", Scoring{Timestamp: time.Now(), Score: 0.1})
+		ipStore.Append("198.51.100.1", Scoring{Timestamp: time.Now(), Score: 0.9})
+	}
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := listenControl(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	reloads := 0
+	go serveControl(listener, func() error {
+		reloads++
+		if reloads > 1 {
+			return errors.Join(errors.New("bad config"), errors.New("bad blacklist"))
+		}
+		return nil
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &controlClient{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	lines, status := client.run(t, "get 192.0.2.1")
+	var reply reputationReply
+	if status != "ok" || len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &reply) != nil || reply.Samples != 10 {
+		t.Errorf("get = %v, %s", lines, status)
+	}
+	if _, status := client.run(t, "get 203.0.113.1"); status != "error no reputation for 203.0.113.1" {
+		t.Errorf("get of an unknown address = %s", status)
+	}
+
+	lines, status = client.run(t, "dump")
+	if status != "ok" || len(lines) != 2 || !strings.HasPrefix(lines[0], "192.0.2.1 ") {
+		t.Errorf("dump = %q, %s, want the worst key first", lines, status)
+	}
+
+	lines, status = client.run(t, "stats 1")
+	var stats statsReply
+	if status != "ok" || len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &stats) != nil {
+		t.Fatalf("stats = %v, %s", lines, status)
+	}
+	if stats.Keys != 2 || len(stats.Worst) != 1 || stats.Worst[0].Key != "192.0.2.1" || stats.Best[0].Key != "198.51.100.1" {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	lines, status = client.run(t, "reset 192.0.2.0/24 dry-run")
+	if status != "ok" || len(lines) != 1 || lines[0] != "192.0.2.1" || ipStore.Load("192.0.2.1") == nil {
+		t.Errorf("dry-run reset = %v, %s", lines, status)
+	}
+	if _, status := client.run(t, "reset 192.0.2.1"); status != "ok" || ipStore.Load("192.0.2.1") != nil {
+		t.Errorf("reset = %s, key left in the store", status)
+	}
+
+	if _, status := client.run(t, "reload"); status != "ok" {
+		t.Errorf("reload = %s", status)
+	}
+	if _, status := client.run(t, "reload"); status != "error bad config; bad blacklist" {
+		t.Errorf("failed reload = %s", status)
+	}
+	for _, command := range []string{"frobnicate", "get", "get not-an-ip", "stats 0", "reset"} {
+		if _, status := client.run(t, command); !strings.HasPrefix(status, "error ") {
+			t.Errorf("%s = %s, want an error", command, status)
+		}
+	}
+
+	// a socket left over by a previous instance is replaced, other files
+	// never are
+	stalePath := filepath.Join(t.TempDir(), "stale.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: stalePath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if listener, err := listenControl(stalePath, 0600); err != nil {
+		t.Errorf("stale socket wasn't replaced: %v", err)
+	} else {
+		listener.Close()
+	}
+	regular := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(regular, nil, 0600)
+	if _, err := listenControl(regular, 0600); err == nil {
+		t.Errorf("listenControl replaced a regular file")
+	}
+}
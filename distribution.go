@@ -0,0 +1,122 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scoreHistogram counts the connect scores falling in each bucket since it
+// was last reset, bounds being the upper bounds of all buckets but the
+// last, which goes up to the top of the scale.
+type scoreHistogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []int
+	since  time.Time
+}
+
+func newScoreHistogram(bounds []float64, since time.Time) *scoreHistogram {
+	return &scoreHistogram{bounds: slices.Clone(bounds), counts: make([]int, len(bounds)+1), since: since}
+}
+
+var scoreDistribution = newScoreHistogram(defaultConfig().Distribution.Buckets, time.Now())
+
+// bucket returns the index of the bucket score falls in.
+func (h *scoreHistogram) bucket(score float64) int {
+	i, _ := slices.BinarySearchFunc(h.bounds, score, func(bound float64, score float64) int {
+		if bound <= score {
+			return -1
+		}
+		return 1
+	})
+	return i
+}
+
+// observe counts score, starting over if the bounds changed since the last
+// score, and returns the label of its bucket.
+func (h *scoreHistogram) observe(score float64, bounds []float64, scale *Scale, timestamp time.Time) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !slices.Equal(h.bounds, bounds) {
+		h.bounds = slices.Clone(bounds)
+		h.counts = make([]int, len(bounds)+1)
+		h.since = timestamp
+	}
+	i := h.bucket(score)
+	h.counts[i]++
+	return bucketLabel(h.bounds, i, scale)
+}
+
+// bucketLabel names bucket i, as the half-open range of scores it holds.
+func bucketLabel(bounds []float64, i int, scale *Scale) string {
+	lower, upper, closing := scale.Min, scale.Max, "]"
+	if i > 0 {
+		lower = bounds[i-1]
+	}
+	if i < len(bounds) {
+		upper, closing = bounds[i], ")"
+	}
+	return "[" + strconv.FormatFloat(lower, 'f', -1, 64) + "-" + strconv.FormatFloat(upper, 'f', -1, 64) + closing
+}
+
+// report returns the counts since the last reset as log attributes, along
+// with the total and the time counting started, resetting them unless
+// cumulative is set.
+func (h *scoreHistogram) report(scale *Scale, cumulative bool, timestamp time.Time) ([]slog.Attr, int, time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	attrs := make([]slog.Attr, 0, len(h.counts))
+	total := 0
+	for i, count := range h.counts {
+		attrs = append(attrs, slog.Int(bucketLabel(h.bounds, i, scale), count))
+		total += count
+	}
+	since := h.since
+	if !cumulative {
+		clear(h.counts)
+		h.since = timestamp
+	}
+	return attrs, total, since
+}
+
+// observeScore counts the connect score of a session in the distribution
+// and its Prometheus counterpart.
+func observeScore(score float64, cfg *Config) {
+	label := scoreDistribution.observe(score, cfg.Distribution.Buckets, &cfg.Scale, now())
+	connectScoreBuckets.WithLabelValues(label).Inc()
+}
+
+// distributionLoop logs the distribution of the connect scores every
+// interval, checking every minute whether it was enabled by a reload.
+func distributionLoop() {
+	for {
+		cfg := currentConfig()
+		if cfg.Distribution.Interval.Duration == 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(cfg.Distribution.Interval.Duration)
+		cfg = currentConfig()
+		attrs, total, since := scoreDistribution.report(&cfg.Scale, cfg.Distribution.Cumulative, now())
+		logger.Info("score-distribution", "since", since, "connects", total, slog.Attr{Key: "buckets", Value: slog.GroupValue(attrs...)})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScoreHistogram(t *testing.T) {
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	scale := &Scale{Min: 0, Max: 1}
+	bounds := []float64{0.1, 0.3, 0.5}
+	h := newScoreHistogram(bounds, start)
+
+	for score, want := range map[float64]string{
+		0.0:  "[0-0.1)",
+		0.1:  "[0.1-0.3)",
+		0.29: "[0.1-0.3)",
+		0.5:  "[0.5-1]",
+		1.0:  "[0.5-1]",
+	} {
+		if label := h.observe(score, bounds, scale, start); label != want {
+			t.Errorf("score %.02f counted in %s, want %s", score, label, want)
+		}
+	}
+
+	attrs, total, since := h.report(scale, false, start.Add(time.Hour))
+	if total != 5 || !since.Equal(start) {
+		t.Errorf("report = %d connects since %s, want 5 since %s", total, since, start)
+	}
+	counts := make(map[string]int64)
+	for _, attr := range attrs {
+		counts[attr.Key] = attr.Value.Int64()
+	}
+	if want := map[string]int64{"[0-0.1)": 1, "[0.1-0.3)": 2, "[0.3-0.5)": 0, "[0.5-1]": 2}; len(counts) != len(want) {
+		t.Errorf("report buckets = %v, want %v", counts, want)
+	} else {
+		for label, count := range want {
+			if counts[label] != count {
+				t.Errorf("bucket %s = %d, want %d", label, counts[label], count)
+			}
+		}
+	}
+
+	// counts start over after a report unless cumulative
+	h.observe(0.4, bounds, scale, start.Add(time.Hour))
+	if _, total, since := h.report(scale, true, start.Add(2*time.Hour)); total != 1 || !since.Equal(start.Add(time.Hour)) {
+		t.Errorf("report after a reset = %d connects since %s, want 1 since the last report", total, since)
+	}
+	h.observe(0.4, bounds, scale, start.Add(2*time.Hour))
+	if _, total, _ := h.report(scale, false, start.Add(3*time.Hour)); total != 2 {
+		t.Errorf("cumulative report = %d connects, want 2", total)
+	}
+
+	// new bounds from a reload start the counts over
+	h.observe(0.4, bounds, scale, start.Add(3*time.Hour))
+	h.observe(0.4, []float64{0.5}, scale, start.Add(4*time.Hour))
+	attrs, total, since = h.report(scale, false, start.Add(5*time.Hour))
+	if total != 1 || len(attrs) != 2 || !since.Equal(start.Add(4*time.Hour)) {
+		t.Errorf("report after new bounds = %d connects in %d buckets since %s", total, len(attrs), since)
+	}
+}
+
+func TestValidateDistribution(t *testing.T) {
+	for _, buckets := range [][]float64{
+		{0.3, 0.1},
+		{0.1, 0.1},
+		{0, 0.5},
+		{0.5, 1},
+		make([]float64, maxDistributionBuckets+1),
+	} {
+		cfg := defaultConfig()
+		cfg.Distribution.Buckets = buckets
+		if err := cfg.validate(); err == nil {
+			t.Errorf("buckets %v were accepted", buckets)
+		}
+	}
+	cfg := defaultConfig()
+	cfg.Distribution.Buckets = nil
+	if err := cfg.validate(); err != nil {
+		t.Errorf("a single bucket was refused: %v", err)
+	}
+}
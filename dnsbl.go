@@ -0,0 +1,145 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dnsblEntry struct {
+	listed  []string
+	expires time.Time
+}
+
+var dnsblCache = make(map[string]dnsblEntry)
+var dnsblCacheMutex sync.Mutex
+
+// dnsblName returns the name to query in zone for ip: the reversed octets
+// of an IPv4 address, or the reversed nibbles of an IPv6 address.
+func dnsblName(ip net.IP, zone string) string {
+	labels := make([]string, 0, 32)
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[i]))
+		}
+	} else {
+		ip6 := ip.To16()
+		for i := len(ip6) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", ip6[i]&0x0f), fmt.Sprintf("%x", ip6[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone + "."
+}
+
+// dnsblResult is the outcome of the lookup of an address in the DNSBL
+// zones: the zones listing it and, failing closed, those that failed to
+// answer, which don't list it but may not be ignored either.
+type dnsblResult struct {
+	listed []string
+	failed []string
+}
+
+// lookupDNSBL returns the configured zones listing ip. Zones are queried in
+// parallel and the result is cached for the configured TTL. A zone that
+// fails to answer in time is considered as not listing the address, unless
+// the failure policy is to fail closed: it is then reported as failed, and
+// the result isn't cached so that the zone is asked again on the next
+// connection.
+func lookupDNSBL(ip net.IP) dnsblResult {
+	dnsblCacheMutex.Lock()
+	entry, exists := dnsblCache[ip.String()]
+	dnsblCacheMutex.Unlock()
+	if exists && entry.expires.After(now()) {
+		return dnsblResult{listed: entry.listed}
+	}
+
+	cfg := currentConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DNSBL.Timeout.Duration)
+	defer cancel()
+
+	zones := cfg.DNSBL.Zones
+	results := make(chan string, len(zones))
+	failures := make(chan string, len(zones))
+	for _, zone := range zones {
+		go func(zone string) {
+			addrs, err := dnsResults.lookupHost(ctx, dnsblName(ip, zone), &cfg.DNS)
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				results <- ""
+				return
+			}
+			if err != nil {
+				// lookups dropped under max-in-flight are counted already
+				closed := cfg.Failure.closed()
+				if err != errDNSBusy {
+					closed = dependencyFailed("dnsbl", err, cfg, "ip", ip.String(), "zone", zone)
+				}
+				if closed {
+					failures <- zone
+					results <- ""
+					return
+				}
+				results <- ""
+				return
+			}
+			for _, addr := range addrs {
+				// 127.255.255.0/24 is used by some zones to report
+				// errors such as queries through public resolvers.
+				if strings.HasPrefix(addr, "127.") && !strings.HasPrefix(addr, "127.255.255.") {
+					results <- zone
+					return
+				}
+			}
+			results <- ""
+		}(zone)
+	}
+
+	listed := make([]string, 0)
+	for range zones {
+		if zone := <-results; zone != "" {
+			listed = append(listed, zone)
+		}
+	}
+
+	close(failures)
+	result := dnsblResult{listed: listed}
+	for zone := range failures {
+		result.failed = append(result.failed, zone)
+	}
+	if len(result.failed) != 0 {
+		return result
+	}
+	dnsblCacheMutex.Lock()
+	dnsblCache[ip.String()] = dnsblEntry{listed: listed, expires: now().Add(cfg.DNSBL.CacheTTL.Duration)}
+	dnsblCacheMutex.Unlock()
+
+	return result
+}
+
+func pruneDNSBLCache() {
+	dnsblCacheMutex.Lock()
+	defer dnsblCacheMutex.Unlock()
+	for ip, entry := range dnsblCache {
+		if entry.expires.Before(now()) {
+			delete(dnsblCache, ip)
+		}
+	}
+}
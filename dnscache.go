@@ -0,0 +1,158 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type dnsCacheEntry struct {
+	addrs   []string
+	err     error // a cached NXDOMAIN
+	expires time.Time
+}
+
+// dnsCache caches the answers to the DNS queries of the features doing
+// their own lookups, so that repeated connects from the same address don't
+// each go to the network. Names that don't exist are cached too, for their
+// own TTL, while failures such as timeouts never are.
+type dnsCache struct {
+	mutex   sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]dnsCacheEntry)}
+}
+
+var dnsResults = newDNSCache()
+
+// resolveHost resolves a name, tests replace it with a fake resolver.
+var resolveHost = net.DefaultResolver.LookupHost
+
+// lookupHost resolves name like net.Resolver.LookupHost, through the cache.
+func (c *dnsCache) lookupHost(ctx context.Context, name string, cfg *DNS) ([]string, error) {
+	c.mutex.Lock()
+	entry, exists := c.entries[name]
+	c.mutex.Unlock()
+	if exists && entry.expires.After(now()) {
+		dnsCacheLookups.WithLabelValues("hit").Inc()
+		return entry.addrs, entry.err
+	}
+	dnsCacheLookups.WithLabelValues("miss").Inc()
+
+	if err := dnsLookups.acquire(ctx, cfg.MaxInFlight, cfg.QueueTimeout.Duration); err != nil {
+		return nil, err
+	}
+	addrs, err := resolveHost(ctx, name)
+	dnsLookups.release()
+	ttl := cfg.CacheTTL.Duration
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return addrs, err
+		}
+		ttl = cfg.NegativeTTL.Duration
+	}
+	if ttl > 0 {
+		c.mutex.Lock()
+		c.entries[name] = dnsCacheEntry{addrs: addrs, err: err, expires: now().Add(ttl)}
+		c.mutex.Unlock()
+	}
+	return addrs, err
+}
+
+func (c *dnsCache) prune(at time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name, entry := range c.entries {
+		if !entry.expires.After(at) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+func (c *dnsCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// errDNSBusy is returned by lookups that couldn't get a slot in time, the
+// features doing them then act as if the name didn't resolve.
+var errDNSBusy = errors.New("too many DNS lookups in flight")
+
+// lookupLimiter bounds the number of DNS queries in flight, so that a surge
+// of connections doesn't overwhelm the resolver. The limit is given on each
+// acquire so that a configuration reload applies right away.
+type lookupLimiter struct {
+	mutex    sync.Mutex
+	inFlight int
+	released chan struct{} // closed and replaced on every release
+}
+
+func newLookupLimiter() *lookupLimiter {
+	return &lookupLimiter{released: make(chan struct{})}
+}
+
+var dnsLookups = newLookupLimiter()
+
+// acquire waits for one of limit slots to be free, for at most timeout or
+// until ctx is done, zero not limiting the queries. A successful acquire
+// must be followed by a release.
+func (l *lookupLimiter) acquire(ctx context.Context, limit int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		l.mutex.Lock()
+		if limit <= 0 || l.inFlight < limit {
+			l.inFlight++
+			l.mutex.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-timer.C:
+			dnsLookupsDropped.Inc()
+			return errDNSBusy
+		case <-ctx.Done():
+			dnsLookupsDropped.Inc()
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *lookupLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *lookupLimiter) len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
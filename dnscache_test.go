@@ -0,0 +1,130 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC))
+	saved := resolveHost
+	defer func() { resolveHost = saved }()
+	queries := make(map[string]int)
+	resolveHost = func(ctx context.Context, name string) ([]string, error) {
+		queries[name]++
+		switch name {
+		case "listed.example.":
+			return []string{"127.0.0.2"}, nil
+		case "timeout.example.":
+			return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	cfg := DNS{CacheTTL: duration{time.Hour}, NegativeTTL: duration{5 * time.Minute}}
+	c := newDNSCache()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if addrs, err := c.lookupHost(ctx, "listed.example.", &cfg); err != nil || len(addrs) != 1 {
+			t.Fatalf("lookupHost(listed) = %v, %v", addrs, err)
+		}
+		var dnsErr *net.DNSError
+		if _, err := c.lookupHost(ctx, "missing.example.", &cfg); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("lookupHost(missing) = %v, want a not found error", err)
+		}
+		c.lookupHost(ctx, "timeout.example.", &cfg)
+	}
+	if queries["listed.example."] != 1 || queries["missing.example."] != 1 {
+		t.Errorf("expected answers to be cached, got %v", queries)
+	}
+	if queries["timeout.example."] != 3 {
+		t.Errorf("expected failures not to be cached, got %d queries", queries["timeout.example."])
+	}
+
+	// the negative TTL is shorter than the positive one
+	*clock = clock.Add(10 * time.Minute)
+	c.prune(*clock)
+	if c.len() != 1 {
+		t.Errorf("expected the negative answer to expire, %d entries left", c.len())
+	}
+	c.lookupHost(ctx, "listed.example.", &cfg)
+	c.lookupHost(ctx, "missing.example.", &cfg)
+	if queries["listed.example."] != 1 || queries["missing.example."] != 2 {
+		t.Errorf("unexpected queries after the negative TTL %v", queries)
+	}
+
+	*clock = clock.Add(time.Hour)
+	c.lookupHost(ctx, "listed.example.", &cfg)
+	if queries["listed.example."] != 2 {
+		t.Errorf("expected the answer to expire, got %d queries", queries["listed.example."])
+	}
+
+	disabled := DNS{}
+	c = newDNSCache()
+	c.lookupHost(ctx, "listed.example.", &disabled)
+	c.lookupHost(ctx, "missing.example.", &disabled)
+	if c.len() != 0 {
+		t.Errorf("expected nothing cached with zero TTLs, got %d entries", c.len())
+	}
+}
+
+func TestLookupLimiter(t *testing.T) {
+	l := newLookupLimiter()
+	ctx := context.Background()
+	if err := l.acquire(ctx, 1, time.Second); err != nil {
+		t.Fatalf("acquire = %v, want a slot", err)
+	}
+	if err := l.acquire(ctx, 1, 10*time.Millisecond); err != errDNSBusy {
+		t.Errorf("acquire over the limit = %v, want %v", err, errDNSBusy)
+	}
+	if err := l.acquire(ctx, 0, time.Millisecond); err != nil {
+		t.Errorf("acquire without a limit = %v, want a slot", err)
+	}
+	l.release()
+
+	// a waiting lookup gets the slot released by another
+	go l.release()
+	if err := l.acquire(ctx, 1, time.Second); err != nil {
+		t.Errorf("acquire after a release = %v, want a slot", err)
+	}
+	if l.len() != 1 {
+		t.Errorf("%d lookups in flight, want 1", l.len())
+	}
+
+	saved, savedResolve := dnsLookups, resolveHost
+	defer func() { dnsLookups, resolveHost = saved, savedResolve }()
+	dnsLookups = l
+	resolveHost = func(ctx context.Context, name string) ([]string, error) {
+		return []string{"127.0.0.2"}, nil
+	}
+	cfg := DNS{MaxInFlight: 1, QueueTimeout: duration{10 * time.Millisecond}}
+	if _, err := newDNSCache().lookupHost(ctx, "listed.example.", &cfg); err != errDNSBusy {
+		t.Errorf("lookupHost with no slot = %v, want %v", err, errDNSBusy)
+	}
+	l.release()
+	if addrs, err := newDNSCache().lookupHost(ctx, "listed.example.", &cfg); err != nil || len(addrs) != 1 {
+		t.Errorf("lookupHost with a slot = %v, %v", addrs, err)
+	}
+	if l.len() != 0 {
+		t.Errorf("lookupHost didn't release its slot, %d in flight", l.len())
+	}
+}
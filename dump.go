@@ -0,0 +1,210 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// dumpOptions selects and orders the keys printed by the dump subcommand.
+type dumpOptions struct {
+	sortBy     string
+	minSamples int
+	minScore   float64
+	maxScore   float64
+}
+
+// storeTables maps the stores that can be dumped to their sqlite table and
+// bolt bucket.
+var storeTables = map[string][2]string{
+	"ip":          {"ip_scoring", "ip"},
+	"rdns":        {"rdns_scoring", "rdns"},
+	"helo":        {"helo_scoring", "helo"},
+	"domain":      {"domain_scoring", "domain"},
+	"asn":         {"asn_scoring", "asn"},
+	"rcpt-domain": {"rcpt_domain_scoring", "rcpt_domain"},
+}
+
+// dumpMain implements "filter-reputation dump", printing the keys of a
+// persisted store along with their reputation. Databases are opened
+// read-only so that it can be run against the files of a live filter.
+func dumpMain(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	stateFile := flags.String("state-file", "", "path to the JSON state file of the memory backend")
+	sqlitePath := flags.String("sqlite-path", "", "path to the SQLite database of the sqlite backend")
+	boltPath := flags.String("bolt-path", "", "path to the bbolt database of the bolt backend")
+	store := flags.String("store", "ip", "store to dump from a database (ip, rdns, helo, domain, asn or rcpt-domain)")
+	configFile := flags.String("config", "/etc/mail/filter-reputation.toml", "path to the TOML configuration file, for the aggregation settings")
+	opts := dumpOptions{}
+	flags.StringVar(&opts.sortBy, "sort", "score", "column to sort by (key, samples, score or last-seen)")
+	flags.IntVar(&opts.minSamples, "min-samples", 0, "only print keys with at least this many samples")
+	flags.Float64Var(&opts.minScore, "min-score", 0, "only print keys with at least this score")
+	flags.Float64Var(&opts.maxScore, "max-score", 1, "only print keys with at most this score")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch opts.sortBy {
+	case "key", "samples", "score", "last-seen":
+	default:
+		return fmt.Errorf("unknown sort column %s", opts.sortBy)
+	}
+	tables, ok := storeTables[*store]
+	if !ok {
+		return fmt.Errorf("unknown store %s", *store)
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	activeConfig.Store(cfg)
+
+	var entries map[string][]Scoring
+	switch {
+	case *stateFile != "":
+		entries, err = dumpStateFile(*stateFile)
+	case *sqlitePath != "":
+		entries, err = dumpSqlite(*sqlitePath, tables[0])
+	case *boltPath != "":
+		entries, err = dumpBolt(*boltPath, tables[1])
+	default:
+		return fmt.Errorf("one of -state-file, -sqlite-path or -bolt-path is required")
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSAMPLES\tSCORE\tLAST-SEEN")
+	for _, stats := range dumpRows(entries, cfg, opts) {
+		fmt.Fprintf(tw, "%s\t%d\t%.4f\t%s\n", stats.Key, stats.Samples, stats.Score, stats.LastSeen.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// dumpRows returns the keys of entries matching opts, sorted as requested.
+func dumpRows(entries map[string][]Scoring, cfg *Config, opts dumpOptions) []keyStats {
+	rows := make([]keyStats, 0, len(entries))
+	for key, scorings := range entries {
+		if len(scorings) == 0 || len(scorings) < opts.minSamples {
+			continue
+		}
+		score, _ := storedReputation(scorings, cfg)
+		if score < opts.minScore || score > opts.maxScore {
+			continue
+		}
+		rows = append(rows, keyStats{
+			Key:      key,
+			Score:    score,
+			Samples:  len(scorings),
+			LastSeen: scorings[len(scorings)-1].Timestamp,
+		})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		switch opts.sortBy {
+		case "samples":
+			if rows[i].Samples != rows[j].Samples {
+				return rows[i].Samples > rows[j].Samples
+			}
+		case "score":
+			if rows[i].Score != rows[j].Score {
+				return rows[i].Score < rows[j].Score
+			}
+		case "last-seen":
+			if !rows[i].LastSeen.Equal(rows[j].LastSeen) {
+				return rows[i].LastSeen.After(rows[j].LastSeen)
+			}
+		}
+		return rows[i].Key < rows[j].Key
+	})
+	return rows
+}
+
+func dumpStateFile(path string) (map[string][]Scoring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]Scoring)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func dumpSqlite(path string, table string) (map[string][]Scoring, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	b := &sqliteBackend{db: db, table: table}
+	entries := make(map[string][]Scoring)
+	for _, key := range b.Keys() {
+		entries[key] = b.Load(key)
+	}
+	return entries, nil
+}
+
+// dumpBolt reads a bolt database, which can't be opened while a live filter
+// holds its lock: it gives up after a few seconds.
+func dumpBolt(path string, bucket string) (map[string][]Scoring, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	entries := make(map[string][]Scoring)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key []byte, value []byte) error {
+			scorings, err := decodeScorings(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			entries[string(key)] = scorings
+			return nil
+		})
+	})
+	return entries, err
+}
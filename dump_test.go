@@ -0,0 +1,128 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDumpRows(t *testing.T) {
+	now := time.Now()
+	history := func(n int, score float64, last time.Time) []Scoring {
+		scorings := make([]Scoring, 0, n)
+		for i := 0; i < n; i++ {
+			scorings = append(scorings, Scoring{Timestamp: last.Add(time.Duration(i-n+1) * time.Minute), Score: score})
+		}
+		return scorings
+	}
+	entries := map[string][]Scoring{
+		"192.0.2.1": history(10, 0.9, now),
+		"192.0.2.2": history(20, 0.1, now.Add(-time.Hour)),
+		"192.0.2.3": history(2, 0.5, now.Add(-2*time.Hour)),
+		"192.0.2.4": {},
+	}
+	cfg := defaultConfig()
+
+	keys := func(rows []keyStats) string {
+		k := make([]string, 0, len(rows))
+		for _, row := range rows {
+			k = append(k, row.Key)
+		}
+		return strings.Join(k, " ")
+	}
+
+	tests := []struct {
+		opts dumpOptions
+		want string
+	}{
+		{dumpOptions{sortBy: "score", maxScore: 1}, "192.0.2.2 192.0.2.3 192.0.2.1"},
+		{dumpOptions{sortBy: "samples", maxScore: 1}, "192.0.2.2 192.0.2.1 192.0.2.3"},
+		{dumpOptions{sortBy: "last-seen", maxScore: 1}, "192.0.2.1 192.0.2.2 192.0.2.3"},
+		{dumpOptions{sortBy: "key", minSamples: 5, maxScore: 1}, "192.0.2.1 192.0.2.2"},
+		{dumpOptions{sortBy: "key", minScore: 0.4, maxScore: 0.6}, "192.0.2.3"},
+	}
+	for _, test := range tests {
+		if got := keys(dumpRows(entries, cfg, test.opts)); got != test.want {
+			t.Errorf("dumpRows(%+v) = %s, want %s", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestDumpMain(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "missing.toml")
+
+	memory := newMemoryBackend()
+	for i := 0; i < 6; i++ {
+		memory.Append("192.0.2.1", Scoring{Timestamp: time.Now(), Score: 0.8})
+	}
+	stateFile := filepath.Join(dir, "state.json")
+	if err := saveState(memory, stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openSqlite(filepath.Join(dir, "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := newSqliteBackend(db, "ip_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Append("192.0.2.1", Scoring{Timestamp: time.Now(), Score: 0.8})
+	db.Close()
+
+	bdb, err := bolt.Open(filepath.Join(dir, "reputation.bolt"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bbackend, err := newBoltBackend(bdb, "ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bbackend.Append("192.0.2.1", Scoring{Timestamp: time.Now(), Score: 0.8})
+	bdb.Close()
+
+	for _, args := range [][]string{
+		{"-state-file", stateFile},
+		{"-sqlite-path", filepath.Join(dir, "reputation.sqlite")},
+		{"-bolt-path", filepath.Join(dir, "reputation.bolt")},
+	} {
+		var out bytes.Buffer
+		if err := dumpMain(append(args, "-config", configFile), &out); err != nil {
+			t.Fatalf("dump %v: %s", args, err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "KEY") || !strings.HasPrefix(lines[1], "192.0.2.1") {
+			t.Errorf("dump %v printed %q", args, out.String())
+		}
+	}
+
+	if err := dumpMain([]string{"-config", configFile}, os.Stderr); err == nil {
+		t.Errorf("dump without a store succeeded")
+	}
+	if err := dumpMain([]string{"-config", configFile, "-sqlite-path", filepath.Join(dir, "missing.sqlite")}, os.Stderr); err == nil {
+		t.Errorf("dump of a missing database succeeded")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// offence is the decayed number of times a key was refused at connect, as
+// of updated.
+type offence struct {
+	count   float64
+	updated time.Time
+}
+
+// decayed returns the count of o at timestamp, halved every halfLife.
+func (o offence) decayed(timestamp time.Time, halfLife time.Duration) float64 {
+	return o.count * math.Exp2(-timestamp.Sub(o.updated).Seconds()/halfLife.Seconds())
+}
+
+// offenceTracker counts the connect refusals of each key, so that persistent
+// offenders can be treated more harshly while a host that stopped being
+// refused is eventually forgotten.
+type offenceTracker struct {
+	mutex   sync.Mutex
+	entries map[string]offence
+}
+
+var offences = newOffenceTracker()
+
+func newOffenceTracker() *offenceTracker {
+	return &offenceTracker{entries: make(map[string]offence)}
+}
+
+// level returns the decayed number of refusals of key at timestamp.
+func (t *offenceTracker) level(key string, timestamp time.Time, halfLife time.Duration) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	o, exists := t.entries[key]
+	if !exists {
+		return 0
+	}
+	return o.decayed(timestamp, halfLife)
+}
+
+// record counts a refusal of key at timestamp and returns its new level.
+func (t *offenceTracker) record(key string, timestamp time.Time, halfLife time.Duration) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	count := 1.0
+	if o, exists := t.entries[key]; exists {
+		count += o.decayed(timestamp, halfLife)
+	}
+	t.entries[key] = offence{count: count, updated: timestamp}
+	return count
+}
+
+// offenceForgotten is the level below which a key is pruned, as good as no
+// refusal at all.
+const offenceForgotten = 0.01
+
+// prune forgets the keys whose level decayed below offenceForgotten.
+func (t *offenceTracker) prune(timestamp time.Time, halfLife time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, o := range t.entries {
+		if o.decayed(timestamp, halfLife) < offenceForgotten {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func (t *offenceTracker) len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.entries)
+}
+
+// offenceLevel returns the number of recent refusals of the key of a
+// session, zero if escalation is disabled.
+func offenceLevel(data *SessionData, cfg *Escalation) float64 {
+	if !cfg.enabled() || data.key == "" {
+		return 0
+	}
+	return offences.level(data.key, now(), cfg.HalfLife.Duration)
+}
+
+// escalationDelay returns how long to hold the refusal of a key refused
+// level times recently: delay for the first, multiplied by factor for each
+// further one, up to maxTarpitDelay.
+func escalationDelay(level float64, cfg *Escalation) time.Duration {
+	if cfg.Delay.Duration == 0 || level < 1 {
+		return 0
+	}
+	delay := float64(cfg.Delay.Duration) * math.Pow(cfg.Factor, math.Floor(level)-1)
+	return time.Duration(min(delay, float64(maxTarpitDelay)))
+}
+
+// escalate counts the refusal v of a session refused level times recently,
+// returning it with the delay to hold it by. In dry-run mode or while
+// learning the client isn't actually refused, so the refusal is only logged
+// and not counted: keys would otherwise be rejected with the longest delays
+// as soon as the filter enforces its decisions.
+func escalate(data *SessionData, cfg *Escalation, level float64, v verdict) (verdict, time.Duration) {
+	if !cfg.enabled() || data.key == "" {
+		return v, 0
+	}
+	delay := escalationDelay(level, cfg)
+	if !enforcing() {
+		logger.Info("would-escalate", "ip", data.addr.String(), "key", data.key, "offences", level, "delay", delay)
+		return v, delay
+	}
+	offences.record(data.key, now(), cfg.HalfLife.Duration)
+	if delay > 0 {
+		logger.Info("escalate", "ip", data.addr.String(), "key", data.key, "offences", level, "delay", delay)
+	}
+	return v, delay
+}
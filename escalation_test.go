@@ -0,0 +1,139 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOffenceTracker(t *testing.T) {
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	o := newOffenceTracker()
+	for i := 0; i < 3; i++ {
+		o.record("192.0.2.1", start, time.Hour)
+	}
+	if level := o.level("192.0.2.1", start, time.Hour); level != 3 {
+		t.Errorf("level = %.02f, want 3", level)
+	}
+	if level := o.level("192.0.2.1", start.Add(time.Hour), time.Hour); level != 1.5 {
+		t.Errorf("level a half-life later = %.02f, want 1.5", level)
+	}
+	if level := o.record("192.0.2.1", start.Add(2*time.Hour), time.Hour); level != 1.75 {
+		t.Errorf("level recorded two half-lives later = %.02f, want 1.75", level)
+	}
+
+	o.prune(start.Add(4*time.Hour), time.Hour)
+	if o.len() != 1 {
+		t.Errorf("recently refused key was pruned")
+	}
+	o.prune(start.Add(12*time.Hour), time.Hour)
+	if o.len() != 0 {
+		t.Errorf("reformed key wasn't forgotten")
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC))
+	savedConfig, savedOffences, savedDryRun := currentConfig(), offences, dryRun
+	defer func() { activeConfig.Store(savedConfig); offences, dryRun = savedOffences, savedDryRun }()
+	offences = newOffenceTracker()
+	dryRun = false
+
+	cfg := defaultConfig()
+	cfg.Escalation.RejectAfter = 3
+	cfg.Escalation.Delay = duration{time.Second}
+	activeConfig.Store(cfg)
+
+	connect := func(score float64) (verdict, time.Duration) {
+		return connectVerdict(&SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", connectScore: score}, nil)
+	}
+
+	// the first refusal isn't held, each further one twice as long
+	for i, want := range []time.Duration{0, time.Second, 2 * time.Second} {
+		v, delay := connect(0.2)
+		if v.message != cfg.Thresholds.DeferMessage || delay != want {
+			t.Errorf("refusal %d = %q held %s, want deferred held %s", i+1, v.message, delay, want)
+		}
+	}
+	// past reject-after a key its reputation would defer is rejected
+	if v, delay := connect(0.2); v.message != cfg.Thresholds.RejectMessage || delay != 4*time.Second {
+		t.Errorf("escalated refusal = %q held %s, want rejected held 4s", v.message, delay)
+	}
+	for i := 0; i < 10; i++ {
+		connect(0.0)
+	}
+	if _, delay := connect(0.0); delay != maxTarpitDelay {
+		t.Errorf("persistent offender held %s, want %s", delay, maxTarpitDelay)
+	}
+	// sessions let through don't count
+	if v, delay := connect(0.9); v.action != "proceed" || delay != 0 {
+		t.Errorf("good session = %+v held %s, want proceed", v, delay)
+	}
+
+	// a host that stopped being refused is deferred as before
+	*clock = clock.Add(12 * time.Hour)
+	if v, delay := connect(0.2); v.message != cfg.Thresholds.DeferMessage || delay != 0 {
+		t.Errorf("reformed key = %q held %s, want deferred without delay", v.message, delay)
+	}
+
+	// escalation is disabled by default
+	offences = newOffenceTracker()
+	activeConfig.Store(defaultConfig())
+	for i := 0; i < 5; i++ {
+		if v, delay := connect(0.2); v.message != cfg.Thresholds.DeferMessage || delay != 0 {
+			t.Errorf("refusal %d without escalation = %q held %s", i+1, v.message, delay)
+		}
+	}
+	if offences.len() != 0 {
+		t.Errorf("refusals counted without escalation")
+	}
+}
+
+func TestEscalationDryRun(t *testing.T) {
+	fakeClock(t, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC))
+	savedConfig, savedOffences, savedDryRun := currentConfig(), offences, dryRun
+	defer func() { activeConfig.Store(savedConfig); offences, dryRun = savedOffences, savedDryRun }()
+	offences = newOffenceTracker()
+
+	cfg := defaultConfig()
+	cfg.Escalation.RejectAfter = 3
+	cfg.Escalation.Delay = duration{time.Second}
+	activeConfig.Store(cfg)
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", connectScore: 0.2}
+
+	// refusals that would have been taken aren't held against the key
+	dryRun = true
+	for i := 0; i < 10; i++ {
+		if v, _ := connectVerdict(data, nil); v.message != cfg.Thresholds.DeferMessage {
+			t.Errorf("would-be refusal %d = %q, want deferred", i+1, v.message)
+		}
+	}
+	if offences.len() != 0 {
+		t.Errorf("refusals counted in dry-run mode")
+	}
+
+	// once enforcing, the key starts from scratch
+	dryRun = false
+	if v, delay := connectVerdict(data, nil); v.message != cfg.Thresholds.DeferMessage || delay != 0 {
+		t.Errorf("first enforced refusal = %q held %s, want deferred without delay", v.message, delay)
+	}
+	if level := offences.level(data.key, now(), cfg.Escalation.HalfLife.Duration); level != 1 {
+		t.Errorf("level after the first enforced refusal = %.02f, want 1", level)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// csvColumn is a column of the CSV export, converting a field of a scoring
+// to and from text.
+type csvColumn struct {
+	name   string
+	format func(s *Scoring) string
+	parse  func(s *Scoring, value string) error
+}
+
+func intColumn(name string, field func(s *Scoring) *int) csvColumn {
+	return csvColumn{
+		name:   name,
+		format: func(s *Scoring) string { return strconv.Itoa(*field(s)) },
+		parse: func(s *Scoring, value string) (err error) {
+			*field(s), err = strconv.Atoi(value)
+			return err
+		},
+	}
+}
+
+// csvColumns are the columns following the key in the CSV export, in order.
+var csvColumns = []csvColumn{
+	{
+		name:   "timestamp",
+		format: func(s *Scoring) string { return s.Timestamp.UTC().Format(time.RFC3339Nano) },
+		parse: func(s *Scoring, value string) (err error) {
+			s.Timestamp, err = time.Parse(time.RFC3339Nano, value)
+			return err
+		},
+	},
+	{
+		name:   "score",
+		format: func(s *Scoring) string { return strconv.FormatFloat(s.Score, 'g', -1, 64) },
+		parse: func(s *Scoring, value string) (err error) {
+			s.Score, err = strconv.ParseFloat(value, 64)
+			return err
+		},
+	},
+	intColumn("auth_failures", func(s *Scoring) *int { return &s.AuthFailures }),
+	intColumn("auth_successes", func(s *Scoring) *int { return &s.AuthSuccesses }),
+	intColumn("resets", func(s *Scoring) *int { return &s.Resets }),
+	intColumn("rcpt_count", func(s *Scoring) *int { return &s.RcptCount }),
+	intColumn("data_count", func(s *Scoring) *int { return &s.DataCount }),
+	intColumn("commit_count", func(s *Scoring) *int { return &s.CommitCount }),
+	intColumn("rollback_count", func(s *Scoring) *int { return &s.RollbackCount }),
+	intColumn("null_senders", func(s *Scoring) *int { return &s.NullSenders }),
+	intColumn("sender_domains", func(s *Scoring) *int { return &s.SenderDomains }),
+	intColumn("dropped_count", func(s *Scoring) *int { return &s.DroppedCount }),
+	intColumn("transactions", func(s *Scoring) *int { return &s.Transactions }),
+	intColumn("auth_attempts", func(s *Scoring) *int { return &s.AuthAttempts }),
+	intColumn("tls_count", func(s *Scoring) *int { return &s.TLSCount }),
+	intColumn("rdns_count", func(s *Scoring) *int { return &s.RDNSCount }),
+	intColumn("fcrdns_count", func(s *Scoring) *int { return &s.FCrDNSCount }),
+	{
+		name:   "bytes",
+		format: func(s *Scoring) string { return strconv.FormatInt(s.Bytes, 10) },
+		parse: func(s *Scoring, value string) (err error) {
+			s.Bytes, err = strconv.ParseInt(value, 10, 64)
+			return err
+		},
+	},
+	{
+		name:   "mean_tx_time_ns",
+		format: func(s *Scoring) string { return strconv.FormatInt(int64(s.MeanTransactionTime), 10) },
+		parse: func(s *Scoring, value string) error {
+			ns, err := strconv.ParseInt(value, 10, 64)
+			s.MeanTransactionTime = time.Duration(ns)
+			return err
+		},
+	},
+	{
+		name:   "asn",
+		format: func(s *Scoring) string { return strconv.FormatUint(uint64(s.ASN), 10) },
+		parse: func(s *Scoring, value string) error {
+			asn, err := strconv.ParseUint(value, 10, 32)
+			s.ASN = uint(asn)
+			return err
+		},
+	},
+	{
+		name:   "country",
+		format: func(s *Scoring) string { return s.Country },
+		parse: func(s *Scoring, value string) error {
+			s.Country = value
+			return nil
+		},
+	},
+}
+
+func csvHeader() []string {
+	header := []string{"key"}
+	for _, column := range csvColumns {
+		header = append(header, column.name)
+	}
+	return header
+}
+
+// transferFlags registers the flags shared by export and import, selecting
+// a persisted store.
+type transferFlags struct {
+	format     *string
+	stateFile  *string
+	sqlitePath *string
+	boltPath   *string
+	store      *string
+	configFile *string
+}
+
+func newTransferFlags(flags *flag.FlagSet) transferFlags {
+	return transferFlags{
+		format:     flags.String("format", "csv", "format of the exported data (csv)"),
+		stateFile:  flags.String("state-file", "", "path to the JSON state file of the memory backend"),
+		sqlitePath: flags.String("sqlite-path", "", "path to the SQLite database of the sqlite backend"),
+		boltPath:   flags.String("bolt-path", "", "path to the bbolt database of the bolt backend"),
+		store:      flags.String("store", "ip", "store to use in a database (ip, rdns, helo, domain, asn or rcpt-domain)"),
+		configFile: flags.String("config", "/etc/mail/filter-reputation.toml", "path to the TOML configuration file, for the history size"),
+	}
+}
+
+// check validates the flags once parsed and loads the configuration,
+// returning the sqlite table and bolt bucket of the selected store.
+func (f transferFlags) check() ([2]string, error) {
+	if *f.format != "csv" {
+		return [2]string{}, fmt.Errorf("unknown format %s", *f.format)
+	}
+	tables, ok := storeTables[*f.store]
+	if !ok {
+		return [2]string{}, fmt.Errorf("unknown store %s", *f.store)
+	}
+	if *f.stateFile == "" && *f.sqlitePath == "" && *f.boltPath == "" {
+		return [2]string{}, fmt.Errorf("one of -state-file, -sqlite-path or -bolt-path is required")
+	}
+	// the state file only ever holds the ip store
+	if *f.stateFile != "" && *f.store != "ip" {
+		return [2]string{}, fmt.Errorf("-state-file only holds the ip store, not %s", *f.store)
+	}
+	cfg, err := loadConfig(*f.configFile)
+	if err != nil {
+		return [2]string{}, err
+	}
+	activeConfig.Store(cfg)
+	return tables, nil
+}
+
+// exportMain implements "filter-reputation export", writing one CSV row per
+// stored scoring. Like dump, it opens databases read-only.
+func exportMain(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	opts := newTransferFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	tables, err := opts.check()
+	if err != nil {
+		return err
+	}
+
+	var entries map[string][]Scoring
+	switch {
+	case *opts.stateFile != "":
+		entries, err = dumpStateFile(*opts.stateFile)
+	case *opts.sqlitePath != "":
+		entries, err = dumpSqlite(*opts.sqlitePath, tables[0])
+	default:
+		entries, err = dumpBolt(*opts.boltPath, tables[1])
+	}
+	if err != nil {
+		return err
+	}
+	return writeCSV(w, entries)
+}
+
+// writeCSV writes entries sorted by key, each history in chronological
+// order, so that exports of the same data are identical.
+func writeCSV(w io.Writer, entries map[string][]Scoring) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader()); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		for _, s := range entries[key] {
+			record := []string{key}
+			for _, column := range csvColumns {
+				record = append(record, column.format(&s))
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readCSV parses an export, skipping with a warning the rows that can't be
+// parsed. Columns are matched by name so that exports missing the columns
+// of newer versions can still be imported, missing fields being zero, but
+// the key, timestamp and score are required.
+func readCSV(r io.Reader) (map[string][]Scoring, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading header: %w", err)
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		index[name] = i
+	}
+	for _, name := range []string{"key", "timestamp", "score"} {
+		if _, ok := index[name]; !ok {
+			return nil, 0, fmt.Errorf("missing %s column", name)
+		}
+	}
+
+	entries := make(map[string][]Scoring)
+	skipped := 0
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			logger.Warn("import-skipped", "line", parseErr.StartLine, "error", parseErr.Err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		key, s, err := parseRecord(record, len(header), index)
+		if err != nil {
+			logger.Warn("import-skipped", "line", line, "error", err)
+			skipped++
+			continue
+		}
+		entries[key] = append(entries[key], s)
+	}
+	return entries, skipped, nil
+}
+
+func parseRecord(record []string, fields int, index map[string]int) (string, Scoring, error) {
+	var s Scoring
+	if len(record) != fields {
+		return "", s, fmt.Errorf("%d fields, want %d", len(record), fields)
+	}
+	key := record[index["key"]]
+	if key == "" {
+		return "", s, fmt.Errorf("empty key")
+	}
+	for _, column := range csvColumns {
+		i, ok := index[column.name]
+		if !ok {
+			continue
+		}
+		if err := column.parse(&s, record[i]); err != nil {
+			return "", s, fmt.Errorf("%s: %w", column.name, err)
+		}
+	}
+	return key, s, nil
+}
+
+// mergeScorings appends imported to the history of a key, in chronological
+// order, dropping the imported scorings already stored and keeping the
+// capacity most recent ones like appending to the store would.
+func mergeScorings(existing []Scoring, imported []Scoring, capacity int) []Scoring {
+	merged := slices.Concat(existing, imported)
+	slices.SortStableFunc(merged, func(a, b Scoring) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	merged = slices.CompactFunc(merged, func(a, b Scoring) bool {
+		return a.Timestamp.Equal(b.Timestamp) && a.Score == b.Score
+	})
+	if len(merged) > capacity {
+		merged = merged[len(merged)-capacity:]
+	}
+	return merged
+}
+
+// importMain implements "filter-reputation import", merging a CSV export
+// into a persisted store. Unlike export it writes, so the filter must not
+// be running on a state file or a bolt database: its next save would undo
+// the import, and bolt can't be opened twice.
+func importMain(args []string, r io.Reader, w io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	opts := newTransferFlags(flags)
+	input := flags.String("input", "-", "path to the CSV file to import, - for the standard input")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	tables, err := opts.check()
+	if err != nil {
+		return err
+	}
+
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, skipped, err := readCSV(r)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *opts.stateFile != "":
+		err = importStateFile(*opts.stateFile, imported)
+	case *opts.sqlitePath != "":
+		err = importSqlite(*opts.sqlitePath, tables[0], imported)
+	default:
+		err = importBolt(*opts.boltPath, tables[1], imported)
+	}
+	if err != nil {
+		return err
+	}
+
+	scorings := 0
+	for _, history := range imported {
+		scorings += len(history)
+	}
+	fmt.Fprintf(w, "imported %d scorings for %d keys, skipped %d rows\n", scorings, len(imported), skipped)
+	return nil
+}
+
+// importStateFile merges imported into the state file at path, which is
+// created if missing.
+func importStateFile(path string, imported map[string][]Scoring) error {
+	entries, err := dumpStateFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		entries, err = make(map[string][]Scoring), nil
+	}
+	if err != nil {
+		return err
+	}
+	for key, history := range imported {
+		entries[key] = mergeScorings(entries[key], history, historySize())
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// importSqlite merges imported into table in a single transaction, which a
+// live filter only waits for.
+func importSqlite(path string, table string, imported map[string][]Scoring) error {
+	db, err := openSqlite(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	b, err := newSqliteBackend(db, table)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string][]Scoring, len(imported))
+	for key := range imported {
+		existing[key] = b.Load(key)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, history := range imported {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE key = ?`, table), key); err != nil {
+			return err
+		}
+		for _, s := range mergeScorings(existing[key], history, historySize()) {
+			if err := b.insert(tx, key, s); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func importBolt(path string, bucket string, imported map[string][]Scoring) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, history := range imported {
+			existing, err := decodeScorings(b.Get([]byte(key)))
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			value, err := json.Marshal(mergeScorings(existing, history, historySize()))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCSVRoundTrip(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	entries := map[string][]Scoring{
+		"192.0.2.1": {
+			{Timestamp: start, Score: 0.125, AuthFailures: 1, RcptCount: 3, DroppedCount: 1, Bytes: 1 << 40, ASN: 64496, Country: "FR", MeanTransactionTime: 1500 * time.Millisecond},
+			{Timestamp: start.Add(time.Minute), Score: 0.9, CommitCount: 2, NullSenders: 1, SenderDomains: 2},
+		},
+		"192.0.2.2": {{Timestamp: start, Score: 1, Country: "a,\"b\""}},
+	}
+
+	var out bytes.Buffer
+	if err := writeCSV(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	got, skipped, err := readCSV(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 0 || len(got) != len(entries) {
+		t.Fatalf("read %d keys, skipped %d", len(got), skipped)
+	}
+	for key, history := range entries {
+		if len(got[key]) != len(history) {
+			t.Fatalf("%s: read %d scorings, want %d", key, len(got[key]), len(history))
+		}
+		for i, s := range history {
+			r := got[key][i]
+			if !r.Timestamp.Equal(s.Timestamp) {
+				t.Errorf("%s: timestamp %s, want %s", key, r.Timestamp, s.Timestamp)
+			}
+			r.Timestamp = s.Timestamp
+			if r != s {
+				t.Errorf("%s: read %+v, want %+v", key, r, s)
+			}
+		}
+	}
+}
+
+func TestReadCSVMalformed(t *testing.T) {
+	input := strings.Join([]string{
+		"key,timestamp,score,rcpt_count",
+		"192.0.2.1,2024-05-01T12:00:00Z,0.5,2",
+		"192.0.2.1,yesterday,0.5,2",
+		"192.0.2.1,2024-05-01T12:01:00Z,high,2",
+		"192.0.2.1,2024-05-01T12:02:00Z,0.5",
+		",2024-05-01T12:03:00Z,0.5,2",
+		"192.0.2.1,\"2024-05-01T12:04:00Z\"x,0.5,2",
+		"192.0.2.2,2024-05-01T12:05:00Z,0.25,1",
+	}, "\n")
+	entries, skipped, err := readCSV(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 5 {
+		t.Errorf("skipped %d rows, want 5", skipped)
+	}
+	if len(entries["192.0.2.1"]) != 1 || entries["192.0.2.1"][0].RcptCount != 2 || len(entries["192.0.2.2"]) != 1 {
+		t.Errorf("read %+v", entries)
+	}
+
+	if _, _, err := readCSV(strings.NewReader("key,score\n")); err == nil {
+		t.Errorf("export without a timestamp column was read")
+	}
+}
+
+func TestMergeScorings(t *testing.T) {
+	start := time.Now()
+	at := func(minutes ...int) []Scoring {
+		scorings := make([]Scoring, 0, len(minutes))
+		for _, m := range minutes {
+			scorings = append(scorings, Scoring{Timestamp: start.Add(time.Duration(m) * time.Minute), Score: float64(m)})
+		}
+		return scorings
+	}
+	minutes := func(scorings []Scoring) []int {
+		m := make([]int, 0, len(scorings))
+		for _, s := range scorings {
+			m = append(m, int(s.Score))
+		}
+		return m
+	}
+
+	got := minutes(mergeScorings(at(1, 3, 5), at(2, 3, 4), 10))
+	if want := []int{1, 2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	got = minutes(mergeScorings(at(1, 3, 5), at(2, 4, 6), 3))
+	if want := []int{4, 5, 6}; !slices.Equal(got, want) {
+		t.Errorf("merged %v with a cap of 3, want %v", got, want)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "missing.toml")
+	saved := currentConfig()
+	defer activeConfig.Store(saved)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	memory := newMemoryBackend()
+	memory.Append("192.0.2.1", Scoring{Timestamp: start, Score: 0.8})
+	memory.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Minute), Score: 0.7})
+	source := filepath.Join(dir, "source.json")
+	if err := saveState(memory, source); err != nil {
+		t.Fatal(err)
+	}
+	var export bytes.Buffer
+	if err := exportMain([]string{"-config", configFile, "-state-file", source}, &export); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(export.String(), "\n"); lines != 3 {
+		t.Fatalf("exported %d lines, want 3:\n%s", lines, export.String())
+	}
+
+	db, err := openSqlite(filepath.Join(dir, "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := newSqliteBackend(db, "ip_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Append("192.0.2.1", Scoring{Timestamp: start, Score: 0.8})
+	backend.Append("192.0.2.1", Scoring{Timestamp: start.Add(-time.Minute), Score: 0.6})
+	db.Close()
+
+	bdb, err := bolt.Open(filepath.Join(dir, "reputation.bolt"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newBoltBackend(bdb, "ip"); err != nil {
+		t.Fatal(err)
+	}
+	bdb.Close()
+
+	for _, target := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-state-file", filepath.Join(dir, "new.json")}, 2},
+		{[]string{"-state-file", source}, 2},
+		{[]string{"-sqlite-path", filepath.Join(dir, "reputation.sqlite")}, 3},
+		{[]string{"-bolt-path", filepath.Join(dir, "reputation.bolt")}, 2},
+	} {
+		args := append([]string{"-config", configFile}, target.args...)
+		var out bytes.Buffer
+		if err := importMain(args, bytes.NewReader(export.Bytes()), &out); err != nil {
+			t.Fatalf("import %v: %s", target.args, err)
+		}
+		if !strings.HasPrefix(out.String(), "imported 2 scorings for 1 keys") {
+			t.Errorf("import %v printed %q", target.args, out.String())
+		}
+
+		var reexport bytes.Buffer
+		if err := exportMain(args, &reexport); err != nil {
+			t.Fatalf("export %v: %s", target.args, err)
+		}
+		if lines := strings.Count(reexport.String(), "\n"); lines != target.want+1 {
+			t.Errorf("export %v after import has %d lines, want %d:\n%s", target.args, lines, target.want+1, reexport.String())
+		}
+	}
+
+	if err := importMain([]string{"-config", configFile, "-format", "json", "-state-file", source}, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+		t.Errorf("import of an unknown format succeeded")
+	}
+
+	// the state file only holds the ip store
+	if err := importMain([]string{"-config", configFile, "-store", "rdns", "-state-file", source}, bytes.NewReader(export.Bytes()), &bytes.Buffer{}); err == nil {
+		t.Errorf("import of the rdns store into a state file succeeded")
+	}
+	if err := exportMain([]string{"-config", configFile, "-store", "helo", "-state-file", source}, &bytes.Buffer{}); err == nil {
+		t.Errorf("export of the helo store from a state file succeeded")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// dependencyFailed logs and counts a failure of an external dependency, and
+// reports whether the failure policy holds it against the session.
+func dependencyFailed(dependency string, err error, cfg *Config, args ...any) bool {
+	dependencyFailures.WithLabelValues(dependency).Inc()
+	args = append([]any{"dependency", dependency, "policy", cfg.Failure.Policy, "error", err}, args...)
+	logger.Error("dependency-failed", args...)
+	return cfg.Failure.closed()
+}
+
+// failedReputation returns what a key is worth when the backend failed to
+// load its history, given the reputation of whatever it could load, as
+// Redis does from its local fallback. Failing closed, the key gets the
+// bottom of the scale. Failing open, it is judged on what could be loaded
+// or on the neutral prior, but as a known key so that an outage doesn't
+// make the grace policy greylist everyone.
+func failedReputation(key string, err error, score float64, known bool, cfg *Config) (float64, bool) {
+	if dependencyFailed("storage", err, cfg, "key", key) {
+		return cfg.Scale.Min, true
+	}
+	if !known {
+		return cfg.Aggregation.Prior, true
+	}
+	return score, true
+}
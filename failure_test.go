@@ -0,0 +1,138 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStore is a memory backend whose loads fail like an unreachable
+// database.
+type failingStore struct {
+	*memoryBackend
+}
+
+func (s *failingStore) LoadChecked(key string) ([]Scoring, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestFailedReputation(t *testing.T) {
+	cfg := defaultConfig()
+	store := &failingStore{memoryBackend: newMemoryBackend()}
+	if score, known := keyReputation(store, "192.0.2.1", cfg); !known || score != cfg.Aggregation.Prior {
+		t.Errorf("failing open = %.04f, %v, want the prior", score, known)
+	}
+	cfg.Failure.Policy = "closed"
+	if score, known := keyReputation(store, "192.0.2.1", cfg); !known || score != cfg.Scale.Min {
+		t.Errorf("failing closed = %.04f, %v, want %.04f", score, known, cfg.Scale.Min)
+	}
+
+	// failures aren't cached, the next load may succeed
+	cached := newCachedBackend(store)
+	keyReputation(cached, "192.0.2.1", cfg)
+	if len(cached.reputations) != 0 {
+		t.Errorf("failed reputation cached: %v", cached.reputations)
+	}
+}
+
+func TestFailurePolicyDNSBL(t *testing.T) {
+	fakeClock(t, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC))
+	savedResolver, savedResults, savedConfig := resolveHost, dnsResults, currentConfig()
+	defer func() { resolveHost, dnsResults = savedResolver, savedResults; activeConfig.Store(savedConfig) }()
+	resolveHost = func(ctx context.Context, name string) ([]string, error) {
+		switch {
+		case strings.HasSuffix(name, ".listed.example."):
+			return []string{"127.0.0.2"}, nil
+		case strings.HasSuffix(name, ".broken.example."):
+			return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	defer func() {
+		dnsblCacheMutex.Lock()
+		delete(dnsblCache, ip.String())
+		dnsblCacheMutex.Unlock()
+	}()
+	for _, policy := range []string{"open", "closed"} {
+		cfg := defaultConfig()
+		cfg.DNSBL.Zones = []string{"listed.example", "broken.example", "clean.example"}
+		cfg.Failure.Policy = policy
+		activeConfig.Store(cfg)
+		dnsResults = newDNSCache()
+		dnsblCacheMutex.Lock()
+		delete(dnsblCache, ip.String())
+		dnsblCacheMutex.Unlock()
+
+		var wantFailed []string
+		if policy == "closed" {
+			wantFailed = []string{"broken.example"}
+		}
+		result := lookupDNSBL(ip)
+		if !slices.Equal(result.listed, []string{"listed.example"}) {
+			t.Errorf("failing %s: listed in %v, want [listed.example]", policy, result.listed)
+		}
+		if !slices.Equal(result.failed, wantFailed) {
+			t.Errorf("failing %s: failed %v, want %v", policy, result.failed, wantFailed)
+		}
+
+		dnsblCacheMutex.Lock()
+		_, cached := dnsblCache[ip.String()]
+		dnsblCacheMutex.Unlock()
+		if cached != (policy == "open") {
+			t.Errorf("failing %s: result cached = %v", policy, cached)
+		}
+	}
+}
+
+func TestFailurePolicyDNSBLVerdict(t *testing.T) {
+	fakeClock(t, time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC))
+	savedConfig, savedOffences, savedDryRun := currentConfig(), offences, dryRun
+	defer func() { activeConfig.Store(savedConfig); offences, dryRun = savedOffences, savedDryRun }()
+	offences = newOffenceTracker()
+	dryRun = false
+
+	cfg := defaultConfig()
+	cfg.Failure.Policy = "closed"
+	cfg.DNSBL.Reject = true
+	cfg.Escalation.RejectAfter = 1
+	activeConfig.Store(cfg)
+
+	// a zone failing to answer defers a session it would otherwise let
+	// through, without holding it against the address
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", connectScore: 0.5, dnsblFailed: []string{"broken.example"}}
+	v, delay := connectVerdict(data, nil)
+	if v.message != cfg.Thresholds.DeferMessage || delay != 0 {
+		t.Errorf("unanswered zone = %v, %s, want a deferral", v, delay)
+	}
+	if offences.len() != 0 {
+		t.Errorf("unanswered zone counted as an offence")
+	}
+
+	// but never rejects a session deferred by its reputation alone
+	data = &SessionData{addr: net.ParseIP("192.0.2.2"), key: "192.0.2.2", connectScore: 0.2, dnsblFailed: []string{"broken.example"}}
+	if v, _ := connectVerdict(data, nil); v.message != cfg.Thresholds.DeferMessage {
+		t.Errorf("unanswered zone = %v, want a deferral", v)
+	}
+}
@@ -17,80 +17,24 @@ package main
  */
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"math"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var ipScoring map[string][]Scoring = make(map[string][]Scoring)
-var ipScoringMutex sync.Mutex
-
-var rdnsScoring map[string][]Scoring = make(map[string][]Scoring)
-var rdnsScoringMutex sync.Mutex
-
-var heloScoring map[string][]Scoring = make(map[string][]Scoring)
-var heloScoringMutex sync.Mutex
-
-var domainScoring map[string][]Scoring = make(map[string][]Scoring)
-var domainScoringMutex sync.Mutex
-
-func init() {
-	go func() {
-		for {
-			time.Sleep(30 * time.Second)
-			ipScoringMutex.Lock()
-			for ip, scoring := range ipScoring {
-				if len(scoring) > 100 {
-					ipScoring[ip] = scoring[len(scoring)-100:]
-				} else if scoring[len(scoring)-1].Timestamp.Add(5 * 24 * time.Hour).Before(time.Now()) {
-					fmt.Fprintf(os.Stderr, "last event over five days ago, deleting scoring for %s\n", ip)
-					delete(ipScoring, ip)
-				}
-			}
-			ipScoringMutex.Unlock()
-
-			rdnsScoringMutex.Lock()
-			for rdns, scoring := range rdnsScoring {
-				if len(scoring) > 100 {
-					rdnsScoring[rdns] = scoring[len(scoring)-100:]
-				} else if scoring[len(scoring)-1].Timestamp.Add(5 * 24 * time.Hour).Before(time.Now()) {
-					fmt.Fprintf(os.Stderr, "last event over five days ago, deleting scoring for %s\n", rdns)
-					delete(rdnsScoring, rdns)
-				}
-			}
-			rdnsScoringMutex.Unlock()
-
-			heloScoringMutex.Lock()
-			for helo, scoring := range heloScoring {
-				if len(scoring) > 100 {
-					heloScoring[helo] = scoring[len(scoring)-100:]
-				} else if scoring[len(scoring)-1].Timestamp.Add(5 * 24 * time.Hour).Before(time.Now()) {
-					fmt.Fprintf(os.Stderr, "last event over five days ago, deleting scoring for %s\n", helo)
-					delete(heloScoring, helo)
-				}
-			}
-			heloScoringMutex.Unlock()
-
-			domainScoringMutex.Lock()
-			for domain, scoring := range domainScoring {
-				if len(scoring) > 100 {
-					domainScoring[domain] = scoring[len(scoring)-100:]
-				} else if scoring[len(scoring)-1].Timestamp.Add(5 * 24 * time.Hour).Before(time.Now()) {
-					fmt.Fprintf(os.Stderr, "last event over five days ago, deleting scoring for %s\n", domain)
-					delete(domainScoring, domain)
-				}
-			}
-			domainScoringMutex.Unlock()
-		}
-	}()
-}
-
 type Scoring struct {
 	Timestamp     time.Time
 	Score         float64
@@ -101,6 +45,21 @@ type Scoring struct {
 	DataCount     int
 	CommitCount   int
 	RollbackCount int
+	NullSenders   int
+	SenderDomains int
+	DroppedCount  int // transactions the client disconnected in past DATA
+	Transactions  int
+	AuthAttempts  int
+	TLSCount      int // 1 if the session started TLS, so that aggregates count sessions
+	RDNSCount     int // 1 if the client had a reverse DNS name
+	FCrDNSCount   int // 1 if it was forward-confirmed
+	Bytes         int64
+	ASN           uint
+	Country       string
+
+	// MeanTransactionTime is the mean time from MAIL FROM to the commit or
+	// rollback of the transactions of the session, zero without any.
+	MeanTransactionTime time.Duration
 }
 
 type Transaction struct {
@@ -108,28 +67,58 @@ type Transaction struct {
 	endTime   time.Time
 
 	mailFromOK     bool
+	nullSender     bool // MAIL FROM:<>, as used by bounces
 	mailDomain     string
+	randomSender   bool // see randomLocalPart()
 	rcptToOK       int
 	rcptToTempfail int
 	rcptToPermfail int
 
-	sawData   bool
-	committed bool
+	randomRecipients int // recipients with a random looking local part
+
+	sawData     bool
+	committed   bool
+	abandoned   bool
+	dropped     bool // disconnected past DATA, neither committed nor rolled back
+	messageSize int
+
+	span trace.Span
+}
+
+// recipientCount counts the recipients of a domain accepted and refused
+// during a session.
+type recipientCount struct {
+	ok     int
+	failed int
 }
 
 type SessionData struct {
+	id   string
 	skip bool
 
 	connectTime    time.Time
 	disconnectTime time.Time
 
 	addr   net.IP
+	key    string
 	rdns   string
 	fcrdns bool
 
+	// addressSource names the addressSources entry addr was found by
+	addressSource string
+
+	asn     uint
+	asnOrg  string
+	country string
+
 	cmdHelo  bool
 	cmdEhlo  bool
 	heloname string
+	badHelo  bool
+	heloKeys int // address keys recently identifying with heloname
+
+	identifies  int  // HELO and EHLO commands issued, heloname being the first name given
+	heloChanged bool // a later HELO or EHLO gave another name than heloname
 
 	cmdAuth  bool
 	authok   int
@@ -138,119 +127,572 @@ type SessionData struct {
 	cmdTLS    bool // pretend smtps is an implicit starttls
 	tlsString string
 
-	nResets int
+	nResets    int
+	nAbandoned int // resets discarding a transaction past MAIL FROM
+	nDropped   int // transactions dropped past DATA, see dropTransaction()
+
+	lastCommand time.Time
+	commands    int
+	minGap      time.Duration
+	totalGap    time.Duration
+
+	timedTransactions int           // transactions committed or rolled back
+	totalTxTime       time.Duration // time they took, see timeTransaction()
+	fastCommits       int           // messages committed faster than min-transaction-time
 
 	transactions []*Transaction
+	overflow     *Transaction // transaction in progress past the transaction limit
+	extraTxs     int          // transactions past the limit, counted but not kept
+
+	rcptDomains map[string]*recipientCount
+	mailDomains map[string]bool // distinct MAIL FROM domains of the session
 
 	currentReputation []float64
+	connectScore      float64  // reputation of the session when it connected
+	connectReasons    *reasons // explanation of connectScore, nil unless explainScores
+
+	dnsbl       chan dnsblResult // zones listing the address, once looked up
+	dnsblFailed []string         // zones that failed to answer, failing closed
+
+	blacklisted     *net.IPNet
+	pinned          *net.IPNet // network of the pin fixing the reputation
+	autoBlacklisted bool       // key promoted to the auto-blacklist
+
+	grace      bool   // address has too little history to be judged
+	greylisted bool   // unknown address deferred on its first contact
+	retried    bool   // came back for a greylisted recipient after the delay
+	challenged bool   // passed the challenge grace policy, see greylist.challenge()
+	harvesting bool   // too many recipients refused, see harvesting()
+	bruteForce bool   // too many authentications failed, see bruteForcing()
+	rate       int    // connects from the same key during the last minute
+	profile    string // profile of the listener connected to, see sessionConfig()
+	local      bool   // local session with a fixed reputation, nothing is learnt
+
+	sender       string // MAIL FROM of the current transaction
+	rcptAttempts int    // RCPT commands seen by filterRcptToCb
+
+	ctx  context.Context // carries span, nil when not traced
+	span trace.Span
 }
 
-func scoreTransaction(tx *Transaction) float64 {
-	const (
-		validSenderWeight         = 0.4
-		dataWeight                = 0.3
-		commitWeight              = 0.3
-		successfulRecipientWeight = 0.1
-		failedRecipientPenalty    = 0.2
-	)
-
+func scoreTransaction(tx *Transaction, cfg *Config) float64 {
+	weights := &cfg.Weights
 	baseScore := 0.0
 
-	if tx.mailFromOK {
-		baseScore += validSenderWeight
+	// A null sender gets its own bonus, as bounces are legitimate but also
+	// what backscatter looks like, and bounces have a single recipient
+	if tx.mailFromOK && tx.nullSender {
+		baseScore += weights.NullSender
+		if tx.rcptToOK > 1 {
+			baseScore -= float64(tx.rcptToOK-1) * weights.NullSenderRecipient
+		}
+	} else if tx.mailFromOK {
+		baseScore += weights.ValidSender
 	}
 	if tx.sawData {
-		baseScore += dataWeight
+		baseScore += weights.Data
 	}
 	if tx.committed {
-		baseScore += commitWeight
+		baseScore += weights.Commit
 	}
 
 	// Add points for each successful recipient
-	baseScore += float64(tx.rcptToOK) * successfulRecipientWeight
+	baseScore += float64(tx.rcptToOK) * weights.SuccessfulRecipient
 
-	// Subtract points for each failed recipient
-	baseScore -= float64(tx.rcptToTempfail+tx.rcptToPermfail) * failedRecipientPenalty
+	// Subtract points for each failed recipient, refused ones being a
+	// stronger sign of harvesting than transient failures
+	baseScore -= float64(tx.rcptToTempfail) * weights.TempfailRecipient
+	baseScore -= float64(tx.rcptToPermfail) * weights.PermfailRecipient
 
-	// Ensure the score is between 0.0 and 1.0
-	score := math.Max(0.0, math.Min(1.0, baseScore))
-	return score
+	// Apply a mild penalty to messages of implausible size
+	baseScore -= scoreSize(tx, &cfg.Size)
+
+	// And to senders and recipients that look randomly generated
+	baseScore -= scoreLocalParts(tx, &cfg.LocalParts)
+
+	// Ensure the score is within the scale
+	return cfg.Scale.clamp(baseScore)
+}
+
+// scoreTransactions returns the weighted mean of the scores of transactions,
+// each one weighing transaction-recency times as much as the previous one so
+// that a long session is judged on how it ended rather than how it began.
+func scoreTransactions(transactions []*Transaction, cfg *Config) float64 {
+	if len(transactions) == 0 {
+		return 0.0
+	}
+	// weights are computed from the most recent transaction backward, so
+	// that they fade toward zero rather than overflow in long sessions
+	weightedScore := 0.0
+	totalWeight := 0.0
+	weight := 1.0
+	for i := len(transactions) - 1; i >= 0; i-- {
+		weightedScore += weight * scoreTransaction(transactions[i], cfg)
+		totalWeight += weight
+		weight /= cfg.Aggregation.TransactionRecency
+	}
+	return weightedScore / totalWeight
 }
 
-func scoreSession(session *SessionData) float64 {
-	const (
-		authSuccessWeight  = 0.1
-		authFailurePenalty = 0.1
-		tlsWeight          = 0.2
-		rdnsWeight         = 0.1
-		fcrdnsWeight       = 0.1
-		resetPenalty       = 0.05
-	)
+func scoreSession(session *SessionData, cfg *Config) float64 {
+	return explainSession(session, cfg, nil)
+}
 
+// explainSession scores a session as scoreSession() does, collecting the
+// terms that moved its score into r unless r is nil.
+func explainSession(session *SessionData, cfg *Config, r *reasons) float64 {
+	weights := &cfg.Weights
 	baseScore := 0.0
+	add := func(name string, count int, value float64) {
+		baseScore += value
+		r.add(name, count, value)
+	}
 
-	// Score each transaction
-	totalTransactions := len(session.transactions)
-	if totalTransactions > 0 {
-		transactionScore := 0.0
-		for _, tx := range session.transactions {
-			transactionScore += scoreTransaction(tx)
+	// Score each transaction, normalized by the number of transactions
+	add("transactions", 0, scoreTransactions(session.transactions, cfg))
+	if r != nil {
+		if _, failed := recipientCounts(session); failed > 0 {
+			r.note("-rcptfail:%d", failed)
 		}
-		// Normalize transaction score by the number of transactions
-		baseScore += transactionScore / float64(totalTransactions)
 	}
 
-	// Adjust score for successful authentications
-	baseScore += float64(session.authok) * authSuccessWeight
+	// Adjust score for successful authentications, up to a cap so that
+	// repeated successes can't mask bad behaviour
+	add("authok", session.authok, math.Min(float64(session.authok)*weights.AuthSuccess, weights.AuthSuccessCap))
+
+	// Apply penalty for failed authentications, up to a cap so that a single
+	// session can't drive the raw score arbitrarily negative
+	add("authfail", session.authfail, -math.Min(float64(session.authfail)*weights.AuthFailure, weights.AuthFailureCap))
 
-	// Apply penalty for failed authentications
-	baseScore -= float64(session.authfail) * authFailurePenalty
+	// Apply a steeper penalty to sessions brute-forcing credentials
+	add("bruteforce", 0, -scoreBruteForce(session, &cfg.BruteForce))
 
-	// Add points for TLS
+	// Add points for TLS, depending on the protocol and cipher negotiated
 	if session.cmdTLS {
-		baseScore += tlsWeight
+		add("tls", 0, scoreTLS(session.tlsString, weights))
 	}
 
 	// Add points for reverse DNS success
 	if session.rdns != "" {
-		baseScore += rdnsWeight
+		add("rdns", 0, weights.RDNS)
 	}
 
 	// Add points for FCrDNS validation success
 	if session.fcrdns {
-		baseScore += fcrdnsWeight
+		add("fcrdns", 0, weights.FCrDNS)
 	}
 
 	// Apply penalty for resets
-	baseScore -= float64(session.nResets) * resetPenalty
+	add("reset", session.nResets, -float64(session.nResets)*weights.Reset)
+
+	// Apply a penalty proportional to the share of rolled back transactions
+	add("rollback", 0, -scoreRollbacks(session, weights))
+
+	// Apply a heavier penalty for resets abandoning a transaction
+	add("abandoned", session.nAbandoned, -float64(session.nAbandoned)*weights.AbandonedTransaction)
+
+	// Apply a penalty for transactions dropped by disconnecting past DATA
+	add("dropped", session.nDropped, -float64(session.nDropped)*weights.DroppedAfterData)
+
+	// Apply penalty for a forged looking HELO
+	add("helo", 0, scoreHelo(session, weights))
+
+	// Apply a steeper penalty to sessions probing for valid recipients
+	add("harvest", 0, -scoreHarvest(session, &cfg.Harvest))
+
+	// Apply a penalty to clients firing commands faster than humans or MTAs
+	add("timing", 0, -scoreTiming(session, &cfg.Timing))
+	add("fast-transaction", 0, -scoreTransactionTime(session, &cfg.Timing))
+
+	// Add points for retrying greylisted recipients as bots rarely do
+	if session.retried {
+		add("retried", 0, cfg.Greylist.RetryBonus)
+	}
+	// Likewise for unknown addresses retrying in time after a challenge
+	if session.challenged {
+		add("challenge", 0, cfg.Grace.ChallengeBonus)
+	}
+
+	// Apply a penalty to sessions sending from many sender domains
+	add("sender-domains", 0, -scoreSenderDomains(session, &cfg.SenderDomains))
+
+	// And to sessions looping over more transactions than any client needs
+	add("transaction-limit", session.extraTxs, -scoreTransactionLimit(session, &cfg.TransactionLimit))
+
+	// Apply a penalty to HELO names shared by many addresses
+	add("shared-helo", 0, -scoreSharedHelo(session, &cfg.SharedHelo))
+
+	// And to clients identifying over and over, or contradicting themselves
+	add("identify", session.identifies, -scoreIdentify(session, &cfg.Identify))
+
+	// Apply a penalty to clients ignoring the STARTTLS they were offered
+	add("downgrade", 0, -scoreDowngrade(session, &cfg.Downgrade))
+
+	// Ensure the score is within the scale
+	return cfg.Scale.clamp(baseScore)
+}
+
+// tlsParameters are the protocol version, cipher and cipher strength
+// negotiated by a session.
+type tlsParameters struct {
+	version string
+	cipher  string
+	bits    int
+}
+
+// parseTLS parses the TLS string reported by smtpd, such as
+// "version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256", or
+// "TLSv1.2:ECDHE-RSA-AES256-GCM-SHA384:256" as older versions report it.
+func parseTLS(s string) (tlsParameters, bool) {
+	var params tlsParameters
+	var bits string
+	if strings.Contains(s, "=") {
+		for _, field := range strings.Split(s, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "version":
+				params.version = value
+			case "cipher":
+				params.cipher = value
+			case "bits":
+				bits = value
+			}
+		}
+	} else if fields := strings.Split(s, ":"); len(fields) == 3 {
+		params.version, params.cipher, bits = fields[0], fields[1], fields[2]
+	}
+
+	var err error
+	if params.bits, err = strconv.Atoi(bits); err != nil || params.version == "" || params.cipher == "" {
+		return tlsParameters{}, false
+	}
+	return params, true
+}
+
+// weakCiphers are the markers of cipher suites that don't protect anything.
+var weakCiphers = []string{"NULL", "EXP", "RC4", "DES", "ANON", "ADH", "AECDH", "MD5"}
+
+// scoreTLS returns the bonus for the TLS negotiated by a session: legacy
+// protocols and weak ciphers earn less than TLS 1.2 and TLS 1.3 more. A TLS
+// string that can't be parsed earns the flat TLS bonus.
+func scoreTLS(tlsString string, weights *Weights) float64 {
+	params, ok := parseTLS(tlsString)
+	if !ok {
+		return weights.TLS
+	}
+
+	cipher := strings.ToUpper(params.cipher)
+	for _, weak := range weakCiphers {
+		if strings.Contains(cipher, weak) {
+			return weights.TLSLegacy
+		}
+	}
+	if params.bits < 128 {
+		return weights.TLSLegacy
+	}
+
+	switch params.version {
+	case "TLSv1.3":
+		return weights.TLSModern
+	case "TLSv1.2":
+		return weights.TLS
+	default:
+		return weights.TLSLegacy
+	}
+}
+
+func scoreHelo(session *SessionData, weights *Weights) float64 {
+	if session.badHelo {
+		return -weights.BadHelo
+	}
+	// a client committing a message without ever identifying itself
+	// isn't following the protocol
+	if !session.cmdHelo && !session.cmdEhlo {
+		for _, tx := range session.transactions {
+			if tx.committed {
+				return -weights.NoHelo
+			}
+		}
+	}
+	return 0.0
+}
+
+// scoreSize returns the penalty for a committed message whose size falls
+// outside of the plausible range.
+func scoreSize(tx *Transaction, size *Size) float64 {
+	if !tx.committed {
+		return 0.0
+	}
+	if tx.messageSize < size.Min || (size.Max > 0 && tx.messageSize > size.Max) {
+		return size.Penalty
+	}
+	return 0.0
+}
+
+// recipientCounts returns the number of recipients tried over all the
+// transactions of a session, and how many of them failed.
+func recipientCounts(session *SessionData) (total int, failed int) {
+	for _, tx := range session.transactions {
+		total += tx.rcptToOK + tx.rcptToTempfail + tx.rcptToPermfail
+		failed += tx.rcptToTempfail + tx.rcptToPermfail
+	}
+	return total, failed
+}
+
+// harvesting reports whether a session looks like a directory-harvest
+// attack: enough recipients tried, most of which were refused.
+func harvesting(session *SessionData, harvest *Harvest) bool {
+	total, failed := recipientCounts(session)
+	if total == 0 || total < harvest.MinRecipients {
+		return false
+	}
+	return float64(failed)/float64(total) >= harvest.Ratio
+}
 
-	// Ensure the score is between 0.0 and 1.0
-	score := math.Max(0.0, math.Min(1.0, baseScore))
+// bruteForcing reports whether a session failed to authenticate often enough
+// to be taken for a credential-stuffing attempt.
+func bruteForcing(session *SessionData, bruteForce *BruteForce) bool {
+	return bruteForce.Failures > 0 && session.authfail >= bruteForce.Failures
+}
 
-	return score
+// scoreBruteForce returns the penalty for a brute-forcing session, on top of
+// the capped penalty of its failures.
+func scoreBruteForce(session *SessionData, bruteForce *BruteForce) float64 {
+	if !bruteForcing(session, bruteForce) {
+		return 0.0
+	}
+	return bruteForce.Penalty
 }
 
-func summarizeSession(session *SessionData) Scoring {
+// scoreHarvest returns the penalty for a harvesting session, proportional to
+// its ratio of failed recipients.
+func scoreHarvest(session *SessionData, harvest *Harvest) float64 {
+	if !harvesting(session, harvest) {
+		return 0.0
+	}
+	total, failed := recipientCounts(session)
+	return harvest.Penalty * float64(failed) / float64(total)
+}
+
+// addressDomain returns the lowercased domain of a mail address, which may
+// be enclosed in angle brackets, or an empty string if it has none.
+func addressDomain(address string) string {
+	address = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(address), "<"), ">")
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(address[at+1:]), ".")
+}
+
+// observeCommand records the gap between a command and the previous one, or
+// the connection for the first command.
+func observeCommand(session *SessionData, timestamp time.Time) {
+	gap := timestamp.Sub(session.lastCommand)
+	if gap < 0 {
+		gap = 0
+	}
+	if session.commands == 0 || gap < session.minGap {
+		session.minGap = gap
+	}
+	session.totalGap += gap
+	session.commands++
+	session.lastCommand = timestamp
+}
+
+// scoreTiming returns the penalty for a session whose commands came too
+// quickly on average. Only sessions with enough commands are considered, so
+// that a client pipelining a single message isn't punished.
+func scoreTiming(session *SessionData, timing *Timing) float64 {
+	if session.commands == 0 || session.commands < timing.MinCommands {
+		return 0.0
+	}
+	if session.totalGap/time.Duration(session.commands) >= timing.MinMeanGap.Duration {
+		return 0.0
+	}
+	return timing.Penalty
+}
+
+// scoreTransactionTime returns the penalty for a session that committed a
+// message faster than a client could type or an MTA would bother to, as
+// automated senders blast messages without waiting on the server.
+func scoreTransactionTime(session *SessionData, timing *Timing) float64 {
+	if session.fastCommits == 0 {
+		return 0.0
+	}
+	return timing.TransactionPenalty
+}
+
+// timeTransaction records the time a transaction took once it is committed
+// or rolled back.
+func timeTransaction(session *SessionData, tx *Transaction, timing *Timing) {
+	elapsed := tx.endTime.Sub(tx.beginTime)
+	if tx.beginTime.IsZero() || elapsed < 0 {
+		return
+	}
+	session.timedTransactions++
+	session.totalTxTime += elapsed
+	if tx.committed && tx.sawData && elapsed < timing.MinTransactionTime.Duration {
+		session.fastCommits++
+	}
+	transactionTime.Observe(elapsed.Seconds())
+}
+
+// meanTransactionTime returns the mean time the transactions of a session
+// took, zero without any.
+func meanTransactionTime(session *SessionData) time.Duration {
+	if session.timedTransactions == 0 {
+		return 0
+	}
+	return session.totalTxTime / time.Duration(session.timedTransactions)
+}
+
+// scoreSenderDomains returns the penalty for a session with at least
+// min-transactions transactions sending from more than one sender domain,
+// growing with each further domain up to max-penalty, as snowshoe spammers
+// rotate sender domains within a session.
+func scoreSenderDomains(session *SessionData, senderDomains *SenderDomains) float64 {
+	if len(session.transactions) < senderDomains.MinTransactions || len(session.mailDomains) < 2 {
+		return 0.0
+	}
+	return math.Min(float64(len(session.mailDomains)-1)*senderDomains.Penalty, senderDomains.MaxPenalty)
+}
+
+// scoreTransactionLimit returns the penalty for a session that went past the
+// transaction limit.
+func scoreTransactionLimit(session *SessionData, transactionLimit *TransactionLimit) float64 {
+	if session.extraTxs == 0 {
+		return 0.0
+	}
+	return transactionLimit.Penalty
+}
+
+// transactionCount returns the number of transactions of a session, kept or
+// past the transaction limit.
+func transactionCount(session *SessionData) int {
+	return len(session.transactions) + session.extraTxs
+}
+
+// scoreSharedHelo returns the penalty for a session identifying with a HELO
+// name more than max-addresses address keys recently used, as snowshoe
+// spammers spread over many addresses sharing a single name.
+func scoreSharedHelo(session *SessionData, sharedHelo *SharedHelo) float64 {
+	if session.heloKeys <= sharedHelo.MaxAddresses {
+		return 0.0
+	}
+	return sharedHelo.Penalty
+}
+
+// scoreDowngrade returns the penalty for a session that issued EHLO on a
+// listener offering STARTTLS, yet never started TLS and committed a message
+// in clear, as bots check capabilities and then dump spam regardless.
+func scoreDowngrade(session *SessionData, downgrade *Downgrade) float64 {
+	if !downgrade.STARTTLSOffered || !session.cmdEhlo || session.cmdTLS {
+		return 0.0
+	}
+	for _, tx := range session.transactions {
+		if tx.committed {
+			return downgrade.Penalty
+		}
+	}
+	return 0.0
+}
+
+// scoreIdentify returns the penalty for a session identifying more than
+// identify.Max times, changing its name or mixing HELO and EHLO. A client
+// issues EHLO again after STARTTLS, but with the name it first gave.
+func scoreIdentify(session *SessionData, identify *Identify) float64 {
+	if session.identifies > identify.Max || session.heloChanged || session.cmdHelo && session.cmdEhlo {
+		return identify.Penalty
+	}
+	return 0.0
+}
+
+// suspiciousHelo reports whether a HELO name is an address literal, isn't a
+// fully qualified name, or obviously doesn't belong to the rDNS of the client.
+func suspiciousHelo(heloname string, rdns string) bool {
+	literal := strings.TrimSuffix(strings.TrimPrefix(heloname, "["), "]")
+	literal = strings.TrimPrefix(literal, "ipv6:")
+	if net.ParseIP(literal) != nil {
+		return true
+	}
+
+	heloname = strings.TrimSuffix(heloname, ".")
+	if !strings.Contains(heloname, ".") {
+		return true
+	}
+
+	rdns = strings.TrimSuffix(strings.ToLower(rdns), ".")
+	if rdns != "" && heloname != rdns && parentDomain(heloname) != parentDomain(rdns) {
+		return true
+	}
+	return false
+}
+
+// parentDomain returns the last two labels of a name, which is good enough
+// to tell whether two names are obviously unrelated.
+func parentDomain(name string) string {
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// commitCounts returns how many transactions of a session were committed
+// and how many were not.
+func commitCounts(session *SessionData) (int, int) {
+	commits, rollbacks := 0, 0
+	for _, tx := range session.transactions {
+		if tx.committed {
+			commits++
+		} else {
+			rollbacks++
+		}
+	}
+	return commits, rollbacks
+}
+
+// scoreRollbacks returns the penalty for the share of transactions of a
+// session that were not committed, so that a single good message doesn't
+// hide a run of abandoned ones.
+func scoreRollbacks(session *SessionData, weights *Weights) float64 {
+	commits, rollbacks := commitCounts(session)
+	if rollbacks == 0 {
+		return 0.0
+	}
+	return float64(rollbacks) / float64(commits+rollbacks) * weights.RollbackRatio
+}
+
+func summarizeSession(session *SessionData, cfg *Config) Scoring {
 	rcptCount := 0
 	dataCount := 0
-	commitCount := 0
-	rollbackCount := 0
+	nullSenders := 0
+	bytes := int64(0)
 
 	for _, tx := range session.transactions {
 		rcptCount += tx.rcptToOK + tx.rcptToTempfail + tx.rcptToPermfail
 		if tx.sawData {
 			dataCount++
 		}
+		if tx.nullSender {
+			nullSenders++
+		}
 		if tx.committed {
-			commitCount++
-		} else {
-			rollbackCount++
+			bytes += int64(tx.messageSize)
 		}
 	}
+	commitCount, rollbackCount := commitCounts(session)
+	count := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
 
 	return Scoring{
-		Timestamp:     time.Now(),
-		Score:         scoreSession(session),
+		Timestamp:     now(),
+		Score:         scoreSession(session, cfg),
 		AuthFailures:  session.authfail,
 		AuthSuccesses: session.authok,
 		Resets:        session.nResets,
@@ -258,6 +700,19 @@ func summarizeSession(session *SessionData) Scoring {
 		DataCount:     dataCount,
 		CommitCount:   commitCount,
 		RollbackCount: rollbackCount,
+		NullSenders:   nullSenders,
+		SenderDomains: len(session.mailDomains),
+		DroppedCount:  session.nDropped,
+		Transactions:  transactionCount(session),
+		AuthAttempts:  session.authok + session.authfail,
+		TLSCount:      count(session.cmdTLS),
+		RDNSCount:     count(session.rdns != ""),
+		FCrDNSCount:   count(session.fcrdns),
+		Bytes:         bytes,
+		ASN:           session.asn,
+		Country:       session.country,
+
+		MeanTransactionTime: meanTransactionTime(session),
 	}
 }
 
@@ -267,6 +722,7 @@ func aggregateScoring(scores []Scoring) Scoring {
 	}
 
 	totalScores := len(scores)
+	timedScores := 0
 	aggregate := Scoring{}
 
 	for _, score := range scores {
@@ -278,174 +734,1074 @@ func aggregateScoring(scores []Scoring) Scoring {
 		aggregate.DataCount += score.DataCount
 		aggregate.CommitCount += score.CommitCount
 		aggregate.RollbackCount += score.RollbackCount
+		aggregate.NullSenders += score.NullSenders
+		aggregate.SenderDomains += score.SenderDomains
+		aggregate.DroppedCount += score.DroppedCount
+		aggregate.Transactions += score.Transactions
+		aggregate.AuthAttempts += score.AuthAttempts
+		aggregate.TLSCount += score.TLSCount
+		aggregate.RDNSCount += score.RDNSCount
+		aggregate.FCrDNSCount += score.FCrDNSCount
+		aggregate.Bytes += score.Bytes
+		if score.MeanTransactionTime > 0 {
+			aggregate.MeanTransactionTime += score.MeanTransactionTime
+			timedScores++
+		}
 	}
 
-	// Averaging the score
+	// Averaging the score, and the transaction time of the sessions that
+	// had transactions
 	aggregate.Score /= float64(totalScores)
+	if timedScores > 0 {
+		aggregate.MeanTransactionTime /= time.Duration(timedScores)
+	}
 
 	return aggregate
 }
 
+// reputationKey returns the key under which the reputation of ip is stored.
+// Addresses are grouped by network, a /64 for IPv6 by default, as a host is
+// usually allocated a whole prefix it can rotate addresses within. Link-local
+// addresses are never grouped: their prefix is shared by every host on the
+// link and says nothing about who is connecting. Unique-local addresses are
+// grouped like global ones. IPv4-mapped IPv6 addresses, as reported by
+// dual-stack sockets, are keyed as the IPv4 address they map.
+func reputationKey(ip net.IP) string {
+	cfg := currentConfig()
+	var prefix, bits int
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, prefix, bits = ip4, cfg.Keys.IPv4Prefix, 32
+	} else {
+		prefix, bits = cfg.Keys.IPv6Prefix, 128
+	}
+
+	if prefix >= bits || ip.IsLinkLocalUnicast() {
+		return ip.String()
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return network.String()
+}
+
+// sd returns the data of a session, tests replace it to drive the callbacks
+// without the framework.
+var sd = func(session filter.Session) *SessionData {
+	return session.Get().(*SessionData)
+}
+
+// aggregateScoringDecayed is like aggregateScoring but the score is a mean
+// weighted by exp(-lambda * age), lambda being derived from halfLife, so that
+// recent sessions count more than old ones. Ages are taken relative to the
+// most recent scoring, which doesn't change the weighted mean but prevents
+// weights from all underflowing to zero when the history is old.
+func aggregateScoringDecayed(scores []Scoring, halfLife time.Duration) Scoring {
+	aggregate := aggregateScoring(scores)
+	if len(scores) == 0 || halfLife <= 0 {
+		return aggregate
+	}
+
+	newest := scores[0].Timestamp
+	for _, score := range scores {
+		if score.Timestamp.After(newest) {
+			newest = score.Timestamp
+		}
+	}
+
+	lambda := math.Ln2 / halfLife.Seconds()
+	weightedScore := 0.0
+	totalWeight := 0.0
+	for _, score := range scores {
+		weight := math.Exp(-lambda * newest.Sub(score.Timestamp).Seconds())
+		weightedScore += score.Score * weight
+		totalWeight += weight
+	}
+	aggregate.Score = weightedScore / totalWeight
+
+	return aggregate
+}
+
+// meanScore is the plain mean of the scores of a history.
+func meanScore(scores []Scoring) float64 {
+	return aggregateScoring(scores).Score
+}
+
+// linearRecencyScore is the mean of the scores of a history weighted by
+// their rank once sorted by age: the oldest scoring counts once, the next
+// one twice and the most recent one n times, however far apart they are.
+func linearRecencyScore(scores []Scoring) float64 {
+	if len(scores) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(scores)
+	slices.SortStableFunc(sorted, func(a, b Scoring) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	weightedScore := 0.0
+	totalWeight := 0.0
+	for i, score := range sorted {
+		weight := float64(i + 1)
+		weightedScore += score.Score * weight
+		totalWeight += weight
+	}
+	return weightedScore / totalWeight
+}
+
+// dampenScorings returns the history in chronological order with each
+// score lowered to at most maxRise above the previous one, the first one
+// above the prior. Scores falling are kept as they are, so that a client
+// can't make up for many bad sessions with an occasional clean one.
+func dampenScorings(scores []Scoring, prior float64, maxRise float64) []Scoring {
+	dampened := slices.Clone(scores)
+	slices.SortStableFunc(dampened, func(a, b Scoring) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	previous := prior
+	for i := range dampened {
+		dampened[i].Score = min(dampened[i].Score, previous+maxRise)
+		previous = dampened[i].Score
+	}
+	return dampened
+}
+
+// aggregationStrategy returns the function reducing a history to a score
+// selected by the strategy of the configuration, once dampened if max-rise
+// is set.
+func aggregationStrategy(cfg *Aggregation) func([]Scoring) float64 {
+	var reduce func([]Scoring) float64
+	switch cfg.Strategy {
+	case "mean":
+		reduce = meanScore
+	case "linear-recency":
+		reduce = linearRecencyScore
+	default:
+		halfLife := cfg.HalfLife.Duration
+		reduce = func(scores []Scoring) float64 {
+			return aggregateScoringDecayed(scores, halfLife).Score
+		}
+	}
+	if cfg.MaxRise == 0 {
+		return reduce
+	}
+	prior, maxRise := cfg.Prior, cfg.MaxRise
+	return func(scores []Scoring) float64 {
+		return reduce(dampenScorings(scores, prior, maxRise))
+	}
+}
+
+// storedReputation returns the reputation derived from the scoring history of
+// a key and whether there was enough history to derive one: a key with fewer
+// than min-samples sessions is given the neutral prior, unless the grace
+// policy is strict or blend. Otherwise the history is reduced by the configured
+// aggregation strategy and the result is shrunk toward the prior as if
+// prior-weight sessions had scored it, so that a key with little history is
+// judged cautiously.
+func storedReputation(scorings []Scoring, cfg *Config) (float64, bool) {
+	return shrunkReputation(len(scorings), func() float64 {
+		return aggregationStrategy(&cfg.Aggregation)(scorings)
+	}, cfg)
+}
+
+// shrunkReputation is storedReputation for a history of n scorings reduced
+// to mean, which is only called if the history is to be judged.
+func shrunkReputation(n int, mean func() float64, cfg *Config) (float64, bool) {
+	prior, k := cfg.Aggregation.Prior, cfg.Aggregation.PriorWeight
+	known := n >= cfg.Grace.MinSamples
+	if n == 0 || !known && cfg.Grace.Policy != "strict" && cfg.Grace.Policy != "blend" {
+		return prior, false
+	}
+	score := (float64(n)*mean() + k*prior) / (float64(n) + k)
+	if !known && cfg.Grace.Policy == "blend" {
+		// ramp from the prior to the history as samples accumulate,
+		// rather than switching at once on the min-samples one.
+		score = prior + (score-prior)*float64(n)/float64(cfg.Grace.MinSamples)
+	}
+	return score, known
+}
+
+// keyReputation returns the stored reputation of key in store. With the mean
+// strategy and no max-rise, backends able to average a history server-side
+// do so rather than loading it. Should the backend fail, the failure policy
+// decides what the key is worth, see failedReputation().
+func keyReputation(store StorageBackend, key string, cfg *Config) (float64, bool) {
+	score, known, err := loadReputation(store, key, cfg)
+	if err != nil {
+		return failedReputation(key, err, score, known, cfg)
+	}
+	return score, known
+}
+
+// loadReputation returns the reputation of key and whether it is known, or
+// the error of the backend that failed to load it along with the reputation
+// of whatever it could load.
+func loadReputation(store StorageBackend, key string, cfg *Config) (float64, bool, error) {
+	if c, ok := store.(*cachedBackend); ok {
+		return c.reputation(key, cfg)
+	}
+	if b, ok := store.(averagingBackend); ok && cfg.Aggregation.Strategy == "mean" && cfg.Aggregation.MaxRise == 0 {
+		n, mean, err := b.Average(key)
+		if err != nil {
+			return cfg.Aggregation.Prior, false, err
+		}
+		score, known := shrunkReputation(n, func() float64 { return mean }, cfg)
+		return score, known, nil
+	}
+	if b, ok := store.(checkedBackend); ok {
+		scorings, err := b.LoadChecked(key)
+		score, known := storedReputation(scorings, cfg)
+		return score, known, err
+	}
+	score, known := storedReputation(store.Load(key), cfg)
+	return score, known, nil
+}
+
+// classifyRDNS returns the reverse DNS name of a client as reported by
+// smtpd, lowercased and without trailing dot, or an empty string if it has
+// none: "", "<unknown>" and "null" mean there is no reverse DNS.
+func classifyRDNS(rdns string) string {
+	rdns = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(rdns)), ".")
+	switch rdns {
+	case "", "<unknown>", "null":
+		return ""
+	}
+	return rdns
+}
+
+// fcrdnsValues maps the forward-confirmed reverse DNS results reported by
+// the known versions of smtpd to whether the check passed.
+var fcrdnsValues = map[string]bool{
+	"ok":        true,
+	"pass":      true,
+	"fail":      false,
+	"error":     false,
+	"temperror": false,
+	"permerror": false,
+	"none":      false,
+	"null":      false,
+	"<unknown>": false,
+	"":          false,
+}
+
+var unknownFCrDNS sync.Map
+
+// classifyFCrDNS reports whether smtpd validated the forward-confirmed
+// reverse DNS of a client. An unrecognized value is treated as not
+// validated, and logged the first time it is seen.
+func classifyFCrDNS(fcrdns string) bool {
+	fcrdns = strings.ToLower(strings.TrimSpace(fcrdns))
+	validated, known := fcrdnsValues[fcrdns]
+	if !known {
+		if _, seen := unknownFCrDNS.LoadOrStore(fcrdns, true); !seen {
+			logger.Warn("unknown-fcrdns", "value", fcrdns)
+		}
+	}
+	return validated
+}
+
 func linkConnectCb(timestamp time.Time, session filter.Session, rdns string, fcrdns string, src net.Addr, dest net.Addr) {
-	addr, ok := src.(*net.TCPAddr)
-	if !ok {
-		session.Get().(*SessionData).skip = true
+	data := sd(session)
+	data.id = session.String()
+	data.profile = currentConfig().selectProfile(dest)
+	cfg := sessionConfig(data)
+	data.transactions = make([]*Transaction, 0)
+	data.currentReputation = make([]float64, 0)
+	data.connectTime = timestamp
+	data.lastCommand = timestamp
+	startSessionSpan(data, session.String(), timestamp)
+
+	if shuttingDown.Load() {
+		data.skip = true
 		return
 	}
 
-	session.Get().(*SessionData).transactions = make([]*Transaction, 0)
-	session.Get().(*SessionData).currentReputation = make([]float64, 0)
-	session.Get().(*SessionData).connectTime = timestamp
-	session.Get().(*SessionData).addr = addr.IP
-	if rdns != "<unknown>" {
-		session.Get().(*SessionData).rdns = rdns
+	client, source := clientAddress(src, dest)
+	data.addressSource = source
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		if network := blacklist.match(addr.IP); network != nil {
+			logger.Info("blacklisted", "session", session.String(), "ip", addr.IP.String(), "network", network.String())
+			data.blacklisted = network
+			data.skip = true
+			return
+		}
+		if network := whitelist.match(addr.IP); network != nil {
+			logger.Info("whitelisted", "session", session.String(), "ip", addr.IP.String(), "network", network.String())
+			data.skip = true
+			return
+		}
+		data.addr = addr.IP
+		data.key = reputationKey(addr.IP)
+		if autoBlacklisted.contains(data.key, timestamp) {
+			logger.Info("auto-blacklisted", "session", session.String(), "ip", addr.IP.String(), "key", data.key)
+			data.autoBlacklisted = true
+			data.skip = true
+			return
+		}
+
+	case *net.UnixAddr:
+		switch cfg.Local.Mode {
+		case "skip":
+			logger.Info("connect", "session", session.String(), "local", addr.Name, "mode", "skip")
+			data.skip = true
+			return
+		case "fixed":
+			logger.Info("connect", "session", session.String(), "local", addr.Name, "mode", "fixed", "score", cfg.Local.Score)
+			data.local = true
+			data.currentReputation = append(data.currentReputation, cfg.Local.Score, cfg.Local.Score)
+			data.connectScore = cfg.Local.Score
+			return
+		case "bucket":
+			logger.Info("connect", "session", session.String(), "local", addr.Name, "mode", "bucket")
+			data.key = "local"
+		}
+
+	default:
+		logger.Warn("unsupported-address", "session", session.String(), "src", client.String(), "address-source", source)
+		data.skip = true
+		return
 	}
-	session.Get().(*SessionData).fcrdns = fcrdns == "ok" || fcrdns == "pass"
 
-	ipScoringMutex.Lock()
-	scorings, exists := ipScoring[session.Get().(*SessionData).addr.String()]
-	ipScoringMutex.Unlock()
-	if exists && len(scorings) > 5 {
-		session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, aggregateScoring(scorings).Score)
-	} else {
-		session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, 0.5)
+	data.rdns = classifyRDNS(rdns)
+	data.fcrdns = classifyFCrDNS(fcrdns)
+
+	if data.addr != nil {
+		data.asn, data.asnOrg, data.country = lookupGeoIP(data.addr)
 	}
 
-	if session.Get().(*SessionData).rdns != "" {
-		rdnsScoringMutex.Lock()
-		scorings, exists = rdnsScoring[session.Get().(*SessionData).rdns]
-		rdnsScoringMutex.Unlock()
-		if exists && len(scorings) > 5 {
-			session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, aggregateScoring(scorings).Score)
+	data.connectReasons = newReasons()
+	if p, ok := pins.match(data.addr); ok {
+		// a pinned address has a fixed reputation, whatever it did.
+		score := cfg.Scale.clamp(p.score)
+		data.connectReasons.note("pinned")
+		logger.Info("pinned", "session", session.String(), "ip", data.addr.String(), "network", p.network.String(), "score", score)
+		data.pinned = p.network
+		data.currentReputation = append(data.currentReputation, score, score)
+	} else {
+		score, known := keyReputation(ipStore, data.key, cfg)
+		if !known && cfg.GeoIP.ASNBucket && data.asn != 0 {
+			// a new address inherits the reputation of its autonomous
+			// system, if it has one, rather than a neutral score.
+			if asnScore, asnKnown := keyReputation(asnStore, asnKey(data.asn), cfg); asnKnown {
+				score, known = asnScore, true
+				data.connectReasons.note("asn:%d", data.asn)
+			}
+		}
+		data.currentReputation = append(data.currentReputation, score)
+		data.connectReasons.note("ip:%.2f", score)
+		if !known {
+			data.connectReasons.note("unknown")
+			switch cfg.Grace.Policy {
+			case "neutral":
+				data.grace = true
+			case "greylist":
+				data.grace = true
+				if data.addr != nil {
+					data.greylisted, _ = greylistEntries.check(data.key, timestamp, cfg.Grace.GreylistDelay.Duration)
+				}
+			case "challenge":
+				data.grace = true
+				if data.addr != nil {
+					data.greylisted, data.challenged = greylistEntries.challenge(data.key, timestamp,
+						cfg.Grace.GreylistDelay.Duration, cfg.Grace.ChallengeWindow.Duration)
+				}
+			}
+		}
+
+		if data.rdns != "" {
+			score, _ := keyReputation(rdnsStore, data.rdns, cfg)
+			data.currentReputation = append(data.currentReputation, score)
+			data.connectReasons.note("rdns:%.2f", score)
 		} else {
-			session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, 0.5)
+			data.currentReputation = append(data.currentReputation, cfg.Scale.Min)
+			data.connectReasons.note("-rdns")
 		}
-	} else {
-		session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, 0.0)
 	}
 
-	score := (session.Get().(*SessionData).currentReputation[0] + session.Get().(*SessionData).currentReputation[1]) / 2
-	fmt.Fprintf(os.Stderr, "connect: ip-address=%s score=%.04f\n", addr.IP.String(), score)
+	if cfg.Velocity.MaxRate > 0 {
+		data.rate = connectRates.record(data.key, timestamp)
+	}
+
+	if data.addr != nil && len(cfg.DNSBL.Zones) != 0 {
+		result := make(chan dnsblResult, 1)
+		data.dnsbl = result
+		go func(ip net.IP) {
+			result <- lookupDNSBL(ip)
+		}(data.addr)
+	}
+
+	score := (data.currentReputation[0] + data.currentReputation[1]) / 2
+	data.connectScore = score
+	connectionsTotal.Inc()
+	connectScore.Observe(score)
+	observeScore(score, cfg)
+	args := []any{"session", session.String(), "ip", data.addr.String(), "key", data.key, "score", score,
+		"asn", data.asn, "as-org", data.asnOrg, "country", data.country, "profile", data.profile,
+		"address-source", data.addressSource}
+	if data.connectReasons != nil {
+		args = append(args, "reasons", data.connectReasons.list())
+	}
+	logger.Info("connect", args...)
+}
+
+func filterConnectCb(timestamp time.Time, session filter.Session, rdns string, src net.Addr) filter.Response {
+	data := sd(session)
+	if data.blacklisted != nil {
+		blacklistHits.Inc()
+		decide(data, "reject", "session", session.String(), "reason", "blacklist", "network", data.blacklisted.String())
+		traceDecision(data, "blacklist")
+		decided := verdict{"disconnect", "554 5.7.1 Connection refused: blacklisted"}
+		publishDecision(data, decided, 0)
+		v, _ := enforce(decided, 0)
+		return v.response()
+	}
+	if data.autoBlacklisted {
+		autoBlacklistHits.Inc()
+		decide(data, "reject", "session", session.String(), "reason", "auto-blacklist", "key", data.key)
+		traceDecision(data, "auto-blacklist")
+		decided := verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}
+		publishDecision(data, decided, 0)
+		v, _ := enforce(decided, 0)
+		return v.response()
+	}
+	if data.skip {
+		return filter.Proceed()
+	}
+
+	if data.dnsbl != nil {
+		respondLater(session, func() verdict {
+			result := <-data.dnsbl
+			data.dnsblFailed = result.failed
+			v, delay := connectResponse(data, result.listed)
+			time.Sleep(delay)
+			return v
+		})
+		return nil
+	}
+
+	v, delay := connectResponse(data, nil)
+	if delay > 0 {
+		delayResponse(session, delay, v)
+		return nil
+	}
+	return v.response()
+}
+
+// connectResponse returns the verdict to answer a connection with, once
+// traced and enforced, as a report of the decision if smtpd is to be told.
+func connectResponse(data *SessionData, listed []string) (verdict, time.Duration) {
+	decided, delay := connectVerdict(data, listed)
+	traceDecision(data, decided.action)
+	publishDecision(data, decided, delay)
+	v, delay := enforce(decided, delay)
+	return reportDecision(data, decided, v), delay
+}
+
+// reportDecisions makes the filter answer the connections it lets through
+// with a report of its decision rather than a plain proceed, so that smtpd
+// logs it with the session.
+var reportDecisions = false
+
+// reportDecision turns an enforced proceed verdict into a report carrying
+// the connect reputation and the decision taken, the one that would have
+// been taken in dry-run mode. Other verdicts are logged by smtpd already.
+func reportDecision(data *SessionData, decided verdict, enforced verdict) verdict {
+	if !reportDecisions || enforced.action != "proceed" {
+		return enforced
+	}
+	decision := decided.action
+	if decision != "proceed" && !enforcing() {
+		decision = "would-" + decision
+	}
+	return verdict{"report", fmt.Sprintf("reputation score=%.4f decision=%s", data.connectScore, decision)}
+}
+
+// connectVerdict decides the fate of a connection from its reputation and
+// the DNSBL zones listing it, along with how long to hold it in the tarpit.
+func connectVerdict(data *SessionData, listed []string) (verdict, time.Duration) {
+	cfg := sessionConfig(data)
+	score := data.connectScore
+	level := offenceLevel(data, &cfg.Escalation)
+
+	hammering := cfg.Velocity.MaxRate > 0 && data.rate > cfg.Velocity.MaxRate
+	if hammering {
+		logger.Info("velocity", "ip", data.addr.String(), "key", data.key, "rate", data.rate)
+		data.connectReasons.note("-velocity:%d", data.rate)
+		if cfg.Velocity.Defer {
+			decide(data, "defer", "ip", data.addr.String(), "reason", "velocity", "score", score)
+			deferredTotal.Inc()
+			return escalate(data, &cfg.Escalation, level,
+				verdict{"disconnect", "421 4.7.0 Connection deferred: too many connections, try again later"})
+		}
+		score = math.Max(cfg.Scale.Min, score-cfg.Velocity.Penalty)
+	}
+
+	unanswered := len(data.dnsblFailed) != 0
+	if len(listed) != 0 {
+		score = math.Max(cfg.Scale.Min, score-float64(len(listed))*cfg.DNSBL.Penalty)
+		logger.Info("dnsbl", "ip", data.addr.String(), "score", score, "listed", listed)
+		data.connectReasons.note("-dnsbl:%d", len(listed))
+		if cfg.DNSBL.Reject {
+			decide(data, "reject", "ip", data.addr.String(), "reason", "dnsbl", "score", score)
+			rejectedTotal.Inc()
+			return escalate(data, &cfg.Escalation, level,
+				verdict{"disconnect", "554 5.7.1 Connection refused: listed in " + listed[0]})
+		}
+	} else if data.greylisted {
+		data.connectReasons.note("greylist")
+		decide(data, "defer", "ip", data.addr.String(), "reason", "greylist")
+		deferredTotal.Inc()
+		return verdict{"disconnect", cfg.Grace.GreylistMessage}, 0
+	} else if data.grace && !hammering && !unanswered {
+		return verdict{action: "proceed"}, 0
+	}
+
+	// zones that failed to answer count against the session failing
+	// closed, but at most enough to defer it, and not as an offence: it
+	// isn't known to be listed
+	if unanswered {
+		penalized := math.Max(cfg.Scale.Min, score-float64(len(data.dnsblFailed))*cfg.DNSBL.Penalty)
+		logger.Info("dnsbl-unanswered", "ip", data.addr.String(), "score", penalized, "zones", data.dnsblFailed)
+		data.connectReasons.note("-dnsbl-unanswered:%d", len(data.dnsblFailed))
+		if penalized >= cfg.Thresholds.Defer {
+			score = penalized
+		} else if score >= cfg.Thresholds.Defer {
+			decide(data, "defer", "ip", data.addr.String(), "reason", "dnsbl-unanswered", "score", penalized)
+			deferredTotal.Inc()
+			return verdict{"disconnect", renderMessage(cfg.Thresholds.DeferMessage, data, penalized)}, 0
+		}
+	}
+
+	// keys refused too often are rejected rather than deferred
+	escalated := cfg.Escalation.RejectAfter > 0 && level >= cfg.Escalation.RejectAfter
+	if score < cfg.Thresholds.Defer && score >= cfg.Thresholds.Reject && escalated {
+		logger.Info("escalate", "ip", data.addr.String(), "key", data.key, "offences", level, "from", "defer", "to", "reject")
+	}
+	if score < cfg.Thresholds.Reject || score < cfg.Thresholds.Defer && escalated {
+		decide(data, "reject", "ip", data.addr.String(), "reason", "reputation", "score", score)
+		rejectedTotal.Inc()
+		return escalate(data, &cfg.Escalation, level,
+			verdict{"disconnect", renderMessage(cfg.Thresholds.RejectMessage, data, score)})
+	}
+	if score < cfg.Thresholds.Defer {
+		decide(data, "defer", "ip", data.addr.String(), "reason", "reputation", "score", score)
+		deferredTotal.Inc()
+		return escalate(data, &cfg.Escalation, level,
+			verdict{"disconnect", renderMessage(cfg.Thresholds.DeferMessage, data, score)})
+	}
+	if delay := tarpitDelay(score); delay > 0 {
+		decide(data, "tarpit", "ip", data.addr.String(), "score", score, "delay", delay)
+		return verdict{action: "proceed"}, delay
+	}
+	return verdict{action: "proceed"}, 0
+}
+
+// renderMessage interpolates the placeholders of a reject or defer message
+// for a session with the given score. The history of its key is only loaded
+// if the message holds the number of samples.
+func renderMessage(message string, data *SessionData, score float64) string {
+	if !strings.Contains(message, "{") {
+		return message
+	}
+	ip, samples := "", ""
+	if data.addr != nil {
+		ip = data.addr.String()
+	}
+	if strings.Contains(message, "{samples}") {
+		samples = strconv.Itoa(len(ipStore.Load(data.key)))
+	}
+	return strings.NewReplacer(
+		"{score}", strconv.FormatFloat(score, 'f', 2, 64),
+		"{ip}", ip,
+		"{samples}", samples,
+	).Replace(message)
+}
+
+// dryRun makes the filter compute and log its decisions without enforcing
+// them: every session proceeds without delay.
+var dryRun = true
+
+// decide logs a decision taken on a session, as "would-" decision in dry-run
+// mode or while learning, along with the detail of the session if
+// logSessionDetail is set.
+func decide(data *SessionData, decision string, args ...any) {
+	if !enforcing() {
+		decision = "would-" + decision
+	}
+	if data.connectReasons != nil {
+		args = append(args, "reasons", data.connectReasons.list())
+	}
+	if logSessionDetail {
+		args = append(args, "detail", sessionDetail(data))
+	}
+	logger.Info(decision, args...)
+}
+
+// enforce returns the verdict and delay to apply, which in dry-run mode is
+// always to proceed at once.
+func enforce(v verdict, delay time.Duration) (verdict, time.Duration) {
+	if !enforcing() {
+		return verdict{action: "proceed"}, 0
+	}
+	return v, delay
+}
+
+// tarpitDelay returns how long to hold a session with the given score, zero
+// if the tarpit doesn't apply.
+func tarpitDelay(score float64) time.Duration {
+	cfg := currentConfig()
+	if score >= cfg.Tarpit.Threshold {
+		return 0
+	}
+	return time.Duration(float64(cfg.Tarpit.MaxDelay.Duration) * (cfg.Scale.Max - score) / (cfg.Scale.Max - cfg.Scale.Min))
+}
+
+// overRecipientLimit counts a RCPT command of a session and reports whether
+// it goes past the recipient limit, which only applies to sessions with a
+// connect reputation below the recipient-limit threshold.
+func overRecipientLimit(data *SessionData, limit *RecipientLimit) bool {
+	data.rcptAttempts++
+	if data.local || data.connectScore >= limit.Threshold {
+		return false
+	}
+	return data.rcptAttempts > limit.Max
+}
+
+func filterRcptToCb(timestamp time.Time, session filter.Session, to string) filter.Response {
+	data := sd(session)
+	if data.skip {
+		return filter.Proceed()
+	}
+	if data.harvesting && sessionConfig(data).Harvest.Reject {
+		harvestRejectedTotal.Inc()
+		decide(data, "reject", "session", session.String(), "ip", data.addr.String(), "reason", "harvest")
+		v, _ := enforce(verdict{"disconnect", "421 4.7.0 Too many invalid recipients, closing connection"}, 0)
+		return v.response()
+	}
+	if greylistRecipient(data, to, timestamp, &sessionConfig(data).Greylist) {
+		rcptDeferredTotal.Inc()
+		decide(data, "greylist", "session", session.String(), "ip", data.addr.String(), "from", data.sender, "to", to, "score", data.connectScore)
+		v, _ := enforce(verdict{"reject", sessionConfig(data).Greylist.Message}, 0)
+		return v.response()
+	}
+	if overRecipientLimit(data, &sessionConfig(data).RecipientLimit) {
+		recipientLimitHits.Inc()
+		decide(data, "recipient-limit", "session", session.String(), "ip", data.addr.String(), "to", to, "recipients", data.rcptAttempts, "score", data.connectScore)
+		v, _ := enforce(verdict{"reject", sessionConfig(data).RecipientLimit.Message}, 0)
+		return v.response()
+	}
+	if data.grace {
+		return filter.Proceed()
+	}
+
+	score := data.connectScore
+	if delay := tarpitDelay(score); delay > 0 && enforcing() {
+		delayResponse(session, delay, verdict{action: "proceed"})
+		return nil
+	}
+	return filter.Proceed()
+}
+
+// fcrdnsMessages are the responses to transactions refused by the
+// require-fcrdns policy, by action.
+var fcrdnsMessages = map[string]string{
+	"defer":  "451 4.7.25 Reverse DNS of the client is not forward-confirmed, try again later",
+	"reject": "550 5.7.25 Reverse DNS of the client is not forward-confirmed",
+}
+
+// fcrdnsVerdict returns the verdict for a transaction of a session without
+// forward-confirmed reverse DNS and whose connect reputation is below the
+// require-fcrdns threshold, and whether the policy applies to it at all.
+// Authenticated sessions are exempt.
+func fcrdnsVerdict(data *SessionData, requireFCrDNS *RequireFCrDNS) (verdict, bool) {
+	if data.addr == nil || data.fcrdns || data.authok > 0 || data.connectScore >= requireFCrDNS.Threshold {
+		return verdict{action: "proceed"}, false
+	}
+	return verdict{"reject", fcrdnsMessages[requireFCrDNS.Action]}, true
+}
+
+// mandatoryTLS reports whether a transaction in clear of a session is to be
+// refused whatever its reputation, as it didn't authenticate.
+func mandatoryTLS(data *SessionData, mandatoryTLS *MandatoryTLS) bool {
+	return mandatoryTLS.Enabled && !data.cmdTLS && data.authok == 0
+}
+
+// filterMailFromCb refuses transactions from sessions without
+// forward-confirmed reverse DNS whose connect reputation is below the
+// require-fcrdns threshold, and transactions in clear from unauthenticated
+// sessions if TLS is mandatory or from sessions whose connect reputation is
+// below the require-tls threshold.
+func filterMailFromCb(timestamp time.Time, session filter.Session, from string) filter.Response {
+	data := sd(session)
+	cfg := sessionConfig(data)
+	data.sender = from
+	if data.skip || data.local {
+		return filter.Proceed()
+	}
+	if v, refused := fcrdnsVerdict(data, &cfg.RequireFCrDNS); refused {
+		decide(data, "require-fcrdns", "session", session.String(), "ip", data.addr.String(), "rdns", data.rdns, "score", data.connectScore)
+		v, _ = enforce(v, 0)
+		return v.response()
+	}
+	if data.cmdTLS {
+		return filter.Proceed()
+	}
+	if mandatoryTLS(data, &cfg.MandatoryTLS) {
+		decide(data, "mandatory-tls", "session", session.String(), "ip", data.addr.String(), "profile", data.profile)
+		v, _ := enforce(verdict{"reject", cfg.MandatoryTLS.Message}, 0)
+		return v.response()
+	}
+
+	score := data.connectScore
+	if score >= cfg.RequireTLS.Threshold {
+		return filter.Proceed()
+	}
+	decide(data, "require-tls", "session", session.String(), "ip", data.addr.String(), "score", score)
+	v, _ := enforce(verdict{"reject", cfg.RequireTLS.Message}, 0)
+	return v.response()
+}
+
+// overRecipientCap returns the number of recipients of the transaction in
+// progress and whether it goes past the recipient cap, which only applies to
+// unauthenticated sessions with a connect reputation below the recipient-cap
+// threshold.
+func overRecipientCap(data *SessionData, recipientCap *RecipientCap) (int, bool) {
+	tx := currentTx(data)
+	if tx == nil || data.authok > 0 || data.connectScore >= recipientCap.Threshold {
+		return 0, false
+	}
+	recipients := tx.rcptToOK + tx.rcptToTempfail + tx.rcptToPermfail
+	return recipients, recipients > recipientCap.Max
+}
+
+// filterDataCb refuses the message body of transactions naming too many
+// recipients for their session reputation and of sessions whose connect
+// reputation is below the refuse-data threshold, once their recipients have
+// been seen.
+func filterDataCb(timestamp time.Time, session filter.Session) filter.Response {
+	data := sd(session)
+	cfg := sessionConfig(data)
+	if data.skip || data.local {
+		return filter.Proceed()
+	}
+
+	if recipients, over := overRecipientCap(data, &cfg.RecipientCap); over {
+		recipientCapHits.Inc()
+		decide(data, "recipient-cap", "session", session.String(), "ip", data.addr.String(), "recipients", recipients, "score", data.connectScore)
+		v, _ := enforce(verdict{"reject", cfg.RecipientCap.Message}, 0)
+		return v.response()
+	}
+
+	if data.connectScore >= cfg.RefuseData.Threshold {
+		return filter.Proceed()
+	}
+	decide(data, "refuse-data", "session", session.String(), "ip", data.addr.String(), "score", data.connectScore)
+	v, _ := enforce(verdict{"reject", cfg.RefuseData.Message}, 0)
+	return v.response()
 }
 
 func linkDisconnectCb(timestamp time.Time, session filter.Session) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	cfg := sessionConfig(data)
+	cancelPending(session)
+	dropTransaction(data)
+	defer endSessionSpan(data, cfg, timestamp)
+	if !recordSession(data, cfg, timestamp) {
+		return
+	}
+
+	if !explainScores {
+		logger.Info("disconnect", "session", session.String(), "ip", data.addr.String(),
+			"connect-score", data.connectScore, "score", scoreSession(data, cfg),
+			"commands", data.commands, "min-gap", data.minGap)
 		return
 	}
-	session.Get().(*SessionData).disconnectTime = timestamp
+	r := &reasons{}
+	score := explainSession(data, cfg, r)
+	logger.Info("disconnect", "session", session.String(), "ip", data.addr.String(),
+		"connect-score", data.connectScore, "score", score,
+		"commands", data.commands, "min-gap", data.minGap, "reasons", r.list())
+}
 
-	ipScoringMutex.Lock()
-	ipScoring[session.Get().(*SessionData).addr.String()] = append(ipScoring[session.Get().(*SessionData).addr.String()], summarizeSession(session.Get().(*SessionData)))
-	ipScoringMutex.Unlock()
+// recordedHistory returns the history key will have once scoring is
+// appended to it. It is loaded before the append, the redis and postgres
+// backends appending in the background so that a load right after it may
+// not see the scoring yet.
+func recordedHistory(key string, scoring Scoring, cfg *Config) []Scoring {
+	history := append(slices.Clip(ipStore.Load(key)), scoring)
+	if excess := len(history) - cfg.Storage.HistorySize; excess > 0 {
+		history = history[excess:]
+	}
+	return history
+}
 
-	if session.Get().(*SessionData).rdns != "" {
-		rdnsScoringMutex.Lock()
-		rdnsScoring[session.Get().(*SessionData).rdns] = append(rdnsScoring[session.Get().(*SessionData).rdns], summarizeSession(session.Get().(*SessionData)))
-		rdnsScoringMutex.Unlock()
+// recordSession appends the scoring of a disconnected session to the stores
+// and reports whether it did. Sessions without a key are never recorded,
+// be they skipped or disconnected without ever being seen connecting, so
+// that no scoring is stored under an empty key.
+func recordSession(data *SessionData, cfg *Config, timestamp time.Time) bool {
+	if data.skip || data.local || data.key == "" {
+		return false
 	}
+	// a greylisted session was turned away before it could show anything
+	if data.greylisted && enforcing() {
+		return false
+	}
+	data.disconnectTime = timestamp
+	learning.record()
 
-	if session.Get().(*SessionData).heloname != "" {
-		heloScoringMutex.Lock()
-		heloScoring[session.Get().(*SessionData).heloname] = append(heloScoring[session.Get().(*SessionData).heloname], summarizeSession(session.Get().(*SessionData)))
-		heloScoringMutex.Unlock()
+	scoring := summarizeSession(data, cfg)
+	var history []Scoring
+	if (cfg.AutoBlacklist.Threshold > 0 || cfg.Webhook.URL != "") && data.addr != nil {
+		history = recordedHistory(data.key, scoring, cfg)
+	}
+	ipStore.Append(data.key, scoring)
+	if cfg.AutoBlacklist.Threshold > 0 && data.addr != nil {
+		checkAutoBlacklist(data, &cfg.AutoBlacklist, history, timestamp)
+	}
+	if cfg.Webhook.URL != "" && data.addr != nil {
+		checkReputationDrop(data, cfg, history, timestamp)
 	}
 
-	for _, tx := range session.Get().(*SessionData).transactions {
+	if data.rdns != "" {
+		rdnsStore.Append(data.rdns, summarizeSession(data, cfg))
+	}
+
+	if data.heloname != "" {
+		heloStore.Append(data.heloname, summarizeSession(data, cfg))
+	}
+
+	if data.asn != 0 {
+		asnStore.Append(asnKey(data.asn), summarizeSession(data, cfg))
+	}
+
+	for _, tx := range data.transactions {
 		if tx.mailDomain != "" {
-			domainScoringMutex.Lock()
-			domainScoring[tx.mailDomain] = append(domainScoring[tx.mailDomain], summarizeSession(session.Get().(*SessionData)))
-			domainScoringMutex.Unlock()
+			domainStore.Append(tx.mailDomain, summarizeSession(data, cfg))
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, "disconnect: ip-address=%s score=%.04f\n", session.Get().(*SessionData).addr.String(), scoreSession(session.Get().(*SessionData)))
+	// the reputation of a recipient domain is its ratio of accepted
+	// recipients, regardless of the session score
+	for domain, count := range data.rcptDomains {
+		rcptDomainStore.Append(domain, Scoring{
+			Timestamp: timestamp,
+			Score:     float64(count.ok) / float64(count.ok+count.failed),
+			RcptCount: count.ok + count.failed,
+		})
+	}
+	return true
 }
 
 func linkIdentifyCb(timestamp time.Time, session filter.Session, method string, hostname string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
+	if len(data.currentReputation) < 2 {
+		// the connect of the session wasn't seen, as after a restart
+		logger.Warn("no-connect", "session", session.String(), "command", "identify")
+		return
+	}
+	observeCommand(data, timestamp)
+	mixed := method == "HELO" && data.cmdEhlo || method == "EHLO" && data.cmdHelo
 	if method == "HELO" {
-		session.Get().(*SessionData).cmdHelo = true
+		data.cmdHelo = true
 	}
 	if method == "EHLO" {
-		session.Get().(*SessionData).cmdEhlo = true
+		data.cmdEhlo = true
 	}
-	session.Get().(*SessionData).heloname = strings.ToLower(hostname)
-
-	heloScoringMutex.Lock()
-	scorings, exists := heloScoring[session.Get().(*SessionData).heloname]
-	heloScoringMutex.Unlock()
-	if exists && len(scorings) > 5 {
-		session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, aggregateScoring(scorings).Score)
-	} else {
-		session.Get().(*SessionData).currentReputation = append(session.Get().(*SessionData).currentReputation, 0.5)
+	data.identifies++
+	heloname := strings.ToLower(hostname)
+	if data.identifies > 1 {
+		// the session keeps the name it first gave, later ones only tell
+		// whether the client contradicts itself
+		changed := heloname != data.heloname
+		data.heloChanged = data.heloChanged || changed
+		data.badHelo = data.badHelo || suspiciousHelo(heloname, data.rdns)
+		logger.Info("reidentify", "session", session.String(), "ip", data.addr.String(), "helo", heloname,
+			"first-helo", data.heloname, "method", method, "identifies", data.identifies, "changed", changed, "mixed", mixed)
+		return
 	}
+	data.heloname = heloname
+	data.badHelo = suspiciousHelo(data.heloname, data.rdns)
+	cfg := sessionConfig(data)
+	if data.addr != nil && data.heloname != "" {
+		data.heloKeys = heloAddresses.record(data.heloname, data.key, timestamp, cfg.SharedHelo.Window.Duration)
+	}
+
+	score, _ := keyReputation(heloStore, data.heloname, cfg)
+	data.currentReputation = append(data.currentReputation, score)
 
-	score := (session.Get().(*SessionData).currentReputation[0] + session.Get().(*SessionData).currentReputation[1] + session.Get().(*SessionData).currentReputation[2]) / 3
+	score = (data.currentReputation[0] + data.currentReputation[1] + data.currentReputation[2]) / 3
 
-	fmt.Fprintf(os.Stderr, "identify: ip-address=%s score=%.04f\n", session.Get().(*SessionData).addr.String(), score)
+	logger.Info("identify", "session", session.String(), "ip", data.addr.String(), "helo", data.heloname, "helo-addresses", data.heloKeys, "score", score)
 }
 
 func linkAuthCb(timestamp time.Time, session filter.Session, result string, username string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
-	session.Get().(*SessionData).cmdAuth = true
+	observeCommand(data, timestamp)
+	recordAuth(data, result, timestamp, sessionConfig(data))
+}
+
+// recordAuth counts an authentication of a session, flagging it once it
+// brute-forces and auto-blacklisting its key right away if configured.
+func recordAuth(data *SessionData, result string, timestamp time.Time, cfg *Config) {
+	data.cmdAuth = true
 	if result == "ok" {
-		session.Get().(*SessionData).authok++
-	} else {
-		session.Get().(*SessionData).authfail++
+		data.authok++
+		return
+	}
+	data.authfail++
+	authFailuresTotal.Inc()
+
+	if data.bruteForce || !bruteForcing(data, &cfg.BruteForce) {
+		return
+	}
+	data.bruteForce = true
+	bruteForceTotal.Inc()
+	logger.Info("brute-force", "ip", data.addr.String(), "key", data.key, "failures", data.authfail)
+	if cfg.BruteForce.Blacklist && data.addr != nil {
+		expires := timestamp.Add(cfg.AutoBlacklist.TTL.Duration)
+		if autoBlacklisted.add(data.key, expires) {
+			logger.Info("auto-blacklist", "ip", data.addr.String(), "key", data.key,
+				"reason", "brute-force", "expires", expires)
+		}
+	}
+}
+
+// filterAuthCb closes brute-forcing sessions at their next AUTH.
+func filterAuthCb(timestamp time.Time, session filter.Session, method string) filter.Response {
+	data := sd(session)
+	if data.skip || !data.bruteForce || !sessionConfig(data).BruteForce.Disconnect {
+		return filter.Proceed()
 	}
+	decide(data, "disconnect", "session", session.String(), "ip", data.addr.String(), "reason", "brute-force", "failures", data.authfail)
+	v, _ := enforce(verdict{"disconnect", "421 4.7.0 Too many authentication failures, closing connection"}, 0)
+	return v.response()
 }
 
 func linkTLSCb(timestamp time.Time, session filter.Session, tlsString string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
-	session.Get().(*SessionData).cmdTLS = true
-	session.Get().(*SessionData).tlsString = tlsString
+	observeCommand(data, timestamp)
+	data.cmdTLS = true
+	data.tlsString = tlsString
 }
 
 func txResetCb(timestamp time.Time, session filter.Session, messageId string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
-	session.Get().(*SessionData).nResets++
+	observeCommand(data, timestamp)
+	resetTransaction(data)
+}
+
+// resetTransaction accounts for a reset, which is benign once a transaction
+// is committed but suspicious when it discards one past MAIL FROM, a pattern
+// of address probing.
+func resetTransaction(data *SessionData) {
+	data.nResets++
+	if tx := currentTx(data); tx != nil && tx.mailFromOK && !tx.committed && !tx.abandoned {
+		tx.abandoned = true
+		data.nAbandoned++
+	}
+}
+
+// dropTransaction accounts for a client disconnecting in the middle of a
+// transaction past DATA, without the transaction being committed or rolled
+// back: a message cut short, typical of clients probing the server.
+func dropTransaction(data *SessionData) {
+	if tx := currentTx(data); tx != nil && tx.sawData && !tx.committed && tx.endTime.IsZero() && !tx.dropped {
+		tx.dropped = true
+		data.nDropped++
+	}
+}
+
+// currentTx returns the transaction in progress, or nil if none has begun.
+func currentTx(data *SessionData) *Transaction {
+	if data.overflow != nil {
+		return data.overflow
+	}
+	if len(data.transactions) == 0 {
+		return nil
+	}
+	return data.transactions[len(data.transactions)-1]
 }
 
 func txBeginCb(timestamp time.Time, session filter.Session, messageId string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
 
 	tx := &Transaction{
 		beginTime: timestamp,
 	}
-	session.Get().(*SessionData).transactions = append(session.Get().(*SessionData).transactions, tx)
+	// past the limit, only the transaction in progress is kept so that a
+	// client looping over transactions can't grow the session unbounded
+	if limit := sessionConfig(data).TransactionLimit.Max; len(data.transactions) >= limit {
+		if data.extraTxs == 0 {
+			logger.Info("transaction-limit", "session", session.String(), "ip", data.addr.String(), "max", limit)
+		}
+		data.extraTxs++
+		data.overflow = tx
+		return
+	}
+	startTransactionSpan(data, tx, messageId, timestamp)
+	data.transactions = append(data.transactions, tx)
 }
 
 func txMailCb(timestamp time.Time, session filter.Session, messageId string, result string, from string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
 		return
 	}
+	observeCommand(data, timestamp)
 
-	tx := session.Get().(*SessionData).transactions[len(session.Get().(*SessionData).transactions)-1]
+	tx := currentTx(data)
+	if tx == nil {
+		logger.Warn("no-transaction", "session", session.String(), "message_id", messageId, "command", "mail")
+		return
+	}
 	if result == "ok" {
 		tx.mailFromOK = true
 	}
-	if tx.mailDomain != "" {
-		if strings.Contains(from, "@") {
-			tx.mailDomain = strings.ToLower(strings.Split(from, "@")[1])
+	recordSender(data, tx, from)
+	if localParts := &sessionConfig(data).LocalParts; localParts.Enabled && randomLocalPart(from, localParts) {
+		logger.Info("random-sender", "session", session.String(), "ip", data.addr.String(), "message_id", messageId, "from", from)
+		tx.randomSender = true
+	}
+}
+
+// recordSender records the MAIL FROM address of a transaction, its domain
+// being added to the distinct sender domains of the session.
+func recordSender(data *SessionData, tx *Transaction, from string) {
+	tx.nullSender = from == "" || from == "<>"
+	if domain := addressDomain(from); domain != "" {
+		tx.mailDomain = domain
+		if data.mailDomains == nil {
+			data.mailDomains = make(map[string]bool)
 		}
+		data.mailDomains[domain] = true
 	}
 }
 
 func txRcptCb(timestamp time.Time, session filter.Session, messageId string, result string, to string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
+		return
+	}
+	observeCommand(data, timestamp)
+	tx := currentTx(data)
+	if tx == nil {
+		logger.Warn("no-transaction", "session", session.String(), "message_id", messageId, "command", "rcpt")
 		return
 	}
-	tx := session.Get().(*SessionData).transactions[len(session.Get().(*SessionData).transactions)-1]
 	if result == "ok" {
 		tx.rcptToOK++
 	} else if result == "tempfail" {
@@ -453,34 +1809,279 @@ func txRcptCb(timestamp time.Time, session filter.Session, messageId string, res
 	} else if result == "permfail" {
 		tx.rcptToPermfail++
 	}
+	if localParts := &sessionConfig(data).LocalParts; localParts.Enabled && localParts.Recipients && randomLocalPart(to, localParts) {
+		tx.randomRecipients++
+	}
+
+	if domain := addressDomain(to); domain != "" && sessionConfig(data).RecipientDomains.Enabled {
+		if data.rcptDomains == nil {
+			data.rcptDomains = make(map[string]*recipientCount)
+		}
+		count, exists := data.rcptDomains[domain]
+		if !exists {
+			count = &recipientCount{}
+			data.rcptDomains[domain] = count
+		}
+		if result == "ok" {
+			count.ok++
+		} else {
+			count.failed++
+		}
+	}
+
+	if !data.harvesting && harvesting(data, &sessionConfig(data).Harvest) {
+		total, failed := recipientCounts(data)
+		logger.Info("harvest", "session", session.String(), "ip", data.addr.String(), "message_id", messageId, "recipients", total, "failed", failed)
+		data.harvesting = true
+	}
 }
 
 func txDataCb(timestamp time.Time, session filter.Session, messageId string, result string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
+		return
+	}
+	observeCommand(data, timestamp)
+	tx := currentTx(data)
+	if tx == nil {
+		logger.Warn("no-transaction", "session", session.String(), "message_id", messageId, "command", "data")
 		return
 	}
-	tx := session.Get().(*SessionData).transactions[len(session.Get().(*SessionData).transactions)-1]
 	tx.sawData = true
 }
 
 func txCommitCb(timestamp time.Time, session filter.Session, messageId string, messageSize int) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
+		return
+	}
+	observeCommand(data, timestamp)
+	tx := currentTx(data)
+	if tx == nil {
+		logger.Warn("no-transaction", "session", session.String(), "message_id", messageId, "command", "commit")
 		return
 	}
-	tx := session.Get().(*SessionData).transactions[len(session.Get().(*SessionData).transactions)-1]
 	tx.endTime = timestamp
 	tx.committed = true
+	tx.messageSize = messageSize
+	timeTransaction(data, tx, &sessionConfig(data).Timing)
+	endTransactionSpan(tx, timestamp)
 }
 
 func txRollbackCb(timestamp time.Time, session filter.Session, messageId string) {
-	if session.Get().(*SessionData).skip {
+	data := sd(session)
+	if data.skip {
+		return
+	}
+	tx := currentTx(data)
+	if tx == nil {
+		logger.Warn("no-transaction", "session", session.String(), "message_id", messageId, "command", "rollback")
 		return
 	}
-	tx := session.Get().(*SessionData).transactions[len(session.Get().(*SessionData).transactions)-1]
 	tx.endTime = timestamp
+	timeTransaction(data, tx, &sessionConfig(data).Timing)
+	endTransactionSpan(tx, timestamp)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		if err := dumpMain(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "filter-reputation dump:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := exportMain(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "filter-reputation export:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := importMain(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "filter-reputation import:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	backend := flag.String("backend", "memory", "storage backend for reputation (memory, sqlite, bolt, redis or postgres)")
+	sqlitePath := flag.String("sqlite-path", "/var/db/filter-reputation.sqlite", "path to the SQLite database used by the sqlite backend")
+	boltPath := flag.String("bolt-path", "/var/db/filter-reputation.bolt", "path to the bbolt database used by the bolt backend")
+	redisURL := flag.String("redis-url", "redis://localhost:6379/0", "URL of the Redis server used by the redis backend")
+	redisPrefix := flag.String("redis-prefix", "reputation:", "prefix of the Redis keys used by the redis backend")
+	redisTTL := flag.Duration("redis-ttl", 5*24*time.Hour, "time after which the Redis keys of an inactive reputation key expire")
+	redisPoolSize := flag.Int("redis-pool-size", 10, "maximum number of connections to the Redis server")
+	postgresDSN := flag.String("postgres-dsn", os.Getenv("REPUTATION_POSTGRES_DSN"), "connection string of the PostgreSQL server used by the postgres backend")
+	postgresPoolSize := flag.Int("postgres-pool-size", 10, "maximum number of connections to the PostgreSQL server")
+	configFile := flag.String("config", "/etc/mail/filter-reputation.toml", "path to the TOML configuration file")
+	blacklistFile := flag.String("blacklist", "", "path to a file of addresses and networks to reject")
+	whitelistFile := flag.String("whitelist", "", "path to a file of trusted addresses and networks")
+	pinsFile := flag.String("pins", "", "path to a file of addresses and networks with a fixed reputation score")
+	httpAddr := flag.String("metrics-addr", "", "address of the HTTP listener serving /metrics, disabled if empty")
+	adminToken := flag.String("admin-token", os.Getenv("REPUTATION_ADMIN_TOKEN"), "bearer token enabling the HTTP and gRPC admin endpoints, disabled if empty")
+	grpcAddr := flag.String("grpc-addr", "", "address of the gRPC listener serving the Reputation service, disabled if empty")
+	controlSocket := flag.String("control-socket", "", "path of the Unix socket serving the control protocol, disabled if empty")
+	controlSocketMode := flag.Uint("control-socket-mode", 0600, "permissions of the control socket")
+	enablePprof := flag.Bool("pprof", false, "serve the Go profiling endpoints under /debug/pprof/ on the HTTP listener")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for state to be flushed when shutting down")
+	stateFile := flag.String("state-file", os.Getenv("REPUTATION_STATE_FILE"), "path to the JSON file used to persist reputation across restarts")
+	greylistFile := flag.String("greylist-file", os.Getenv("REPUTATION_GREYLIST_FILE"), "path to the JSON file used to persist the greylist across restarts")
+	flag.BoolVar(&reportDecisions, "report-decisions", false, "report the connect reputation and decision to smtpd with the report filter response")
+	flag.BoolVar(&logSessionDetail, "log-session-detail", false, "log the whole state of a session along with the decisions taken on it")
+	flag.BoolVar(&explainScores, "explain-scores", false, "explain the scores logged and served with reason tokens")
+	flag.BoolVar(&dryRun, "dry-run", true, "only log the decisions that would be taken, never reject, defer or delay a session")
+	learningPeriod := flag.Duration("learning-period", 0, "how long after starting to only record sessions without enforcing decisions, disabled if zero")
+	learningSamples := flag.Int("learning-samples", 0, "number of sessions to record after starting before enforcing decisions, disabled if zero")
+	asnDatabase := flag.String("asn-db", "", "path to a MaxMind GeoLite2/GeoIP2 ASN database, disabled if empty")
+	countryDatabase := flag.String("country-db", "", "path to a MaxMind GeoLite2/GeoIP2 Country database, disabled if empty")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "URL of the OTLP/HTTP collector to export session traces to, disabled if empty")
+	logFormat := flag.String("log-format", "text", "format of the log lines (text or json)")
+	logTarget := flag.String("log-target", "stderr", "where log lines are written (stderr or syslog)")
+	syslogFacility := flag.String("syslog-facility", "mail", "syslog facility used with -log-target=syslog")
+	syslogTag := flag.String("syslog-tag", "filter-reputation", "syslog tag used with -log-target=syslog")
+	flag.Parse()
+
+	if err := setupLogger(os.Stderr, *logFormat); err != nil {
+		fatal("bad-log-format", "error", err)
+	}
+	switch *logTarget {
+	case "stderr":
+	case "syslog":
+		facility, err := parseFacility(*syslogFacility)
+		if err != nil {
+			fatal("bad-syslog-facility", "error", err)
+		}
+		if err := setupSyslog(*logFormat, facility, *syslogTag); err != nil {
+			logger.Warn("syslog-unavailable", "error", err, "message", "logging to stderr")
+		}
+	default:
+		fatal("bad-log-target", "target", *logTarget)
+	}
+	if dryRun {
+		logger.Warn("dry-run", "message", "decisions are logged but not enforced, run with -dry-run=false to enforce them")
+	}
+	learning.start(now(), *learningPeriod, *learningSamples)
+	if *learningPeriod > 0 || *learningSamples > 0 {
+		logger.Warn("learning", "period", *learningPeriod, "samples", *learningSamples,
+			"message", "decisions are logged but not enforced until the learning period ends")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fatal("config-load-failed", "path", *configFile, "error", err)
+	}
+	activeConfig.Store(cfg)
+
+	switch *backend {
+	case "memory":
+	case "sqlite":
+		if err := setupSqlite(*sqlitePath); err != nil {
+			fatal("sqlite-open-failed", "path", *sqlitePath, "error", err)
+		}
+	case "bolt":
+		if err := setupBolt(*boltPath); err != nil {
+			fatal("bolt-open-failed", "path", *boltPath, "error", err)
+		}
+	case "redis":
+		if err := setupRedis(*redisURL, *redisPrefix, *redisTTL, *redisPoolSize); err != nil {
+			fatal("redis-setup-failed", "url", *redisURL, "error", err)
+		}
+	case "postgres":
+		// the connection string may hold a password, it is not logged
+		if err := setupPostgres(*postgresDSN, *postgresPoolSize); err != nil {
+			fatal("postgres-setup-failed", "error", err)
+		}
+	default:
+		fatal("unknown-backend", "backend", *backend)
+	}
+
+	if memory, ok := ipStore.(*memoryBackend); ok && *stateFile != "" {
+		loadState(memory, *stateFile)
+		go saveStateLoop(memory, *stateFile, 60*time.Second)
+		onShutdown(func() error {
+			return saveState(memory, *stateFile)
+		})
+		useSnapshots(fileSnapshots{path: *stateFile})
+	}
+	// redis and postgres are shared by several instances
+	switch *backend {
+	case "memory", "sqlite", "bolt":
+		cacheStores()
+	}
+	if *greylistFile != "" {
+		snapshotGreylist = false
+		loadGreylist(greylistEntries, *greylistFile)
+		go saveGreylistLoop(greylistEntries, *greylistFile, 60*time.Second)
+		onShutdown(func() error {
+			return saveGreylist(greylistEntries, *greylistFile)
+		})
+	}
+	if snapshots != nil {
+		loadSnapshots()
+		go saveSnapshotsLoop(60 * time.Second)
+	}
+	if *otlpEndpoint != "" {
+		if err := setupTracing(*otlpEndpoint); err != nil {
+			fatal("tracing-setup-failed", "endpoint", *otlpEndpoint, "error", err)
+		}
+	}
+	handleSignals(*shutdownTimeout)
+
+	if *blacklistFile != "" {
+		if err := blacklist.load(*blacklistFile); err != nil {
+			fatal("blacklist-load-failed", "path", *blacklistFile, "error", err)
+		}
+	}
+	if *whitelistFile != "" {
+		if err := whitelist.load(*whitelistFile); err != nil {
+			fatal("whitelist-load-failed", "path", *whitelistFile, "error", err)
+		}
+	}
+	if *pinsFile != "" {
+		if err := pins.load(*pinsFile); err != nil {
+			fatal("pins-load-failed", "path", *pinsFile, "error", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadAll(*configFile)
+		}
+	}()
+
+	openGeoIP(*asnDatabase, *countryDatabase)
+
+	go pruneLoop()
+	go distributionLoop()
+	go webhookLoop()
+
+	if *httpAddr != "" {
+		go serveHTTP(*httpAddr, *adminToken, *enablePprof)
+	}
+	if *controlSocket != "" {
+		listener, err := listenControl(*controlSocket, os.FileMode(*controlSocketMode))
+		if err != nil {
+			fatal("control-listen-failed", "path", *controlSocket, "error", err)
+		}
+		onShutdown(listener.Close)
+		go serveControl(listener, func() error { return reloadAll(*configFile) })
+	}
+	if *grpcAddr != "" {
+		server, serve, err := listenGRPC(*grpcAddr, *adminToken)
+		if err != nil {
+			fatal("grpc-listen-failed", "addr", *grpcAddr, "error", err)
+		}
+		onShutdown(func() error {
+			server.Stop()
+			return nil
+		})
+		go serve()
+	}
+
 	filter.Init()
 
 	filter.SMTP_IN.SessionAllocator(func() filter.SessionData {
@@ -500,5 +2101,17 @@ func main() {
 	filter.SMTP_IN.OnTxCommit(txCommitCb)
 	filter.SMTP_IN.OnTxRollback(txRollbackCb)
 
+	filter.SMTP_IN.ConnectRequest(filterConnectCb)
+	filter.SMTP_IN.AuthRequest(filterAuthCb)
+	filter.SMTP_IN.MailFromRequest(filterMailFromCb)
+	filter.SMTP_IN.RcptToRequest(filterRcptToCb)
+	filter.SMTP_IN.DataRequest(filterDataCb)
+
+	// smtpd closes stdin when it stops, shut down before the framework
+	// notices and exits on its own.
+	if err := interceptStdin(func() { shutdown(*shutdownTimeout) }); err != nil {
+		fatal("stdin-intercept-failed", "error", err)
+	}
+
 	filter.Dispatch()
 }
@@ -0,0 +1,1239 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+func TestReputationKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::7", "2001:db8:1:2::/64"},
+		{"fd00:1:2:3::4", "fd00:1:2:3::/64"},
+		{"fe80::1", "fe80::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		if got := reputationKey(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("reputationKey(%s) = %s, want %s", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestReputationKeyMapped(t *testing.T) {
+	saved := currentConfig()
+	defer activeConfig.Store(saved)
+
+	mapped := net.IP{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1}
+	for _, prefix := range []int{32, 24} {
+		cfg := defaultConfig()
+		cfg.Keys.IPv4Prefix = prefix
+		activeConfig.Store(cfg)
+
+		if plain := reputationKey(net.IPv4(192, 0, 2, 1).To4()); reputationKey(mapped) != plain {
+			t.Errorf("/%d: mapped address keyed %s, plain one %s", prefix, reputationKey(mapped), plain)
+		}
+	}
+}
+
+func TestSuspiciousHelo(t *testing.T) {
+	tests := []struct {
+		heloname string
+		rdns     string
+		want     bool
+	}{
+		{"mail.example.org", "mail.example.org", false},
+		{"mx1.example.org", "out.example.org", false},
+		{"mail.example.org", "", false},
+		{"[192.0.2.1]", "", true},
+		{"192.0.2.1", "", true},
+		{"[ipv6:2001:db8::1]", "", true},
+		{"localhost", "", true},
+		{"mail.example.org", "host.example.net", true},
+	}
+	for _, test := range tests {
+		if got := suspiciousHelo(test.heloname, test.rdns); got != test.want {
+			t.Errorf("suspiciousHelo(%s, %s) = %v, want %v", test.heloname, test.rdns, got, test.want)
+		}
+	}
+}
+
+func TestScoreHeloMissing(t *testing.T) {
+	weights := &defaultConfig().Weights
+	committed := []*Transaction{{mailFromOK: true, rcptToOK: 1, committed: true}}
+
+	tests := []struct {
+		name    string
+		session *SessionData
+		want    float64
+	}{
+		{"no-activity", &SessionData{}, 0},
+		{"rolled-back", &SessionData{transactions: []*Transaction{{mailFromOK: true}}}, 0},
+		{"committed", &SessionData{transactions: committed}, -weights.NoHelo},
+		{"helo", &SessionData{cmdHelo: true, heloname: "mail.example.org", transactions: committed}, 0},
+		{"ehlo", &SessionData{cmdEhlo: true, heloname: "mail.example.org", transactions: committed}, 0},
+	}
+	for _, test := range tests {
+		if got := scoreHelo(test.session, weights); got != test.want {
+			t.Errorf("%s: scoreHelo = %.04f, want %.04f", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBruteForce(t *testing.T) {
+	saved := autoBlacklisted
+	defer func() { autoBlacklisted = saved }()
+	autoBlacklisted = newAutoBlacklist()
+
+	cfg := defaultConfig()
+	cfg.BruteForce.Blacklist = true
+	start := time.Now()
+
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", cmdTLS: true, rdns: "mail.example.org",
+		transactions: []*Transaction{cleanTransaction()}}
+	for i := 1; i < cfg.BruteForce.Failures; i++ {
+		recordAuth(data, "fail", start, cfg)
+	}
+	if data.bruteForce || autoBlacklisted.contains(data.key, start) {
+		t.Fatalf("brute-force tripped after %d failures", data.authfail)
+	}
+	below := scoreSession(data, cfg)
+
+	recordAuth(data, "fail", start, cfg)
+	if !data.bruteForce {
+		t.Fatalf("brute-force not tripped after %d failures", data.authfail)
+	}
+	if !autoBlacklisted.contains(data.key, start) {
+		t.Errorf("brute-forcing key isn't auto-blacklisted")
+	}
+	if got := scoreSession(data, cfg); got > below-cfg.BruteForce.Penalty+1e-9 {
+		t.Errorf("brute-forcing session scored %.04f, %.04f before the last failure", got, below)
+	}
+
+	// successes don't reset the count
+	recordAuth(data, "ok", start, cfg)
+	if !bruteForcing(data, &cfg.BruteForce) {
+		t.Errorf("success cleared the brute-force detection")
+	}
+
+	cfg.BruteForce.Failures = 0
+	if bruteForcing(data, &cfg.BruteForce) {
+		t.Errorf("brute-force detection isn't disabled by zero failures")
+	}
+}
+
+func TestHarvesting(t *testing.T) {
+	harvest := &defaultConfig().Harvest
+	tests := []struct {
+		ok     int
+		failed int
+		want   bool
+	}{
+		{0, 0, false},
+		{0, 5, false},
+		{2, 8, true},
+		{5, 5, true},
+		{6, 4, false},
+		{1, 50, true},
+	}
+	for _, test := range tests {
+		session := &SessionData{transactions: []*Transaction{{rcptToOK: test.ok, rcptToPermfail: test.failed}}}
+		if got := harvesting(session, harvest); got != test.want {
+			t.Errorf("harvesting(%d ok, %d failed) = %v, want %v", test.ok, test.failed, got, test.want)
+		}
+	}
+
+	// the ratio is taken over the whole session, not per transaction
+	session := &SessionData{transactions: []*Transaction{
+		{rcptToOK: 1, rcptToPermfail: 4},
+		{rcptToOK: 1, rcptToTempfail: 4},
+	}}
+	if !harvesting(session, harvest) {
+		t.Errorf("harvesting over two transactions not detected")
+	}
+	if penalty := scoreHarvest(session, harvest); penalty != harvest.Penalty*0.8 {
+		t.Errorf("scoreHarvest = %.04f, want %.04f", penalty, harvest.Penalty*0.8)
+	}
+}
+
+func TestScoreTiming(t *testing.T) {
+	timing := &defaultConfig().Timing
+	start := time.Now()
+
+	observe := func(commands int, gap time.Duration) *SessionData {
+		session := &SessionData{lastCommand: start}
+		for i := 1; i <= commands; i++ {
+			observeCommand(session, start.Add(time.Duration(i)*gap))
+		}
+		return session
+	}
+
+	if penalty := scoreTiming(observe(20, time.Millisecond), timing); penalty != timing.Penalty {
+		t.Errorf("back-to-back session penalty = %.04f, want %.04f", penalty, timing.Penalty)
+	}
+	if penalty := scoreTiming(observe(20, time.Second), timing); penalty != 0 {
+		t.Errorf("paced session penalty = %.04f, want 0", penalty)
+	}
+	if penalty := scoreTiming(observe(timing.MinCommands-1, 0), timing); penalty != 0 {
+		t.Errorf("short pipelined session penalty = %.04f, want 0", penalty)
+	}
+
+	session := observe(3, 10*time.Millisecond)
+	observeCommand(session, session.lastCommand.Add(time.Millisecond))
+	if session.minGap != time.Millisecond || session.commands != 4 {
+		t.Errorf("minGap = %s after %d commands, want 1ms after 4", session.minGap, session.commands)
+	}
+}
+
+func TestOverRecipientLimit(t *testing.T) {
+	limit := &defaultConfig().RecipientLimit
+	limit.Threshold, limit.Max = 0.4, 3
+
+	count := func(data *SessionData, n int) int {
+		over := 0
+		for i := 0; i < n; i++ {
+			if overRecipientLimit(data, limit) {
+				over++
+			}
+		}
+		return over
+	}
+	if over := count(&SessionData{connectScore: 0.2}, 10); over != 7 {
+		t.Errorf("low reputation session had %d recipients over the limit, want 7", over)
+	}
+	if over := count(&SessionData{connectScore: 0.8}, 10); over != 0 {
+		t.Errorf("good reputation session had %d recipients over the limit, want 0", over)
+	}
+	if over := count(&SessionData{connectScore: 0.2, local: true}, 10); over != 0 {
+		t.Errorf("local session had %d recipients over the limit, want 0", over)
+	}
+}
+
+func TestScoreSharedHelo(t *testing.T) {
+	sharedHelo := &defaultConfig().SharedHelo
+	if got := scoreSharedHelo(&SessionData{heloKeys: sharedHelo.MaxAddresses}, sharedHelo); got != 0 {
+		t.Errorf("penalty at max-addresses = %.04f, want 0", got)
+	}
+	if got := scoreSharedHelo(&SessionData{heloKeys: sharedHelo.MaxAddresses + 1}, sharedHelo); got != sharedHelo.Penalty {
+		t.Errorf("penalty past max-addresses = %.04f, want %.04f", got, sharedHelo.Penalty)
+	}
+}
+
+func TestMandatoryTLS(t *testing.T) {
+	policy := &MandatoryTLS{Enabled: true}
+	tests := []struct {
+		session *SessionData
+		refused bool
+	}{
+		{&SessionData{}, true},
+		{&SessionData{cmdTLS: true}, false},
+		{&SessionData{authok: 1}, false},
+		{&SessionData{authfail: 2}, true},
+	}
+	for i, test := range tests {
+		if got := mandatoryTLS(test.session, policy); got != test.refused {
+			t.Errorf("session %d: refused = %v, want %v", i, got, test.refused)
+		}
+	}
+	policy.Enabled = false
+	if mandatoryTLS(&SessionData{}, policy) {
+		t.Errorf("session refused with mandatory-tls disabled")
+	}
+}
+
+func TestFCrDNSVerdict(t *testing.T) {
+	requireFCrDNS := &RequireFCrDNS{Threshold: 0.4, Action: "defer"}
+	addr := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		session *SessionData
+		refused bool
+	}{
+		{&SessionData{addr: addr, fcrdns: false, connectScore: 0.2}, true},
+		{&SessionData{addr: addr, fcrdns: true, connectScore: 0.2}, false},
+		{&SessionData{addr: addr, fcrdns: false, connectScore: 0.4}, false},
+		{&SessionData{addr: addr, fcrdns: true, connectScore: 0.8}, false},
+		{&SessionData{addr: addr, fcrdns: false, connectScore: 0.2, authok: 1}, false},
+		{&SessionData{fcrdns: false, connectScore: 0.2}, false},
+	}
+	for i, test := range tests {
+		v, refused := fcrdnsVerdict(test.session, requireFCrDNS)
+		if refused != test.refused {
+			t.Errorf("session %d: refused = %v, want %v", i, refused, test.refused)
+		}
+		if refused && (v.action != "reject" || v.message[0] != '4') {
+			t.Errorf("session %d: verdict = %+v, want a 4xx reject", i, v)
+		}
+	}
+
+	requireFCrDNS.Action = "reject"
+	if v, _ := fcrdnsVerdict(tests[0].session, requireFCrDNS); v.message[0] != '5' {
+		t.Errorf("reject action verdict = %+v, want a 5xx reject", v)
+	}
+}
+
+func TestRecipientCap(t *testing.T) {
+	recipientCap := &RecipientCap{Threshold: 0.4, Max: 5, Message: "550 5.5.3 Too many recipients for a single message"}
+	session := func(score float64, ok, tempfail, permfail int) *SessionData {
+		tx := &Transaction{mailFromOK: true, rcptToOK: ok, rcptToTempfail: tempfail, rcptToPermfail: permfail}
+		return &SessionData{addr: net.ParseIP("192.0.2.1"), connectScore: score, transactions: []*Transaction{tx}}
+	}
+
+	tests := []struct {
+		session    *SessionData
+		recipients int
+		over       bool
+	}{
+		{session(0.2, 5, 0, 0), 5, false},
+		{session(0.2, 6, 0, 0), 6, true},
+		{session(0.2, 2, 2, 2), 6, true},
+		{session(0.4, 10, 0, 0), 0, false},
+		{&SessionData{connectScore: 0.2}, 0, false},
+	}
+	for i, test := range tests {
+		if recipients, over := overRecipientCap(test.session, recipientCap); recipients != test.recipients || over != test.over {
+			t.Errorf("session %d: %d recipients, over = %v, want %d and %v", i, recipients, over, test.recipients, test.over)
+		}
+	}
+	authenticated := session(0.2, 10, 0, 0)
+	authenticated.authok = 1
+	if _, over := overRecipientCap(authenticated, recipientCap); over {
+		t.Errorf("authenticated session is capped")
+	}
+
+	// the whole transaction is refused at DATA
+	saved, savedDryRun := currentConfig(), dryRun
+	defer func() { activeConfig.Store(saved); dryRun = savedDryRun }()
+	cfg := defaultConfig()
+	cfg.RecipientCap = *recipientCap
+	activeConfig.Store(cfg)
+	dryRun = false
+	over := fakeSession(t, session(0.35, 6, 0, 0))
+	if response := filterDataCb(time.Now(), over); response != filter.Reject(recipientCap.Message) {
+		t.Errorf("over-cap transaction response = %#v, want a reject", response)
+	}
+	under := fakeSession(t, session(0.35, 5, 0, 0))
+	if response := filterDataCb(time.Now(), under); response != filter.Proceed() {
+		t.Errorf("under-cap transaction response = %#v, want proceed", response)
+	}
+}
+
+func TestScoreSenderDomains(t *testing.T) {
+	senderDomains := &defaultConfig().SenderDomains
+
+	session := func(froms ...string) *SessionData {
+		data := &SessionData{}
+		for _, from := range froms {
+			tx := &Transaction{}
+			data.transactions = append(data.transactions, tx)
+			recordSender(data, tx, from)
+		}
+		return data
+	}
+
+	tests := []struct {
+		session *SessionData
+		want    float64
+	}{
+		{session("a@example.org", "b@example.org", "c@EXAMPLE.org", "d@example.org"), 0},
+		{session("a@example.org", "b@example.com"), 0},
+		{session("a@example.org", "b@example.com", "c@example.net"), 2 * senderDomains.Penalty},
+		{session("a@one.example", "b@two.example", "c@three.example", "d@four.example",
+			"e@five.example", "f@six.example", "g@seven.example"), senderDomains.MaxPenalty},
+	}
+	for i, test := range tests {
+		if got := scoreSenderDomains(test.session, senderDomains); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("session %d: penalty = %.04f, want %.04f", i, got, test.want)
+		}
+	}
+
+	if s := summarizeSession(tests[2].session, defaultConfig()); s.SenderDomains != 3 {
+		t.Errorf("summarized sender domains = %d, want 3", s.SenderDomains)
+	}
+}
+
+func TestScoreDowngrade(t *testing.T) {
+	downgrade := &defaultConfig().Downgrade
+	downgrade.STARTTLSOffered = true
+
+	committed := []*Transaction{{mailFromOK: true, committed: true}}
+	if penalty := scoreDowngrade(&SessionData{cmdEhlo: true, transactions: committed}, downgrade); penalty != downgrade.Penalty {
+		t.Errorf("EHLO without TLS penalty = %.04f, want %.04f", penalty, downgrade.Penalty)
+	}
+	if penalty := scoreDowngrade(&SessionData{cmdEhlo: true, cmdTLS: true, transactions: committed}, downgrade); penalty != 0 {
+		t.Errorf("EHLO with TLS penalty = %.04f, want 0", penalty)
+	}
+	if penalty := scoreDowngrade(&SessionData{cmdHelo: true, transactions: committed}, downgrade); penalty != 0 {
+		t.Errorf("HELO without TLS penalty = %.04f, want 0", penalty)
+	}
+	uncommitted := []*Transaction{{mailFromOK: true}}
+	if penalty := scoreDowngrade(&SessionData{cmdEhlo: true, transactions: uncommitted}, downgrade); penalty != 0 {
+		t.Errorf("EHLO without message penalty = %.04f, want 0", penalty)
+	}
+
+	downgrade.STARTTLSOffered = false
+	if penalty := scoreDowngrade(&SessionData{cmdEhlo: true, transactions: committed}, downgrade); penalty != 0 {
+		t.Errorf("penalty = %.04f on listeners without STARTTLS, want 0", penalty)
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	saved := dryRun
+	defer func() { dryRun = saved }()
+
+	reject := verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}
+
+	dryRun = true
+	if v, delay := enforce(reject, time.Second); v.action != "proceed" || delay != 0 {
+		t.Errorf("dry-run enforce = %s after %s, want proceed at once", v, delay)
+	}
+
+	dryRun = false
+	if v, delay := enforce(reject, time.Second); v != reject || delay != time.Second {
+		t.Errorf("enforce = %s after %s, want %s after 1s", v, delay, reject)
+	}
+}
+
+func TestReportDecision(t *testing.T) {
+	savedDryRun, savedReport := dryRun, reportDecisions
+	defer func() { dryRun, reportDecisions = savedDryRun, savedReport }()
+
+	data := &SessionData{connectScore: 0.25}
+	proceed := verdict{action: "proceed"}
+	reject := verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}
+
+	reportDecisions = false
+	if v := reportDecision(data, proceed, proceed); v != proceed {
+		t.Errorf("unreported decision = %s, want proceed", v)
+	}
+
+	reportDecisions, dryRun = true, false
+	if v := reportDecision(data, proceed, proceed); v.String() != "report|reputation score=0.2500 decision=proceed" {
+		t.Errorf("reported proceed = %s", v)
+	}
+	if v := reportDecision(data, reject, reject); v != reject {
+		t.Errorf("reported reject = %s, want the reject itself", v)
+	}
+
+	dryRun = true
+	v, _ := enforce(reject, 0)
+	if v := reportDecision(data, reject, v); v.String() != "report|reputation score=0.2500 decision=would-disconnect" {
+		t.Errorf("reported dry-run reject = %s", v)
+	}
+}
+
+func TestScoreSize(t *testing.T) {
+	size := &defaultConfig().Size
+	tests := []struct {
+		tx   Transaction
+		want float64
+	}{
+		{Transaction{committed: true, messageSize: 4096}, 0},
+		{Transaction{committed: true, messageSize: 10}, size.Penalty},
+		{Transaction{committed: true, messageSize: size.Max + 1}, size.Penalty},
+		{Transaction{committed: false, messageSize: 10}, 0},
+	}
+	for _, test := range tests {
+		if got := scoreSize(&test.tx, size); got != test.want {
+			t.Errorf("scoreSize(%d bytes, committed=%v) = %.04f, want %.04f", test.tx.messageSize, test.tx.committed, got, test.want)
+		}
+	}
+
+	session := &SessionData{transactions: []*Transaction{
+		{committed: true, messageSize: 1000},
+		{committed: true, messageSize: 2000},
+		{messageSize: 5000},
+	}}
+	if s := summarizeSession(session, defaultConfig()); s.Bytes != 3000 {
+		t.Errorf("summarized bytes = %d, want 3000", s.Bytes)
+	}
+}
+
+func TestScoreFailedRecipients(t *testing.T) {
+	cfg := defaultConfig()
+
+	session := func(tempfail int, permfail int) *SessionData {
+		return &SessionData{rdns: "mail.example.org", fcrdns: true, cmdTLS: true, transactions: []*Transaction{
+			{mailFromOK: true, rcptToOK: 5, rcptToTempfail: tempfail, rcptToPermfail: permfail},
+		}}
+	}
+	tempfails := scoreSession(session(3, 0), cfg)
+	permfails := scoreSession(session(0, 3), cfg)
+	if permfails >= tempfails {
+		t.Errorf("permfails session = %.04f, want below tempfails session %.04f", permfails, tempfails)
+	}
+
+	tx := &Transaction{mailFromOK: true, rcptToOK: 5, rcptToTempfail: 1, rcptToPermfail: 1}
+	want := cfg.Weights.ValidSender + 5*cfg.Weights.SuccessfulRecipient - cfg.Weights.TempfailRecipient - cfg.Weights.PermfailRecipient
+	if got := scoreTransaction(tx, cfg); math.Abs(got-want) > 1e-9 {
+		t.Errorf("scoreTransaction = %.04f, want %.04f", got, want)
+	}
+}
+
+func TestScoreRollbacks(t *testing.T) {
+	cfg := defaultConfig()
+	committed := func() *Transaction {
+		return &Transaction{mailFromOK: true, rcptToOK: 1, sawData: true, committed: true, messageSize: 4096}
+	}
+	rolledBack := func() *Transaction {
+		return &Transaction{mailFromOK: true, rcptToOK: 1}
+	}
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		want float64
+	}{
+		{"all-commit", []*Transaction{committed(), committed(), committed()}, 0},
+		{"all-rollback", []*Transaction{rolledBack(), rolledBack()}, cfg.Weights.RollbackRatio},
+		{"mixed", []*Transaction{committed(), rolledBack(), rolledBack(), rolledBack()}, 0.75 * cfg.Weights.RollbackRatio},
+	}
+	scores := make(map[string]float64)
+	for _, test := range tests {
+		session := &SessionData{rdns: "mail.example.org", fcrdns: true, cmdTLS: true, transactions: test.txs}
+		if got := scoreRollbacks(session, &cfg.Weights); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: penalty = %.04f, want %.04f", test.name, got, test.want)
+		}
+		scores[test.name] = scoreSession(session, cfg)
+	}
+	if !(scores["all-rollback"] < scores["mixed"] && scores["mixed"] < scores["all-commit"]) {
+		t.Errorf("all-rollback %.04f < mixed %.04f < all-commit %.04f does not hold",
+			scores["all-rollback"], scores["mixed"], scores["all-commit"])
+	}
+}
+
+func TestScoreNullSender(t *testing.T) {
+	cfg := defaultConfig()
+	w := &cfg.Weights
+
+	sender := &Transaction{mailFromOK: true, rcptToOK: 1, sawData: true, committed: true, messageSize: 4096}
+	bounce := &Transaction{mailFromOK: true, nullSender: true, rcptToOK: 1, sawData: true, committed: true, messageSize: 4096}
+	backscatter := &Transaction{mailFromOK: true, nullSender: true, rcptToOK: 5, sawData: true, committed: true, messageSize: 4096}
+
+	// a bounce scores between a message from a valid sender and one with
+	// no sender bonus at all
+	if got, want := scoreTransaction(bounce, cfg), w.NullSender+w.Data+w.Commit+w.SuccessfulRecipient; math.Abs(got-want) > 1e-9 {
+		t.Errorf("bounce = %.04f, want %.04f", got, want)
+	}
+	if scoreTransaction(bounce, cfg) >= scoreTransaction(sender, cfg) {
+		t.Errorf("bounce scores as well as a valid sender")
+	}
+	if scoreTransaction(backscatter, cfg) >= scoreTransaction(bounce, cfg) {
+		t.Errorf("null sender with 5 recipients scores as well as a bounce")
+	}
+
+	bounces := &SessionData{transactions: []*Transaction{bounce}}
+	abusive := &SessionData{transactions: []*Transaction{backscatter, backscatter, backscatter}}
+	if scoreSession(abusive, cfg) >= scoreSession(bounces, cfg) {
+		t.Errorf("backscatter session %.04f scores as well as a bounce session %.04f",
+			scoreSession(abusive, cfg), scoreSession(bounces, cfg))
+	}
+	if s := summarizeSession(abusive, cfg); s.NullSenders != 3 {
+		t.Errorf("summarized null senders = %d, want 3", s.NullSenders)
+	}
+}
+
+func TestScoreSessionAuthCaps(t *testing.T) {
+	cfg := defaultConfig()
+	w := &cfg.Weights
+
+	// a baseline session far from both clamps
+	base := func() *SessionData {
+		return &SessionData{rdns: "mail.example.org", fcrdns: true, cmdTLS: true}
+	}
+	baseline := scoreSession(base(), cfg)
+
+	previous := baseline
+	for authok := 1; authok <= 10; authok++ {
+		session := base()
+		session.authok = authok
+		score := scoreSession(session, cfg)
+		if score < previous {
+			t.Errorf("score decreased from %.04f to %.04f with %d successes", previous, score, authok)
+		}
+		if score-baseline > w.AuthSuccessCap+1e-9 {
+			t.Errorf("auth bonus %.04f with %d successes exceeds cap %.04f", score-baseline, authok, w.AuthSuccessCap)
+		}
+		previous = score
+	}
+
+	// with a low failure weight and a tight cap, failures saturate
+	// before the clamp at 0.0 does, brute-force detection aside
+	cfg.Weights.AuthFailure = 0.01
+	cfg.Weights.AuthFailureCap = 0.05
+	cfg.BruteForce.Failures = 0
+	session := base()
+	session.authfail = 1000
+	if got, want := scoreSession(session, cfg), baseline-0.05; math.Abs(got-want) > 1e-9 {
+		t.Errorf("score with 1000 failures = %.04f, want %.04f", got, want)
+	}
+
+	// many successes can't mask failures beyond the cap
+	cfg = defaultConfig()
+	good := base()
+	good.authok, good.authfail = 100, 5
+	bad := base()
+	bad.authok, bad.authfail = 2, 5
+	if scoreSession(good, cfg) != scoreSession(bad, cfg) {
+		t.Errorf("100 successes score %.04f, 2 successes score %.04f, want identical", scoreSession(good, cfg), scoreSession(bad, cfg))
+	}
+}
+
+// cleanTransaction returns a single recipient message of a plausible size.
+func cleanTransaction() *Transaction {
+	return &Transaction{mailFromOK: true, rcptToOK: 1, sawData: true, committed: true, messageSize: 2048}
+}
+
+func TestScoreTransaction(t *testing.T) {
+	cfg := defaultConfig()
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want float64
+	}{
+		{"empty", &Transaction{}, 0},
+		{"committed", cleanTransaction(), 1},
+		{"rolled-back", &Transaction{mailFromOK: true, rcptToOK: 2}, 0.6},
+		{"tempfails", &Transaction{mailFromOK: true, rcptToOK: 1, rcptToTempfail: 2}, 0.3},
+		{"harvest", &Transaction{mailFromOK: true, rcptToOK: 1, rcptToPermfail: 9}, 0},
+		{"bounce", &Transaction{mailFromOK: true, nullSender: true, rcptToOK: 1, sawData: true, committed: true, messageSize: 2048}, 0.9},
+		{"tiny", &Transaction{mailFromOK: true, sawData: true, committed: true, messageSize: 10}, 0.95},
+	}
+	for _, test := range tests {
+		if got := scoreTransaction(test.tx, cfg); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: scoreTransaction = %.04f, want %.04f", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScoreSession(t *testing.T) {
+	cfg := defaultConfig()
+	tests := []struct {
+		name    string
+		session *SessionData
+		want    float64
+	}{
+		{"empty", &SessionData{}, 0},
+		{"no-transaction", &SessionData{cmdTLS: true, rdns: "mail.example.org"}, 0.3},
+		{"authenticated-tls", &SessionData{
+			authok: 1, cmdTLS: true, cmdEhlo: true, heloname: "mail.example.org",
+			rdns: "mail.example.org", fcrdns: true,
+			transactions: []*Transaction{cleanTransaction(), cleanTransaction()},
+		}, 1},
+		{"harvesting", &SessionData{
+			cmdEhlo: true, heloname: "mail.example.org", rdns: "mail.example.org",
+			transactions: []*Transaction{{mailFromOK: true, rcptToOK: 1, rcptToPermfail: 19}},
+		}, 0},
+		{"all-rollback", &SessionData{
+			cmdEhlo: true, heloname: "mail.example.org", rdns: "mail.example.org",
+			transactions: []*Transaction{{mailFromOK: true, rcptToOK: 1}, {mailFromOK: true, rcptToOK: 1}, {mailFromOK: true, rcptToOK: 1}},
+		}, 0.4},
+		{"auth-failures", &SessionData{authfail: 10, cmdTLS: true}, 0},
+	}
+	for _, test := range tests {
+		if got := scoreSession(test.session, cfg); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: scoreSession = %.04f, want %.04f", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScoreTransactions(t *testing.T) {
+	cfg := defaultConfig()
+	warmingUp := []*Transaction{{}, {}, cleanTransaction(), cleanTransaction()}
+	coolingDown := []*Transaction{cleanTransaction(), cleanTransaction(), {}, {}}
+
+	if got := scoreTransactions(warmingUp, cfg); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("unweighted warming up = %.04f, want 0.5", got)
+	}
+	if got := scoreTransactions(coolingDown, cfg); math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("unweighted cooling down = %.04f, want 0.5", got)
+	}
+
+	// weights 1, 2, 4 and 8 from the first transaction to the last
+	cfg.Aggregation.TransactionRecency = 2
+	if got, want := scoreTransactions(warmingUp, cfg), 12.0/15; math.Abs(got-want) > 1e-9 {
+		t.Errorf("weighted warming up = %.04f, want %.04f", got, want)
+	}
+	if got, want := scoreTransactions(coolingDown, cfg), 3.0/15; math.Abs(got-want) > 1e-9 {
+		t.Errorf("weighted cooling down = %.04f, want %.04f", got, want)
+	}
+
+	long := make([]*Transaction, 10000)
+	for i := range long {
+		long[i] = &Transaction{}
+	}
+	long[len(long)-1] = cleanTransaction()
+	cfg.Aggregation.TransactionRecency = 10
+	if got := scoreTransactions(long, cfg); math.IsNaN(got) || math.Abs(got-0.9) > 1e-9 {
+		t.Errorf("weighted long session = %.04f, want 0.9", got)
+	}
+	if got := scoreTransactions(nil, cfg); got != 0 {
+		t.Errorf("no transaction = %.04f, want 0", got)
+	}
+}
+
+func TestSummarizeSession(t *testing.T) {
+	cfg := defaultConfig()
+	session := &SessionData{
+		authok: 1, authfail: 2, nResets: 1, asn: 64496, country: "FR",
+		mailDomains: map[string]bool{"example.org": true, "example.net": true},
+		transactions: []*Transaction{
+			cleanTransaction(),
+			{mailFromOK: true, nullSender: true, rcptToOK: 1, rcptToTempfail: 1, sawData: true},
+			{mailFromOK: true, rcptToPermfail: 3},
+		},
+	}
+
+	got := summarizeSession(session, cfg)
+	want := Scoring{
+		Timestamp:     got.Timestamp,
+		Score:         scoreSession(session, cfg),
+		AuthFailures:  2,
+		AuthSuccesses: 1,
+		Resets:        1,
+		RcptCount:     6,
+		DataCount:     2,
+		CommitCount:   1,
+		RollbackCount: 2,
+		NullSenders:   1,
+		SenderDomains: 2,
+		Transactions:  3,
+		AuthAttempts:  3,
+		Bytes:         2048,
+		ASN:           64496,
+		Country:       "FR",
+	}
+	if got != want {
+		t.Errorf("summarizeSession = %+v, want %+v", got, want)
+	}
+
+	secure := &SessionData{cmdTLS: true, rdns: "mx.example.org", fcrdns: true}
+	if s := summarizeSession(secure, cfg); s.TLSCount != 1 || s.RDNSCount != 1 || s.FCrDNSCount != 1 || s.Transactions != 0 {
+		t.Errorf("secure session summary = %+v, want TLS, rDNS and FCrDNS counted", s)
+	}
+	unconfirmed := &SessionData{rdns: "dynamic.example.net"}
+	if s := summarizeSession(unconfirmed, cfg); s.TLSCount != 0 || s.RDNSCount != 1 || s.FCrDNSCount != 0 {
+		t.Errorf("unconfirmed session summary = %+v, want only rDNS counted", s)
+	}
+}
+
+func TestAggregateScoring(t *testing.T) {
+	if got := aggregateScoring(nil); got != (Scoring{}) {
+		t.Errorf("aggregateScoring of no scoring = %+v, want zero", got)
+	}
+
+	got := aggregateScoring([]Scoring{
+		{Score: 0.2, AuthFailures: 1, RcptCount: 3, DataCount: 1, CommitCount: 1, Bytes: 100,
+			Transactions: 1, AuthAttempts: 1, TLSCount: 1, RDNSCount: 1, FCrDNSCount: 1},
+		{Score: 0.6, AuthSuccesses: 2, Resets: 1, RcptCount: 1, RollbackCount: 2, NullSenders: 1,
+			Transactions: 2, AuthAttempts: 2, RDNSCount: 1},
+	})
+	want := Scoring{
+		Score: 0.4, AuthFailures: 1, AuthSuccesses: 2, Resets: 1, RcptCount: 4,
+		DataCount: 1, CommitCount: 1, RollbackCount: 2, NullSenders: 1, Bytes: 100,
+		Transactions: 3, AuthAttempts: 3, TLSCount: 1, RDNSCount: 2, FCrDNSCount: 1,
+	}
+	if math.Abs(got.Score-want.Score) > 1e-9 {
+		t.Errorf("aggregate score = %.04f, want %.04f", got.Score, want.Score)
+	}
+	got.Score = want.Score
+	if got != want {
+		t.Errorf("aggregateScoring = %+v, want %+v", got, want)
+	}
+}
+
+func TestScoreTLS(t *testing.T) {
+	weights := &defaultConfig().Weights
+	tests := []struct {
+		tlsString string
+		want      float64
+	}{
+		{"version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256", weights.TLSModern},
+		{"version=TLSv1.3, cipher=TLS_CHACHA20_POLY1305_SHA256, bits=256", weights.TLSModern},
+		{"version=TLSv1.2, cipher=ECDHE-RSA-AES256-GCM-SHA384, bits=256", weights.TLS},
+		{"TLSv1.2:ECDHE-RSA-AES128-GCM-SHA256:128", weights.TLS},
+		{"version=TLSv1.1, cipher=ECDHE-RSA-AES256-SHA, bits=256", weights.TLSLegacy},
+		{"version=TLSv1, cipher=AES256-SHA, bits=256", weights.TLSLegacy},
+		{"version=TLSv1.2, cipher=RC4-SHA, bits=128", weights.TLSLegacy},
+		{"version=TLSv1.2, cipher=EXP-RC2-CBC-MD5, bits=40", weights.TLSLegacy},
+		{"version=TLSv1.2, cipher=DES-CBC3-SHA, bits=112", weights.TLSLegacy},
+		{"version=TLSv1.2, cipher=AECDH-AES256-SHA, bits=256", weights.TLSLegacy},
+		{"", weights.TLS},
+		{"TLSv1.3", weights.TLS},
+		{"version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=strong", weights.TLS},
+	}
+	for _, test := range tests {
+		if got := scoreTLS(test.tlsString, weights); got != test.want {
+			t.Errorf("scoreTLS(%q) = %.04f, want %.04f", test.tlsString, got, test.want)
+		}
+	}
+}
+
+func TestClassifyRDNS(t *testing.T) {
+	tests := map[string]string{
+		"mail.example.org":   "mail.example.org",
+		"Mail.Example.ORG.":  "mail.example.org",
+		" mail.example.org ": "mail.example.org",
+		"<unknown>":          "",
+		"<UNKNOWN>":          "",
+		"null":               "",
+		"":                   "",
+	}
+	for rdns, want := range tests {
+		if got := classifyRDNS(rdns); got != want {
+			t.Errorf("classifyRDNS(%q) = %q, want %q", rdns, got, want)
+		}
+	}
+}
+
+func TestClassifyFCrDNS(t *testing.T) {
+	tests := map[string]bool{
+		"ok":        true,
+		"OK":        true,
+		"pass":      true,
+		" Pass ":    true,
+		"fail":      false,
+		"error":     false,
+		"temperror": false,
+		"permerror": false,
+		"none":      false,
+		"null":      false,
+		"<unknown>": false,
+		"":          false,
+		"whatever":  false,
+	}
+	for fcrdns, want := range tests {
+		if got := classifyFCrDNS(fcrdns); got != want {
+			t.Errorf("classifyFCrDNS(%q) = %v, want %v", fcrdns, got, want)
+		}
+	}
+}
+
+func TestStoredReputationShrinkage(t *testing.T) {
+	cfg := defaultConfig()
+	now := time.Now()
+
+	history := func(scores ...float64) []Scoring {
+		scorings := make([]Scoring, 0, len(scores))
+		for _, score := range scores {
+			scorings = append(scorings, Scoring{Timestamp: now, Score: score})
+		}
+		return scorings
+	}
+
+	if score, known := storedReputation(history(0, 0, 0), cfg); known || score != cfg.Aggregation.Prior {
+		t.Errorf("short history = %.04f known=%v, want prior", score, known)
+	}
+
+	// one bad session among six with a raw mean of 0.5 barely moves it
+	sparse := history(0.0, 0.6, 0.6, 0.6, 0.6, 0.6)
+	score, known := storedReputation(sparse, cfg)
+	if !known || math.Abs(score-(3.0+2.5)/11) > 1e-9 {
+		t.Errorf("sparse history = %.04f known=%v, want %.04f", score, known, (3.0+2.5)/11)
+	}
+
+	// an all bad sparse history is pulled noticeably toward neutral, above
+	// the reject threshold
+	score, _ = storedReputation(history(0, 0, 0, 0, 0, 0), cfg)
+	if score < cfg.Thresholds.Reject {
+		t.Errorf("six bad sessions = %.04f, want pulled above %.04f", score, cfg.Thresholds.Reject)
+	}
+
+	// the more history, the closer to the observed mean
+	long := make([]float64, 100)
+	score, _ = storedReputation(history(long...), cfg)
+	if score > 0.05 {
+		t.Errorf("a hundred bad sessions = %.04f, want close to 0", score)
+	}
+
+	cfg.Aggregation.PriorWeight = 0
+	if score, _ := storedReputation(history(0, 0, 0, 0, 0, 0), cfg); score != 0 {
+		t.Errorf("without prior weight = %.04f, want the raw mean", score)
+	}
+}
+
+func TestGracePolicies(t *testing.T) {
+	now := time.Now()
+	history := func(n int, score float64) []Scoring {
+		scorings := make([]Scoring, 0, n)
+		for i := 0; i < n; i++ {
+			scorings = append(scorings, Scoring{Timestamp: now, Score: score})
+		}
+		return scorings
+	}
+
+	for _, policy := range []string{"neutral", "greylist"} {
+		cfg := defaultConfig()
+		cfg.Grace.Policy = policy
+		if score, known := storedReputation(history(3, 0), cfg); known || score != cfg.Aggregation.Prior {
+			t.Errorf("%s: short history = %.04f known=%v, want prior", policy, score, known)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.Grace.Policy = "strict"
+	if score, known := storedReputation(history(3, 0), cfg); known || score >= cfg.Aggregation.Prior {
+		t.Errorf("strict: short bad history = %.04f known=%v, want below prior", score, known)
+	}
+	if score, known := storedReputation(nil, cfg); known || score != cfg.Aggregation.Prior {
+		t.Errorf("strict: no history = %.04f known=%v, want prior", score, known)
+	}
+
+	// the blend policy ramps from the prior to the shrunk history
+	cfg = defaultConfig()
+	cfg.Grace.Policy = "blend"
+	cfg.Grace.MinSamples = 4
+	prior, k := cfg.Aggregation.Prior, cfg.Aggregation.PriorWeight
+	previous := prior
+	for n := 0; n <= 6; n++ {
+		score, known := storedReputation(history(n, 0), cfg)
+		if known != (n >= 4) {
+			t.Errorf("blend: %d samples known=%v", n, known)
+		}
+		shrunk := k * prior / (float64(n) + k)
+		want := prior + (shrunk-prior)*float64(min(n, 4))/4
+		if math.Abs(score-want) > 1e-9 {
+			t.Errorf("blend: %d samples = %.04f, want %.04f", n, score, want)
+		}
+		if n > 0 && score >= previous {
+			t.Errorf("blend: %d samples = %.04f, not below %.04f with one less", n, score, previous)
+		}
+		previous = score
+	}
+	if score, _ := storedReputation(history(4, 0), cfg); score != k*prior/(4+k) {
+		t.Errorf("blend: full history = %.04f, want the shrunk history %.04f", score, k*prior/(4+k))
+	}
+
+	cfg = defaultConfig()
+	cfg.Grace.MinSamples = 3
+	if _, known := storedReputation(history(3, 1), cfg); !known {
+		t.Errorf("3 samples unknown with min-samples 3")
+	}
+	if _, known := storedReputation(history(2, 1), cfg); known {
+		t.Errorf("2 samples known with min-samples 3")
+	}
+
+	// a greylisted session is deferred, a graced one proceeds
+	greylisted := &SessionData{grace: true, greylisted: true, connectScore: 0.5}
+	if v, _ := connectVerdict(greylisted, nil); v.action != "disconnect" || v.message[0] != '4' {
+		t.Errorf("greylisted session verdict = %+v, want a 4xx disconnect", v)
+	}
+	graced := &SessionData{grace: true, connectScore: 0.0}
+	if v, _ := connectVerdict(graced, nil); v.action != "proceed" {
+		t.Errorf("graced session verdict = %+v, want proceed", v)
+	}
+	strict := &SessionData{connectScore: 0.0}
+	if v, _ := connectVerdict(strict, nil); v.action != "disconnect" {
+		t.Errorf("strict session verdict = %+v, want disconnect", v)
+	}
+}
+
+func TestAggregationStrategies(t *testing.T) {
+	// a worsening history: good sessions a week ago, bad ones lately
+	now := time.Now()
+	scorings := make([]Scoring, 0, 10)
+	for day := 9; day >= 0; day-- {
+		score := 0.0
+		if day >= 5 {
+			score = 1.0
+		}
+		scorings = append(scorings, Scoring{Timestamp: now.Add(-time.Duration(day) * 24 * time.Hour), Score: score})
+	}
+
+	cfg := defaultConfig().Aggregation
+	results := make(map[string]float64)
+	for _, strategy := range []string{"mean", "decay", "linear-recency"} {
+		cfg.Strategy = strategy
+		results[strategy] = aggregationStrategy(&cfg)(scorings)
+	}
+
+	if math.Abs(results["mean"]-0.5) > 1e-9 {
+		t.Errorf("mean = %.04f, want 0.5", results["mean"])
+	}
+	if want := 15.0 / 55; math.Abs(results["linear-recency"]-want) > 1e-9 {
+		t.Errorf("linear-recency = %.04f, want %.04f", results["linear-recency"], want)
+	}
+	// weighing recent sessions more lowers the score, the two days half-life
+	// more so than the linear ranks
+	if !(results["decay"] < results["linear-recency"] && results["linear-recency"] < results["mean"]) {
+		t.Errorf("decay %.04f < linear-recency %.04f < mean %.04f does not hold",
+			results["decay"], results["linear-recency"], results["mean"])
+	}
+
+	// the ranks don't depend on the order of the history
+	reversed := slices.Clone(scorings)
+	slices.Reverse(reversed)
+	if score := linearRecencyScore(reversed); math.Abs(score-results["linear-recency"]) > 1e-9 {
+		t.Errorf("linear-recency of reversed history = %.04f, want %.04f", score, results["linear-recency"])
+	}
+
+	// an unchanging history has the same score whatever the strategy
+	for i := range scorings {
+		scorings[i].Score = 0.7
+	}
+	for _, strategy := range []string{"mean", "decay", "linear-recency"} {
+		cfg.Strategy = strategy
+		if score := aggregationStrategy(&cfg)(scorings); math.Abs(score-0.7) > 1e-9 {
+			t.Errorf("%s of a constant history = %.04f, want 0.7", strategy, score)
+		}
+	}
+}
+
+func TestMaxRise(t *testing.T) {
+	start := time.Now().Add(-30 * 24 * time.Hour)
+	history := func(scores ...float64) []Scoring {
+		scorings := make([]Scoring, 0, len(scores))
+		for i, score := range scores {
+			scorings = append(scorings, Scoring{Timestamp: start.Add(time.Duration(i) * time.Hour), Score: score})
+		}
+		return scorings
+	}
+
+	cfg := defaultConfig().Aggregation
+	cfg.Strategy = "mean"
+	undamped := aggregationStrategy(&cfg)
+	cfg.MaxRise = 0.1
+	dampened := aggregationStrategy(&cfg)
+
+	// a bot slipping clean sessions between bad ones barely moves up
+	bot := history(0.0, 0.0, 1.0, 0.0, 0.0, 1.0)
+	if got, want := dampened(bot), 0.2/6; math.Abs(got-want) > 1e-9 {
+		t.Errorf("dampened bot = %.04f, want %.04f", got, want)
+	}
+	if undamped(bot) <= dampened(bot) {
+		t.Errorf("dampening didn't lower the bot score %.04f", undamped(bot))
+	}
+
+	// scores fall right away but take sustained good behavior to rise
+	falling := history(1.0, 1.0, 1.0, 0.0, 0.0, 0.0)
+	rising := history(0.0, 0.0, 0.0, 1.0, 1.0, 1.0)
+	if got, want := dampened(falling), (0.6+0.7+0.8)/6; math.Abs(got-want) > 1e-9 {
+		t.Errorf("dampened falling history = %.04f, want %.04f", got, want)
+	}
+	if got, want := dampened(rising), (0.1+0.2+0.3)/6; math.Abs(got-want) > 1e-9 {
+		t.Errorf("dampened rising history = %.04f, want %.04f", got, want)
+	}
+	if math.Abs(undamped(falling)-undamped(rising)) > 1e-9 || dampened(rising) >= dampened(falling) {
+		t.Errorf("falling %.04f and rising %.04f histories aren't asymmetric", dampened(falling), dampened(rising))
+	}
+
+	// the history is walked in chronological order, whatever its order
+	reversed := slices.Clone(rising)
+	slices.Reverse(reversed)
+	if math.Abs(dampened(reversed)-dampened(rising)) > 1e-9 {
+		t.Errorf("dampened reversed history = %.04f, want %.04f", dampened(reversed), dampened(rising))
+	}
+}
+
+func TestResetTransaction(t *testing.T) {
+	cfg := defaultConfig()
+
+	clean := &SessionData{rdns: "mail.example.org", fcrdns: true, cmdTLS: true}
+	for i := 0; i < 3; i++ {
+		clean.transactions = append(clean.transactions, &Transaction{mailFromOK: true, rcptToOK: 1, sawData: true, committed: true})
+		resetTransaction(clean)
+	}
+	if clean.nResets != 3 || clean.nAbandoned != 0 {
+		t.Errorf("resets after commits: %d resets, %d abandoned, want 3 and 0", clean.nResets, clean.nAbandoned)
+	}
+
+	// a scripted MAIL FROM + RSET loop
+	probe := &SessionData{rdns: "mail.example.org", fcrdns: true, cmdTLS: true}
+	for i := 0; i < 3; i++ {
+		probe.transactions = append(probe.transactions, &Transaction{mailFromOK: true})
+		resetTransaction(probe)
+		resetTransaction(probe)
+	}
+	if probe.nResets != 6 || probe.nAbandoned != 3 {
+		t.Errorf("probe loop: %d resets, %d abandoned, want 6 and 3", probe.nResets, probe.nAbandoned)
+	}
+
+	if scoreSession(probe, cfg) >= cfg.Thresholds.Defer {
+		t.Errorf("probe loop scored %.04f, want below %.04f", scoreSession(probe, cfg), cfg.Thresholds.Defer)
+	}
+	if scoreSession(probe, cfg) >= scoreSession(clean, cfg) {
+		t.Errorf("probe loop scored %.04f, clean session %.04f", scoreSession(probe, cfg), scoreSession(clean, cfg))
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	for i := 0; i < 7; i++ {
+		ipStore.Append("192.0.2.4", Scoring{Timestamp: time.Now(), Score: 0.05})
+	}
+
+	data := &SessionData{addr: net.ParseIP("192.0.2.4"), key: "192.0.2.4"}
+	message := "554 5.7.1 {ip} refused, score {score} over {samples} sessions"
+	if got, want := renderMessage(message, data, 0.0512), "554 5.7.1 192.0.2.4 refused, score 0.05 over 7 sessions"; got != want {
+		t.Errorf("renderMessage = %q, want %q", got, want)
+	}
+	cfg := defaultConfig()
+	if got := renderMessage(cfg.Thresholds.RejectMessage, data, 0.05); got != cfg.Thresholds.RejectMessage {
+		t.Errorf("renderMessage changed a message without placeholders: %q", got)
+	}
+}
+
+func TestTransactionTime(t *testing.T) {
+	cfg := defaultConfig()
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	timed := func(elapsed time.Duration) *SessionData {
+		session := &SessionData{cmdEhlo: true, heloname: "mail.example.org"}
+		tx := cleanTransaction()
+		tx.beginTime, tx.endTime = start, start.Add(elapsed)
+		session.transactions = append(session.transactions, tx)
+		timeTransaction(session, tx, &cfg.Timing)
+		return session
+	}
+
+	instantaneous := timed(5 * time.Millisecond)
+	paced := timed(2 * time.Second)
+	if instantaneous.fastCommits != 1 || paced.fastCommits != 0 {
+		t.Errorf("fast commits: %d instantaneous, %d paced, want 1 and 0", instantaneous.fastCommits, paced.fastCommits)
+	}
+	if s := summarizeSession(paced, cfg); s.MeanTransactionTime != 2*time.Second {
+		t.Errorf("summarized mean transaction time = %s, want 2s", s.MeanTransactionTime)
+	}
+
+	// the penalty is disabled by default
+	if scoreSession(instantaneous, cfg) != scoreSession(paced, cfg) {
+		t.Errorf("instantaneous transaction penalized by default")
+	}
+	cfg.Timing.TransactionPenalty = 0.1
+	if got := scoreSession(paced, cfg) - scoreSession(instantaneous, cfg); math.Abs(got-0.1) > 1e-9 {
+		t.Errorf("instantaneous transaction cost %.04f, want 0.1", got)
+	}
+
+	// rolled back transactions are timed but never deemed too fast
+	rolledBack := &SessionData{}
+	tx := &Transaction{beginTime: start, endTime: start, mailFromOK: true, sawData: true}
+	timeTransaction(rolledBack, tx, &cfg.Timing)
+	timeTransaction(rolledBack, &Transaction{beginTime: start, endTime: start.Add(time.Second)}, &cfg.Timing)
+	if rolledBack.fastCommits != 0 || meanTransactionTime(rolledBack) != 500*time.Millisecond {
+		t.Errorf("rolled back: %d fast commits, mean %s", rolledBack.fastCommits, meanTransactionTime(rolledBack))
+	}
+
+	aggregate := aggregateScoring([]Scoring{{MeanTransactionTime: time.Second}, {}, {MeanTransactionTime: 3 * time.Second}})
+	if aggregate.MeanTransactionTime != 2*time.Second {
+		t.Errorf("aggregated mean transaction time = %s, want 2s", aggregate.MeanTransactionTime)
+	}
+}
+
+func TestDropTransaction(t *testing.T) {
+	cfg := defaultConfig()
+	start := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	session := func(tx *Transaction) *SessionData {
+		return &SessionData{
+			cmdEhlo: true, heloname: "mail.example.org", rdns: "mail.example.org",
+			transactions: []*Transaction{cleanTransaction(), tx},
+		}
+	}
+
+	// the client disconnects after DATA, before the message is committed
+	dropped := session(&Transaction{beginTime: start, mailFromOK: true, rcptToOK: 1, sawData: true})
+	dropTransaction(dropped)
+	dropTransaction(dropped)
+	if dropped.nDropped != 1 || !dropped.transactions[1].dropped {
+		t.Fatalf("drop after DATA: %d dropped, want 1", dropped.nDropped)
+	}
+	if s := summarizeSession(dropped, cfg); s.DroppedCount != 1 {
+		t.Errorf("summarized dropped transactions = %d, want 1", s.DroppedCount)
+	}
+
+	// neither a rolled back transaction nor one dropped before DATA is
+	rolledBack := session(&Transaction{beginTime: start, endTime: start.Add(time.Second), mailFromOK: true, rcptToOK: 1, sawData: true})
+	beforeData := session(&Transaction{beginTime: start, mailFromOK: true, rcptToOK: 1})
+	committed := session(cleanTransaction())
+	for name, data := range map[string]*SessionData{"rolled-back": rolledBack, "before-data": beforeData, "committed": committed} {
+		dropTransaction(data)
+		if data.nDropped != 0 {
+			t.Errorf("%s: %d dropped, want 0", name, data.nDropped)
+		}
+	}
+
+	if got, want := scoreSession(rolledBack, cfg)-scoreSession(dropped, cfg), cfg.Weights.DroppedAfterData; math.Abs(got-want) > 1e-9 {
+		t.Errorf("drop after DATA costs %.04f more than a rollback, want %.04f", got, want)
+	}
+}
+
+func TestRecordSession(t *testing.T) {
+	saved := []StorageBackend{ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore}
+	defer func() {
+		ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = saved[0], saved[1], saved[2], saved[3], saved[4], saved[5]
+	}()
+	memory := newMemoryBackend()
+	ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = memory, memory, memory, memory, memory, memory
+
+	cfg := defaultConfig()
+	for name, data := range map[string]*SessionData{
+		"never-connected": {},
+		"skipped":         {skip: true, heloname: "mail.example.org"},
+		"unix":            {skip: true, rdns: "localhost"},
+	} {
+		if recordSession(data, cfg, time.Now()) {
+			t.Errorf("%s session was recorded", name)
+		}
+	}
+	if n := memory.Count(); n != 0 {
+		t.Fatalf("%d keys stored for sessions without a key, want 0", n)
+	}
+
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", heloname: "mail.example.org"}
+	if !recordSession(data, cfg, time.Now()) {
+		t.Errorf("connected session wasn't recorded")
+	}
+	if keys := memory.Keys(); len(keys) != 2 || len(memory.Load("")) != 0 {
+		t.Errorf("stored keys = %q, want the address and HELO name", keys)
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	tests := map[string]string{
+		"<user@Example.ORG>":  "example.org",
+		"user@example.org":    "example.org",
+		"\"a@b\"@example.org": "example.org",
+		"<>":                  "",
+		"postmaster":          "",
+	}
+	for address, want := range tests {
+		if got := addressDomain(address); got != want {
+			t.Errorf("addressDomain(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
+
+func TestScoreTransactionLimit(t *testing.T) {
+	transactionLimit := &defaultConfig().TransactionLimit
+	if penalty := scoreTransactionLimit(&SessionData{transactions: make([]*Transaction, 100)}, transactionLimit); penalty != 0 {
+		t.Errorf("session at the limit penalized by %.02f", penalty)
+	}
+	if penalty := scoreTransactionLimit(&SessionData{transactions: make([]*Transaction, 100), extraTxs: 1}, transactionLimit); penalty != transactionLimit.Penalty {
+		t.Errorf("session past the limit penalized by %.02f, want %.02f", penalty, transactionLimit.Penalty)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// The MaxMind databases are optional: an address that can't be looked up,
+// be it for lack of a database or of an entry, has no ASN and no country.
+var asnReader *geoip2.Reader
+var countryReader *geoip2.Reader
+
+// openGeoIP opens the ASN and country databases at the given paths, either
+// of which may be empty. A database that can't be opened is reported and
+// left out.
+func openGeoIP(asnPath string, countryPath string) {
+	if asnPath != "" {
+		reader, err := geoip2.Open(asnPath)
+		if err != nil {
+			logger.Warn("geoip-open-failed", "path", asnPath, "error", err)
+		} else {
+			asnReader = reader
+		}
+	}
+	if countryPath != "" {
+		reader, err := geoip2.Open(countryPath)
+		if err != nil {
+			logger.Warn("geoip-open-failed", "path", countryPath, "error", err)
+		} else {
+			countryReader = reader
+		}
+	}
+}
+
+// lookupGeoIP returns the autonomous system and the ISO country code of ip,
+// zero values if unknown.
+func lookupGeoIP(ip net.IP) (asn uint, org string, country string) {
+	if asnReader != nil {
+		if record, err := asnReader.ASN(ip); err == nil {
+			asn, org = record.AutonomousSystemNumber, record.AutonomousSystemOrganization
+		}
+	}
+	if countryReader != nil {
+		if record, err := countryReader.Country(ip); err == nil {
+			country = record.Country.IsoCode
+		}
+	}
+	return asn, org, country
+}
+
+// asnKey returns the key under which the reputation of an autonomous system
+// is stored.
+func asnKey(asn uint) string {
+	return fmt.Sprintf("AS%d", asn)
+}
@@ -0,0 +1,38 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoIPMissingDatabase(t *testing.T) {
+	openGeoIP(filepath.Join(t.TempDir(), "missing-asn.mmdb"), filepath.Join(t.TempDir(), "missing-country.mmdb"))
+	if asnReader != nil || countryReader != nil {
+		t.Fatal("missing databases left a reader open")
+	}
+
+	asn, org, country := lookupGeoIP(net.ParseIP("192.0.2.1"))
+	if asn != 0 || org != "" || country != "" {
+		t.Errorf("lookup without databases = %d %q %q, want zero values", asn, org, country)
+	}
+	if key := asnKey(64496); key != "AS64496" {
+		t.Errorf("asnKey(64496) = %s, want AS64496", key)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+type greylistEntry struct {
+	FirstSeen time.Time `json:"first-seen"`
+	Passed    bool      `json:"passed"`
+}
+
+// greylist remembers when unknown keys and (key, sender, recipient)
+// triplets were first seen, so that they can be deferred until they retry
+// later, as spam bots rarely do.
+type greylist struct {
+	mutex   sync.Mutex
+	entries map[string]greylistEntry
+}
+
+var greylistEntries = newGreylist()
+
+func newGreylist() *greylist {
+	return &greylist{entries: make(map[string]greylistEntry)}
+}
+
+// check records the first contact of key and reports whether key is still
+// greylisted at timestamp, that is whether it was first seen less than delay
+// before, and whether this is the first retry letting it through.
+func (g *greylist) check(key string, timestamp time.Time, delay time.Duration) (bool, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	entry, exists := g.entries[key]
+	if !exists {
+		g.entries[key] = greylistEntry{FirstSeen: timestamp}
+		return true, false
+	}
+	if timestamp.Sub(entry.FirstSeen) < delay {
+		return true, false
+	}
+	if entry.Passed {
+		return false, false
+	}
+	entry.Passed = true
+	g.entries[key] = entry
+	return false, true
+}
+
+// challenge is check with a retry window, for the challenge grace policy
+// and greylisted triplets: a key retrying more than window after the delay
+// is deferred again as if first seen, as MTAs retry within hours where bots
+// coming back much later are unlikely to be the same sender. passed reports
+// the first retry letting key through.
+func (g *greylist) challenge(key string, timestamp time.Time, delay time.Duration, window time.Duration) (bool, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	entry, exists := g.entries[key]
+	if !exists || !entry.Passed && timestamp.Sub(entry.FirstSeen) > delay+window {
+		g.entries[key] = greylistEntry{FirstSeen: timestamp}
+		return true, false
+	}
+	if timestamp.Sub(entry.FirstSeen) < delay {
+		return true, false
+	}
+	if entry.Passed {
+		return false, false
+	}
+	entry.Passed = true
+	g.entries[key] = entry
+	return false, true
+}
+
+// prune forgets the keys first seen before before.
+func (g *greylist) prune(before time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for key, entry := range g.entries {
+		if entry.FirstSeen.Before(before) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// greylistRecipient reports whether a recipient of a session should be
+// deferred: greylisting only applies to sessions whose connect reputation
+// is uncertain, between the lower and upper bounds of the greylist band.
+// A retry of a greylisted triplet within the window marks the session as
+// retried, a later one is greylisted again.
+func greylistRecipient(data *SessionData, to string, timestamp time.Time, cfg *Greylist) bool {
+	if !cfg.Enabled || data.local || data.addr == nil {
+		return false
+	}
+	if data.connectScore < cfg.Lower || data.connectScore >= cfg.Upper {
+		return false
+	}
+	greylisted, retried := greylistEntries.challenge(data.key+"|"+data.sender+"|"+to, timestamp, cfg.Delay.Duration, cfg.Window.Duration)
+	if retried {
+		data.retried = true
+	}
+	return greylisted
+}
+
+func (g *greylist) snapshot() ([]byte, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return json.Marshal(g.entries)
+}
+
+// restore replaces the entries with those of a snapshot first seen less
+// than max-age before timestamp, the others being dropped by the next prune.
+func (g *greylist) restore(data []byte, timestamp time.Time) (int, error) {
+	entries := make(map[string]greylistEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, err
+	}
+	before := timestamp.Add(-historyMaxAge())
+	for key, entry := range entries {
+		if entry.FirstSeen.Before(before) {
+			delete(entries, key)
+		}
+	}
+	g.mutex.Lock()
+	g.entries = entries
+	g.mutex.Unlock()
+	return len(entries), nil
+}
+
+// loadGreylist restores the greylist from the JSON snapshot at path, like
+// loadState a missing or unreadable snapshot is not fatal.
+func loadGreylist(g *greylist, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("greylist-missing", "path", path)
+		} else {
+			logger.Warn("greylist-unreadable", "path", path, "error", err)
+		}
+		return
+	}
+
+	entries, err := g.restore(data, now())
+	if err != nil {
+		logger.Warn("greylist-corrupt", "path", path, "error", err)
+		return
+	}
+	logger.Info("greylist-load", "path", path, "entries", entries)
+}
+
+// saveGreylist writes a snapshot of the greylist to path.
+func saveGreylist(g *greylist, path string) error {
+	data, err := g.snapshot()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func saveGreylistLoop(g *greylist, path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveGreylist(g, path); err != nil {
+			logger.Error("greylist-save-failed", "path", path, "error", err)
+		}
+	}
+}
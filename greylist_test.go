@@ -0,0 +1,185 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	g := newGreylist()
+	start := time.Now()
+
+	if greylisted, _ := g.check("192.0.2.1", start, 5*time.Minute); !greylisted {
+		t.Errorf("first contact isn't greylisted")
+	}
+	if greylisted, retried := g.check("192.0.2.1", start.Add(time.Minute), 5*time.Minute); !greylisted || retried {
+		t.Errorf("early retry = %v, %v, want greylisted", greylisted, retried)
+	}
+	if greylisted, retried := g.check("192.0.2.1", start.Add(6*time.Minute), 5*time.Minute); greylisted || !retried {
+		t.Errorf("retry past the delay = %v, %v, want retried", greylisted, retried)
+	}
+	if greylisted, retried := g.check("192.0.2.1", start.Add(7*time.Minute), 5*time.Minute); greylisted || retried {
+		t.Errorf("later attempt = %v, %v, want neither", greylisted, retried)
+	}
+
+	g.prune(start.Add(time.Second))
+	if greylisted, _ := g.check("192.0.2.1", start.Add(8*time.Minute), 5*time.Minute); !greylisted {
+		t.Errorf("pruned key isn't greylisted again")
+	}
+}
+
+func TestGreylistChallenge(t *testing.T) {
+	g := newGreylist()
+	start := time.Now()
+	delay, window := 5*time.Minute, time.Hour
+
+	if greylisted, passed := g.challenge("192.0.2.1", start, delay, window); !greylisted || passed {
+		t.Errorf("first contact = %v, %v, want greylisted", greylisted, passed)
+	}
+	if greylisted, passed := g.challenge("192.0.2.1", start.Add(time.Minute), delay, window); !greylisted || passed {
+		t.Errorf("early retry = %v, %v, want greylisted", greylisted, passed)
+	}
+	if greylisted, passed := g.challenge("192.0.2.1", start.Add(30*time.Minute), delay, window); greylisted || !passed {
+		t.Errorf("retry within the window = %v, %v, want passed", greylisted, passed)
+	}
+	if greylisted, passed := g.challenge("192.0.2.1", start.Add(2*time.Hour), delay, window); greylisted || passed {
+		t.Errorf("later attempt = %v, %v, want neither", greylisted, passed)
+	}
+
+	g.challenge("192.0.2.2", start, delay, window)
+	late := start.Add(delay + window + time.Minute)
+	if greylisted, passed := g.challenge("192.0.2.2", late, delay, window); !greylisted || passed {
+		t.Errorf("retry past the window = %v, %v, want greylisted", greylisted, passed)
+	}
+	if greylisted, passed := g.challenge("192.0.2.2", late.Add(delay), delay, window); greylisted || !passed {
+		t.Errorf("retry after the renewed delay = %v, %v, want passed", greylisted, passed)
+	}
+}
+
+func TestChallengeReputation(t *testing.T) {
+	savedStore, savedList, savedDryRun := ipStore, greylistEntries, dryRun
+	defer func() { ipStore, greylistEntries, dryRun = savedStore, savedList, savedDryRun }()
+	ipStore = newMemoryBackend()
+	greylistEntries = newGreylist()
+	dryRun = false
+
+	cfg := defaultConfig()
+	cfg.Grace.Policy = "challenge"
+	delay, window := cfg.Grace.GreylistDelay.Duration, cfg.Grace.ChallengeWindow.Duration
+	start := time.Now()
+
+	attempt := func(key string, timestamp time.Time) *SessionData {
+		data := &SessionData{addr: net.ParseIP(key), key: key, grace: true, cmdEhlo: true, heloname: "mail.example.org"}
+		data.greylisted, data.challenged = greylistEntries.challenge(key, timestamp, delay, window)
+		recordSession(data, cfg, timestamp)
+		return data
+	}
+
+	// a compliant MTA comes back after the delay and earns the bonus
+	attempt("192.0.2.1", start)
+	compliant := attempt("192.0.2.1", start.Add(delay))
+	if !compliant.challenged {
+		t.Fatalf("compliant retry didn't pass the challenge")
+	}
+	plain := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", cmdEhlo: true, heloname: "mail.example.org"}
+	if got, want := scoreSession(compliant, cfg), scoreSession(plain, cfg)+cfg.Grace.ChallengeBonus; math.Abs(got-want) > 1e-9 {
+		t.Errorf("challenged session scored %.04f, want %.04f", got, want)
+	}
+	if history := ipStore.Load("192.0.2.1"); len(history) != 1 {
+		t.Errorf("compliant client has %d scorings, want 1", len(history))
+	}
+
+	// a client never retrying is turned away without leaving any history
+	if bot := attempt("192.0.2.2", start); !bot.greylisted {
+		t.Errorf("first contact wasn't greylisted")
+	}
+	if history := ipStore.Load("192.0.2.2"); len(history) != 0 {
+		t.Errorf("client that never retried has %d scorings, want none", len(history))
+	}
+}
+
+func TestGreylistRecipient(t *testing.T) {
+	saved := greylistEntries
+	defer func() { greylistEntries = saved }()
+	greylistEntries = newGreylist()
+
+	cfg := defaultConfig().Greylist
+	cfg.Enabled = true
+	start := time.Now()
+
+	uncertain := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", sender: "a@example.org", connectScore: 0.4}
+	if !greylistRecipient(uncertain, "b@example.net", start, &cfg) {
+		t.Errorf("uncertain session isn't greylisted")
+	}
+	if !greylistRecipient(uncertain, "c@example.net", start.Add(cfg.Delay.Duration), &cfg) {
+		t.Errorf("another recipient isn't greylisted on its own")
+	}
+	retry := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", sender: "a@example.org", connectScore: 0.4}
+	if greylistRecipient(retry, "b@example.net", start.Add(cfg.Delay.Duration), &cfg) || !retry.retried {
+		t.Errorf("retry after the delay is greylisted or not marked retried")
+	}
+	if scoreSession(retry, defaultConfig()) <= scoreSession(&SessionData{}, defaultConfig()) {
+		t.Errorf("retrying doesn't improve the session score")
+	}
+
+	// a triplet retried within the window passes, one retried past it is
+	// greylisted again as if first seen
+	inTime := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", sender: "a@example.org", connectScore: 0.4}
+	if greylistRecipient(inTime, "c@example.net", start.Add(cfg.Delay.Duration+cfg.Window.Duration), &cfg) || !inTime.retried {
+		t.Errorf("retry at the end of the window is greylisted or not marked retried")
+	}
+	greylistRecipient(uncertain, "d@example.net", start, &cfg)
+	late := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", sender: "a@example.org", connectScore: 0.4}
+	lateRetry := start.Add(cfg.Delay.Duration + cfg.Window.Duration + time.Minute)
+	if !greylistRecipient(late, "d@example.net", lateRetry, &cfg) || late.retried {
+		t.Errorf("retry past the window isn't greylisted again")
+	}
+	if !greylistRecipient(late, "d@example.net", lateRetry.Add(cfg.Delay.Duration-time.Second), &cfg) {
+		t.Errorf("late retry wasn't deferred as if first seen")
+	}
+	if greylistRecipient(late, "d@example.net", lateRetry.Add(cfg.Delay.Duration), &cfg) || !late.retried {
+		t.Errorf("retry after the delay following a late retry is greylisted")
+	}
+
+	for _, score := range []float64{0.1, 0.9} {
+		session := &SessionData{addr: net.ParseIP("192.0.2.2"), key: "192.0.2.2", sender: "a@example.org", connectScore: score}
+		if greylistRecipient(session, "b@example.net", start, &cfg) {
+			t.Errorf("session with reputation %.02f outside the band is greylisted", score)
+		}
+	}
+}
+
+func TestGreylistPersistence(t *testing.T) {
+	g := newGreylist()
+	start := time.Now().Truncate(time.Second)
+	g.check("192.0.2.1|a@example.org|b@example.net", start, time.Minute)
+
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	if err := saveGreylist(g, path); err != nil {
+		t.Fatal(err)
+	}
+	restored := newGreylist()
+	loadGreylist(restored, path)
+	if greylisted, retried := restored.check("192.0.2.1|a@example.org|b@example.net", start.Add(2*time.Minute), time.Minute); greylisted || !retried {
+		t.Errorf("restored triplet = %v, %v, want retried", greylisted, retried)
+	}
+}
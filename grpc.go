@@ -0,0 +1,221 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/filter-reputation/reputationpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// connectDecision is a connect decision as streamed to the subscribers of
+// the decision feed.
+type connectDecision struct {
+	timestamp time.Time
+	session   string
+	ip        string
+	key       string
+	score     float64
+	decision  string
+	enforced  bool
+}
+
+// decisionBuffer is how many decisions may be queued for a subscriber
+// before the next ones are dropped.
+const decisionBuffer = 256
+
+// decisionFeed fans connect decisions out to its subscribers. Publishing
+// never blocks: a subscriber whose buffer is full misses decisions rather
+// than holding up the sessions.
+type decisionFeed struct {
+	mutex       sync.Mutex
+	subscribers map[chan connectDecision]struct{}
+}
+
+func newDecisionFeed() *decisionFeed {
+	return &decisionFeed{subscribers: make(map[chan connectDecision]struct{})}
+}
+
+var decisions = newDecisionFeed()
+
+func (f *decisionFeed) subscribe() chan connectDecision {
+	ch := make(chan connectDecision, decisionBuffer)
+	f.mutex.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mutex.Unlock()
+	return ch
+}
+
+func (f *decisionFeed) unsubscribe(ch chan connectDecision) {
+	f.mutex.Lock()
+	delete(f.subscribers, ch)
+	f.mutex.Unlock()
+}
+
+func (f *decisionFeed) publish(d connectDecision) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- d:
+		default:
+			decisionsDropped.Inc()
+		}
+	}
+}
+
+// publishDecision feeds the connect decision taken on a session, named
+// after the verdict decided and the tarpit delay.
+func publishDecision(data *SessionData, decided verdict, delay time.Duration) {
+	decision := "proceed"
+	switch {
+	case decided.action != "proceed" && strings.HasPrefix(decided.message, "4"):
+		decision = "defer"
+	case decided.action != "proceed":
+		decision = "reject"
+	case delay > 0:
+		decision = "tarpit"
+	}
+	ip := ""
+	if data.addr != nil {
+		ip = data.addr.String()
+	}
+	decisions.publish(connectDecision{
+		timestamp: now(),
+		session:   data.id,
+		ip:        ip,
+		key:       data.key,
+		score:     data.connectScore,
+		decision:  decision,
+		enforced:  enforcing(),
+	})
+}
+
+// reputationServer implements the gRPC Reputation service on top of the
+// same accessors as the HTTP endpoints. Resets are only allowed if
+// adminToken is set.
+type reputationServer struct {
+	reputationpb.UnimplementedReputationServer
+	adminToken string
+}
+
+func (s *reputationServer) GetReputation(ctx context.Context, req *reputationpb.GetReputationRequest) (*reputationpb.GetReputationReply, error) {
+	ip := net.ParseIP(req.GetIp())
+	if ip == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing or invalid ip")
+	}
+	reply, exists := lookupReputation(ip)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "no reputation for "+reply.Key)
+	}
+	return &reputationpb.GetReputationReply{
+		Ip:      reply.IP,
+		Key:     reply.Key,
+		Samples: int32(reply.Samples),
+		Grace:   reply.Grace,
+		Score:   reply.Score,
+		Pinned:  reply.Pinned,
+		Reasons: reply.Reasons,
+	}, nil
+}
+
+func (s *reputationServer) ResetReputation(ctx context.Context, req *reputationpb.ResetReputationRequest) (*reputationpb.ResetReputationReply, error) {
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	if !s.authorized(ctx) {
+		logger.Warn("grpc-unauthorized", "method", "ResetReputation", "remote", remote)
+		return nil, status.Error(codes.PermissionDenied, "unauthorized")
+	}
+	target, err := parseNetwork(req.GetTarget())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "missing or invalid target")
+	}
+
+	keys := resetReputation(target, req.GetDryRun())
+	logger.Info("reset", "remote", remote, "target", target.String(), "keys", len(keys), "dry-run", req.GetDryRun())
+	return &reputationpb.ResetReputationReply{Target: target.String(), DryRun: req.GetDryRun(), Keys: keys}, nil
+}
+
+// authorized reports whether the call carries the admin token as a bearer
+// token in its authorization metadata.
+func (s *reputationServer) authorized(ctx context.Context) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		given, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(given), []byte(s.adminToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *reputationServer) StreamDecisions(req *reputationpb.StreamDecisionsRequest, stream reputationpb.Reputation_StreamDecisionsServer) error {
+	ch := decisions.subscribe()
+	defer decisions.unsubscribe(ch)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case d := <-ch:
+			err := stream.Send(&reputationpb.Decision{
+				Timestamp: timestamppb.New(d.timestamp),
+				Session:   d.session,
+				Ip:        d.ip,
+				Key:       d.key,
+				Score:     d.score,
+				Decision:  d.decision,
+				Enforced:  d.enforced,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// listenGRPC listens on addr for the gRPC Reputation service, which is
+// served by the returned function.
+func listenGRPC(addr string, adminToken string) (*grpc.Server, func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := grpc.NewServer()
+	reputationpb.RegisterReputationServer(server, &reputationServer{adminToken: adminToken})
+	serve := func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("grpc-serve-failed", "addr", addr, "error", err)
+		}
+	}
+	return server, serve, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/filter-reputation/reputationpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestDecisionFeedBounded(t *testing.T) {
+	feed := newDecisionFeed()
+	ch := feed.subscribe()
+	defer feed.unsubscribe(ch)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*decisionBuffer; i++ {
+			feed.publish(connectDecision{decision: "proceed"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a subscriber that doesn't read")
+	}
+	if len(ch) != decisionBuffer {
+		t.Errorf("expected %d queued decisions, got %d", decisionBuffer, len(ch))
+	}
+}
+
+func TestPublishDecision(t *testing.T) {
+	ch := decisions.subscribe()
+	defer decisions.unsubscribe(ch)
+	data := &SessionData{id: "5f6e2a1b9c", addr: net.ParseIP("192.0.2.4"), key: "192.0.2.4", connectScore: 0.2}
+
+	tests := []struct {
+		decided verdict
+		delay   time.Duration
+		want    string
+	}{
+		{verdict{action: "proceed"}, 0, "proceed"},
+		{verdict{action: "proceed"}, time.Second, "tarpit"},
+		{verdict{"disconnect", "421 4.7.0 Connection deferred: poor reputation, try again later"}, 0, "defer"},
+		{verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}, 0, "reject"},
+	}
+	for _, test := range tests {
+		publishDecision(data, test.decided, test.delay)
+		d := <-ch
+		if d.decision != test.want || d.session != data.id || d.ip != "192.0.2.4" || d.score != 0.2 {
+			t.Errorf("%v: unexpected decision %+v, want %s", test.decided, d, test.want)
+		}
+	}
+}
+
+// dialReputation serves the Reputation service over an in-memory listener
+// and returns a client of it.
+func dialReputation(t *testing.T, adminToken string) reputationpb.ReputationClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	reputationpb.RegisterReputationServer(server, &reputationServer{adminToken: adminToken})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return reputationpb.NewReputationClient(conn)
+}
+
+func TestReputationServer(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	for i := 0; i < 6; i++ {
+		ipStore.Append("192.0.2.4", Scoring{Timestamp: time.Now(), Score: 0.8, RcptCount: 1})
+	}
+
+	client := dialReputation(t, "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reply, err := client.GetReputation(ctx, &reputationpb.GetReputationRequest{Ip: "192.0.2.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := lookupReputation(net.ParseIP("192.0.2.4"))
+	if reply.Key != want.Key || reply.Samples != 6 || reply.Score != want.Score {
+		t.Errorf("unexpected reply %v, want %+v", reply, want)
+	}
+	if len(reply.Reasons) != 0 {
+		t.Errorf("reasons %v without -explain-scores", reply.Reasons)
+	}
+
+	savedExplain := explainScores
+	defer func() { explainScores = savedExplain }()
+	explainScores = true
+	for i := 0; i < 6; i++ {
+		ipStore.Append("198.51.100.6", Scoring{Timestamp: time.Now(), Score: 0.8, TLSCount: 1})
+	}
+	if reply, err := client.GetReputation(ctx, &reputationpb.GetReputationRequest{Ip: "198.51.100.6"}); err != nil || !slices.Equal(reply.Reasons, []string{"+tls:6"}) {
+		t.Errorf("GetReputation reasons = %v, %v, want [+tls:6]", reply.GetReasons(), err)
+	}
+	ipStore.Delete("198.51.100.6")
+	if _, err := client.GetReputation(ctx, &reputationpb.GetReputationRequest{Ip: "192.0.2.5"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetReputation of an unknown address = %v, want NotFound", err)
+	}
+	if _, err := client.GetReputation(ctx, &reputationpb.GetReputationRequest{Ip: "bogus"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("GetReputation of a bogus address = %v, want InvalidArgument", err)
+	}
+
+	reset := &reputationpb.ResetReputationRequest{Target: "192.0.2.0/24"}
+	if _, err := client.ResetReputation(ctx, reset); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ResetReputation without token = %v, want PermissionDenied", err)
+	}
+	authorized := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	resetReply, err := client.ResetReputation(authorized, reset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resetReply.Keys) != 1 || resetReply.Keys[0] != "192.0.2.4" || ipStore.Count() != 0 {
+		t.Errorf("unexpected reset reply %v, %d keys left", resetReply, ipStore.Count())
+	}
+}
+
+func TestReputationServerResetDisabled(t *testing.T) {
+	client := dialReputation(t, "")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer ")
+	_, err := client.ResetReputation(ctx, &reputationpb.ResetReputationRequest{Target: "192.0.2.4"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ResetReputation without an admin token = %v, want PermissionDenied", err)
+	}
+}
+
+func TestStreamDecisions(t *testing.T) {
+	client := dialReputation(t, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.StreamDecisions(ctx, &reputationpb.StreamDecisionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription is only registered once the server handles the call
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		decisions.mutex.Lock()
+		subscribed := len(decisions.subscribers) != 0
+		decisions.mutex.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream never subscribed to the decision feed")
+		}
+	}
+
+	data := &SessionData{id: "5f6e2a1b9c", addr: net.ParseIP("192.0.2.4"), key: "192.0.2.4", connectScore: 0.1}
+	publishDecision(data, verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}, 0)
+	d, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Session != data.id || d.Ip != "192.0.2.4" || d.Decision != "reject" || d.Score != 0.1 || d.Timestamp == nil {
+		t.Errorf("unexpected decision %v", d)
+	}
+}
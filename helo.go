@@ -0,0 +1,129 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// heloMaxAddresses is the number of address keys remembered per HELO name,
+// which bounds both the memory used by a name and the count it can reach.
+const heloMaxAddresses = 1024
+
+type heloShard struct {
+	mutex sync.Mutex
+	names map[string]map[string]time.Time // address keys by HELO name, with their last use
+}
+
+// heloTracker indexes the address keys that recently identified with each
+// HELO name, sharded like the memory backend, as snowshoe spammers send the
+// same name from many addresses.
+type heloTracker struct {
+	shards [storeShards]heloShard
+}
+
+var heloAddresses = newHeloTracker()
+
+func newHeloTracker() *heloTracker {
+	h := &heloTracker{}
+	for i := range h.shards {
+		h.shards[i].names = make(map[string]map[string]time.Time)
+	}
+	return h
+}
+
+// record notes that key identified with name at timestamp and returns the
+// number of distinct keys that identified with name since the window before
+// it, this one included. Past heloMaxAddresses keys, the least recently
+// seen one is forgotten.
+func (h *heloTracker) record(name string, key string, timestamp time.Time, window time.Duration) int {
+	shard := &h.shards[shardIndex(name)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	keys, ok := shard.names[name]
+	if !ok {
+		keys = make(map[string]time.Time)
+		shard.names[name] = keys
+	}
+	if _, seen := keys[key]; !seen && len(keys) >= heloMaxAddresses {
+		oldest := ""
+		for k, t := range keys {
+			if oldest == "" || t.Before(keys[oldest]) {
+				oldest = k
+			}
+		}
+		delete(keys, oldest)
+	}
+	keys[key] = timestamp
+
+	count := 0
+	for _, t := range keys {
+		if timestamp.Sub(t) < window {
+			count++
+		}
+	}
+	return count
+}
+
+// prune forgets the uses of HELO names older than before, and the names no
+// longer used.
+func (h *heloTracker) prune(before time.Time) {
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mutex.Lock()
+		for name, keys := range shard.names {
+			for key, t := range keys {
+				if t.Before(before) {
+					delete(keys, key)
+				}
+			}
+			if len(keys) == 0 {
+				delete(shard.names, name)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+type heloStats struct {
+	Name      string `json:"name"`
+	Addresses int    `json:"addresses"`
+}
+
+// worst returns the n HELO names used by the most address keys, as held
+// since the last prune.
+func (h *heloTracker) worst(n int) []heloStats {
+	stats := make([]heloStats, 0)
+	for i := range h.shards {
+		shard := &h.shards[i]
+		shard.mutex.Lock()
+		for name, keys := range shard.names {
+			stats = append(stats, heloStats{Name: name, Addresses: len(keys)})
+		}
+		shard.mutex.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Addresses != stats[j].Addresses {
+			return stats[i].Addresses > stats[j].Addresses
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats[:min(n, len(stats))]
+}
@@ -0,0 +1,58 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHeloTracker(t *testing.T) {
+	h := newHeloTracker()
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if got := h.record("mail.example.org", fmt.Sprintf("192.0.2.%d", i), start, time.Hour); got != i+1 {
+			t.Fatalf("record #%d = %d, want %d", i, got, i+1)
+		}
+	}
+	if got := h.record("mail.example.org", "192.0.2.0", start.Add(time.Minute), time.Hour); got != 5 {
+		t.Errorf("known key counted again: %d, want 5", got)
+	}
+	if got := h.record("mx.example.com", "192.0.2.0", start, time.Hour); got != 1 {
+		t.Errorf("unrelated name count = %d, want 1", got)
+	}
+
+	// uses older than the window no longer count
+	if got := h.record("mail.example.org", "192.0.2.9", start.Add(time.Hour), time.Hour); got != 2 {
+		t.Errorf("count after the window = %d, want 2", got)
+	}
+
+	// the number of keys remembered per name is capped
+	for i := 0; i < heloMaxAddresses+10; i++ {
+		h.record("snowshoe.example", fmt.Sprintf("key-%d", i), start.Add(time.Duration(i)*time.Millisecond), time.Hour)
+	}
+	if worst := h.worst(1); len(worst) != 1 || worst[0] != (heloStats{Name: "snowshoe.example", Addresses: heloMaxAddresses}) {
+		t.Errorf("worst = %v, want snowshoe.example with %d addresses", worst, heloMaxAddresses)
+	}
+
+	h.prune(start.Add(30 * time.Minute))
+	if worst := h.worst(10); len(worst) != 1 || worst[0] != (heloStats{Name: "mail.example.org", Addresses: 1}) {
+		t.Errorf("worst after prune = %v, want mail.example.org with 1 address", worst)
+	}
+}
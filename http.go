@@ -0,0 +1,352 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveHTTP runs the optional HTTP listener exposing the filter internals.
+// The admin endpoints are only served if adminToken is set, the profiling
+// ones if enablePprof is.
+func serveHTTP(addr string, adminToken string, enablePprof bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/reputation", reputationHandler)
+	mux.HandleFunc("/recipient-domain", recipientDomainHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	if adminToken != "" {
+		mux.Handle("/reputation/reset", requireToken(adminToken, resetHandler))
+	}
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("http-listen-failed", "addr", addr, "error", err)
+	}
+}
+
+type reputationReply struct {
+	IP      string   `json:"ip"`
+	Key     string   `json:"key"`
+	Samples int      `json:"samples"`
+	Grace   bool     `json:"grace"`
+	Score   float64  `json:"score"`
+	Scoring Scoring  `json:"scoring"`
+	Reasons []string `json:"reasons,omitempty"`
+
+	// Pinned is the network of the pin fixing Score, if any.
+	Pinned string `json:"pinned,omitempty"`
+}
+
+// reputationHandler serves GET /reputation?ip=, the reputation stored for the
+// key an address maps to. Score is the address part of the connect score, the
+// rDNS part depends on the session. Addresses without history get a 404
+// unless pinned.
+func reputationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		http.Error(w, "missing or invalid ip parameter", http.StatusBadRequest)
+		return
+	}
+
+	reply, exists := lookupReputation(ip)
+	if !exists {
+		http.Error(w, "no reputation for "+reply.Key, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logger.Warn("http-write-failed", "key", reply.Key, "error", err)
+	}
+}
+
+// lookupReputation returns the reputation stored for the key ip maps to,
+// or the score of the pin matching ip as that is the one enforced, false if
+// the key has no history and ip isn't pinned.
+func lookupReputation(ip net.IP) (reputationReply, bool) {
+	cfg := currentConfig()
+	key := reputationKey(ip)
+	scorings := ipStore.Load(key)
+	p, pinned := pins.match(ip)
+	if len(scorings) == 0 && !pinned {
+		return reputationReply{IP: ip.String(), Key: key}, false
+	}
+
+	score, known := storedReputation(scorings, cfg)
+	reply := reputationReply{
+		IP:      ip.String(),
+		Key:     key,
+		Samples: len(scorings),
+		Grace:   !known,
+		Score:   score,
+		Scoring: aggregateScoringDecayed(scorings, cfg.Aggregation.HalfLife.Duration),
+	}
+	if pinned {
+		// the pinned score is the one enforced, whatever the history
+		reply.Score, reply.Grace, reply.Pinned = cfg.Scale.clamp(p.score), false, p.network.String()
+	}
+	if explainScores {
+		reply.Reasons = explainScoring(reply.Scoring)
+	}
+	return reply, true
+}
+
+// requireToken only lets through requests carrying token as a bearer token.
+func requireToken(token string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			logger.Warn("http-unauthorized", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+type resetReply struct {
+	Target string   `json:"target"`
+	DryRun bool     `json:"dry-run"`
+	Keys   []string `json:"keys"`
+}
+
+// resetHandler serves POST /reputation/reset?target=, which forgets the
+// reputation of every address key within target, an address or a network.
+// With dry-run=true the keys are only reported.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := parseNetwork(r.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(w, "missing or invalid target parameter", http.StatusBadRequest)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry-run") == "true"
+
+	reply := resetReply{Target: target.String(), DryRun: dryRun, Keys: resetReputation(target, dryRun)}
+	logger.Info("reset", "remote", r.RemoteAddr, "target", target.String(), "keys", len(reply.Keys), "dry-run", dryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logger.Warn("http-write-failed", "target", target.String(), "error", err)
+	}
+}
+
+// resetReputation forgets every address key within target unless dryRun is
+// set, returning the keys concerned.
+func resetReputation(target *net.IPNet, dryRun bool) []string {
+	keys := make([]string, 0)
+	for _, key := range ipStore.Keys() {
+		if keyWithin(key, target) {
+			keys = append(keys, key)
+		}
+	}
+	if !dryRun {
+		for _, key := range keys {
+			ipStore.Delete(key)
+		}
+	}
+	return keys
+}
+
+// keyWithin reports whether the address or network a reputation key stands
+// for overlaps target, so that resetting an address clears the network key
+// it is grouped under.
+func keyWithin(key string, target *net.IPNet) bool {
+	network, err := parseNetwork(key)
+	if err != nil {
+		return false
+	}
+	return target.Contains(network.IP) || network.Contains(target.IP)
+}
+
+type recipientDomainReply struct {
+	Domain     string  `json:"domain"`
+	Samples    int     `json:"samples"`
+	Recipients int     `json:"recipients"`
+	Acceptance float64 `json:"acceptance"`
+}
+
+// recipientDomainHandler serves GET /recipient-domain?domain=, the ratio of
+// recipients accepted for a domain, weighted toward recent sessions. Domains
+// without history get a 404.
+func recipientDomainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domain := strings.ToLower(r.URL.Query().Get("domain"))
+	if domain == "" {
+		http.Error(w, "missing domain parameter", http.StatusBadRequest)
+		return
+	}
+
+	scorings := rcptDomainStore.Load(domain)
+	if len(scorings) == 0 {
+		http.Error(w, "no reputation for "+domain, http.StatusNotFound)
+		return
+	}
+	aggregate := aggregateScoringDecayed(scorings, currentConfig().Aggregation.HalfLife.Duration)
+	reply := recipientDomainReply{
+		Domain:     domain,
+		Samples:    len(scorings),
+		Recipients: aggregate.RcptCount,
+		Acceptance: aggregate.Score,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logger.Warn("http-write-failed", "domain", domain, "error", err)
+	}
+}
+
+const (
+	statsDefaultN = 10
+	statsMaxN     = 100
+)
+
+type keyStats struct {
+	Key      string    `json:"key"`
+	Score    float64   `json:"score"`
+	Samples  int       `json:"samples"`
+	LastSeen time.Time `json:"last-seen"`
+}
+
+type statsReply struct {
+	Keys        int         `json:"keys"`
+	Worst       []keyStats  `json:"worst"`
+	Best        []keyStats  `json:"best"`
+	SharedHelos []heloStats `json:"shared-helos"`
+}
+
+// statsHandler serves GET /stats?n=, the n address keys with the worst and
+// the best reputation, among those with enough history to be judged, and
+// the n HELO names used by the most addresses. Keys are loaded one at a
+// time, so only the lock of a single shard is ever held.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := statsDefaultN
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		n, err = strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid n parameter", http.StatusBadRequest)
+			return
+		}
+		n = min(n, statsMaxN)
+	}
+
+	reply := collectStats(n)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logger.Warn("http-write-failed", "path", r.URL.Path, "error", err)
+	}
+}
+
+// collectStats returns the n address keys with the worst and the best
+// reputation and the n most shared HELO names.
+func collectStats(n int) statsReply {
+	cfg := currentConfig()
+	keys := ipStore.Keys()
+	judged := make([]keyStats, 0)
+	for _, key := range keys {
+		scorings := ipStore.Load(key)
+		score, known := storedReputation(scorings, cfg)
+		if !known {
+			continue
+		}
+		judged = append(judged, keyStats{
+			Key:      key,
+			Score:    score,
+			Samples:  len(scorings),
+			LastSeen: scorings[len(scorings)-1].Timestamp,
+		})
+	}
+	sort.Slice(judged, func(i, j int) bool {
+		return judged[i].Score < judged[j].Score
+	})
+
+	reply := statsReply{
+		Keys:  len(keys),
+		Worst: judged[:min(n, len(judged))],
+		Best:  make([]keyStats, 0, min(n, len(judged))),
+
+		SharedHelos: heloAddresses.worst(n),
+	}
+	for i := len(judged) - 1; i >= 0 && len(reply.Best) < n; i-- {
+		reply.Best = append(reply.Best, judged[i])
+	}
+	return reply
+}
+
+type healthReply struct {
+	Keys      int        `json:"keys"`
+	LastPrune *time.Time `json:"last-prune"`
+	Backend   bool       `json:"backend-reachable"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// healthHandler serves GET /healthz, for liveness and readiness probes: the
+// number of address keys, when the stores were last pruned and whether the
+// storage backend is reachable, with a 503 if it isn't.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reply := healthReply{LastPrune: lastPrune.Load(), Backend: true}
+	code := http.StatusOK
+	if err := pingStore(ipStore); err != nil {
+		reply.Backend = false
+		reply.Error = err.Error()
+		code = http.StatusServiceUnavailable
+	} else {
+		reply.Keys = ipStore.Count()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		logger.Warn("http-write-failed", "path", r.URL.Path, "error", err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReputationHandler(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	for i := 0; i < 6; i++ {
+		ipStore.Append("192.0.2.4", Scoring{Timestamp: time.Now(), Score: 0.8, RcptCount: 1})
+	}
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"ip=192.0.2.4", http.StatusOK},
+		{"ip=192.0.2.5", http.StatusNotFound},
+		{"ip=bogus", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		reputationHandler(rec, httptest.NewRequest(http.MethodGet, "/reputation?"+test.query, nil))
+		if rec.Code != test.code {
+			t.Errorf("GET /reputation?%s = %d, want %d", test.query, rec.Code, test.code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	reputationHandler(rec, httptest.NewRequest(http.MethodGet, "/reputation?ip=192.0.2.4", nil))
+	var reply reputationReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := storedReputation(ipStore.Load("192.0.2.4"), currentConfig())
+	if reply.Key != "192.0.2.4" || reply.Samples != 6 || reply.Grace || reply.Score != want {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if reply.Scoring.RcptCount != 6 {
+		t.Errorf("aggregated rcpt count = %d, want 6", reply.Scoring.RcptCount)
+	}
+}
+
+func TestResetHandler(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	for _, key := range []string{"192.0.2.4", "192.0.2.5", "198.51.100.1", "2001:db8:1:2::/64", "local"} {
+		ipStore.Append(key, Scoring{Timestamp: time.Now(), Score: 0.1})
+	}
+	handler := requireToken("secret", resetHandler)
+
+	post := func(query string, token string) (*httptest.ResponseRecorder, resetReply) {
+		req := httptest.NewRequest(http.MethodPost, "/reputation/reset?"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var reply resetReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		return rec, reply
+	}
+
+	if rec, _ := post("target=192.0.2.4", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reset without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec, _ := post("target=192.0.2.4", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reset with wrong token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec, _ := post("target=bogus", "secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("reset of bogus target = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	_, reply := post("target=192.0.2.0/24&dry-run=true", "secret")
+	if len(reply.Keys) != 2 || ipStore.Count() != 5 {
+		t.Errorf("dry run matched %v and left %d keys, want 2 matches and 5 keys", reply.Keys, ipStore.Count())
+	}
+
+	_, reply = post("target=192.0.2.0/24", "secret")
+	if len(reply.Keys) != 2 || ipStore.Count() != 3 {
+		t.Errorf("reset matched %v and left %d keys, want 2 matches and 3 keys", reply.Keys, ipStore.Count())
+	}
+
+	// an address within a grouped network resets the whole network key
+	_, reply = post("target=2001:db8:1:2::42", "secret")
+	if len(reply.Keys) != 1 || reply.Keys[0] != "2001:db8:1:2::/64" {
+		t.Errorf("reset of grouped address matched %v", reply.Keys)
+	}
+}
+
+func TestRecipientDomainHandler(t *testing.T) {
+	saved := rcptDomainStore
+	defer func() { rcptDomainStore = saved }()
+	rcptDomainStore = newMemoryBackend()
+	rcptDomainStore.Append("example.org", Scoring{Timestamp: time.Now(), Score: 1.0, RcptCount: 3})
+	rcptDomainStore.Append("example.org", Scoring{Timestamp: time.Now(), Score: 0.0, RcptCount: 1})
+
+	rec := httptest.NewRecorder()
+	recipientDomainHandler(rec, httptest.NewRequest(http.MethodGet, "/recipient-domain?domain=Example.org", nil))
+	var reply recipientDomainReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Samples != 2 || reply.Recipients != 4 || math.Abs(reply.Acceptance-0.5) > 1e-6 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	rec = httptest.NewRecorder()
+	recipientDomainHandler(rec, httptest.NewRequest(http.MethodGet, "/recipient-domain?domain=example.net", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown domain = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	now := time.Now()
+	for i, score := range []float64{0.9, 0.1, 0.5, 0.3} {
+		for j := 0; j < 6; j++ {
+			ipStore.Append(fmt.Sprintf("192.0.2.%d", i), Scoring{Timestamp: now, Score: score})
+		}
+	}
+	ipStore.Append("192.0.2.42", Scoring{Timestamp: now, Score: 0.0})
+	savedHelos := heloAddresses
+	defer func() { heloAddresses = savedHelos }()
+	heloAddresses = newHeloTracker()
+	for i := 0; i < 3; i++ {
+		heloAddresses.record("mail.example.org", fmt.Sprintf("192.0.2.%d", i), now, time.Hour)
+	}
+	heloAddresses.record("mx.example.com", "192.0.2.1", now, time.Hour)
+
+	get := func(query string) (*httptest.ResponseRecorder, statsReply) {
+		rec := httptest.NewRecorder()
+		statsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats?"+query, nil))
+		var reply statsReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		return rec, reply
+	}
+
+	_, reply := get("n=2")
+	if reply.Keys != 5 || len(reply.Worst) != 2 || len(reply.Best) != 2 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if reply.Worst[0].Key != "192.0.2.1" || reply.Worst[1].Key != "192.0.2.3" {
+		t.Errorf("worst = %v, want 192.0.2.1 then 192.0.2.3", reply.Worst)
+	}
+	if reply.Best[0].Key != "192.0.2.0" || reply.Best[1].Key != "192.0.2.2" {
+		t.Errorf("best = %v, want 192.0.2.0 then 192.0.2.2", reply.Best)
+	}
+	if len(reply.SharedHelos) != 2 || reply.SharedHelos[0] != (heloStats{Name: "mail.example.org", Addresses: 3}) {
+		t.Errorf("shared-helos = %v, want mail.example.org first with 3 addresses", reply.SharedHelos)
+	}
+	if reply.Worst[0].Samples != 6 {
+		t.Errorf("samples = %d, want 6", reply.Worst[0].Samples)
+	}
+
+	if _, reply := get(""); len(reply.Worst) != 4 {
+		t.Errorf("default n returned %d keys, want the 4 judged ones", len(reply.Worst))
+	}
+	if rec, _ := get("n=zero"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid n = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	saved := ipStore
+	defer func() { ipStore = saved }()
+	ipStore = newMemoryBackend()
+	ipStore.Append("192.0.2.4", Scoring{Timestamp: time.Now(), Score: 0.8})
+	savedPrune := lastPrune.Load()
+	defer lastPrune.Store(savedPrune)
+	lastPrune.Store(nil)
+
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /healthz = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var reply healthReply
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Keys != 1 || !reply.Backend || reply.LastPrune != nil {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	pruned := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	lastPrune.Store(&pruned)
+	rec = httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	reply = healthReply{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.LastPrune == nil || !reply.LastPrune.Equal(pruned) {
+		t.Errorf("last prune = %v, want %v", reply.LastPrune, pruned)
+	}
+
+	db, err := openSqlite(filepath.Join(t.TempDir(), "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := newSqliteBackend(db, "ip_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipStore = newCachedBackend(backend)
+	db.Close()
+
+	rec = httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz with a closed database = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	reply = healthReply{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Backend || reply.Error == "" {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestReputationPinned(t *testing.T) {
+	savedStore, savedPins := ipStore, pins
+	defer func() { ipStore, pins = savedStore, savedPins }()
+	ipStore = newMemoryBackend()
+	for i := 0; i < 10; i++ {
+		ipStore.Append("192.0.2.4", Scoring{Timestamp: time.Now(), Score: 0.0})
+	}
+	path := filepath.Join(t.TempDir(), "pins")
+	if err := os.WriteFile(path, []byte("192.0.2.0/24 0.9\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pins = &pinList{}
+	if err := pins.load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pinned score is reported rather than the history, and pinned
+	// addresses without history are found all the same
+	for _, ip := range []string{"192.0.2.4", "192.0.2.5"} {
+		reply, exists := lookupReputation(net.ParseIP(ip))
+		if !exists || reply.Score != 0.9 || reply.Pinned != "192.0.2.0/24" || reply.Grace {
+			t.Errorf("reputation of pinned %s = %+v, %v, want the pinned score", ip, reply, exists)
+		}
+	}
+	if reply, _ := lookupReputation(net.ParseIP("192.0.2.4")); reply.Samples != 10 {
+		t.Errorf("pinned address with history reported %d samples, want 10", reply.Samples)
+	}
+	if _, exists := lookupReputation(net.ParseIP("198.51.100.1")); exists {
+		t.Errorf("unpinned address without history found")
+	}
+}
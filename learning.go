@@ -0,0 +1,90 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+// warmup is the learning period following the start of the filter, during
+// which sessions are scored and recorded but no decision is enforced, as in
+// dry-run mode, so that a new deployment builds some history before judging
+// anyone. It ends once its period has elapsed or its number of sessions has
+// been recorded, whichever comes first.
+type warmup struct {
+	mutex   sync.Mutex
+	active  bool
+	until   time.Time // zero if not bounded in time
+	target  int       // zero if not bounded in sessions
+	samples int
+}
+
+var learning = &warmup{}
+
+// start begins a learning period of period or samples sessions from
+// timestamp, a zero bound being ignored. Nothing is learnt if both are zero.
+func (w *warmup) start(timestamp time.Time, period time.Duration, samples int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.active = period > 0 || samples > 0
+	w.until = time.Time{}
+	if period > 0 {
+		w.until = timestamp.Add(period)
+	}
+	w.target = samples
+	w.samples = 0
+}
+
+// record counts a recorded session, which may end the learning period.
+func (w *warmup) record() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.active {
+		return
+	}
+	w.samples++
+	if w.target > 0 && w.samples >= w.target {
+		w.end("samples")
+	}
+}
+
+// ongoing reports whether the filter is still learning at timestamp.
+func (w *warmup) ongoing(timestamp time.Time) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.active && !w.until.IsZero() && !timestamp.Before(w.until) {
+		w.end("period")
+	}
+	return w.active
+}
+
+// end ends the learning period, the mutex must be held.
+func (w *warmup) end(reason string) {
+	w.active = false
+	mode := "enforce"
+	if dryRun {
+		mode = "dry-run"
+	}
+	logger.Warn("learning-end", "reason", reason, "samples", w.samples, "mode", mode)
+}
+
+// enforcing reports whether decisions are enforced, neither in dry-run mode
+// nor learning.
+func enforcing() bool {
+	return !dryRun && !learning.ongoing(now())
+}
@@ -0,0 +1,78 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLearningPeriod(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	savedDryRun, savedLearning := dryRun, learning
+	defer func() { dryRun, learning = savedDryRun, savedLearning }()
+	dryRun = false
+	learning = &warmup{}
+
+	learning.start(*clock, time.Hour, 0)
+	if enforcing() {
+		t.Errorf("decisions enforced while learning")
+	}
+	if v, _ := enforce(verdict{"disconnect", "554 5.7.1 Connection refused: poor reputation"}, 0); v.action != "proceed" {
+		t.Errorf("enforced %s while learning", v.action)
+	}
+	for i := 0; i < 1000; i++ {
+		learning.record()
+	}
+	if enforcing() {
+		t.Errorf("sessions ended a learning period bounded in time only")
+	}
+
+	*clock = clock.Add(time.Hour)
+	if !enforcing() {
+		t.Errorf("decisions not enforced once the period elapsed")
+	}
+
+	dryRun = true
+	if enforcing() {
+		t.Errorf("decisions enforced in dry-run mode after learning")
+	}
+}
+
+func TestLearningSamples(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	savedDryRun, savedLearning := dryRun, learning
+	defer func() { dryRun, learning = savedDryRun, savedLearning }()
+	dryRun = false
+	learning = &warmup{}
+
+	learning.start(*clock, 24*time.Hour, 3)
+	learning.record()
+	learning.record()
+	if enforcing() {
+		t.Errorf("decisions enforced before enough sessions were recorded")
+	}
+	learning.record()
+	if !enforcing() {
+		t.Errorf("decisions not enforced once enough sessions were recorded")
+	}
+
+	learning.start(*clock, 0, 0)
+	if !enforcing() {
+		t.Errorf("learning without bounds")
+	}
+}
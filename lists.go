@@ -0,0 +1,216 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// networkList is a set of networks read from a file holding one address or
+// CIDR per line. Empty lines and anything following a # are ignored.
+type networkList struct {
+	mutex    sync.RWMutex
+	path     string
+	networks []*net.IPNet
+}
+
+var whitelist = &networkList{}
+var blacklist = &networkList{}
+
+func (l *networkList) load(path string) error {
+	networks := make([]*net.IPNet, 0)
+	err := scanList(path, func(line string) error {
+		network, err := parseNetwork(line)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.path = path
+	l.networks = networks
+	l.mutex.Unlock()
+	return nil
+}
+
+// reload reads the list again from the file it was loaded from, keeping the
+// current entries if that fails.
+func (l *networkList) reload() error {
+	l.mutex.RLock()
+	path := l.path
+	l.mutex.RUnlock()
+	if path == "" {
+		return nil
+	}
+	return l.load(path)
+}
+
+// match returns the network containing ip, or nil.
+func (l *networkList) match(ip net.IP) *net.IPNet {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+func (l *networkList) len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.networks)
+}
+
+// scanList calls fn with each line of the file at path, stripped of
+// comments and surrounding spaces, skipping the empty ones.
+func scanList(path string, fn func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// pin is a reputation fixed for the addresses of a network.
+type pin struct {
+	network *net.IPNet
+	score   float64
+}
+
+// pinList is a set of pins read from a file holding an address or CIDR and
+// a score per line, with the same syntax as a networkList.
+type pinList struct {
+	mutex sync.RWMutex
+	path  string
+	pins  []pin
+}
+
+var pins = &pinList{}
+
+func (l *pinList) load(path string) error {
+	pins := make([]pin, 0)
+	err := scanList(path, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected an address and a score")
+		}
+		network, err := parseNetwork(fields[0])
+		if err != nil {
+			return err
+		}
+		score, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid score %s", fields[1])
+		}
+		pins = append(pins, pin{network: network, score: score})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.path = path
+	l.pins = pins
+	l.mutex.Unlock()
+	return nil
+}
+
+// reload reads the pins again from the file they were loaded from, keeping
+// the current ones if that fails.
+func (l *pinList) reload() error {
+	l.mutex.RLock()
+	path := l.path
+	l.mutex.RUnlock()
+	if path == "" {
+		return nil
+	}
+	return l.load(path)
+}
+
+// match returns the most specific pin containing ip, or false.
+func (l *pinList) match(ip net.IP) (pin, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	best, found := pin{}, false
+	for _, p := range l.pins {
+		if !p.network.Contains(ip) {
+			continue
+		}
+		if !found || prefixLength(p.network) > prefixLength(best.network) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
+func (l *pinList) len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.pins)
+}
+
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetworkList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	content := "# comment\n\n192.0.2.0/24\n198.51.100.7 # single address\n2001:db8::/32\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &networkList{}
+	if err := l.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.len(); n != 3 {
+		t.Fatalf("expected 3 networks, got %d", n)
+	}
+
+	tests := []struct {
+		ip    string
+		match bool
+	}{
+		{"192.0.2.42", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, test := range tests {
+		if got := l.match(net.ParseIP(test.ip)) != nil; got != test.match {
+			t.Errorf("match(%s) = %v, want %v", test.ip, got, test.match)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("not-an-address\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.reload(); err == nil {
+		t.Fatalf("expected reload of an invalid list to fail")
+	}
+	if n := l.len(); n != 3 {
+		t.Fatalf("expected failed reload to keep 3 networks, got %d", n)
+	}
+}
+
+func TestPinList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins")
+	content := "# relays\n192.0.2.0/24 0.25\n192.0.2.7 0.9 # known good\n2001:db8::/32 0.1\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &pinList{}
+	if err := l.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.len(); n != 3 {
+		t.Fatalf("expected 3 pins, got %d", n)
+	}
+
+	tests := []struct {
+		ip    string
+		match bool
+		score float64
+	}{
+		{"192.0.2.42", true, 0.25},
+		{"192.0.2.7", true, 0.9},
+		{"198.51.100.7", false, 0},
+		{"2001:db8:1::1", true, 0.1},
+	}
+	for _, test := range tests {
+		p, ok := l.match(net.ParseIP(test.ip))
+		if ok != test.match || p.score != test.score {
+			t.Errorf("match(%s) = %v, %v, want %v, %v", test.ip, p.score, ok, test.score, test.match)
+		}
+	}
+	if _, ok := l.match(nil); ok {
+		t.Errorf("match(nil) matched")
+	}
+
+	for _, invalid := range []string{"192.0.2.1\n", "192.0.2.1 high\n", "not-an-address 0.5\n"} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.reload(); err == nil {
+			t.Errorf("reload of %q succeeded", invalid)
+		}
+	}
+	if n := l.len(); n != 3 {
+		t.Fatalf("expected failed reloads to keep 3 pins, got %d", n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"strings"
+)
+
+// addressLocalPart returns the local part of an address, lowercased and
+// without its sub-address, or an empty string for the null sender.
+func addressLocalPart(address string) string {
+	address = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(address), "<"), ">")
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return ""
+	}
+	local, _, _ := strings.Cut(strings.ToLower(address[:at]), "+")
+	return local
+}
+
+// localPartEntropy returns the highest Shannon entropy, in bits per
+// character, of the tokens of local separated by '.', '-' or '_'. Entropy
+// grows with length, so that names such as christopher.williamson would
+// otherwise look as random as any generated string: scored token by token,
+// only a long run of mostly distinct characters does.
+func localPartEntropy(local string) float64 {
+	highest := 0.0
+	tokens := strings.FieldsFunc(local, func(r rune) bool { return r == '.' || r == '-' || r == '_' })
+	for _, token := range tokens {
+		highest = math.Max(highest, tokenEntropy(token))
+	}
+	return highest
+}
+
+// tokenEntropy returns the Shannon entropy of token, in bits per character.
+func tokenEntropy(token string) float64 {
+	counts := make(map[rune]int)
+	n := 0
+	for _, r := range token {
+		counts[r]++
+		n++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// randomLocalPart reports whether the local part of address looks randomly
+// generated: digit-heavy, without any vowel or of high entropy. Local parts
+// shorter than min-length, encoded ones such as SRS and VERP addresses,
+// which hold a '=', and those starting with an exempt prefix, as used by
+// mailing lists and bounces, never do.
+func randomLocalPart(address string, localParts *LocalParts) bool {
+	local := addressLocalPart(address)
+	if len(local) < localParts.MinLength || strings.Contains(local, "=") {
+		return false
+	}
+	for _, prefix := range localParts.Exempt {
+		if strings.HasPrefix(local, prefix) {
+			return false
+		}
+	}
+
+	letters, digits, vowels := 0, 0, 0
+	for _, r := range local {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'a' && r <= 'z':
+			letters++
+			if strings.ContainsRune("aeiouy", r) {
+				vowels++
+			}
+		}
+	}
+	switch {
+	case letters+digits == 0:
+		return false
+	case float64(digits)/float64(letters+digits) > localParts.DigitRatio:
+		return true
+	case letters >= localParts.MinLength/2 && vowels == 0:
+		return true
+	}
+	return localPartEntropy(local) >= localParts.Entropy
+}
+
+// scoreLocalParts returns the penalty for a transaction with a random
+// looking sender, and as much more if any of its recipients looked random.
+func scoreLocalParts(tx *Transaction, localParts *LocalParts) float64 {
+	penalty := 0.0
+	if tx.randomSender {
+		penalty += localParts.Penalty
+	}
+	if tx.randomRecipients > 0 {
+		penalty += localParts.Penalty
+	}
+	return penalty
+}
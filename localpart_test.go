@@ -0,0 +1,94 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddressLocalPart(t *testing.T) {
+	for address, want := range map[string]string{
+		"<Alice@example.org>":       "alice",
+		"alice+lists@example.org":   "alice",
+		"\"odd@local\"@example.org": "\"odd@local\"",
+		"<>":                        "",
+		"alice":                     "",
+	} {
+		if got := addressLocalPart(address); got != want {
+			t.Errorf("addressLocalPart(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
+
+func TestRandomLocalPart(t *testing.T) {
+	localParts := &defaultConfig().LocalParts
+	random := []string{
+		"x7k2q9vz3m8w@example.org",
+		"qwxzrtplkj@example.org",
+		"8472910384@example.org",
+		"a9f3k2m8z7q1x5b6@example.org",
+		"kfjdhgwuiqoeyrtb@example.org",
+		"<QZ8XK3JW7PLM@example.org>",
+	}
+	human := []string{
+		"alice@example.org",
+		"bob@example.org",
+		"john.smith@example.org",
+		"jean-pierre.dupont@example.org",
+		"christopher.robinson@example.org",
+		"christopher.williamson@example.org",
+		"alexandra.papadopoulou@example.org",
+		"jean-baptiste.dupont@example.org",
+		"maximilian_schwarzenberger@example.org",
+		"h.jones1981@example.org",
+		"info2024@example.org",
+		"alice+x7k2q9vz3m8w@example.org",
+		"postmaster@example.org",
+		"mailer-daemon@example.org",
+		"noreply-8f3k2m9x@example.org",
+		"bounces-x7k2q9vz3m8w@lists.example.org",
+		"srs0=x7k2=q9=example.org=alice@example.net",
+		"prvs=4829174ab3=alice@example.org",
+		"<>",
+	}
+	for _, address := range random {
+		if !randomLocalPart(address, localParts) {
+			t.Errorf("%s doesn't look random, entropy %.02f", address, localPartEntropy(addressLocalPart(address)))
+		}
+	}
+	for _, address := range human {
+		if randomLocalPart(address, localParts) {
+			t.Errorf("%s looks random, entropy %.02f", address, localPartEntropy(addressLocalPart(address)))
+		}
+	}
+}
+
+func TestScoreLocalParts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LocalParts.Enabled = true
+	human := &Transaction{mailFromOK: true, rcptToOK: 1}
+	random := &Transaction{mailFromOK: true, rcptToOK: 1}
+	random.randomSender = true
+	if got := scoreTransaction(human, cfg) - scoreTransaction(random, cfg); math.Abs(got-cfg.LocalParts.Penalty) > 1e-9 {
+		t.Errorf("random sender penalty = %.04f, want %.04f", got, cfg.LocalParts.Penalty)
+	}
+	random.randomRecipients = 3
+	if got := scoreLocalParts(random, &cfg.LocalParts); math.Abs(got-2*cfg.LocalParts.Penalty) > 1e-9 {
+		t.Errorf("random sender and recipients penalty = %.04f, want %.04f", got, 2*cfg.LocalParts.Penalty)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logger is where every event of the filter is logged, as text by default.
+// Messages are short event names, details go in attributes.
+var logger = slog.New(newLogHandler(os.Stderr, "text"))
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch a.Key {
+				case slog.MessageKey:
+					a.Key = "event"
+				case slog.TimeKey:
+					a.Key = "timestamp"
+				}
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogger switches the logger to format, either "text" or "json".
+func setupLogger(w io.Writer, format string) error {
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	logger = slog.New(newLogHandler(w, format))
+	return nil
+}
+
+// syslogFacilities maps the facility names accepted by -syslog-facility to
+// their value.
+var syslogFacilities = map[string]syslog.Priority{
+	"mail":   syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// syslogWriter is the part of *syslog.Writer used to log a line with the
+// severity of its event.
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// levelWriter writes each line it is given to syslog with the severity of
+// the event being logged, lines being written one at a time.
+type levelWriter struct {
+	mutex sync.Mutex
+	w     syslogWriter
+	level slog.Level
+}
+
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch {
+	case lw.level >= slog.LevelError:
+		err = lw.w.Err(line)
+	case lw.level >= slog.LevelWarn:
+		err = lw.w.Warning(line)
+	case lw.level >= slog.LevelInfo:
+		err = lw.w.Info(line)
+	default:
+		err = lw.w.Debug(line)
+	}
+	return len(p), err
+}
+
+// syslogHandler formats events like the stderr handlers and hands them to a
+// levelWriter along with their level.
+type syslogHandler struct {
+	slog.Handler
+	lw *levelWriter
+}
+
+func newSyslogHandler(w syslogWriter, format string) *syslogHandler {
+	lw := &levelWriter{w: w}
+	return &syslogHandler{Handler: newLogHandler(lw, format), lw: lw}
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.lw.mutex.Lock()
+	defer h.lw.mutex.Unlock()
+	h.lw.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), lw: h.lw}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), lw: h.lw}
+}
+
+// parseFacility returns the syslog facility named name.
+func parseFacility(name string) (syslog.Priority, error) {
+	facility, exists := syslogFacilities[name]
+	if !exists {
+		return 0, fmt.Errorf("unknown syslog facility %s", name)
+	}
+	return facility, nil
+}
+
+// setupSyslog switches the logger to the local syslog daemon, logging lines
+// formatted as format with facility and tag. The logger is left untouched
+// if the daemon can't be reached.
+func setupSyslog(format string, facility syslog.Priority, tag string) error {
+	w, err := syslog.New(facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+	logger = slog.New(newSyslogHandler(w, format))
+	onFinalShutdown(w.Close)
+	return nil
+}
+
+// logSessionDetail makes decisions log the whole state of the session they
+// are taken on, see sessionDetail().
+var logSessionDetail = false
+
+// sessionDetail returns the state of a session as a group of attributes,
+// recording everything the filter knows about it when a decision is taken.
+func sessionDetail(data *SessionData) slog.Value {
+	attrs := []slog.Attr{
+		slog.String("session", data.id),
+		slog.String("ip", data.addr.String()),
+		slog.String("key", data.key),
+		slog.String("address-source", data.addressSource),
+		slog.String("rdns", data.rdns),
+		slog.Bool("fcrdns", data.fcrdns),
+		slog.Uint64("asn", uint64(data.asn)),
+		slog.String("asn-org", data.asnOrg),
+		slog.String("country", data.country),
+		slog.String("profile", data.profile),
+		slog.Time("connect-time", data.connectTime),
+		slog.Duration("elapsed", now().Sub(data.connectTime)),
+		slog.Int("commands", data.commands),
+		slog.Duration("min-gap", data.minGap),
+		slog.Bool("helo", data.cmdHelo),
+		slog.Bool("ehlo", data.cmdEhlo),
+		slog.String("heloname", data.heloname),
+		slog.Int("identifies", data.identifies),
+		slog.Bool("helo-changed", data.heloChanged),
+		slog.Bool("bad-helo", data.badHelo),
+		slog.Int("helo-addresses", data.heloKeys),
+		slog.Bool("tls", data.cmdTLS),
+		slog.String("tls-string", data.tlsString),
+		slog.Bool("auth", data.cmdAuth),
+		slog.Int("auth-successes", data.authok),
+		slog.Int("auth-failures", data.authfail),
+		slog.Int("resets", data.nResets),
+		slog.Int("abandoned", data.nAbandoned),
+		slog.Int("dropped", data.nDropped),
+		slog.Int("extra-transactions", data.extraTxs),
+		slog.Int("rcpt-attempts", data.rcptAttempts),
+		slog.Float64("connect-score", data.connectScore),
+		slog.Int("rate", data.rate),
+		slog.Bool("grace", data.grace),
+		slog.Bool("greylisted", data.greylisted),
+		slog.Bool("auto-blacklisted", data.autoBlacklisted),
+		slog.Bool("harvesting", data.harvesting),
+		slog.Bool("brute-force", data.bruteForce),
+	}
+	if data.blacklisted != nil {
+		attrs = append(attrs, slog.String("blacklisted", data.blacklisted.String()))
+	}
+	if data.pinned != nil {
+		attrs = append(attrs, slog.String("pinned", data.pinned.String()))
+	}
+
+	domains := make([]slog.Attr, 0, len(data.rcptDomains))
+	for domain, count := range data.rcptDomains {
+		domains = append(domains, slog.Group(domain, "ok", count.ok, "failed", count.failed))
+	}
+	attrs = append(attrs, slog.Attr{Key: "rcpt-domains", Value: slog.GroupValue(domains...)})
+
+	transactions := make([]slog.Attr, 0, len(data.transactions))
+	for i, tx := range data.transactions {
+		transactions = append(transactions, slog.Group(fmt.Sprint(i),
+			"begin", tx.beginTime,
+			"mail-from-ok", tx.mailFromOK,
+			"null-sender", tx.nullSender,
+			"mail-domain", tx.mailDomain,
+			"rcpt-ok", tx.rcptToOK,
+			"rcpt-tempfail", tx.rcptToTempfail,
+			"rcpt-permfail", tx.rcptToPermfail,
+			"data", tx.sawData,
+			"committed", tx.committed,
+			"abandoned", tx.abandoned,
+			"dropped", tx.dropped,
+			"size", tx.messageSize,
+		))
+	}
+	attrs = append(attrs, slog.Attr{Key: "transactions", Value: slog.GroupValue(transactions...)})
+	return slog.GroupValue(attrs...)
+}
+
+// fatal logs an error event and exits.
+func fatal(event string, args ...any) {
+	logger.Error(event, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,159 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+
+	var buf bytes.Buffer
+	if err := setupLogger(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("connect", "ip", "192.0.2.1", "score", 0.5)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("json log line %q: %s", buf.String(), err)
+	}
+	if line["event"] != "connect" || line["ip"] != "192.0.2.1" || line["score"] != 0.5 {
+		t.Errorf("unexpected json log line %v", line)
+	}
+	if _, ok := line["timestamp"]; !ok {
+		t.Errorf("json log line has no timestamp: %v", line)
+	}
+
+	buf.Reset()
+	if err := setupLogger(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("connect", "ip", "192.0.2.1")
+	if !strings.Contains(buf.String(), "event=connect ip=192.0.2.1") {
+		t.Errorf("unexpected text log line %q", buf.String())
+	}
+
+	if err := setupLogger(&buf, "xml"); err == nil {
+		t.Errorf("setupLogger accepted an unknown format")
+	}
+}
+
+// fakeSyslog records the lines it is given with their severity.
+type fakeSyslog struct {
+	lines []string
+}
+
+func (f *fakeSyslog) log(severity string, m string) error {
+	f.lines = append(f.lines, severity+" "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Debug(m string) error   { return f.log("debug", m) }
+func (f *fakeSyslog) Info(m string) error    { return f.log("info", m) }
+func (f *fakeSyslog) Warning(m string) error { return f.log("warning", m) }
+func (f *fakeSyslog) Err(m string) error     { return f.log("err", m) }
+
+func TestSyslogHandler(t *testing.T) {
+	w := &fakeSyslog{}
+	l := slog.New(newSyslogHandler(w, "json")).With("ip", "192.0.2.1")
+	l.Info("connect")
+	l.Warn("state-missing")
+	l.Error("sqlite-append-failed")
+
+	if len(w.lines) != 3 {
+		t.Fatalf("expected 3 syslog lines, got %q", w.lines)
+	}
+	for i, severity := range []string{"info", "warning", "err"} {
+		if !strings.HasPrefix(w.lines[i], severity+" {") || strings.HasSuffix(w.lines[i], "\n") {
+			t.Errorf("line %d: expected a %s json line, got %q", i, severity, w.lines[i])
+		}
+		if !strings.Contains(w.lines[i], `"ip":"192.0.2.1"`) {
+			t.Errorf("line %d: attributes lost: %q", i, w.lines[i])
+		}
+	}
+
+	if facility, err := parseFacility("local3"); err != nil || facility != syslog.LOG_LOCAL3 {
+		t.Errorf("parseFacility(local3) = %v, %v", facility, err)
+	}
+	if _, err := parseFacility("kitchen"); err == nil {
+		t.Errorf("parseFacility accepted an unknown facility")
+	}
+}
+
+func TestSessionDetail(t *testing.T) {
+	saved, savedDetail, savedDryRun := logger, logSessionDetail, dryRun
+	defer func() { logger, logSessionDetail, dryRun = saved, savedDetail, savedDryRun }()
+
+	var buf bytes.Buffer
+	if err := setupLogger(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	data := &SessionData{
+		id:          "0123456789abcdef",
+		addr:        net.ParseIP("192.0.2.1"),
+		heloname:    "mx.example.org",
+		cmdTLS:      true,
+		authfail:    3,
+		rcptDomains: map[string]*recipientCount{"example.com": {ok: 1, failed: 2}},
+		transactions: []*Transaction{
+			{mailFromOK: true, rcptToOK: 1, rcptToPermfail: 2},
+		},
+	}
+
+	decode := func() map[string]any {
+		var line map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("json log line %q: %s", buf.String(), err)
+		}
+		buf.Reset()
+		return line
+	}
+
+	logSessionDetail = false
+	decide(data, "reject", "ip", "192.0.2.1")
+	if line := decode(); line["detail"] != nil {
+		t.Errorf("decision logged the session detail without -log-session-detail: %v", line)
+	}
+
+	logSessionDetail, dryRun = true, true
+	decide(data, "reject", "ip", "192.0.2.1")
+	line := decode()
+	if line["event"] != "would-reject" {
+		t.Errorf("dry-run decision logged as %v", line["event"])
+	}
+	detail, _ := line["detail"].(map[string]any)
+	if detail["session"] != data.id || detail["heloname"] != "mx.example.org" || detail["tls"] != true || detail["auth-failures"] != 3.0 {
+		t.Errorf("unexpected session detail %v", detail)
+	}
+	domains, _ := detail["rcpt-domains"].(map[string]any)
+	if domain, _ := domains["example.com"].(map[string]any); domain["failed"] != 2.0 {
+		t.Errorf("unexpected recipient domains %v", detail["rcpt-domains"])
+	}
+	transactions, _ := detail["transactions"].(map[string]any)
+	if tx, _ := transactions["0"].(map[string]any); tx["rcpt-permfail"] != 2.0 || tx["mail-from-ok"] != true {
+		t.Errorf("unexpected transactions %v", detail["transactions"])
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_connections_total",
+		Help: "Number of scored connections.",
+	})
+	rejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_rejected_total",
+		Help: "Number of connections rejected because of a poor reputation.",
+	})
+	deferredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_deferred_total",
+		Help: "Number of connections deferred because of a poor reputation.",
+	})
+	rcptDeferredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_rcpt_deferred_total",
+		Help: "Number of recipients deferred by greylisting.",
+	})
+	harvestRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_harvest_rejected_total",
+		Help: "Number of sessions closed for harvesting recipients.",
+	})
+	decisionsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_grpc_decisions_dropped_total",
+		Help: "Number of connect decisions dropped for slow gRPC subscribers.",
+	})
+	blacklistHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_blacklist_hits",
+		Help: "Number of connections rejected because of the blacklist.",
+	})
+	autoBlacklistHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_auto_blacklist_hits",
+		Help: "Number of connections rejected because of the auto-blacklist.",
+	})
+	authFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_auth_failures_total",
+		Help: "Number of failed authentications.",
+	})
+	bruteForceTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_brute_force_total",
+		Help: "Number of sessions detected brute-forcing credentials.",
+	})
+	recipientLimitHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_recipient_limit_hits",
+		Help: "Number of recipients deferred because of the recipient limit.",
+	})
+	recipientCapHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_recipient_cap_hits",
+		Help: "Number of transactions refused at DATA because of the recipient cap.",
+	})
+	dnsCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reputation_dns_cache_lookups_total",
+		Help: "Number of DNS lookups by cache result, hit or miss.",
+	}, []string{"result"})
+	dependencyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reputation_dependency_failures_total",
+		Help: "Number of failures of external dependencies by dependency, storage or dnsbl.",
+	}, []string{"dependency"})
+	dnsLookupsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reputation_dns_lookups_dropped_total",
+		Help: "Number of DNS lookups given up waiting for a slot under max-in-flight.",
+	})
+	transactionTime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reputation_transaction_duration_seconds",
+		Help:    "Time from MAIL FROM to the commit or rollback of transactions.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+	connectScore = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reputation_connect_score",
+		Help:    "Reputation score computed at connect time.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 9),
+	})
+	connectScoreBuckets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reputation_connect_score_buckets_total",
+		Help: "Number of connections by connect score bucket of the distribution report.",
+	}, []string{"bucket"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reputation_tracked_ips",
+		Help: "Number of address keys with a scoring history.",
+	}, func() float64 {
+		return float64(ipStore.Count())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reputation_auto_blacklisted_keys",
+		Help: "Number of keys on the auto-blacklist.",
+	}, func() float64 {
+		return float64(autoBlacklisted.len())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reputation_dns_cache_entries",
+		Help: "Number of DNS answers cached.",
+	}, func() float64 {
+		return float64(dnsResults.len())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "reputation_dns_lookups_in_flight",
+		Help: "Number of DNS lookups currently sent to the resolver.",
+	}, func() float64 {
+		return float64(dnsLookups.len())
+	})
+)
@@ -0,0 +1,153 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Profile overrides the thresholds, weights and mandatory TLS policy for the
+// sessions connecting to one of the Listen addresses. The filter protocol doesn't tell which
+// listener a session came through, so listeners are told apart by the local
+// address sessions connect to: "587", ":587", "192.0.2.1:25" or
+// "[2001:db8::1]:25", a port alone matching any address.
+type Profile struct {
+	Name       string         `toml:"name"`
+	Listen     []string       `toml:"listen"`
+	Thresholds toml.Primitive `toml:"thresholds"`
+	Weights    toml.Primitive `toml:"weights"`
+
+	MandatoryTLS toml.Primitive `toml:"mandatory-tls"`
+
+	listeners []listener
+	config    *Config
+}
+
+// listener is a local address sessions connect to, a nil ip matching any
+// address.
+type listener struct {
+	ip   net.IP
+	port int
+}
+
+func parseListener(s string) (listener, error) {
+	host, port := "", s
+	if _, err := strconv.Atoi(s); err != nil {
+		host, port, err = net.SplitHostPort(s)
+		if err != nil {
+			return listener{}, err
+		}
+	}
+
+	l := listener{}
+	if host != "" {
+		if l.ip = net.ParseIP(host); l.ip == nil {
+			return listener{}, fmt.Errorf("invalid address %s", host)
+		}
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return listener{}, fmt.Errorf("invalid port %s", port)
+	}
+	l.port = n
+	return l, nil
+}
+
+func (l listener) match(addr *net.TCPAddr) bool {
+	return addr.Port == l.port && (l.ip == nil || l.ip.Equal(addr.IP))
+}
+
+// buildProfiles derives the configuration of each profile from cfg, the
+// thresholds, weights and mandatory TLS policy of the profile being decoded
+// over those of cfg so that a profile only lists what it changes.
+func (cfg *Config) buildProfiles(md toml.MetaData) error {
+	names := make(map[string]bool)
+	for i := range cfg.Profiles {
+		p := &cfg.Profiles[i]
+		if p.Name == "" {
+			return fmt.Errorf("profile %d has no name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate profile %s", p.Name)
+		}
+		names[p.Name] = true
+
+		if len(p.Listen) == 0 {
+			return fmt.Errorf("profile %s has no listen address", p.Name)
+		}
+		p.listeners = make([]listener, 0, len(p.Listen))
+		for _, s := range p.Listen {
+			l, err := parseListener(s)
+			if err != nil {
+				return fmt.Errorf("profile %s: listen %s: %s", p.Name, s, err)
+			}
+			p.listeners = append(p.listeners, l)
+		}
+
+		config := *cfg
+		config.Profiles = nil
+		if err := md.PrimitiveDecode(p.Thresholds, &config.Thresholds); err != nil {
+			return fmt.Errorf("profile %s: %s", p.Name, err)
+		}
+		if err := md.PrimitiveDecode(p.Weights, &config.Weights); err != nil {
+			return fmt.Errorf("profile %s: %s", p.Name, err)
+		}
+		if err := md.PrimitiveDecode(p.MandatoryTLS, &config.MandatoryTLS); err != nil {
+			return fmt.Errorf("profile %s: %s", p.Name, err)
+		}
+		p.config = &config
+	}
+	return nil
+}
+
+// selectProfile returns the name of the profile whose listeners include the
+// local address of a session, or an empty string for the base configuration.
+func (cfg *Config) selectProfile(dest net.Addr) string {
+	addr, ok := dest.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	for _, p := range cfg.Profiles {
+		for _, l := range p.listeners {
+			if l.match(addr) {
+				return p.Name
+			}
+		}
+	}
+	return ""
+}
+
+// profile returns the configuration of the named profile, cfg itself if
+// there is no such profile, as after a reload removing it.
+func (cfg *Config) profile(name string) *Config {
+	for _, p := range cfg.Profiles {
+		if p.Name == name {
+			return p.config
+		}
+	}
+	return cfg
+}
+
+// sessionConfig returns the configuration applying to a session, that of the
+// profile selected when it connected if any.
+func sessionConfig(data *SessionData) *Config {
+	return currentConfig().profile(data.profile)
+}
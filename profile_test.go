@@ -0,0 +1,132 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "filter-reputation.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProfiles(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `
+[thresholds]
+reject = 0.2
+defer = 0.4
+
+[[profiles]]
+name = "submission"
+listen = ["587", "[2001:db8::1]:465"]
+[profiles.thresholds]
+reject = 0.0
+defer = 0.0
+[profiles.weights]
+auth-success = 0.5
+[profiles.mandatory-tls]
+enabled = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dest net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 587}, "submission"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 465}, "submission"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 465}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, ""},
+		{&net.UnixAddr{Name: "/var/run/smtpd.sock"}, ""},
+	}
+	for _, test := range tests {
+		if got := cfg.selectProfile(test.dest); got != test.want {
+			t.Errorf("selectProfile(%s) = %q, want %q", test.dest, got, test.want)
+		}
+	}
+
+	submission := cfg.profile("submission")
+	if submission.Thresholds.Reject != 0 || submission.Thresholds.Defer != 0 || submission.Weights.AuthSuccess != 0.5 {
+		t.Errorf("submission overrides not applied: %+v, auth-success %.02f", submission.Thresholds, submission.Weights.AuthSuccess)
+	}
+	// what a profile doesn't override comes from the base configuration
+	if submission.Weights.TLS != cfg.Weights.TLS || submission.Harvest != cfg.Harvest {
+		t.Errorf("submission doesn't inherit the base configuration")
+	}
+	if !submission.MandatoryTLS.Enabled || submission.MandatoryTLS.Message != cfg.MandatoryTLS.Message {
+		t.Errorf("submission mandatory-tls = %+v, want enabled with the base message", submission.MandatoryTLS)
+	}
+	if cfg.Thresholds.Reject != 0.2 || cfg.Weights.AuthSuccess != defaultConfig().Weights.AuthSuccess || cfg.MandatoryTLS.Enabled {
+		t.Errorf("profile overrides leaked into the base configuration")
+	}
+	if cfg.profile("") != cfg || cfg.profile("removed") != cfg {
+		t.Errorf("unknown profile doesn't fall back to the base configuration")
+	}
+}
+
+func TestProfilesInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unnamed": `
+[[profiles]]
+listen = ["587"]`,
+		"no listen": `
+[[profiles]]
+name = "submission"`,
+		"bad listen": `
+[[profiles]]
+name = "submission"
+listen = ["submission"]`,
+		"duplicate": `
+[[profiles]]
+name = "submission"
+listen = ["587"]
+[[profiles]]
+name = "submission"
+listen = ["465"]`,
+		"invalid thresholds": `
+[[profiles]]
+name = "submission"
+listen = ["587"]
+[profiles.thresholds]
+reject = 0.5
+defer = 0.1`,
+		"unknown key": `
+[[profiles]]
+name = "submission"
+listen = ["587"]
+[profiles.weights]
+authentication = 0.5`,
+	}
+	for name, content := range tests {
+		if _, err := loadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("%s profile was accepted", name)
+		} else if name == "unknown key" && !strings.Contains(err.Error(), "authentication") {
+			t.Errorf("unknown key error %q doesn't name the key", err)
+		}
+	}
+}
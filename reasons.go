@@ -0,0 +1,91 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// explainScores makes the filter explain the scores it computes with reason
+// tokens, logged along with them and returned by the query APIs.
+var explainScores = false
+
+// reasons collects the tokens explaining a score, such as "+tls" or
+// "-authfail:3". A nil *reasons collects nothing so that scoring doesn't pay
+// for explanations unless explainScores is set.
+type reasons struct {
+	tokens []string
+}
+
+// newReasons returns a collector if scores are explained, nil otherwise.
+func newReasons() *reasons {
+	if !explainScores {
+		return nil
+	}
+	return &reasons{}
+}
+
+// add records a term that moved a score by value, as "+name" or "-name"
+// followed by ":count" if count isn't zero. Terms that didn't move the score
+// explain nothing and are left out.
+func (r *reasons) add(name string, count int, value float64) {
+	if r == nil || value == 0 {
+		return
+	}
+	token := "+" + name
+	if value < 0 {
+		token = "-" + name
+	}
+	if count != 0 {
+		token += ":" + strconv.Itoa(count)
+	}
+	r.tokens = append(r.tokens, token)
+}
+
+// note records a token as is, for what informs a score without being one of
+// its terms.
+func (r *reasons) note(format string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.tokens = append(r.tokens, fmt.Sprintf(format, args...))
+}
+
+// list returns the tokens collected, nil for a nil collector.
+func (r *reasons) list() []string {
+	if r == nil {
+		return nil
+	}
+	return r.tokens
+}
+
+// explainScoring returns the tokens explaining the aggregated history of a
+// key, from the counters recorded with its scorings.
+func explainScoring(s Scoring) []string {
+	r := &reasons{}
+	r.add("authok", s.AuthSuccesses, float64(s.AuthSuccesses))
+	r.add("authfail", s.AuthFailures, -float64(s.AuthFailures))
+	r.add("tls", s.TLSCount, float64(s.TLSCount))
+	r.add("rdns", s.RDNSCount, float64(s.RDNSCount))
+	r.add("fcrdns", s.FCrDNSCount, float64(s.FCrDNSCount))
+	r.add("commit", s.CommitCount, float64(s.CommitCount))
+	r.add("rollback", s.RollbackCount, -float64(s.RollbackCount))
+	r.add("reset", s.Resets, -float64(s.Resets))
+	r.add("dropped", s.DroppedCount, -float64(s.DroppedCount))
+	return r.tokens
+}
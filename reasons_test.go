@@ -0,0 +1,83 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestExplainSession(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BruteForce.Failures = 0
+	session := &SessionData{
+		authfail: 3, cmdTLS: true, cmdEhlo: true, heloname: "mail.example.org",
+		rdns: "mail.example.org", fcrdns: true,
+		transactions: []*Transaction{cleanTransaction(), {mailFromOK: true, rcptToOK: 1, rcptToPermfail: 2}},
+	}
+
+	r := &reasons{}
+	if got, want := explainSession(session, cfg, r), scoreSession(session, cfg); math.Abs(got-want) > 1e-9 {
+		t.Errorf("explainSession = %.04f, scoreSession = %.04f", got, want)
+	}
+	want := []string{"+transactions", "-rcptfail:2", "-authfail:3", "+tls", "+rdns", "+fcrdns", "-rollback"}
+	if !slices.Equal(r.list(), want) {
+		t.Errorf("reasons = %v, want %v", r.list(), want)
+	}
+
+	// terms that didn't move the score explain nothing
+	r = &reasons{}
+	explainSession(&SessionData{}, cfg, r)
+	if len(r.list()) != 0 {
+		t.Errorf("reasons of an empty session = %v, want none", r.list())
+	}
+}
+
+func TestReasonsDisabled(t *testing.T) {
+	saved := explainScores
+	defer func() { explainScores = saved }()
+
+	explainScores = false
+	r := newReasons()
+	if r != nil {
+		t.Fatalf("newReasons() = %v with scores unexplained, want nil", r)
+	}
+	r.add("tls", 0, 0.1)
+	r.note("ip:%.2f", 0.5)
+	if r.list() != nil {
+		t.Errorf("nil reasons collected %v", r.list())
+	}
+
+	explainScores = true
+	r = newReasons()
+	r.add("tls", 0, 0.1)
+	r.note("ip:%.2f", 0.5)
+	if want := []string{"+tls", "ip:0.50"}; !slices.Equal(r.list(), want) {
+		t.Errorf("reasons = %v, want %v", r.list(), want)
+	}
+}
+
+func TestExplainScoring(t *testing.T) {
+	s := Scoring{TLSCount: 12, AuthFailures: 40, CommitCount: 3, RcptCount: 9}
+	if got, want := explainScoring(s), []string{"-authfail:40", "+tls:12", "+commit:3"}; !slices.Equal(got, want) {
+		t.Errorf("explainScoring = %v, want %v", got, want)
+	}
+	if got := explainScoring(Scoring{}); len(got) != 0 {
+		t.Errorf("explainScoring of an empty scoring = %v, want none", got)
+	}
+}
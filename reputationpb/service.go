@@ -0,0 +1,197 @@
+package reputationpb
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The messages of reputation.proto are generated by protoc-gen-go, run with
+// go generate. The service is small enough for its client and server stubs
+// to be written out here rather than pulling in protoc-gen-go-grpc.
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative reputation.proto
+
+const (
+	serviceName           = "reputation.Reputation"
+	getReputationMethod   = "/" + serviceName + "/GetReputation"
+	resetReputationMethod = "/" + serviceName + "/ResetReputation"
+	streamDecisionsMethod = "/" + serviceName + "/StreamDecisions"
+)
+
+// ReputationServer is the server API of the Reputation service.
+type ReputationServer interface {
+	GetReputation(context.Context, *GetReputationRequest) (*GetReputationReply, error)
+	ResetReputation(context.Context, *ResetReputationRequest) (*ResetReputationReply, error)
+	StreamDecisions(*StreamDecisionsRequest, Reputation_StreamDecisionsServer) error
+}
+
+// UnimplementedReputationServer answers every call with UNIMPLEMENTED, it
+// can be embedded to implement only part of the service.
+type UnimplementedReputationServer struct{}
+
+func (UnimplementedReputationServer) GetReputation(context.Context, *GetReputationRequest) (*GetReputationReply, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetReputation not implemented")
+}
+
+func (UnimplementedReputationServer) ResetReputation(context.Context, *ResetReputationRequest) (*ResetReputationReply, error) {
+	return nil, status.Error(codes.Unimplemented, "method ResetReputation not implemented")
+}
+
+func (UnimplementedReputationServer) StreamDecisions(*StreamDecisionsRequest, Reputation_StreamDecisionsServer) error {
+	return status.Error(codes.Unimplemented, "method StreamDecisions not implemented")
+}
+
+// Reputation_StreamDecisionsServer is the server side of a StreamDecisions
+// call.
+type Reputation_StreamDecisionsServer interface {
+	Send(*Decision) error
+	grpc.ServerStream
+}
+
+type streamDecisionsServer struct {
+	grpc.ServerStream
+}
+
+func (s *streamDecisionsServer) Send(d *Decision) error {
+	return s.ServerStream.SendMsg(d)
+}
+
+// RegisterReputationServer registers srv as the Reputation service of s.
+func RegisterReputationServer(s grpc.ServiceRegistrar, srv ReputationServer) {
+	s.RegisterService(&Reputation_ServiceDesc, srv)
+}
+
+func getReputationHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := new(GetReputationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReputationServer).GetReputation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: getReputationMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(ReputationServer).GetReputation(ctx, req.(*GetReputationRequest))
+	})
+}
+
+func resetReputationHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := new(ResetReputationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReputationServer).ResetReputation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: resetReputationMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(ReputationServer).ResetReputation(ctx, req.(*ResetReputationRequest))
+	})
+}
+
+func streamDecisionsHandler(srv any, stream grpc.ServerStream) error {
+	in := new(StreamDecisionsRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(ReputationServer).StreamDecisions(in, &streamDecisionsServer{stream})
+}
+
+// Reputation_ServiceDesc describes the Reputation service to grpc.
+var Reputation_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ReputationServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetReputation", Handler: getReputationHandler},
+		{MethodName: "ResetReputation", Handler: resetReputationHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamDecisions", Handler: streamDecisionsHandler, ServerStreams: true},
+	},
+	Metadata: "reputation.proto",
+}
+
+// ReputationClient is the client API of the Reputation service.
+type ReputationClient interface {
+	GetReputation(ctx context.Context, in *GetReputationRequest, opts ...grpc.CallOption) (*GetReputationReply, error)
+	ResetReputation(ctx context.Context, in *ResetReputationRequest, opts ...grpc.CallOption) (*ResetReputationReply, error)
+	StreamDecisions(ctx context.Context, in *StreamDecisionsRequest, opts ...grpc.CallOption) (Reputation_StreamDecisionsClient, error)
+}
+
+type reputationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewReputationClient returns a client of the Reputation service over cc.
+func NewReputationClient(cc grpc.ClientConnInterface) ReputationClient {
+	return &reputationClient{cc}
+}
+
+func (c *reputationClient) GetReputation(ctx context.Context, in *GetReputationRequest, opts ...grpc.CallOption) (*GetReputationReply, error) {
+	out := new(GetReputationReply)
+	if err := c.cc.Invoke(ctx, getReputationMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *reputationClient) ResetReputation(ctx context.Context, in *ResetReputationRequest, opts ...grpc.CallOption) (*ResetReputationReply, error) {
+	out := new(ResetReputationReply)
+	if err := c.cc.Invoke(ctx, resetReputationMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *reputationClient) StreamDecisions(ctx context.Context, in *StreamDecisionsRequest, opts ...grpc.CallOption) (Reputation_StreamDecisionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Reputation_ServiceDesc.Streams[0], streamDecisionsMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &streamDecisionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Reputation_StreamDecisionsClient is the client side of a StreamDecisions
+// call.
+type Reputation_StreamDecisionsClient interface {
+	Recv() (*Decision, error)
+	grpc.ClientStream
+}
+
+type streamDecisionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *streamDecisionsClient) Recv() (*Decision, error) {
+	m := new(Decision)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
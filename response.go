@@ -0,0 +1,158 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poolpOrg/OpenSMTPD-framework/filter"
+)
+
+// The framework answers filter requests synchronously from its dispatch
+// loop, so a callback sleeping or waiting on the network before it returns
+// would stall every session. To answer later instead, stdin is teed before it
+// reaches the framework and the opaque token of each pending filter request
+// is recorded; a callback may then return a nil response, which the framework
+// doesn't answer, and have the result written on its behalf.
+
+var filterTokens = make(map[string]string)
+var filterTokensMutex sync.Mutex
+
+type pendingResponse struct {
+	cancelled bool
+}
+
+var pending = make(map[string]*pendingResponse)
+var pendingMutex sync.Mutex
+
+// interceptStdin tees stdin to the framework, calling onEOF when it is
+// closed.
+func interceptStdin(onEOF func()) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+
+	go func() {
+		defer w.Close()
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "filter|") {
+				// filter|version|timestamp|subsystem|phase|session|token|...
+				atoms := strings.SplitN(line, "|", 8)
+				if len(atoms) >= 7 {
+					filterTokensMutex.Lock()
+					filterTokens[atoms[5]] = atoms[6]
+					filterTokensMutex.Unlock()
+				}
+			}
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return
+			}
+		}
+		onEOF()
+	}()
+	return nil
+}
+
+// verdict is the answer to a filter request, in a form that can either be
+// returned to the framework or written later by respondLater.
+type verdict struct {
+	action  string // "proceed", "reject", "disconnect" or "report"
+	message string
+}
+
+func (v verdict) response() filter.Response {
+	switch v.action {
+	case "disconnect":
+		return filter.Disconnect(v.message)
+	case "reject":
+		return filter.Reject(v.message)
+	case "report":
+		return filter.Report(v.message)
+	}
+	return filter.Proceed()
+}
+
+func (v verdict) String() string {
+	if v.message == "" {
+		return v.action
+	}
+	return v.action + "|" + v.message
+}
+
+// respondLater answers the pending filter request of session with the
+// verdict returned by fn, which runs in its own goroutine. The caller must
+// return a nil response.
+func respondLater(session filter.Session, fn func() verdict) {
+	filterTokensMutex.Lock()
+	token := filterTokens[session.String()]
+	filterTokensMutex.Unlock()
+
+	p := &pendingResponse{}
+	pendingMutex.Lock()
+	pending[session.String()] = p
+	pendingMutex.Unlock()
+
+	go func() {
+		v := fn()
+
+		pendingMutex.Lock()
+		defer pendingMutex.Unlock()
+		if p.cancelled {
+			return
+		}
+		delete(pending, session.String())
+
+		// a single line is written at once, well below PIPE_BUF, so it
+		// can't interleave with the framework's own writes.
+		fmt.Fprintf(os.Stdout, "filter-result|%s|%s|%s\n", session, token, v)
+	}()
+}
+
+// delayResponse answers the pending filter request of session with v after
+// delay. The caller must return a nil response.
+func delayResponse(session filter.Session, delay time.Duration, v verdict) {
+	respondLater(session, func() verdict {
+		time.Sleep(delay)
+		return v
+	})
+}
+
+// cancelPending drops the pending response of a session that is gone, as
+// OpenSMTPD no longer expects it.
+func cancelPending(session filter.Session) {
+	pendingMutex.Lock()
+	if p, exists := pending[session.String()]; exists {
+		p.cancelled = true
+		delete(pending, session.String())
+	}
+	pendingMutex.Unlock()
+
+	filterTokensMutex.Lock()
+	delete(filterTokens, session.String())
+	filterTokensMutex.Unlock()
+}
@@ -0,0 +1,120 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown is set once the filter starts shutting down, new sessions are
+// no longer scored from then on.
+var shuttingDown atomic.Bool
+
+var shutdownHooks []func() error
+var finalHooks []func() error
+var shutdownOnce sync.Once
+
+// onShutdown registers fn to flush or close something before the filter
+// exits, hooks run in the order they were registered.
+func onShutdown(fn func() error) {
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// onFinalShutdown registers fn to run once the shutdown is over, after the
+// other hooks and the last lines logged, as closing the log output must.
+func onFinalShutdown(fn func() error) {
+	finalHooks = append(finalHooks, fn)
+}
+
+// exit runs the final hooks and exits with code.
+func exit(code int) {
+	for _, hook := range finalHooks {
+		hook()
+	}
+	os.Exit(code)
+}
+
+// handleSignals shuts the filter down on SIGINT or SIGTERM.
+func handleSignals(timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("shutdown", "signal", sig.String())
+		shutdown(timeout)
+	}()
+}
+
+// shutdown gives in-flight responses half of timeout to be written, then
+// runs the shutdown hooks and exits. The filter exits with an error if the
+// hooks fail or don't complete within timeout.
+func shutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		shuttingDown.Store(true)
+
+		done := make(chan bool, 1)
+		go func() {
+			drainPending(timeout / 2)
+			ok := true
+			for _, hook := range shutdownHooks {
+				if err := hook(); err != nil {
+					logger.Error("shutdown-hook-failed", "error", err)
+					ok = false
+				}
+			}
+			done <- ok
+		}()
+
+		select {
+		case ok := <-done:
+			if !ok {
+				exit(1)
+			}
+			logger.Info("shutdown-complete")
+			exit(0)
+		case <-time.After(timeout):
+			logger.Error("shutdown-timeout", "timeout", timeout)
+			exit(1)
+		}
+	})
+	// another goroutine is shutting down, wait for it to exit
+	select {}
+}
+
+// drainPending waits for the pending responses to be written, at most for
+// timeout.
+func drainPending(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pendingMutex.Lock()
+		n := len(pending)
+		pendingMutex.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			logger.Warn("shutdown-pending-dropped", "responses", n)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
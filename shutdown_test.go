@@ -0,0 +1,57 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainPending(t *testing.T) {
+	p := &pendingResponse{}
+	pendingMutex.Lock()
+	pending["drain-test"] = p
+	pendingMutex.Unlock()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pendingMutex.Lock()
+		delete(pending, "drain-test")
+		pendingMutex.Unlock()
+	}()
+
+	start := time.Now()
+	drainPending(time.Second)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("drained in %s, want right after the response was written", elapsed)
+	}
+
+	pendingMutex.Lock()
+	pending["drain-test"] = p
+	pendingMutex.Unlock()
+	defer func() {
+		pendingMutex.Lock()
+		delete(pending, "drain-test")
+		pendingMutex.Unlock()
+	}()
+
+	start = time.Now()
+	drainPending(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("drain with a stuck response took %s, want bounded by its timeout", elapsed)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// snapshotStore persists the state of the filter other than the scoring
+// histories, such as the auto-blacklist, as named snapshots kept alongside
+// the histories by the storage backend.
+type snapshotStore interface {
+	// loadSnapshot returns the snapshot saved as name, nil if none was.
+	loadSnapshot(name string) ([]byte, error)
+	saveSnapshot(name string, data []byte) error
+}
+
+// snapshotter is implemented by the structures persisted in the snapshot
+// store. restore drops the entries expired at timestamp and returns how
+// many were kept.
+type snapshotter interface {
+	snapshot() ([]byte, error)
+	restore(data []byte, timestamp time.Time) (int, error)
+}
+
+// snapshots is where the snapshots are persisted, nil if they aren't, as
+// with a memory backend without state file.
+var snapshots snapshotStore
+
+// snapshotGreylist is cleared when the greylist is persisted in a file of
+// its own instead.
+var snapshotGreylist = true
+
+func snapshotted() map[string]snapshotter {
+	structures := map[string]snapshotter{"auto-blacklist": autoBlacklisted}
+	if snapshotGreylist {
+		structures["greylist"] = greylistEntries
+	}
+	return structures
+}
+
+// useSnapshots makes store persist the snapshots, which are saved when the
+// filter shuts down. It must be called before the hook closing store is
+// registered.
+func useSnapshots(store snapshotStore) {
+	snapshots = store
+	onShutdown(saveSnapshots)
+}
+
+// loadSnapshots restores the snapshotted structures, an unreadable snapshot
+// being skipped like a missing state file.
+func loadSnapshots() {
+	if snapshots == nil {
+		return
+	}
+	for name, s := range snapshotted() {
+		data, err := snapshots.loadSnapshot(name)
+		if err != nil {
+			logger.Warn("snapshot-unreadable", "name", name, "error", err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		entries, err := s.restore(data, now())
+		if err != nil {
+			logger.Warn("snapshot-corrupt", "name", name, "error", err)
+			continue
+		}
+		logger.Info("snapshot-load", "name", name, "entries", entries)
+	}
+}
+
+func saveSnapshots() error {
+	if snapshots == nil {
+		return nil
+	}
+	var errs []error
+	for name, s := range snapshotted() {
+		data, err := s.snapshot()
+		if err == nil {
+			err = snapshots.saveSnapshot(name, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func saveSnapshotsLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveSnapshots(); err != nil {
+			logger.Error("snapshot-save-failed", "error", err)
+		}
+	}
+}
+
+// fileSnapshots saves each snapshot of a memory backend next to its state
+// file, as path.name.
+type fileSnapshots struct {
+	path string
+}
+
+func (f fileSnapshots) loadSnapshot(name string) ([]byte, error) {
+	data, err := os.ReadFile(f.path + "." + name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f fileSnapshots) saveSnapshot(name string, data []byte) error {
+	return writeFileAtomic(f.path+"."+name, data)
+}
@@ -0,0 +1,111 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSnapshotStores(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := openSqlite(filepath.Join(dir, "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sqliteStore, err := newSqliteSnapshots(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bdb, err := bolt.Open(filepath.Join(dir, "reputation.bolt"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+	boltStore, err := newBoltSnapshots(bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	stores := map[string]snapshotStore{
+		"file":   fileSnapshots{path: filepath.Join(dir, "state.json")},
+		"sqlite": sqliteStore,
+		"bolt":   boltStore,
+		"redis":  &redisSnapshots{client: client, prefix: "test:snapshot:"},
+	}
+	for name, store := range stores {
+		if data, err := store.loadSnapshot("greylist"); data != nil || err != nil {
+			t.Errorf("%s: missing snapshot = %q, %v, want nil", name, data, err)
+		}
+		for _, saved := range []string{`{"a":1}`, `{"b":2}`} {
+			if err := store.saveSnapshot("greylist", []byte(saved)); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if data, err := store.loadSnapshot("greylist"); !bytes.Equal(data, []byte(saved)) || err != nil {
+				t.Errorf("%s: loaded %q, %v, want %s", name, data, err, saved)
+			}
+		}
+	}
+}
+
+func TestSnapshotsSaveLoad(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	savedStore, savedList, savedGreylist := snapshots, autoBlacklisted, greylistEntries
+	defer func() { snapshots, autoBlacklisted, greylistEntries = savedStore, savedList, savedGreylist }()
+
+	snapshots = fileSnapshots{path: filepath.Join(t.TempDir(), "state.json")}
+	autoBlacklisted = newAutoBlacklist()
+	autoBlacklisted.add("192.0.2.1", clock.Add(time.Hour))
+	autoBlacklisted.add("192.0.2.2", clock.Add(time.Minute))
+	greylistEntries = newGreylist()
+	greylistEntries.check("192.0.2.3", clock.Add(-historyMaxAge()-time.Minute), time.Minute)
+	greylistEntries.check("192.0.2.4", *clock, time.Minute)
+	if err := saveSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart ten minutes later
+	*clock = clock.Add(10 * time.Minute)
+	autoBlacklisted, greylistEntries = newAutoBlacklist(), newGreylist()
+	loadSnapshots()
+
+	if !autoBlacklisted.contains("192.0.2.1", *clock) {
+		t.Errorf("auto-blacklisted key not restored")
+	}
+	if n := autoBlacklisted.len(); n != 1 {
+		t.Errorf("restored %d auto-blacklist entries, want the one not expired", n)
+	}
+	if _, exists := greylistEntries.entries["192.0.2.4"]; !exists {
+		t.Errorf("greylist entry not restored")
+	}
+	if _, exists := greylistEntries.entries["192.0.2.3"]; exists {
+		t.Errorf("greylist entry older than max-age restored")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// loadState populates the ip memory backend from the JSON snapshot at path. A
+// missing or unreadable snapshot is not fatal: the filter starts empty.
+func loadState(b *memoryBackend, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("state-missing", "path", path)
+		} else {
+			logger.Warn("state-unreadable", "path", path, "error", err)
+		}
+		return
+	}
+
+	state := make(map[string][]Scoring)
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Warn("state-corrupt", "path", path, "error", err)
+		return
+	}
+
+	for ip, scoring := range state {
+		if len(scoring) == 0 {
+			delete(state, ip)
+		}
+	}
+
+	b.restore(state)
+
+	logger.Info("state-load", "path", path, "keys", len(state))
+}
+
+// saveState writes a snapshot of the ip memory backend to path. The map is
+// copied under the backend lock but the file I/O happens without holding it,
+// and the file is replaced atomically so that a crash never leaves a truncated
+// snapshot.
+func saveState(b *memoryBackend, path string) error {
+	data, err := json.Marshal(b.snapshot())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data through a synced
+// temporary file, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func saveStateLoop(b *memoryBackend, path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveState(b, path); err != nil {
+			logger.Error("state-save-failed", "path", path, "error", err)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StorageBackend stores the scoring history of a reputation key, be it an
+// address, a reverse DNS name, a HELO name or a sender domain.
+type StorageBackend interface {
+	Append(key string, s Scoring)
+	Load(key string) []Scoring
+	Prune()
+	Count() int
+	Keys() []string
+	Delete(key string)
+}
+
+// averagingBackend is implemented by the backends able to compute the number
+// of recent scorings of a key and their mean score themselves.
+type averagingBackend interface {
+	Average(key string) (int, float64, error)
+}
+
+// checkedBackend is implemented by the backends whose Load may fail, to
+// report the error along with whatever could be loaded.
+type checkedBackend interface {
+	LoadChecked(key string) ([]Scoring, error)
+}
+
+// pingingBackend is implemented by the backends relying on a database server
+// or file that may become unreachable.
+type pingingBackend interface {
+	Ping() error
+}
+
+// pingStore reports whether the database behind store is reachable, stores
+// without one always are.
+func pingStore(store StorageBackend) error {
+	if c, ok := store.(*cachedBackend); ok {
+		store = c.StorageBackend
+	}
+	if p, ok := store.(pingingBackend); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+var ipStore StorageBackend = newMemoryBackend()
+var rdnsStore StorageBackend = newMemoryBackend()
+var heloStore StorageBackend = newMemoryBackend()
+var domainStore StorageBackend = newMemoryBackend()
+var asnStore StorageBackend = newMemoryBackend()
+var rcptDomainStore StorageBackend = newMemoryBackend()
+
+// lastPrune is the time the stores were last pruned, nil until then.
+var lastPrune atomic.Pointer[time.Time]
+
+func pruneLoop() {
+	for {
+		time.Sleep(currentConfig().Storage.PruneInterval.Duration)
+		ipStore.Prune()
+		rdnsStore.Prune()
+		heloStore.Prune()
+		domainStore.Prune()
+		asnStore.Prune()
+		rcptDomainStore.Prune()
+		pruneDNSBLCache()
+		dnsResults.prune(now())
+		connectRates.prune(now())
+		heloAddresses.prune(now().Add(-currentConfig().SharedHelo.Window.Duration))
+		lastReputations.prune(now().Add(-historyMaxAge()))
+		greylistEntries.prune(now().Add(-historyMaxAge()))
+		autoBlacklisted.prune(now())
+		offences.prune(now(), currentConfig().Escalation.HalfLife.Duration)
+		pruned := now()
+		lastPrune.Store(&pruned)
+	}
+}
+
+const storeShards = 256
+
+// now returns the current time, tests replace it with a fake clock to make
+// expiry deterministic.
+var now = time.Now
+
+// historySize returns how many scorings are kept per key.
+func historySize() int {
+	return currentConfig().Storage.HistorySize
+}
+
+// historyMaxAge returns how long a key is kept without a scoring.
+func historyMaxAge() time.Duration {
+	return currentConfig().Storage.MaxAge.Duration
+}
+
+// scoringRing is a fixed-capacity history of scorings, in which the oldest
+// scoring is overwritten once it is full, so that the memory used by a key
+// is bounded when appending rather than lazily trimmed.
+type scoringRing struct {
+	buf   []Scoring
+	start int // index of the oldest scoring
+	n     int
+}
+
+func newScoringRing(capacity int) *scoringRing {
+	return &scoringRing{buf: make([]Scoring, capacity)}
+}
+
+// push appends s, resizing the ring first if capacity changed since the
+// ring was created.
+func (r *scoringRing) push(s Scoring, capacity int) {
+	if capacity != len(r.buf) {
+		r.resize(capacity)
+	}
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = s
+		r.n++
+		return
+	}
+	r.buf[r.start] = s
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+func (r *scoringRing) resize(capacity int) {
+	scorings := r.slice()
+	if len(scorings) > capacity {
+		scorings = scorings[len(scorings)-capacity:]
+	}
+	r.buf = make([]Scoring, capacity)
+	r.start = 0
+	r.n = copy(r.buf, scorings)
+}
+
+// slice returns a copy of the scorings in chronological order.
+func (r *scoringRing) slice() []Scoring {
+	scorings := make([]Scoring, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		scorings = append(scorings, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return scorings
+}
+
+// last returns the most recent scoring, the ring must not be empty.
+func (r *scoringRing) last() Scoring {
+	return r.buf[(r.start+r.n-1)%len(r.buf)]
+}
+
+type storeShard struct {
+	mutex   sync.Mutex
+	scoring map[string]*scoringRing
+}
+
+// shardedStore spreads keys over storeShards maps, each with its own lock, so
+// that sessions for unrelated keys don't contend on a single mutex.
+type shardedStore struct {
+	shards [storeShards]storeShard
+}
+
+func newShardedStore() *shardedStore {
+	s := &shardedStore{}
+	for i := range s.shards {
+		s.shards[i].scoring = make(map[string]*scoringRing)
+	}
+	return s
+}
+
+// shardIndex returns the shard a key belongs to.
+func shardIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % storeShards
+}
+
+func (s *shardedStore) shard(key string) *storeShard {
+	return &s.shards[shardIndex(key)]
+}
+
+func (s *shardedStore) Append(key string, scoring Scoring) {
+	capacity := historySize()
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	ring, exists := shard.scoring[key]
+	if !exists {
+		ring = newScoringRing(capacity)
+		shard.scoring[key] = ring
+	}
+	ring.push(scoring, capacity)
+}
+
+func (s *shardedStore) Load(key string) []Scoring {
+	shard := s.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	ring, exists := shard.scoring[key]
+	if !exists {
+		return nil
+	}
+	return ring.slice()
+}
+
+// Range calls fn with the map of each shard in turn, holding only the lock
+// of that shard. fn may modify the map it is given.
+func (s *shardedStore) Range(fn func(scoring map[string]*scoringRing)) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mutex.Lock()
+		fn(shard.scoring)
+		shard.mutex.Unlock()
+	}
+}
+
+type memoryBackend struct {
+	*shardedStore
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		shardedStore: newShardedStore(),
+	}
+}
+
+// Prune forgets the keys with no event in max-age, histories being bounded
+// on append, then evicts the least recently seen keys past max-keys.
+func (b *memoryBackend) Prune() {
+	expired := 0
+	b.Range(func(scoring map[string]*scoringRing) {
+		for key, ring := range scoring {
+			if ring.n == 0 {
+				delete(scoring, key)
+				continue
+			}
+			if ring.last().Timestamp.Add(historyMaxAge()).Before(now()) {
+				logger.Info("expire", "key", key)
+				delete(scoring, key)
+				expired++
+			}
+		}
+	})
+
+	evicted := 0
+	if maxKeys := currentConfig().Storage.MaxKeys; maxKeys > 0 {
+		evicted = b.evict(maxKeys)
+	}
+	if expired > 0 || evicted > 0 {
+		logger.Info("prune", "expired", expired, "evicted", evicted, "keys", b.Count())
+	}
+}
+
+// lastSeen is the time of the most recent scoring of a key.
+type lastSeen struct {
+	key       string
+	timestamp time.Time
+}
+
+// evict forgets the least recently seen keys until at most maxKeys remain,
+// returning how many were evicted. A key scored again since it was picked
+// is spared.
+func (b *memoryBackend) evict(maxKeys int) int {
+	excess := b.Count() - maxKeys
+	if excess <= 0 {
+		return 0
+	}
+
+	seen := make([]lastSeen, 0, maxKeys+excess)
+	b.Range(func(scoring map[string]*scoringRing) {
+		for key, ring := range scoring {
+			seen = append(seen, lastSeen{key: key, timestamp: ring.last().Timestamp})
+		}
+	})
+	slices.SortFunc(seen, func(a, b lastSeen) int {
+		return a.timestamp.Compare(b.timestamp)
+	})
+
+	evicted := 0
+	for _, candidate := range seen[:min(excess, len(seen))] {
+		shard := b.shard(candidate.key)
+		shard.mutex.Lock()
+		if ring, exists := shard.scoring[candidate.key]; exists && ring.last().Timestamp.Equal(candidate.timestamp) {
+			delete(shard.scoring, candidate.key)
+			evicted++
+		}
+		shard.mutex.Unlock()
+	}
+	return evicted
+}
+
+func (b *memoryBackend) Count() int {
+	count := 0
+	b.Range(func(scoring map[string]*scoringRing) {
+		count += len(scoring)
+	})
+	return count
+}
+
+func (b *memoryBackend) Keys() []string {
+	keys := make([]string, 0)
+	b.Range(func(scoring map[string]*scoringRing) {
+		for key := range scoring {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+func (b *memoryBackend) Delete(key string) {
+	shard := b.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	delete(shard.scoring, key)
+}
+
+// snapshot returns a copy of the stored scorings that can be used without
+// holding the backend locks.
+func (b *memoryBackend) snapshot() map[string][]Scoring {
+	snapshot := make(map[string][]Scoring)
+	b.Range(func(scoring map[string]*scoringRing) {
+		for key, ring := range scoring {
+			snapshot[key] = ring.slice()
+		}
+	})
+	return snapshot
+}
+
+func (b *memoryBackend) restore(scoring map[string][]Scoring) {
+	b.Range(func(shard map[string]*scoringRing) {
+		clear(shard)
+	})
+	capacity := historySize()
+	for key, history := range scoring {
+		ring := newScoringRing(capacity)
+		for _, s := range history {
+			ring.push(s, capacity)
+		}
+		shard := b.shard(key)
+		shard.mutex.Lock()
+		shard.scoring[key] = ring
+		shard.mutex.Unlock()
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBackend stores the scoring history of each key as a JSON list in a
+// bucket of an embedded bbolt database, which survives unclean shutdowns.
+// Several backends may share the same database, each with its own bucket.
+type boltBackend struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltBackend(db *bolt.DB, bucket string) (*boltBackend, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackend{db: db, bucket: []byte(bucket)}, nil
+}
+
+// lastScorings returns the history-size most recent of scorings.
+func lastScorings(scorings []Scoring) []Scoring {
+	if capacity := historySize(); len(scorings) > capacity {
+		return scorings[len(scorings)-capacity:]
+	}
+	return scorings
+}
+
+func decodeScorings(value []byte) ([]Scoring, error) {
+	scorings := make([]Scoring, 0)
+	if value == nil {
+		return scorings, nil
+	}
+	err := json.Unmarshal(value, &scorings)
+	return scorings, err
+}
+
+// Append goes through db.Batch so that concurrent disconnects share a
+// single write transaction. The history is trimmed to history-size as it is
+// rewritten anyway.
+func (b *boltBackend) Append(key string, s Scoring) {
+	err := b.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		scorings, err := decodeScorings(bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(lastScorings(append(scorings, s)))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+	if err != nil {
+		logger.Error("bolt-append-failed", "bucket", string(b.bucket), "key", key, "error", err)
+	}
+}
+
+func (b *boltBackend) Load(key string) []Scoring {
+	scorings, err := b.LoadChecked(key)
+	if err != nil {
+		logger.Error("bolt-load-failed", "bucket", string(b.bucket), "key", key, "error", err)
+		return nil
+	}
+	return scorings
+}
+
+// LoadChecked is Load reporting the errors of the database. Histories
+// written before history-size was lowered are trimmed as they are loaded.
+func (b *boltBackend) LoadChecked(key string) ([]Scoring, error) {
+	var scorings []Scoring
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		scorings, err = decodeScorings(tx.Bucket(b.bucket).Get([]byte(key)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lastScorings(scorings), nil
+}
+
+// Prune keeps the history-size most recent scorings of each key and forgets
+// keys with no event in max-age, like the memory backend.
+func (b *boltBackend) Prune() {
+	capacity := historySize()
+	expired := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+
+		// the bucket can't be modified while it is iterated over
+		deleted := make([][]byte, 0)
+		trimmed := make(map[string][]Scoring)
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			scorings, err := decodeScorings(value)
+			if err != nil || len(scorings) == 0 ||
+				scorings[len(scorings)-1].Timestamp.Add(historyMaxAge()).Before(now()) {
+				deleted = append(deleted, append([]byte(nil), key...))
+			} else if len(scorings) > capacity {
+				trimmed[string(key)] = scorings[len(scorings)-capacity:]
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range deleted {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		for key, scorings := range trimmed {
+			value, err := json.Marshal(scorings)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		expired = len(deleted)
+		return nil
+	})
+	if err != nil {
+		logger.Error("bolt-prune-failed", "bucket", string(b.bucket), "error", err)
+		return
+	}
+	if expired > 0 {
+		logger.Info("expire", "bucket", string(b.bucket), "keys", expired)
+	}
+}
+
+func (b *boltBackend) Count() int {
+	count := 0
+	b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(b.bucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+func (b *boltBackend) Keys() []string {
+	keys := make([]string, 0)
+	b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).ForEach(func(key []byte, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	return keys
+}
+
+func (b *boltBackend) Delete(key string) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+	if err != nil {
+		logger.Error("bolt-delete-failed", "bucket", string(b.bucket), "key", key, "error", err)
+	}
+}
+
+func setupBolt(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	backends := make([]*boltBackend, 0)
+	for _, bucket := range []string{"ip", "rdns", "helo", "domain", "asn", "rcpt_domain"} {
+		backend, err := newBoltBackend(db, bucket)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		backends = append(backends, backend)
+	}
+	ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = backends[0], backends[1], backends[2], backends[3], backends[4], backends[5]
+
+	store, err := newBoltSnapshots(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	useSnapshots(store)
+	onShutdown(db.Close)
+	return nil
+}
+
+// boltSnapshots keeps the snapshots in a bucket of their own.
+type boltSnapshots struct {
+	db *bolt.DB
+}
+
+var snapshotsBucket = []byte("snapshots")
+
+func newBoltSnapshots(db *bolt.DB) (*boltSnapshots, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(snapshotsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshots{db: db}, nil
+}
+
+func (s *boltSnapshots) loadSnapshot(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(snapshotsBucket).Get([]byte(name)); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltSnapshots) saveSnapshot(name string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Put([]byte(name), data)
+	})
+}
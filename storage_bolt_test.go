@@ -0,0 +1,93 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reputation.bolt")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBoltBackend(db, "ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 110; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.Append("192.0.2.1", Scoring{Timestamp: now.Add(time.Duration(i) * time.Second), Score: 0.5})
+		}(i)
+	}
+	wg.Wait()
+	b.Append("192.0.2.2", Scoring{Timestamp: now.Add(-6 * 24 * time.Hour), Score: 0.1})
+
+	// appends keep the history-size most recent scorings
+	if n := len(b.Load("192.0.2.1")); n != 100 {
+		t.Fatalf("loaded %d scorings, want 100", n)
+	}
+
+	// histories written with a larger history-size are trimmed on load
+	savedConfig := currentConfig()
+	defer activeConfig.Store(savedConfig)
+	cfg := defaultConfig()
+	cfg.Storage.HistorySize = 50
+	activeConfig.Store(cfg)
+	if scorings := b.Load("192.0.2.1"); len(scorings) != 50 {
+		t.Errorf("loaded %d scorings with a history-size of 50", len(scorings))
+	}
+	activeConfig.Store(savedConfig)
+
+	b.Prune()
+	if n := len(b.Load("192.0.2.1")); n != 100 {
+		t.Errorf("loaded %d scorings after prune, want 100", n)
+	}
+	if b.Count() != 1 {
+		t.Errorf("count = %d after prune, want 1", b.Count())
+	}
+
+	// reopening the database reloads the same state
+	db.Close()
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b, err = newBoltBackend(db, "ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := b.Keys(); len(keys) != 1 || keys[0] != "192.0.2.1" {
+		t.Errorf("keys after reopen = %v, want [192.0.2.1]", keys)
+	}
+	b.Delete("192.0.2.1")
+	if b.Count() != 0 {
+		t.Errorf("count = %d after delete, want 0", b.Count())
+	}
+}
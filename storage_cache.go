@@ -0,0 +1,113 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"sync"
+)
+
+// cachedReputation is the reputation of a key along with the settings it
+// was derived with.
+type cachedReputation struct {
+	score       float64
+	known       bool
+	aggregation Aggregation
+	grace       Grace
+}
+
+// cachedBackend caches the reputation derived from the history of each key
+// of a backend, so that a key connecting repeatedly doesn't have its whole
+// history loaded and aggregated every time. An entry is dropped when the
+// history of its key changes and the whole cache when the backend prunes.
+// The decay strategy weighs scorings by their age relative to the most
+// recent one, so a cached reputation doesn't go stale as time passes.
+//
+// Only backends owned by a single filter instance can be cached: the
+// histories of a shared backend change behind its back.
+type cachedBackend struct {
+	StorageBackend
+	mutex       sync.Mutex
+	reputations map[string]cachedReputation
+
+	// generation changes with every change of the histories, so that a
+	// reputation loaded while one happened isn't cached stale.
+	generation uint64
+}
+
+func newCachedBackend(b StorageBackend) *cachedBackend {
+	return &cachedBackend{StorageBackend: b, reputations: make(map[string]cachedReputation)}
+}
+
+func (c *cachedBackend) Append(key string, s Scoring) {
+	c.StorageBackend.Append(key, s)
+	c.mutex.Lock()
+	delete(c.reputations, key)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+func (c *cachedBackend) Prune() {
+	c.StorageBackend.Prune()
+	c.mutex.Lock()
+	clear(c.reputations)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+func (c *cachedBackend) Delete(key string) {
+	c.StorageBackend.Delete(key)
+	c.mutex.Lock()
+	delete(c.reputations, key)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+// reputation returns the reputation of key like loadReputation, from the
+// cache if it was derived with the same aggregation and grace settings.
+// Reputations that couldn't be loaded aren't cached, nor are those loaded
+// while the histories changed as they may predate the change.
+func (c *cachedBackend) reputation(key string, cfg *Config) (float64, bool, error) {
+	c.mutex.Lock()
+	cached, exists := c.reputations[key]
+	generation := c.generation
+	c.mutex.Unlock()
+	if exists && cached.aggregation == cfg.Aggregation && cached.grace == cfg.Grace {
+		return cached.score, cached.known, nil
+	}
+
+	score, known, err := loadReputation(c.StorageBackend, key, cfg)
+	if err != nil {
+		return score, known, err
+	}
+	c.mutex.Lock()
+	if c.generation == generation {
+		c.reputations[key] = cachedReputation{score: score, known: known, aggregation: cfg.Aggregation, grace: cfg.Grace}
+	}
+	c.mutex.Unlock()
+	return score, known, nil
+}
+
+// cacheStores caches the reputations of the stores, which must not be
+// shared with other filter instances.
+func cacheStores() {
+	ipStore = newCachedBackend(ipStore)
+	rdnsStore = newCachedBackend(rdnsStore)
+	heloStore = newCachedBackend(heloStore)
+	domainStore = newCachedBackend(domainStore)
+	asnStore = newCachedBackend(asnStore)
+	rcptDomainStore = newCachedBackend(rcptDomainStore)
+}
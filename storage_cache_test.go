@@ -0,0 +1,142 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedBackend(t *testing.T) {
+	cfg := defaultConfig()
+	memory := newMemoryBackend()
+	c := newCachedBackend(memory)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Duration(i) * time.Minute), Score: 0.9})
+	}
+
+	want, _ := storedReputation(memory.Load("192.0.2.1"), cfg)
+	if score, known := keyReputation(c, "192.0.2.1", cfg); !known || score != want {
+		t.Fatalf("reputation = %.04f, %v, want %.04f, true", score, known, want)
+	}
+
+	// a change behind the back of the cache goes unnoticed
+	memory.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Hour), Score: 0.0})
+	if score, _ := keyReputation(c, "192.0.2.1", cfg); score != want {
+		t.Errorf("reputation = %.04f, want the cached %.04f", score, want)
+	}
+
+	// appending through it invalidates the key
+	c.Append("192.0.2.1", Scoring{Timestamp: start.Add(2 * time.Hour), Score: 0.0})
+	want, _ = storedReputation(memory.Load("192.0.2.1"), cfg)
+	if score, _ := keyReputation(c, "192.0.2.1", cfg); score != want {
+		t.Errorf("reputation after append = %.04f, want %.04f", score, want)
+	}
+
+	// as does a change of the aggregation settings
+	reloaded := defaultConfig()
+	reloaded.Aggregation.Strategy = "mean"
+	want, _ = storedReputation(memory.Load("192.0.2.1"), reloaded)
+	if score, _ := keyReputation(c, "192.0.2.1", reloaded); score != want {
+		t.Errorf("reputation after reload = %.04f, want %.04f", score, want)
+	}
+
+	memory.Append("192.0.2.1", Scoring{Timestamp: start.Add(3 * time.Hour), Score: 0.0})
+	c.Prune()
+	want, _ = storedReputation(memory.Load("192.0.2.1"), reloaded)
+	if score, _ := keyReputation(c, "192.0.2.1", reloaded); score != want {
+		t.Errorf("reputation after prune = %.04f, want %.04f", score, want)
+	}
+
+	c.Delete("192.0.2.1")
+	if score, known := keyReputation(c, "192.0.2.1", cfg); known || score != cfg.Aggregation.Prior {
+		t.Errorf("reputation of a deleted key = %.04f, %v, want the prior", score, known)
+	}
+}
+
+// blockingStore is a memory backend whose loads wait for release, to
+// interleave them with appends.
+type blockingStore struct {
+	*memoryBackend
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Load(key string) []Scoring {
+	scorings := s.memoryBackend.Load(key)
+	s.loading <- struct{}{}
+	<-s.release
+	return scorings
+}
+
+func TestCachedBackendAppendDuringLoad(t *testing.T) {
+	cfg := defaultConfig()
+	store := &blockingStore{memoryBackend: newMemoryBackend(), loading: make(chan struct{}), release: make(chan struct{})}
+	c := newCachedBackend(store)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		store.memoryBackend.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Duration(i) * time.Minute), Score: 0.9})
+	}
+
+	// an append landing while the history is loaded must not leave the
+	// reputation loaded before it in the cache
+	done := make(chan float64)
+	go func() {
+		score, _ := keyReputation(c, "192.0.2.1", cfg)
+		done <- score
+	}()
+	<-store.loading
+	c.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Hour), Score: 0.0})
+	close(store.release)
+	stale := <-done
+
+	go func() { <-store.loading }()
+	want, _ := storedReputation(store.memoryBackend.Load("192.0.2.1"), cfg)
+	if score, _ := keyReputation(c, "192.0.2.1", cfg); score != want || score == stale {
+		t.Errorf("reputation after append during load = %.04f, want %.04f", score, want)
+	}
+}
+
+func TestCachedBackendConcurrentAppend(t *testing.T) {
+	cfg := defaultConfig()
+	memory := newMemoryBackend()
+	c := newCachedBackend(memory)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			c.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Duration(i) * time.Second), Score: float64(i%2) * 0.9})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			c.reputation("192.0.2.1", cfg)
+		}
+	}()
+	wg.Wait()
+
+	want, _ := storedReputation(memory.Load("192.0.2.1"), cfg)
+	if score, _ := keyReputation(c, "192.0.2.1", cfg); score != want {
+		t.Errorf("reputation after concurrent appends = %.04f, want %.04f", score, want)
+	}
+}
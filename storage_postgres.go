@@ -0,0 +1,336 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresTimeout bounds every PostgreSQL query, an unreachable server must
+// not hold sessions for longer than that.
+const postgresTimeout = 500 * time.Millisecond
+
+// postgresBackend stores each scoring as a row of table, like the sqlite
+// backend, in a server shared by several filter instances and open to
+// analytics. Appends are fire-and-forget and a failed load yields an empty
+// history, so that a database outage degrades to the neutral prior rather
+// than blocking mail.
+type postgresBackend struct {
+	db      *sql.DB
+	table   string
+	append  *sql.Stmt
+	load    *sql.Stmt
+	average *sql.Stmt
+	appends sync.WaitGroup
+}
+
+func newPostgresBackend(db *sql.DB, table string) (*postgresBackend, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		key            TEXT             NOT NULL,
+		timestamp      TIMESTAMPTZ      NOT NULL,
+		score          DOUBLE PRECISION NOT NULL,
+		auth_failures  INTEGER          NOT NULL,
+		auth_successes INTEGER          NOT NULL,
+		resets         INTEGER          NOT NULL,
+		rcpt_count     INTEGER          NOT NULL,
+		data_count     INTEGER          NOT NULL,
+		commit_count   INTEGER          NOT NULL,
+		rollback_count INTEGER          NOT NULL,
+		null_senders   INTEGER          NOT NULL DEFAULT 0,
+		sender_domains INTEGER          NOT NULL DEFAULT 0,
+		dropped_count  INTEGER          NOT NULL DEFAULT 0,
+		mean_tx_time   BIGINT           NOT NULL DEFAULT 0,
+		transactions   INTEGER          NOT NULL DEFAULT 0,
+		auth_attempts  INTEGER          NOT NULL DEFAULT 0,
+		tls_count      INTEGER          NOT NULL DEFAULT 0,
+		rdns_count     INTEGER          NOT NULL DEFAULT 0,
+		fcrdns_count   INTEGER          NOT NULL DEFAULT 0,
+		bytes          BIGINT           NOT NULL DEFAULT 0,
+		asn            BIGINT           NOT NULL DEFAULT 0,
+		country        TEXT             NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS %[1]s_key_timestamp ON %[1]s (key, timestamp);
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS dropped_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS mean_tx_time BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS transactions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS auth_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS tls_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS rdns_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS fcrdns_count INTEGER NOT NULL DEFAULT 0;`, table))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &postgresBackend{db: db, table: table}
+	b.append, err = db.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s
+		(key, timestamp, score, auth_failures, auth_successes, resets, rcpt_count, data_count, commit_count, rollback_count, null_senders, sender_domains, dropped_count, bytes, mean_tx_time, transactions, auth_attempts, tls_count, rdns_count, fcrdns_count, asn, country)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22)`, table))
+	if err != nil {
+		return nil, err
+	}
+	b.load, err = db.PrepareContext(ctx, fmt.Sprintf(`SELECT * FROM (SELECT
+		timestamp, score, auth_failures, auth_successes, resets, rcpt_count, data_count, commit_count, rollback_count, null_senders, sender_domains, dropped_count, bytes, mean_tx_time, transactions, auth_attempts, tls_count, rdns_count, fcrdns_count, asn, country
+		FROM %s WHERE key = $1 ORDER BY timestamp DESC LIMIT $2) AS recent ORDER BY timestamp`, table))
+	if err != nil {
+		return nil, err
+	}
+	b.average, err = db.PrepareContext(ctx, fmt.Sprintf(`SELECT COUNT(*), COALESCE(AVG(score), 0) FROM (
+		SELECT score FROM %s WHERE key = $1 ORDER BY timestamp DESC LIMIT $2
+	) AS recent`, table))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *postgresBackend) Append(key string, s Scoring) {
+	b.appends.Add(1)
+	go func() {
+		defer b.appends.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+		defer cancel()
+
+		_, err := b.append.ExecContext(ctx, key, s.Timestamp, s.Score, s.AuthFailures, s.AuthSuccesses, s.Resets,
+			s.RcptCount, s.DataCount, s.CommitCount, s.RollbackCount, s.NullSenders, s.SenderDomains, s.DroppedCount, s.Bytes, s.MeanTransactionTime,
+			s.Transactions, s.AuthAttempts, s.TLSCount, s.RDNSCount, s.FCrDNSCount, s.ASN, s.Country)
+		if err != nil {
+			logger.Warn("postgres-append-failed", "table", b.table, "key", key, "error", err)
+		}
+	}()
+}
+
+// Load returns the history-size most recent scorings of key, older rows
+// being left for Prune to trim.
+func (b *postgresBackend) Load(key string) []Scoring {
+	scorings, err := b.LoadChecked(key)
+	if err != nil {
+		logger.Warn("postgres-load-failed", "table", b.table, "key", key, "error", err)
+		return nil
+	}
+	return scorings
+}
+
+// LoadChecked is Load reporting the errors of the database.
+func (b *postgresBackend) LoadChecked(key string) ([]Scoring, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	rows, err := b.load.QueryContext(ctx, key, historySize())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scorings := make([]Scoring, 0)
+	for rows.Next() {
+		var s Scoring
+		if err := rows.Scan(&s.Timestamp, &s.Score, &s.AuthFailures, &s.AuthSuccesses, &s.Resets,
+			&s.RcptCount, &s.DataCount, &s.CommitCount, &s.RollbackCount, &s.NullSenders, &s.SenderDomains, &s.DroppedCount, &s.Bytes, &s.MeanTransactionTime,
+			&s.Transactions, &s.AuthAttempts, &s.TLSCount, &s.RDNSCount, &s.FCrDNSCount, &s.ASN, &s.Country); err != nil {
+			return nil, err
+		}
+		scorings = append(scorings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return scorings, nil
+}
+
+// Average returns the number of recent scorings of key and their mean
+// score, computed by the server rather than by loading the rows.
+func (b *postgresBackend) Average(key string) (int, float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	var count int
+	var mean float64
+	if err := b.average.QueryRowContext(ctx, key, historySize()).Scan(&count, &mean); err != nil {
+		return 0, 0, err
+	}
+	return count, mean, nil
+}
+
+// Prune keeps the history-size most recent scorings of each key and forgets
+// keys with no event in max-age, like the sqlite backend.
+func (b *postgresBackend) Prune() {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*postgresTimeout)
+	defer cancel()
+
+	_, err := b.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %[1]s WHERE ctid IN (
+		SELECT ctid FROM (
+			SELECT ctid, ROW_NUMBER() OVER (PARTITION BY key ORDER BY timestamp DESC) AS rank FROM %[1]s
+		) AS ranked WHERE rank > $1
+	)`, b.table), historySize())
+	if err != nil {
+		logger.Error("postgres-trim-failed", "table", b.table, "error", err)
+	}
+
+	res, err := b.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %[1]s WHERE key IN (
+		SELECT key FROM %[1]s GROUP BY key HAVING MAX(timestamp) < $1
+	)`, b.table), now().Add(-historyMaxAge()))
+	if err != nil {
+		logger.Error("postgres-expire-failed", "table", b.table, "error", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		logger.Info("expire", "table", b.table, "scorings", n)
+	}
+}
+
+func (b *postgresBackend) Count() int {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+
+	var count int
+	err := b.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(DISTINCT key) FROM %s`, b.table)).Scan(&count)
+	if err != nil {
+		logger.Error("postgres-count-failed", "table", b.table, "error", err)
+		return 0
+	}
+	return count
+}
+
+func (b *postgresBackend) Keys() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+
+	rows, err := b.db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT key FROM %s`, b.table))
+	if err != nil {
+		logger.Error("postgres-keys-failed", "table", b.table, "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			logger.Error("postgres-keys-failed", "table", b.table, "error", err)
+			return nil
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("postgres-keys-failed", "table", b.table, "error", err)
+		return nil
+	}
+	return keys
+}
+
+func (b *postgresBackend) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+	return b.db.PingContext(ctx)
+}
+
+func (b *postgresBackend) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	_, err := b.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE key = $1`, b.table), key)
+	if err != nil {
+		logger.Error("postgres-delete-failed", "table", b.table, "key", key, "error", err)
+	}
+}
+
+// setupPostgres connects to the server at dsn with a pool of at most poolSize
+// connections. The server must be reachable at startup to create the tables
+// and prepare the statements.
+func setupPostgres(dsn string, poolSize int) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(poolSize)
+	db.SetMaxIdleConns(poolSize)
+
+	backends := make([]*postgresBackend, 0)
+	for _, table := range []string{"ip_scoring", "rdns_scoring", "helo_scoring", "domain_scoring", "asn_scoring", "rcpt_domain_scoring"} {
+		backend, err := newPostgresBackend(db, table)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		backends = append(backends, backend)
+	}
+	ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = backends[0], backends[1], backends[2], backends[3], backends[4], backends[5]
+
+	store, err := newPostgresSnapshots(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	useSnapshots(store)
+
+	// appends are fire-and-forget, let those in flight complete
+	onShutdown(func() error {
+		for _, backend := range backends {
+			backend.appends.Wait()
+		}
+		return db.Close()
+	})
+	return nil
+}
+
+// postgresSnapshots keeps the snapshots in a table of their own, shared by
+// the instances using the same server: the last one saving wins.
+type postgresSnapshots struct {
+	db *sql.DB
+}
+
+func newPostgresSnapshots(db *sql.DB) (*postgresSnapshots, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS snapshots (
+		name TEXT PRIMARY KEY,
+		data BYTEA NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresSnapshots{db: db}, nil
+}
+
+func (s *postgresSnapshots) loadSnapshot(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM snapshots WHERE name = $1`, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *postgresSnapshots) saveSnapshot(name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*postgresTimeout)
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO snapshots (name, data) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET data = EXCLUDED.data`, name, data)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// averagingStore is a memory backend averaging histories itself, or failing
+// to like an unreachable server.
+type averagingStore struct {
+	*memoryBackend
+	err error
+}
+
+func (s *averagingStore) Average(key string) (int, float64, error) {
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	scorings := s.Load(key)
+	return len(scorings), meanScore(scorings), nil
+}
+
+func TestKeyReputation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Aggregation.Strategy = "mean"
+	store := &averagingStore{memoryBackend: newMemoryBackend()}
+	for i := 0; i < 10; i++ {
+		store.Append("192.0.2.1", Scoring{Timestamp: time.Now(), Score: 0.2})
+	}
+
+	want, _ := storedReputation(store.Load("192.0.2.1"), cfg)
+	if score, known := keyReputation(store, "192.0.2.1", cfg); !known || math.Abs(score-want) > 1e-9 {
+		t.Errorf("server-side average = %.04f, %v, want %.04f, true", score, known, want)
+	}
+
+	// failing open, the key is judged on the prior rather than left to
+	// the grace policy, failing closed it is given the bottom of the scale
+	store.err = errors.New("connection refused")
+	if score, known := keyReputation(store, "192.0.2.1", cfg); !known || score != cfg.Aggregation.Prior {
+		t.Errorf("failed average = %.04f, %v, want the prior", score, known)
+	}
+	cfg.Failure.Policy = "closed"
+	if score, known := keyReputation(store, "192.0.2.1", cfg); !known || score != cfg.Scale.Min {
+		t.Errorf("failed average = %.04f, %v failing closed, want %.04f", score, known, cfg.Scale.Min)
+	}
+}
+
+// TestPostgresBackend runs against the server REPUTATION_TEST_POSTGRES_DSN
+// points to, in a scratch table.
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv("REPUTATION_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("REPUTATION_TEST_POSTGRES_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Exec(`DROP TABLE IF EXISTS test_scoring`)
+	defer db.Exec(`DROP TABLE IF EXISTS test_scoring`)
+
+	b, err := newPostgresBackend(db, "test_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 110; i++ {
+		b.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Duration(i) * time.Second), Score: 0.5, RcptCount: 1})
+	}
+	b.appends.Wait()
+
+	scorings := b.Load("192.0.2.1")
+	if len(scorings) != 100 || !scorings[0].Timestamp.Equal(start.Add(10*time.Second).Truncate(time.Microsecond)) {
+		t.Fatalf("loaded %d scorings, want the 100 most recent", len(scorings))
+	}
+	if n, mean, err := b.Average("192.0.2.1"); err != nil || n != 100 || math.Abs(mean-0.5) > 1e-9 {
+		t.Errorf("Average = %d, %.04f, %v, want 100, 0.5", n, mean, err)
+	}
+
+	b.Prune()
+	if keys := b.Keys(); len(keys) != 1 || b.Count() != 1 {
+		t.Errorf("keys = %v, want [192.0.2.1]", keys)
+	}
+	b.Delete("192.0.2.1")
+	if b.Count() != 0 {
+		t.Errorf("key not deleted")
+	}
+}
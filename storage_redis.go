@@ -0,0 +1,218 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds every Redis operation, an unreachable server must not
+// hold sessions for longer than that.
+const redisTimeout = 200 * time.Millisecond
+
+// redisBackend stores the scoring history of each key as a sorted set of
+// JSON scorings keyed by timestamp, so that several filter instances share
+// the same reputation. Appends are fire-and-forget, and both appends and
+// loads fall back to a local memory backend while Redis is unreachable.
+type redisBackend struct {
+	client   *redis.Client
+	prefix   string
+	ttl      time.Duration
+	fallback *memoryBackend
+	appends  sync.WaitGroup
+}
+
+func newRedisBackend(client *redis.Client, prefix string, ttl time.Duration) *redisBackend {
+	return &redisBackend{
+		client:   client,
+		prefix:   prefix,
+		ttl:      ttl,
+		fallback: newMemoryBackend(),
+	}
+}
+
+func (b *redisBackend) Append(key string, s Scoring) {
+	member, err := json.Marshal(s)
+	if err != nil {
+		logger.Error("redis-append-failed", "prefix", b.prefix, "key", key, "error", err)
+		return
+	}
+
+	b.appends.Add(1)
+	go func() {
+		defer b.appends.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+
+		_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, b.prefix+key, redis.Z{Score: float64(s.Timestamp.UnixNano()), Member: member})
+			pipe.ZRemRangeByRank(ctx, b.prefix+key, 0, int64(-historySize()-1))
+			pipe.Expire(ctx, b.prefix+key, b.ttl)
+			return nil
+		})
+		if err != nil {
+			logger.Warn("redis-append-failed", "prefix", b.prefix, "key", key, "error", err)
+			b.fallback.Append(key, s)
+		}
+	}()
+}
+
+// Load returns the scorings stored in Redis along with those kept locally
+// while it was unreachable, ordered by timestamp.
+func (b *redisBackend) Load(key string) []Scoring {
+	scorings, err := b.LoadChecked(key)
+	if err != nil {
+		logger.Warn("redis-load-failed", "prefix", b.prefix, "key", key, "error", err)
+	}
+	return scorings
+}
+
+// LoadChecked is Load reporting the errors of Redis, along with the
+// scorings of the local fallback.
+func (b *redisBackend) LoadChecked(key string) ([]Scoring, error) {
+	scorings := b.fallback.Load(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	members, err := b.client.ZRange(ctx, b.prefix+key, 0, -1).Result()
+	if err != nil {
+		return scorings, err
+	}
+	for _, member := range members {
+		var s Scoring
+		if err := json.Unmarshal([]byte(member), &s); err != nil {
+			logger.Warn("redis-load-failed", "prefix", b.prefix, "key", key, "error", err)
+			continue
+		}
+		scorings = append(scorings, s)
+	}
+	sort.SliceStable(scorings, func(i, j int) bool {
+		return scorings[i].Timestamp.Before(scorings[j].Timestamp)
+	})
+	return scorings, nil
+}
+
+// Prune only needs to prune the local fallback, Redis trims histories on
+// append and expires the keys that haven't been updated for ttl.
+func (b *redisBackend) Prune() {
+	b.fallback.Prune()
+}
+
+func (b *redisBackend) Count() int {
+	return len(b.Keys())
+}
+
+func (b *redisBackend) Keys() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+
+	keys := make([]string, 0)
+	iter := b.client.Scan(ctx, 0, b.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), b.prefix))
+	}
+	if err := iter.Err(); err != nil {
+		logger.Warn("redis-keys-failed", "prefix", b.prefix, "error", err)
+	}
+	return keys
+}
+
+func (b *redisBackend) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *redisBackend) Delete(key string) {
+	b.fallback.Delete(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := b.client.Del(ctx, b.prefix+key).Err(); err != nil {
+		logger.Error("redis-delete-failed", "prefix", b.prefix, "key", key, "error", err)
+	}
+}
+
+func setupRedis(url string, prefix string, ttl time.Duration, poolSize int) error {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return err
+	}
+	opts.PoolSize = poolSize
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		logger.Warn("redis-unreachable", "url", url, "error", err)
+	}
+
+	backends := []*redisBackend{
+		newRedisBackend(client, prefix+"ip:", ttl),
+		newRedisBackend(client, prefix+"rdns:", ttl),
+		newRedisBackend(client, prefix+"helo:", ttl),
+		newRedisBackend(client, prefix+"domain:", ttl),
+		newRedisBackend(client, prefix+"asn:", ttl),
+		newRedisBackend(client, prefix+"rcpt-domain:", ttl),
+	}
+	ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = backends[0], backends[1], backends[2], backends[3], backends[4], backends[5]
+	useSnapshots(&redisSnapshots{client: client, prefix: prefix + "snapshot:"})
+
+	// appends are fire-and-forget, let those in flight complete
+	onShutdown(func() error {
+		for _, backend := range backends {
+			backend.appends.Wait()
+		}
+		return client.Close()
+	})
+	return nil
+}
+
+// redisSnapshots keeps each snapshot in a key of its own, under prefix,
+// shared by the instances using the same server: the last one saving wins.
+type redisSnapshots struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisSnapshots) loadSnapshot(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.prefix+name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *redisSnapshots) saveSnapshot(name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.prefix+name, data, 0).Err()
+}
@@ -0,0 +1,69 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// waitFor polls cond as Redis appends happen in the background.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition not reached in time")
+}
+
+func TestRedisBackend(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	b := newRedisBackend(client, "test:ip:", time.Hour)
+
+	now := time.Now()
+	for i := 0; i < 110; i++ {
+		b.Append("192.0.2.1", Scoring{Timestamp: now.Add(time.Duration(i) * time.Second), Score: 0.5})
+	}
+	waitFor(t, func() bool { return len(b.Load("192.0.2.1")) == 100 })
+
+	scorings := b.Load("192.0.2.1")
+	if !scorings[0].Timestamp.Equal(now.Add(10 * time.Second)) {
+		t.Errorf("oldest scoring at %s, want the 10 oldest trimmed", scorings[0].Timestamp)
+	}
+	if ttl := server.TTL("test:ip:192.0.2.1"); ttl != time.Hour {
+		t.Errorf("ttl = %s, want 1h", ttl)
+	}
+	if keys := b.Keys(); len(keys) != 1 || keys[0] != "192.0.2.1" {
+		t.Errorf("keys = %v, want [192.0.2.1]", keys)
+	}
+
+	b.Delete("192.0.2.1")
+	if b.Count() != 0 {
+		t.Errorf("count = %d after delete, want 0", b.Count())
+	}
+
+	// an outage falls back to local storage without losing scorings
+	server.Close()
+	b.Append("192.0.2.2", Scoring{Timestamp: now, Score: 0.1})
+	waitFor(t, func() bool { return len(b.Load("192.0.2.2")) == 1 })
+}
@@ -0,0 +1,305 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteBackend stores each scoring as a row of table, keyed by reputation
+// key and timestamp. Several backends may share the same database.
+type sqliteBackend struct {
+	db    *sql.DB
+	table string
+}
+
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newSqliteBackend(db *sql.DB, table string) (*sqliteBackend, error) {
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+		key            TEXT    NOT NULL,
+		timestamp      INTEGER NOT NULL,
+		score          REAL    NOT NULL,
+		auth_failures  INTEGER NOT NULL,
+		auth_successes INTEGER NOT NULL,
+		resets         INTEGER NOT NULL,
+		rcpt_count     INTEGER NOT NULL,
+		data_count     INTEGER NOT NULL,
+		commit_count   INTEGER NOT NULL,
+		rollback_count INTEGER NOT NULL,
+		null_senders   INTEGER NOT NULL DEFAULT 0,
+		sender_domains INTEGER NOT NULL DEFAULT 0,
+		dropped_count  INTEGER NOT NULL DEFAULT 0,
+		mean_tx_time   INTEGER NOT NULL DEFAULT 0,
+		transactions   INTEGER NOT NULL DEFAULT 0,
+		auth_attempts  INTEGER NOT NULL DEFAULT 0,
+		tls_count      INTEGER NOT NULL DEFAULT 0,
+		rdns_count     INTEGER NOT NULL DEFAULT 0,
+		fcrdns_count   INTEGER NOT NULL DEFAULT 0,
+		bytes          INTEGER NOT NULL DEFAULT 0,
+		asn            INTEGER NOT NULL DEFAULT 0,
+		country        TEXT    NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS %[1]s_key_timestamp ON %[1]s (key, timestamp);`, table))
+	if err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "bytes", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "asn", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "country", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "null_senders", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "sender_domains", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "dropped_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, table, "mean_tx_time", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	for _, column := range []string{"transactions", "auth_attempts", "tls_count", "rdns_count", "fcrdns_count"} {
+		if err := addColumn(db, table, column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return nil, err
+		}
+	}
+	return &sqliteBackend{db: db, table: table}, nil
+}
+
+// addColumn adds a column to a table created by an older version, if it
+// doesn't have it yet.
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil || count != 0 {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// sqlExecer is implemented by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (b *sqliteBackend) Append(key string, s Scoring) {
+	if err := b.insert(b.db, key, s); err != nil {
+		logger.Error("sqlite-append-failed", "table", b.table, "key", key, "error", err)
+	}
+}
+
+// insert adds a scoring row through db, which may be a transaction.
+func (b *sqliteBackend) insert(db sqlExecer, key string, s Scoring) error {
+	_, err := db.Exec(fmt.Sprintf(`INSERT INTO %s
+		(key, timestamp, score, auth_failures, auth_successes, resets, rcpt_count, data_count, commit_count, rollback_count, null_senders, sender_domains, dropped_count, bytes, mean_tx_time, transactions, auth_attempts, tls_count, rdns_count, fcrdns_count, asn, country)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, b.table),
+		key, s.Timestamp.UnixNano(), s.Score, s.AuthFailures, s.AuthSuccesses, s.Resets,
+		s.RcptCount, s.DataCount, s.CommitCount, s.RollbackCount, s.NullSenders, s.SenderDomains, s.DroppedCount, s.Bytes, s.MeanTransactionTime,
+		s.Transactions, s.AuthAttempts, s.TLSCount, s.RDNSCount, s.FCrDNSCount, s.ASN, s.Country)
+	return err
+}
+
+func (b *sqliteBackend) Load(key string) []Scoring {
+	scorings, err := b.LoadChecked(key)
+	if err != nil {
+		logger.Error("sqlite-load-failed", "table", b.table, "key", key, "error", err)
+		return nil
+	}
+	return scorings
+}
+
+// LoadChecked is Load reporting the errors of the database. Only the
+// history-size most recent scorings are loaded, the older ones waiting for
+// the next prune.
+func (b *sqliteBackend) LoadChecked(key string) ([]Scoring, error) {
+	rows, err := b.db.Query(fmt.Sprintf(`SELECT
+		timestamp, score, auth_failures, auth_successes, resets, rcpt_count, data_count, commit_count, rollback_count, null_senders, sender_domains, dropped_count, bytes, mean_tx_time, transactions, auth_attempts, tls_count, rdns_count, fcrdns_count, asn, country
+		FROM %s WHERE key = ? ORDER BY timestamp DESC LIMIT ?`, b.table), key, historySize())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scorings := make([]Scoring, 0)
+	for rows.Next() {
+		var s Scoring
+		var timestamp int64
+		if err := rows.Scan(&timestamp, &s.Score, &s.AuthFailures, &s.AuthSuccesses, &s.Resets,
+			&s.RcptCount, &s.DataCount, &s.CommitCount, &s.RollbackCount, &s.NullSenders, &s.SenderDomains, &s.DroppedCount, &s.Bytes, &s.MeanTransactionTime,
+			&s.Transactions, &s.AuthAttempts, &s.TLSCount, &s.RDNSCount, &s.FCrDNSCount, &s.ASN, &s.Country); err != nil {
+			return nil, err
+		}
+		s.Timestamp = time.Unix(0, timestamp)
+		scorings = append(scorings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(scorings)
+	return scorings, nil
+}
+
+// Prune keeps the history-size most recent scorings of each key and forgets
+// keys with no event in max-age, like the memory backend.
+func (b *sqliteBackend) Prune() {
+	_, err := b.db.Exec(fmt.Sprintf(`DELETE FROM %[1]s WHERE rowid IN (
+		SELECT rowid FROM (
+			SELECT rowid, ROW_NUMBER() OVER (PARTITION BY key ORDER BY timestamp DESC) AS rank FROM %[1]s
+		) WHERE rank > ?
+	)`, b.table), historySize())
+	if err != nil {
+		logger.Error("sqlite-trim-failed", "table", b.table, "error", err)
+	}
+
+	res, err := b.db.Exec(fmt.Sprintf(`DELETE FROM %[1]s WHERE key IN (
+		SELECT key FROM %[1]s GROUP BY key HAVING MAX(timestamp) < ?
+	)`, b.table), now().Add(-historyMaxAge()).UnixNano())
+	if err != nil {
+		logger.Error("sqlite-expire-failed", "table", b.table, "error", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		logger.Info("expire", "table", b.table, "scorings", n)
+	}
+}
+
+func (b *sqliteBackend) Count() int {
+	var count int
+	err := b.db.QueryRow(fmt.Sprintf(`SELECT COUNT(DISTINCT key) FROM %s`, b.table)).Scan(&count)
+	if err != nil {
+		logger.Error("sqlite-count-failed", "table", b.table, "error", err)
+		return 0
+	}
+	return count
+}
+
+func (b *sqliteBackend) Keys() []string {
+	rows, err := b.db.Query(fmt.Sprintf(`SELECT DISTINCT key FROM %s`, b.table))
+	if err != nil {
+		logger.Error("sqlite-keys-failed", "table", b.table, "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			logger.Error("sqlite-keys-failed", "table", b.table, "error", err)
+			return nil
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("sqlite-keys-failed", "table", b.table, "error", err)
+		return nil
+	}
+	return keys
+}
+
+func (b *sqliteBackend) Ping() error {
+	return b.db.Ping()
+}
+
+func (b *sqliteBackend) Delete(key string) {
+	_, err := b.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE key = ?`, b.table), key)
+	if err != nil {
+		logger.Error("sqlite-delete-failed", "table", b.table, "key", key, "error", err)
+	}
+}
+
+func setupSqlite(path string) error {
+	db, err := openSqlite(path)
+	if err != nil {
+		return err
+	}
+
+	backends := make([]*sqliteBackend, 0)
+	for _, table := range []string{"ip_scoring", "rdns_scoring", "helo_scoring", "domain_scoring", "asn_scoring", "rcpt_domain_scoring"} {
+		backend, err := newSqliteBackend(db, table)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		backends = append(backends, backend)
+	}
+	ipStore, rdnsStore, heloStore, domainStore, asnStore, rcptDomainStore = backends[0], backends[1], backends[2], backends[3], backends[4], backends[5]
+
+	store, err := newSqliteSnapshots(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	useSnapshots(store)
+	onShutdown(db.Close)
+	return nil
+}
+
+// sqliteSnapshots keeps the snapshots in a table of their own.
+type sqliteSnapshots struct {
+	db *sql.DB
+}
+
+func newSqliteSnapshots(db *sql.DB) (*sqliteSnapshots, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS snapshots (
+		name TEXT PRIMARY KEY,
+		data BLOB NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSnapshots{db: db}, nil
+}
+
+func (s *sqliteSnapshots) loadSnapshot(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM snapshots WHERE name = ?`, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *sqliteSnapshots) saveSnapshot(name string, data []byte) error {
+	_, err := s.db.Exec(`INSERT INTO snapshots (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, name, data)
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSqliteMigration checks that a table created before the later columns
+// were added is migrated, its rows loading with those fields zero.
+func TestSqliteMigration(t *testing.T) {
+	db, err := openSqlite(filepath.Join(t.TempDir(), "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE ip_scoring (
+		key            TEXT    NOT NULL,
+		timestamp      INTEGER NOT NULL,
+		score          REAL    NOT NULL,
+		auth_failures  INTEGER NOT NULL,
+		auth_successes INTEGER NOT NULL,
+		resets         INTEGER NOT NULL,
+		rcpt_count     INTEGER NOT NULL,
+		data_count     INTEGER NOT NULL,
+		commit_count   INTEGER NOT NULL,
+		rollback_count INTEGER NOT NULL
+	);
+	INSERT INTO ip_scoring VALUES ('192.0.2.1', 1714564800000000000, 0.5, 1, 2, 0, 3, 1, 1, 0);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := newSqliteBackend(db, "ip_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scorings := b.Load("192.0.2.1")
+	want := Scoring{Timestamp: time.Unix(0, 1714564800000000000), Score: 0.5, AuthFailures: 1, AuthSuccesses: 2, RcptCount: 3, DataCount: 1, CommitCount: 1}
+	if len(scorings) != 1 || scorings[0] != want {
+		t.Fatalf("loaded %+v, want %+v", scorings, want)
+	}
+
+	s := Scoring{
+		Timestamp: want.Timestamp.Add(time.Minute), Score: 0.75, Transactions: 2, AuthAttempts: 3,
+		TLSCount: 1, RDNSCount: 1, FCrDNSCount: 1, MeanTransactionTime: time.Second, ASN: 64496, Country: "FR",
+	}
+	b.Append("192.0.2.1", s)
+	if scorings := b.Load("192.0.2.1"); len(scorings) != 2 || scorings[1] != s {
+		t.Errorf("loaded %+v, want %+v last", scorings, s)
+	}
+}
+
+func TestSqliteHistorySize(t *testing.T) {
+	db, err := openSqlite(filepath.Join(t.TempDir(), "reputation.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b, err := newSqliteBackend(db, "ip_scoring")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1714564800, 0)
+	for i := 0; i < historySize()+10; i++ {
+		b.Append("192.0.2.1", Scoring{Timestamp: start.Add(time.Duration(i) * time.Second), Score: 0.5})
+	}
+
+	// the most recent scorings are loaded, oldest first, before any prune
+	scorings := b.Load("192.0.2.1")
+	if len(scorings) != historySize() {
+		t.Fatalf("loaded %d scorings, want %d", len(scorings), historySize())
+	}
+	if !scorings[0].Timestamp.Equal(start.Add(10*time.Second)) || !scorings[len(scorings)-1].Timestamp.After(scorings[0].Timestamp) {
+		t.Errorf("loaded scorings from %s to %s", scorings[0].Timestamp, scorings[len(scorings)-1].Timestamp)
+	}
+}
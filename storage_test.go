@@ -0,0 +1,216 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackendPruneEmpty(t *testing.T) {
+	b := newMemoryBackend()
+	b.shard("192.0.2.1").scoring["192.0.2.1"] = newScoringRing(100)
+	b.shard("192.0.2.2").scoring["192.0.2.2"] = newScoringRing(1)
+
+	b.Prune()
+
+	if n := b.Count(); n != 0 {
+		t.Fatalf("expected empty keys to be deleted, got %d keys", n)
+	}
+}
+
+func TestMemoryBackendPrune(t *testing.T) {
+	b := newMemoryBackend()
+
+	for i := 0; i < 150; i++ {
+		b.Append("192.0.2.1", Scoring{Timestamp: time.Now()})
+		b.Append("192.0.2.2", Scoring{Timestamp: time.Now().Add(-6 * 24 * time.Hour)})
+	}
+	b.Append("192.0.2.3", Scoring{Timestamp: time.Now().Add(-6 * 24 * time.Hour)})
+
+	if n := len(b.Load("192.0.2.1")); n != 100 {
+		t.Errorf("expected 100 scorings for recent key before prune, got %d", n)
+	}
+
+	b.Prune()
+
+	if n := len(b.Load("192.0.2.1")); n != 100 {
+		t.Errorf("expected 100 scorings for recent key, got %d", n)
+	}
+	if _, exists := b.shard("192.0.2.2").scoring["192.0.2.2"]; exists {
+		t.Errorf("expected stale key with more than 100 scorings to be deleted")
+	}
+	if _, exists := b.shard("192.0.2.3").scoring["192.0.2.3"]; exists {
+		t.Errorf("expected stale key to be deleted")
+	}
+}
+
+// fakeClock makes now return the returned time until the end of the test,
+// so that it can be advanced at will.
+func fakeClock(t *testing.T, start time.Time) *time.Time {
+	saved := now
+	t.Cleanup(func() { now = saved })
+	current := start
+	now = func() time.Time { return current }
+	return &current
+}
+
+func TestMemoryBackendPruneClock(t *testing.T) {
+	clock := fakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	b := newMemoryBackend()
+	b.Append("192.0.2.1", Scoring{Timestamp: *clock})
+
+	*clock = clock.Add(historyMaxAge() - time.Second)
+	b.Prune()
+	if b.Count() != 1 {
+		t.Fatalf("key pruned before max-age")
+	}
+
+	*clock = clock.Add(2 * time.Second)
+	b.Prune()
+	if b.Count() != 0 {
+		t.Fatalf("key not pruned past max-age")
+	}
+}
+
+func TestMemoryBackendEvict(t *testing.T) {
+	saved := currentConfig()
+	defer activeConfig.Store(saved)
+	cfg := defaultConfig()
+	cfg.Storage.MaxKeys = 10
+	activeConfig.Store(cfg)
+
+	clock := fakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	b := newMemoryBackend()
+	for i := 0; i < 15; i++ {
+		b.Append(fmt.Sprintf("192.0.2.%d", i), Scoring{Timestamp: clock.Add(time.Duration(i) * time.Minute)})
+	}
+	// the first key is seen again, it is now the most recent one
+	b.Append("192.0.2.0", Scoring{Timestamp: clock.Add(time.Hour)})
+
+	b.Prune()
+
+	if n := b.Count(); n != 10 {
+		t.Fatalf("expected 10 keys after eviction, got %d", n)
+	}
+	for i := 1; i <= 5; i++ {
+		if b.Load(fmt.Sprintf("192.0.2.%d", i)) != nil {
+			t.Errorf("expected least recently seen key 192.0.2.%d to be evicted", i)
+		}
+	}
+	for _, i := range []int{0, 6, 14} {
+		if b.Load(fmt.Sprintf("192.0.2.%d", i)) == nil {
+			t.Errorf("expected recently seen key 192.0.2.%d to be kept", i)
+		}
+	}
+
+	cfg.Storage.MaxKeys = 0
+	b.Append("192.0.2.100", Scoring{Timestamp: *clock})
+	b.Prune()
+	if n := b.Count(); n != 11 {
+		t.Errorf("expected no eviction without max-keys, got %d keys", n)
+	}
+}
+
+func TestScoringRing(t *testing.T) {
+	start := time.Now()
+	at := func(i int) Scoring {
+		return Scoring{Timestamp: start.Add(time.Duration(i) * time.Second)}
+	}
+	chronological := func(scorings []Scoring, first int) bool {
+		for i, s := range scorings {
+			if !s.Timestamp.Equal(at(first + i).Timestamp) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := newScoringRing(3)
+	for i := 0; i < 2; i++ {
+		r.push(at(i), 3)
+	}
+	if scorings := r.slice(); len(scorings) != 2 || !chronological(scorings, 0) {
+		t.Errorf("partial ring = %v", scorings)
+	}
+
+	for i := 2; i < 10; i++ {
+		r.push(at(i), 3)
+	}
+	if scorings := r.slice(); len(scorings) != 3 || !chronological(scorings, 7) || !r.last().Timestamp.Equal(at(9).Timestamp) {
+		t.Errorf("wrapped ring = %v", scorings)
+	}
+
+	// a smaller capacity keeps the most recent scorings
+	r.push(at(10), 2)
+	if scorings := r.slice(); len(scorings) != 2 || !chronological(scorings, 9) {
+		t.Errorf("shrunk ring = %v", scorings)
+	}
+	r.push(at(11), 5)
+	if scorings := r.slice(); len(scorings) != 3 || !chronological(scorings, 9) {
+		t.Errorf("grown ring = %v", scorings)
+	}
+}
+
+// mutexStore is the single-mutex store the sharded store replaced, kept as a
+// baseline for benchmarks.
+type mutexStore struct {
+	mutex   sync.Mutex
+	scoring map[string][]Scoring
+}
+
+func (s *mutexStore) Append(key string, scoring Scoring) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scoring[key] = append(s.scoring[key], scoring)
+}
+
+func (s *mutexStore) Load(key string) []Scoring {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Scoring(nil), s.scoring[key]...)
+}
+
+func benchmarkStore(b *testing.B, store interface {
+	Append(string, Scoring)
+	Load(string) []Scoring
+}) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("192.0.%d.%d", i/256, i%256)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			store.Load(key)
+			store.Append(key, Scoring{Timestamp: time.Now()})
+			i++
+		}
+	})
+}
+
+func BenchmarkMutexStore(b *testing.B) {
+	benchmarkStore(b, &mutexStore{scoring: make(map[string][]Scoring)})
+}
+
+func BenchmarkShardedStore(b *testing.B) {
+	benchmarkStore(b, newShardedStore())
+}
@@ -0,0 +1,115 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracer creates the session and transaction spans. It is a no-op unless
+// setupTracing is given a collector, so that tracing costs nothing when it
+// is disabled.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer("filter-reputation")
+
+// setupTracing exports spans over OTLP/HTTP to the collector at endpoint, an
+// URL such as http://localhost:4318.
+func setupTracing(endpoint string) error {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("filter-reputation"))),
+	)
+	tracer = provider.Tracer("filter-reputation")
+	onShutdown(func() error {
+		return provider.Shutdown(context.Background())
+	})
+	return nil
+}
+
+// startSessionSpan starts the span covering a session, from its connection
+// to its disconnection.
+func startSessionSpan(data *SessionData, session string, timestamp time.Time) {
+	data.ctx, data.span = tracer.Start(context.Background(), "session",
+		trace.WithTimestamp(timestamp), trace.WithAttributes(attribute.String("session", session)))
+}
+
+// startTransactionSpan starts the span covering a transaction, as a child
+// of the span of its session.
+func startTransactionSpan(data *SessionData, tx *Transaction, messageId string, timestamp time.Time) {
+	if data.ctx == nil {
+		return
+	}
+	_, tx.span = tracer.Start(data.ctx, "transaction",
+		trace.WithTimestamp(timestamp), trace.WithAttributes(attribute.String("message-id", messageId)))
+}
+
+func endTransactionSpan(tx *Transaction, timestamp time.Time) {
+	if tx.span == nil {
+		return
+	}
+	tx.span.SetAttributes(
+		attribute.Bool("committed", tx.committed),
+		attribute.Int("recipients.ok", tx.rcptToOK),
+		attribute.Int("recipients.tempfail", tx.rcptToTempfail),
+		attribute.Int("recipients.permfail", tx.rcptToPermfail),
+		attribute.Int("size", tx.messageSize),
+	)
+	tx.span.End(trace.WithTimestamp(timestamp))
+	tx.span = nil
+}
+
+// traceDecision records a decision taken on a session as an event of its
+// span.
+func traceDecision(data *SessionData, decision string) {
+	if data.span == nil {
+		return
+	}
+	data.span.AddEvent(decision, trace.WithAttributes(attribute.Bool("dry-run", !enforcing())))
+}
+
+// endSessionSpan ends the span of a session along with the spans of the
+// transactions it never ended. The session is only scored for the span if
+// it is recorded.
+func endSessionSpan(data *SessionData, cfg *Config, timestamp time.Time) {
+	if data.span == nil || !data.span.IsRecording() {
+		return
+	}
+	for _, tx := range data.transactions {
+		endTransactionSpan(tx, timestamp)
+	}
+	data.span.SetAttributes(
+		attribute.String("ip", data.addr.String()),
+		attribute.String("key", data.key),
+		attribute.Float64("connect-score", data.connectScore),
+		attribute.Float64("score", scoreSession(data, cfg)),
+		attribute.Int("transactions", transactionCount(data)),
+	)
+	data.span.End(trace.WithTimestamp(timestamp))
+	data.span = nil
+}
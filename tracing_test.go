@@ -0,0 +1,75 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSessionSpans(t *testing.T) {
+	saved := tracer
+	defer func() { tracer = saved }()
+	recorder := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	start := time.Now()
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", connectScore: 0.7}
+	startSessionSpan(data, "0123456789abcdef", start)
+	traceDecision(data, "proceed")
+
+	committed := &Transaction{mailFromOK: true, rcptToOK: 2, committed: true}
+	abandoned := &Transaction{mailFromOK: true}
+	startTransactionSpan(data, committed, "01234567", start)
+	data.transactions = append(data.transactions, committed)
+	endTransactionSpan(committed, start.Add(time.Second))
+	startTransactionSpan(data, abandoned, "89abcdef", start.Add(time.Second))
+	data.transactions = append(data.transactions, abandoned)
+	endSessionSpan(data, defaultConfig(), start.Add(2*time.Second))
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans ended, want 3", len(spans))
+	}
+	session := spans[2]
+	if session.Name() != "session" || len(session.Events()) != 1 || session.Events()[0].Name != "proceed" {
+		t.Errorf("unexpected session span %s with events %v", session.Name(), session.Events())
+	}
+	for _, tx := range spans[:2] {
+		if tx.Name() != "transaction" || tx.Parent().SpanID() != session.SpanContext().SpanID() {
+			t.Errorf("transaction span %s isn't a child of the session span", tx.Name())
+		}
+	}
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "recipients.ok" && attr.Value.AsInt64() != 2 {
+			t.Errorf("recipients.ok = %d, want 2", attr.Value.AsInt64())
+		}
+	}
+}
+
+func TestSessionSpansDisabled(t *testing.T) {
+	data := &SessionData{}
+	startSessionSpan(data, "0123456789abcdef", time.Now())
+	if data.span.IsRecording() {
+		t.Errorf("span is recorded with tracing disabled")
+	}
+	endSessionSpan(data, defaultConfig(), time.Now())
+}
@@ -0,0 +1,93 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+// velocityWindow is the number of connects remembered per key, which bounds
+// the rate that can be measured over a minute.
+const velocityWindow = 128
+
+// connectHistory is a ring buffer of the most recent connect times of a key.
+type connectHistory struct {
+	times [velocityWindow]time.Time
+	next  int
+}
+
+type velocityShard struct {
+	mutex     sync.Mutex
+	histories map[string]*connectHistory
+}
+
+// velocityTracker records connect times per reputation key, sharded like the
+// memory backend so that concurrent sessions don't contend on a single lock.
+type velocityTracker struct {
+	shards [storeShards]velocityShard
+}
+
+var connectRates = newVelocityTracker()
+
+func newVelocityTracker() *velocityTracker {
+	v := &velocityTracker{}
+	for i := range v.shards {
+		v.shards[i].histories = make(map[string]*connectHistory)
+	}
+	return v
+}
+
+// record adds a connect for key at timestamp and returns the number of
+// connects for key during the minute before it, this one included.
+func (v *velocityTracker) record(key string, timestamp time.Time) int {
+	shard := &v.shards[shardIndex(key)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	history, ok := shard.histories[key]
+	if !ok {
+		history = &connectHistory{}
+		shard.histories[key] = history
+	}
+	history.times[history.next] = timestamp
+	history.next = (history.next + 1) % velocityWindow
+
+	count := 0
+	for _, t := range history.times {
+		if !t.IsZero() && timestamp.Sub(t) < time.Minute {
+			count++
+		}
+	}
+	return count
+}
+
+// prune forgets the keys that haven't connected during the minute before
+// timestamp.
+func (v *velocityTracker) prune(timestamp time.Time) {
+	for i := range v.shards {
+		shard := &v.shards[i]
+		shard.mutex.Lock()
+		for key, history := range shard.histories {
+			last := history.times[(history.next+velocityWindow-1)%velocityWindow]
+			if timestamp.Sub(last) >= time.Minute {
+				delete(shard.histories, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
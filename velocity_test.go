@@ -0,0 +1,56 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVelocityTracker(t *testing.T) {
+	v := newVelocityTracker()
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		if got := v.record("192.0.2.1", start.Add(time.Duration(i)*time.Second)); got != i+1 {
+			t.Fatalf("record #%d = %d, want %d", i, got, i+1)
+		}
+	}
+	if got := v.record("192.0.2.2", start); got != 1 {
+		t.Errorf("unrelated key rate = %d, want 1", got)
+	}
+
+	// connects older than a minute no longer count
+	if got := v.record("192.0.2.1", start.Add(65*time.Second)); got != 5 {
+		t.Errorf("rate after a minute = %d, want 5", got)
+	}
+
+	// the ring buffer caps the measured rate
+	for i := 0; i < 2*velocityWindow; i++ {
+		v.record("192.0.2.3", start)
+	}
+	if got := v.record("192.0.2.3", start); got != velocityWindow {
+		t.Errorf("saturated rate = %d, want %d", got, velocityWindow)
+	}
+
+	v.prune(start.Add(3 * time.Minute))
+	for i := range v.shards {
+		if n := len(v.shards[i].histories); n != 0 {
+			t.Fatalf("shard %d still holds %d keys after prune", i, n)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookEvent is the JSON payload POSTed when the reputation of an address
+// drops below the webhook threshold.
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	IP        string    `json:"ip"`
+	Key       string    `json:"key"`
+	OldScore  float64   `json:"old-score"`
+	NewScore  float64   `json:"new-score"`
+	Samples   int       `json:"samples"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type trackedReputation struct {
+	score float64
+	seen  time.Time
+}
+
+// reputationTracker remembers the last reputation computed for each key, so
+// that a drop below the threshold is only notified once, when it happens,
+// rather than on every session that follows.
+type reputationTracker struct {
+	mutex  sync.Mutex
+	scores map[string]trackedReputation
+}
+
+var lastReputations = newReputationTracker()
+
+func newReputationTracker() *reputationTracker {
+	return &reputationTracker{scores: make(map[string]trackedReputation)}
+}
+
+// update records score as the reputation of key and returns the previous
+// one, fallback if key wasn't tracked, and whether the reputation crossed
+// from threshold or above to below it.
+func (r *reputationTracker) update(key string, fallback float64, score float64, threshold float64, timestamp time.Time) (float64, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous := fallback
+	if tracked, exists := r.scores[key]; exists {
+		previous = tracked.score
+	}
+	r.scores[key] = trackedReputation{score: score, seen: timestamp}
+	return previous, previous >= threshold && score < threshold
+}
+
+// prune forgets the keys not updated since before.
+func (r *reputationTracker) prune(before time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for key, tracked := range r.scores {
+		if tracked.seen.Before(before) {
+			delete(r.scores, key)
+		}
+	}
+}
+
+// checkReputationDrop recomputes the reputation of the key of a session from
+// its history, including the scoring being recorded, and queues a webhook
+// notification if it dropped below the threshold. Keys not tracked yet are
+// compared with their reputation when the session connected.
+func checkReputationDrop(data *SessionData, cfg *Config, scorings []Scoring, timestamp time.Time) {
+	score, known := storedReputation(scorings, cfg)
+	if !known {
+		return
+	}
+	previous, crossed := lastReputations.update(data.key, data.currentReputation[0], score, cfg.Webhook.Threshold, timestamp)
+	if !crossed {
+		return
+	}
+	logger.Info("reputation-drop", "ip", data.addr.String(), "key", data.key, "old-score", previous, "new-score", score)
+	notifyWebhook(webhookEvent{
+		Event:     "reputation-drop",
+		IP:        data.addr.String(),
+		Key:       data.key,
+		OldScore:  previous,
+		NewScore:  score,
+		Samples:   len(scorings),
+		Timestamp: timestamp,
+	})
+}
+
+// webhookQueue holds the events waiting for delivery, events being dropped
+// when it is full rather than blocking sessions.
+var webhookQueue = make(chan webhookEvent, 128)
+
+// webhookBackoff is the delay before the first retry of a delivery, doubled
+// on each further retry.
+var webhookBackoff = time.Second
+
+func notifyWebhook(event webhookEvent) {
+	select {
+	case webhookQueue <- event:
+	default:
+		logger.Warn("webhook-queue-full", "key", event.Key)
+	}
+}
+
+func webhookLoop() {
+	for event := range webhookQueue {
+		// the webhook may have been disabled by a reload since
+		if webhook := currentConfig().Webhook; webhook.URL != "" {
+			deliverWebhook(&webhook, event)
+		}
+	}
+}
+
+// deliverWebhook POSTs event to the webhook URL, retrying failed attempts
+// with an exponential backoff.
+func deliverWebhook(webhook *Webhook, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: webhook.Timeout.Duration}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(client, webhook.URL, body)
+		if err == nil {
+			return nil
+		}
+		if attempt == webhook.Retries {
+			break
+		}
+		logger.Warn("webhook-retry", "key", event.Key, "attempt", attempt+1, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	logger.Error("webhook-failed", "key", event.Key, "error", err)
+	return err
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
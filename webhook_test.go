@@ -0,0 +1,127 @@
+package main
+
+/*
+ * Copyright (c) 2024 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReputationTracker(t *testing.T) {
+	tracker := newReputationTracker()
+	now := time.Now()
+
+	if _, crossed := tracker.update("192.0.2.1", 0.6, 0.5, 0.3, now); crossed {
+		t.Errorf("staying above the threshold crossed it")
+	}
+	previous, crossed := tracker.update("192.0.2.1", 0.9, 0.2, 0.3, now)
+	if !crossed || previous != 0.5 {
+		t.Errorf("dropping from tracked 0.5 to 0.2 = %.02f, %v, want 0.5, true", previous, crossed)
+	}
+	if _, crossed := tracker.update("192.0.2.1", 0.9, 0.1, 0.3, now); crossed {
+		t.Errorf("staying below the threshold crossed it again")
+	}
+
+	// an untracked key is compared with its fallback
+	if _, crossed := tracker.update("192.0.2.2", 0.4, 0.2, 0.3, now); !crossed {
+		t.Errorf("dropping from fallback 0.4 to 0.2 didn't cross")
+	}
+	if _, crossed := tracker.update("192.0.2.3", 0.2, 0.1, 0.3, now); crossed {
+		t.Errorf("an untracked key already below crossed")
+	}
+
+	tracker.prune(now.Add(time.Second))
+	if len(tracker.scores) != 0 {
+		t.Errorf("%d keys left after prune, want 0", len(tracker.scores))
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	saved := webhookBackoff
+	defer func() { webhookBackoff = saved }()
+	webhookBackoff = time.Millisecond
+
+	attempts, failures := 0, 2
+	var received webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("invalid payload: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	webhook := defaultConfig().Webhook
+	webhook.URL = server.URL
+	event := webhookEvent{Event: "reputation-drop", IP: "192.0.2.1", Key: "192.0.2.1", OldScore: 0.5, NewScore: 0.2, Samples: 10}
+	if err := deliverWebhook(&webhook, event); err != nil {
+		t.Fatalf("delivery failed: %s", err)
+	}
+	if attempts != 3 || received.IP != "192.0.2.1" || received.NewScore != 0.2 || received.Samples != 10 {
+		t.Errorf("after %d attempts, received %+v", attempts, received)
+	}
+
+	attempts, failures = 0, 5
+	webhook.Retries = 1
+	if err := deliverWebhook(&webhook, event); err == nil {
+		t.Errorf("delivery succeeded despite failures")
+	}
+	if attempts != 2 {
+		t.Errorf("%d attempts, want 2", attempts)
+	}
+}
+
+func TestCheckReputationDropPendingAppend(t *testing.T) {
+	savedStore, savedTracker := ipStore, lastReputations
+	defer func() { ipStore, lastReputations = savedStore, savedTracker }()
+	store := &laggingStore{memoryBackend: newMemoryBackend()}
+	ipStore = store
+	lastReputations = newReputationTracker()
+
+	cfg := defaultConfig()
+	cfg.Grace.MinSamples = 5
+	cfg.Aggregation.PriorWeight = 1
+	cfg.Webhook.Threshold = 0.3
+	start := time.Now()
+	data := &SessionData{addr: net.ParseIP("192.0.2.1"), key: "192.0.2.1", currentReputation: []float64{0.9}}
+
+	// the fifth scoring makes the key known, before it landed in the store
+	for i := 0; i < 4; i++ {
+		store.memoryBackend.Append(data.key, Scoring{Timestamp: start, Score: 0.0})
+	}
+	scoring := Scoring{Timestamp: start, Score: 0.0}
+	history := recordedHistory(data.key, scoring, cfg)
+	ipStore.Append(data.key, scoring)
+	checkReputationDrop(data, cfg, history, start)
+	select {
+	case event := <-webhookQueue:
+		if event.Samples != 5 || event.OldScore != 0.9 {
+			t.Errorf("reputation drop = %+v, want 5 samples from 0.9", event)
+		}
+	default:
+		t.Errorf("reputation drop wasn't notified")
+	}
+}